@@ -6,6 +6,7 @@ angular.module('magna-app').constant('magnaConfig', {
   projectBaseUrl: '/api/v1/projects/',
   socketUrl: 'ws://' + window.location.host + '/api/v1/changes?',
   mapnikUrl: '/api/v1/map?',
+  compareUrl: '/api/v1/compare',
   mapnikLayers: 'osm',
   mapnikImageFormat: 'image/png',
   version: '0.1',
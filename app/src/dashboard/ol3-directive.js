@@ -1,7 +1,7 @@
 angular.module('magna-app')
 
-.directive('ol3Map', ['$timeout', '$websocket', 'magnaConfig', 'ProjectService',
-  function($timeout, $websocket, magnaConfig, ProjectService) {
+.directive('ol3Map', ['$http', '$timeout', '$websocket', 'magnaConfig', 'ProjectService',
+  function($http, $timeout, $websocket, magnaConfig, ProjectService) {
     return {
       restrict: 'A',
       scope: {
@@ -26,11 +26,17 @@ angular.module('magna-app')
             scope.params.mss = createMSSString();
             scope.params.t = Date.now();
             scope.params.wsid = scope.wsid;
+            // render with both renderers in compare mode, mapnik on the left
+            // and mapserver on the right side of the swipe control
+            // (updateParams keeps missing params, empty RENDERER is the default renderer)
+            scope.params.RENDERER = scope.settings.compare ? 'mapnik' : '';
             scope.olSource.updateParams(scope.params);
+            scope.compareSource.updateParams(angular.extend({}, scope.params, {RENDERER: 'mapserver'}));
 
             if (scope.layer.source === undefined) {
               scope.layer.setSource(scope.olSource);
             }
+            scope.compareLayer.setVisible(scope.settings.compare === true && !scope.staticMap);
           };
 
           scope.socket = ProjectService.getSocket();
@@ -83,9 +89,21 @@ angular.module('magna-app')
           // init openlayers layer without source - add the source if we have wsid or we have a static map
           scope.layer = new ol.layer.Image({});
 
+          // mapserver layer for compare mode, clipped by the swipe control
+          scope.compareSource = new ol.source.ImageWMS({
+            url: magnaConfig.mapnikUrl,
+            ratio: 1,
+            params: angular.extend({}, scope.params, {RENDERER: 'mapserver'})
+          });
+          scope.compareLayer = new ol.layer.Image({
+            source: scope.compareSource,
+            visible: false
+          });
+          scope.swipe = 0.5;
+
           // init map
           scope.olMap = new ol.Map({
-            layers: [scope.layer],
+            layers: [scope.layer, scope.compareLayer],
             interactions: scope.olInteractions,
             controls: scope.olControls,
             logo: false,
@@ -140,6 +158,80 @@ angular.module('magna-app')
             scope.olMap.addControl(showRenderTimeControl);
           }
 
+          if (!scope.staticMap) {
+            // swipe control and similarity of mapnik and mapserver in compare mode
+            var swipeInput = angular.element('<input type="range" min="0" max="1" step="0.01">');
+            swipeInput.val(scope.swipe);
+            var compareInfo = angular.element('<span></span>');
+            var compareContainer = angular.element('<div></div>');
+            compareContainer.addClass('ol-control');
+            compareContainer.addClass('compare-renderers');
+            compareContainer.append('<span class="compare-label">Mapnik</span>');
+            compareContainer.append(swipeInput);
+            compareContainer.append('<span class="compare-label">MapServer</span>');
+            compareContainer.append(compareInfo);
+            var compareControl = new ol.control.Control({element: compareContainer[0]});
+
+            swipeInput.on('input change', function() {
+              scope.swipe = parseFloat(swipeInput.val());
+              scope.olMap.render();
+            });
+
+            scope.compareLayer.on('precompose', function(event) {
+              var ctx = event.context;
+              var width = ctx.canvas.width * scope.swipe;
+              ctx.save();
+              ctx.beginPath();
+              ctx.rect(width, 0, ctx.canvas.width - width, ctx.canvas.height);
+              ctx.clip();
+            });
+            scope.compareLayer.on('postcompose', function(event) {
+              event.context.restore();
+            });
+
+            // request similarity and unsupported features for the current extent
+            var updateCompareInfo = function() {
+              var size = scope.olMap.getSize();
+              var params = angular.extend({}, scope.params, {
+                SRS: ProjectService.mapOptions.SRS,
+                BBOX: scope.olMap.getView().calculateExtent(size).join(','),
+                WIDTH: Math.round(size[0]),
+                HEIGHT: Math.round(size[1])
+              });
+              delete params.RENDERER;
+              compareInfo.text('');
+              compareInfo.attr('title', '');
+              $http.get(magnaConfig.compareUrl, {params: params}).then(function(resp) {
+                var text = 'Similarity: ' + (resp.data.similarity * 100).toFixed(2) + '%';
+                var unsupported = [];
+                angular.forEach(resp.data.unsupported, function(f) {
+                  unsupported.push(f.feature + ' (' + f.renderers.join(', ') + ')');
+                });
+                if (unsupported.length > 0) {
+                  text += ', ' + unsupported.length + ' unsupported';
+                }
+                compareInfo.text(text);
+                compareInfo.attr('title', unsupported.join('\n'));
+              }, function(resp) {
+                compareInfo.text('Compare failed: ' + resp.data);
+              });
+            };
+            scope.compareSource.on('imageloadend', function() {
+              if (scope.settings.compare) {
+                updateCompareInfo();
+              }
+            });
+
+            scope.$watch('settings.compare', function(compare) {
+              if (compare) {
+                scope.olMap.addControl(compareControl);
+              } else {
+                scope.olMap.removeControl(compareControl);
+              }
+              scope.updateSource();
+            });
+          }
+
           scope.socket.$on('$message', function (resp) {
             if (resp.wsid) {
               scope.wsid = resp.wsid;
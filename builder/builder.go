@@ -21,6 +21,8 @@ type Builder struct {
 	locator         config.Locator
 	dumpRules       io.Writer
 	includeInactive bool
+	warnings        []string
+	style           *mss.MSS
 }
 
 // New returns a Builder
@@ -48,8 +50,29 @@ func (b *Builder) SetIncludeInactive(includeInactive bool) {
 	b.includeInactive = includeInactive
 }
 
+// Warnings returns all warnings of the last Build (e.g. unknown layer
+// properties).
+func (b *Builder) Warnings() []string {
+	return b.warnings
+}
+
+// MSS returns the decoded style of the last Build.
+func (b *Builder) MSS() *mss.MSS {
+	return b.style
+}
+
+// InputFiles returns the MML file and all MSS files of the last Build.
+func (b *Builder) InputFiles() []string {
+	var files []string
+	if b.mml != "" {
+		files = append(files, b.mml)
+	}
+	return append(files, b.mss...)
+}
+
 // Build parses MML, MSS files, builds all rules and adds them to the Map.
 func (b *Builder) Build() error {
+	b.warnings = nil
 	layerIDs := []string{}
 	layers := []mml.Layer{}
 
@@ -64,6 +87,7 @@ func (b *Builder) Build() error {
 		if err != nil {
 			return err
 		}
+		b.warnings = append(b.warnings, mmlObj.Warnings...)
 		if len(b.mss) == 0 {
 			for _, s := range mmlObj.Stylesheets {
 				b.mss = append(b.mss, filepath.Join(filepath.Dir(b.mml), s))
@@ -88,6 +112,7 @@ func (b *Builder) Build() error {
 	if err := carto.Evaluate(); err != nil {
 		return err
 	}
+	b.style = carto.MSS()
 
 	if m, ok := b.dstMap.(MapZoomScaleSetter); ok {
 		if mmlObj != nil && mmlObj.Map.ZoomScales != nil {
@@ -98,16 +123,30 @@ func (b *Builder) Build() error {
 	if b.mml == "" {
 		layerIDs = carto.MSS().Layers()
 		for _, layerID := range layerIDs {
-			layers = append(layers,
-				// XXX assume we only have LineStrings for -mss only export
-				mml.Layer{ID: layerID, Type: mml.LineString},
-			)
+			// geometry type is inferred from the rules
+			layers = append(layers, mml.Layer{ID: layerID, Type: mml.Unknown})
 		}
 	}
 
 	for _, l := range layers {
-		zoom := layerZoomRange(l)
+		zoom, visible := layerZoomRange(l)
+		if !visible {
+			continue
+		}
+		if l.ZoomStatus != nil {
+			// status is handled by zoom range
+			l.Active = true
+		}
 		rules := carto.MSS().LayerZoomRules(l.ID, zoom, l.Classes...)
+		if b.mml != "" {
+			b.warnings = append(b.warnings, inferGeometryType(&l, rules, filepath.Dir(b.mml))...)
+		} else {
+			inferGeometryType(&l, rules, "")
+			if l.Type == mml.Unknown {
+				// XXX assume we only have LineStrings for -mss only export
+				l.Type = mml.LineString
+			}
+		}
 
 		if b.dumpRules != nil {
 			for _, r := range rules {
@@ -119,16 +158,106 @@ func (b *Builder) Build() error {
 		}
 	}
 
-	if m, ok := b.dstMap.(MapOptionsSetter); ok {
-		if bgColor, ok := carto.MSS().Map().GetColor("background-color"); ok {
-			m.SetBackgroundColor(bgColor)
+	warnings, err := setMapOptions(b.dstMap, carto.MSS().Map(), mmlObj)
+	b.warnings = append(b.warnings, warnings...)
+	return err
+}
+
+// setMapOptions sets all Map {} properties and MML parameters that are
+// supported by m. It returns warnings for properties that m does not
+// support.
+func setMapOptions(m Map, p *mss.Properties, mmlObj *mml.MML) ([]string, error) {
+	var warnings []string
+	unsupported := func(property string) {
+		warnings = append(warnings, fmt.Sprintf("Map property %s not supported by builder", property))
+	}
+
+	if bgColor, ok := p.GetColor("background-color"); ok {
+		if o, ok := m.(MapOptionsSetter); ok {
+			o.SetBackgroundColor(bgColor)
+		} else {
+			unsupported("background-color")
+		}
+	}
+	bg, bgOk := m.(BackgroundImageSetter)
+	if v, ok := p.GetString("background-image"); ok {
+		if bgOk {
+			bg.SetBackgroundImage(v)
+		} else {
+			unsupported("background-image")
+		}
+	}
+	if v, ok := p.GetString("background-image-comp-op"); ok {
+		if bgOk {
+			bg.SetBackgroundImageCompOp(v)
+		} else {
+			unsupported("background-image-comp-op")
+		}
+	}
+	if v, ok := p.GetFloat("background-image-opacity"); ok {
+		if bgOk {
+			bg.SetBackgroundImageOpacity(v)
+		} else {
+			unsupported("background-image-opacity")
+		}
+	}
+	srs, srsOk := p.GetString("srs")
+	if !srsOk && mmlObj != nil && mmlObj.Map.SRS != "" {
+		srs, srsOk = mmlObj.Map.SRS, true
+	}
+	if srsOk {
+		if o, ok := m.(SRSSetter); ok {
+			o.SetSRS(srs)
+		} else {
+			unsupported("srs")
+		}
+	}
+	if v, ok := p.GetFloat("buffer-size"); ok {
+		if o, ok := m.(BufferSizeSetter); ok {
+			o.SetBufferSize(int(v))
+		} else {
+			unsupported("buffer-size")
+		}
+	}
+	if extent, ok := p.GetExtent("maximum-extent"); ok {
+		if o, ok := m.(MaximumExtentSetter); ok {
+			o.SetMaximumExtent(extent)
+		} else {
+			unsupported("maximum-extent")
+		}
+	} else if v, ok := p.GetString("maximum-extent"); ok {
+		return warnings, fmt.Errorf("invalid maximum-extent %q", v)
+	}
+	if v, ok := p.GetString("font-directory"); ok {
+		if o, ok := m.(FontDirectorySetter); ok {
+			o.SetFontDirectory(v)
+		} else {
+			unsupported("font-directory")
+		}
+	}
+	if v, ok := p.GetString("base"); ok {
+		if o, ok := m.(BaseSetter); ok {
+			o.SetBase(v)
+		} else {
+			unsupported("base")
+		}
+	}
+	if mmlObj != nil && mmlObj.Parameters != nil {
+		if o, ok := m.(ParametersSetter); ok {
+			o.SetParameters(mmlObj.Parameters)
+		} else {
+			unsupported("parameters")
 		}
 	}
-	return nil
+	return warnings, nil
 }
 
-func layerZoomRange(l mml.Layer) mss.ZoomRange {
-	zoom := mss.InvalidZoom
+// layerZoomRange returns the ZoomRange of the layer, based on minzoom,
+// maxzoom and status per zoom. InvalidZoom is returned for layers without
+// restrictions and visible is false if the layer is disabled for all zoom
+// levels.
+func layerZoomRange(l mml.Layer) (zoom mss.ZoomRange, visible bool) {
+	zoom = mss.InvalidZoom
 	minZoom, minOk := l.Properties["minzoom"].(int)
 	maxZoom, maxOk := l.Properties["maxzoom"].(int)
 	if minOk {
@@ -139,13 +268,81 @@ func layerZoomRange(l mml.Layer) mss.ZoomRange {
 	} else if maxOk {
 		zoom = mss.NewZoomRange(mss.LTE, int64(maxZoom))
 	}
-	return zoom
+
+	if l.ZoomStatus != nil {
+		status := l.Active
+		on := mss.InvalidZoom
+		for z := 0; z <= maxZoomLevel; z++ {
+			if s, ok := l.ZoomStatus[z]; ok {
+				status = s
+			}
+			if status {
+				on |= mss.NewZoomRange(mss.EQ, int64(z))
+			}
+		}
+		if on == mss.InvalidZoom {
+			return on, false
+		}
+		if zoom == mss.InvalidZoom {
+			zoom = on
+		} else {
+			zoom &= on
+			if zoom == mss.InvalidZoom {
+				return zoom, false
+			}
+		}
+	}
+	return zoom, true
 }
 
+// maxZoomLevel is the highest zoom level supported by mss.ZoomRange.
+const maxZoomLevel = 30
+
 type MapOptionsSetter interface {
 	SetBackgroundColor(color.Color)
 }
 
+// BackgroundImageSetter is implemented by maps that support the
+// background-image properties.
+type BackgroundImageSetter interface {
+	SetBackgroundImage(string)
+	SetBackgroundImageCompOp(string)
+	SetBackgroundImageOpacity(float64)
+}
+
+// SRSSetter is implemented by maps that support the srs property.
+type SRSSetter interface {
+	SetSRS(string)
+}
+
+// BufferSizeSetter is implemented by maps that support the buffer-size
+// property.
+type BufferSizeSetter interface {
+	SetBufferSize(int)
+}
+
+// MaximumExtentSetter is implemented by maps that support the
+// maximum-extent property.
+type MaximumExtentSetter interface {
+	SetMaximumExtent([4]float64)
+}
+
+// FontDirectorySetter is implemented by maps that support the
+// font-directory property.
+type FontDirectorySetter interface {
+	SetFontDirectory(string)
+}
+
+// BaseSetter is implemented by maps that support the base property.
+type BaseSetter interface {
+	SetBase(string)
+}
+
+// ParametersSetter is implemented by maps that support MML parameters.
+type ParametersSetter interface {
+	SetParameters(map[string]string)
+}
+
 type MapZoomScaleSetter interface {
 	SetZoomScales([]int)
 }
@@ -185,18 +382,22 @@ func BuildMapFromString(m Map, mml *mml.MML, style string) error {
 	}
 
 	for _, l := range mml.Layers {
-		zoom := layerZoomRange(l)
+		zoom, visible := layerZoomRange(l)
+		if !visible {
+			continue
+		}
+		if l.ZoomStatus != nil {
+			// status is handled by zoom range
+			l.Active = true
+		}
 		rules := carto.MSS().LayerZoomRules(l.ID, zoom, l.Classes...)
+		inferGeometryType(&l, rules, "")
 
 		if len(rules) > 0 {
 			m.AddLayer(l, rules)
 		}
 	}
 
-	if m, ok := m.(MapOptionsSetter); ok {
-		if bgColor, ok := carto.MSS().Map().GetColor("background-color"); ok {
-			m.SetBackgroundColor(bgColor)
-		}
-	}
-	return nil
+	_, err = setMapOptions(m, carto.MSS().Map(), mml)
+	return err
 }
@@ -4,6 +4,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
 
 	"github.com/omniscale/magnacarto/mml"
@@ -27,6 +28,34 @@ func (m *mockMap) UnsupportedFeatures() []string {
 	return nil
 }
 
+type srsMap struct {
+	mockMap
+	srs string
+}
+
+func (m *srsMap) SetSRS(srs string) {
+	m.srs = srs
+}
+
+func TestSetMapOptions(t *testing.T) {
+	m := srsMap{}
+	p := mss.NewProperties("srs", "epsg:4326", "buffer-size", 64.0)
+	warnings, err := setMapOptions(&m, p, &mml.MML{Parameters: map[string]string{"center": "0,0,2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.srs != "epsg:4326" {
+		t.Errorf("unexpected srs %q", m.srs)
+	}
+	expected := []string{
+		"Map property buffer-size not supported by builder",
+		"Map property parameters not supported by builder",
+	}
+	if !reflect.DeepEqual(warnings, expected) {
+		t.Errorf("unexpected warnings %v", warnings)
+	}
+}
+
 func TestBuildEmpty(t *testing.T) {
 	m := mockMap{}
 	b := New(&m)
@@ -122,3 +151,82 @@ func TestBuilMapFromString(t *testing.T) {
 		t.Fatal(m.layers)
 	}
 }
+
+func TestLayerZoomRange(t *testing.T) {
+	for i, tt := range []struct {
+		layer   mml.Layer
+		zoom    mss.ZoomRange
+		visible bool
+	}{
+		{mml.Layer{Active: true}, mss.InvalidZoom, true},
+		{
+			mml.Layer{Properties: map[string]interface{}{"minzoom": 3, "maxzoom": 12}},
+			mss.NewZoomRange(mss.GTE, 3) & mss.NewZoomRange(mss.LTE, 12), true,
+		},
+		{
+			mml.Layer{ZoomStatus: map[int]bool{5: true, 10: false}},
+			mss.NewZoomRange(mss.GTE, 5) & mss.NewZoomRange(mss.LT, 10), true,
+		},
+		{
+			mml.Layer{
+				Active:     true,
+				ZoomStatus: map[int]bool{8: false},
+				Properties: map[string]interface{}{"minzoom": 3, "maxzoom": 12},
+			},
+			mss.NewZoomRange(mss.GTE, 3) & mss.NewZoomRange(mss.LT, 8), true,
+		},
+		{
+			mml.Layer{
+				ZoomStatus: map[int]bool{14: true},
+				Properties: map[string]interface{}{"maxzoom": 12},
+			},
+			mss.InvalidZoom, false,
+		},
+	} {
+		zoom, visible := layerZoomRange(tt.layer)
+		if visible != tt.visible {
+			t.Errorf("%d: visible %v != %v", i, visible, tt.visible)
+		}
+		if visible && zoom != tt.zoom {
+			t.Errorf("%d: zoom %v != %v", i, zoom, tt.zoom)
+		}
+	}
+}
+
+func TestInferGeometryType(t *testing.T) {
+	fill := []mss.Rule{{Properties: mss.NewProperties("polygon-fill", "red")}}
+	line := []mss.Rule{{Properties: mss.NewProperties("line-width", 1.0)}}
+	marker := []mss.Rule{{Properties: mss.NewProperties("marker-width", 2.0)}}
+	point := []mss.Rule{{Properties: mss.NewProperties("point-file", "poi.png")}}
+	shp := mml.Shapefile{Filename: "polygons.shp"}
+	geojson := mml.GeoJson{Filename: "mixed.geojson"}
+
+	for i, tt := range []struct {
+		layer    mml.Layer
+		rules    []mss.Rule
+		typ      mml.GeometryType
+		types    []mml.GeometryType
+		warnings int
+	}{
+		{mml.Layer{Type: mml.Unknown}, line, mml.LineString, nil, 0},
+		{mml.Layer{Type: mml.Unknown}, append(point, fill...), mml.Point, []mml.GeometryType{mml.Point, mml.Polygon}, 0},
+		{mml.Layer{Type: mml.Unknown, Datasource: shp}, line, mml.Polygon, nil, 0},
+		{mml.Layer{Type: mml.Unknown, Datasource: shp}, marker, mml.Polygon, nil, 0},
+		{mml.Layer{Type: mml.LineString, Datasource: shp}, line, mml.LineString, nil, 1},
+		{mml.Layer{Type: mml.Point}, fill, mml.Point, nil, 1},
+		{mml.Layer{Type: mml.Unknown, Datasource: geojson}, marker, mml.Point, []mml.GeometryType{mml.Point, mml.Polygon}, 0},
+		{mml.Layer{Type: mml.Unknown, Datasource: mml.Shapefile{Filename: "missing.shp"}}, nil, mml.Unknown, nil, 0},
+	} {
+		l := tt.layer
+		warnings := inferGeometryType(&l, tt.rules, "geomtype/tests")
+		if l.Type != tt.typ {
+			t.Errorf("%d: type %v != %v", i, l.Type, tt.typ)
+		}
+		if len(l.GeometryTypes) != len(tt.types) {
+			t.Errorf("%d: types %v != %v", i, l.GeometryTypes, tt.types)
+		}
+		if len(warnings) != tt.warnings {
+			t.Errorf("%d: unexpected warnings %v", i, warnings)
+		}
+	}
+}
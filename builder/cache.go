@@ -30,6 +30,8 @@ type style struct {
 	mss        []string
 	file       string
 	lastUpdate time.Time
+	// unsupported features of the last build
+	unsupported []string
 }
 
 func styleHash(mapType string, mml string, mss []string) uint32 {
@@ -152,6 +154,16 @@ func (c *Cache) StyleFile(mm MapMaker, mml string, mss []string) (string, error)
 	return style.file, nil
 }
 
+// UnsupportedFeatures returns the unsupported features of the build
+// result, see MapWriter.UnsupportedFeatures. (Re)builds style if required.
+func (c *Cache) UnsupportedFeatures(mm MapMaker, mml string, mss []string) ([]string, error) {
+	style, err := c.style(mm, mml, mss)
+	if err != nil {
+		return nil, err
+	}
+	return style.unsupported, nil
+}
+
 func (c *Cache) style(mm MapMaker, mml string, mss []string) (*style, error) {
 	hash := styleHash(mm.Type(), mml, mss)
 	c.mu.Lock()
@@ -248,6 +260,7 @@ func (c *Cache) build(style *style) error {
 	log.Printf("rebuild style %s as %s with %v\n", style.mml, styleFile, style.mss)
 	style.lastUpdate = time.Now()
 	style.file = styleFile
+	style.unsupported = m.UnsupportedFeatures()
 	return nil
 }
 
@@ -1,11 +1,14 @@
 package builder
 
 import (
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
 	"time"
+
+	"github.com/omniscale/magnacarto/config"
 )
 
 func TestIsStale(t *testing.T) {
@@ -74,3 +77,85 @@ func TestIsStale(t *testing.T) {
 	}
 
 }
+
+type testMaker struct{}
+
+func (testMaker) Type() string       { return "test" }
+func (testMaker) FileSuffix() string { return ".txt" }
+func (testMaker) New(config.Locator) MapWriter {
+	return &testMap{}
+}
+
+// testMap reports all layers as unsupported.
+type testMap struct {
+	Collector
+}
+
+func (m *testMap) Write(w io.Writer) error {
+	_, err := io.WriteString(w, "test")
+	return err
+}
+
+func (m *testMap) WriteFiles(basename string) error {
+	return ioutil.WriteFile(basename, []byte("test"), 0644)
+}
+
+func (m *testMap) UnsupportedFeatures() []string {
+	var features []string
+	for _, l := range m.Layers {
+		features = append(features, "layer "+l.Layer.ID)
+	}
+	return features
+}
+
+func TestCacheUnsupportedFeatures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magnacarto_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mml := filepath.Join(dir, "test.mml")
+	mss := filepath.Join(dir, "test.mss")
+	writeMML := func(layers string) {
+		content := `{"Stylesheet": ["test.mss"], "Layer": [` + layers + `]}`
+		if err := ioutil.WriteFile(mml, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeMML(`{"id": "roads", "Datasource": {"type": "postgis", "table": "roads"}}`)
+	if err := ioutil.WriteFile(mss, []byte("#roads, #rivers { line-width: 1; }"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := config.Magnacarto{}
+	c := NewCache(conf.Locator)
+	defer c.ClearAll()
+
+	features, err := c.UnsupportedFeatures(testMaker{}, mml, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(features) != 1 || features[0] != "layer roads" {
+		t.Error("unexpected features", features)
+	}
+
+	// rebuild after change
+	future := time.Now().Add(time.Minute)
+	writeMML(`{"id": "roads", "Datasource": {"type": "postgis", "table": "roads"}},
+		{"id": "rivers", "Datasource": {"type": "postgis", "table": "rivers"}}`)
+	if err := os.Chtimes(mml, future, future); err != nil {
+		t.Fatal(err)
+	}
+	features, err = c.UnsupportedFeatures(testMaker{}, mml, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(features) != 2 || features[1] != "layer rivers" {
+		t.Error("unexpected features", features)
+	}
+
+	if _, err := c.UnsupportedFeatures(testMaker{}, filepath.Join(dir, "missing.mml"), nil); err == nil {
+		t.Error("expected error for missing mml")
+	}
+}
@@ -0,0 +1,28 @@
+package builder
+
+import (
+	"github.com/omniscale/magnacarto/mml"
+	"github.com/omniscale/magnacarto/mss"
+)
+
+// LayerRules contains a layer with all rules for this layer.
+type LayerRules struct {
+	Layer mml.Layer
+	Rules []mss.Rule
+}
+
+// Collector is a Map that collects all layers and rules, e.g. for
+// analyzing a style without writing it.
+type Collector struct {
+	Layers []LayerRules
+}
+
+func (c *Collector) AddLayer(layer mml.Layer, rules []mss.Rule) {
+	c.Layers = append(c.Layers, LayerRules{Layer: layer, Rules: rules})
+}
+
+func (c *Collector) UnsupportedFeatures() []string {
+	return nil
+}
+
+var _ Map = &Collector{}
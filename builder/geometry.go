@@ -0,0 +1,92 @@
+package builder
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/omniscale/magnacarto/builder/geomtype"
+	"github.com/omniscale/magnacarto/mml"
+	"github.com/omniscale/magnacarto/mss"
+)
+
+// inferGeometryType sets the type of layers without geometry, based on
+// the data of local files or on the symbolizers of the rules. Layers
+// with multiple geometry types get all types in GeometryTypes. Files are
+// resolved relative to baseDir and not read if baseDir is empty.
+// Returns warnings for conflicting types.
+func inferGeometryType(l *mml.Layer, rules []mss.Rule, baseDir string) []string {
+	var warnings []string
+	ruleTypes := geomtype.Rules(rules)
+
+	var dataTypes []mml.GeometryType
+	if baseDir != "" && l.Datasource != nil {
+		types, err := geomtype.Datasource(l.Datasource, baseDir)
+		if err != nil && !os.IsNotExist(err) {
+			warnings = append(warnings, fmt.Sprintf("layer %s: %v", l.ID, err))
+		}
+		dataTypes = types
+	}
+
+	if l.Type != mml.Unknown {
+		if len(dataTypes) > 0 && !containsType(dataTypes, l.Type) {
+			warnings = append(warnings, fmt.Sprintf("layer %s: geometry %s does not match data (%s)",
+				l.ID, l.Type, typeNames(dataTypes)))
+		} else if len(dataTypes) > 1 {
+			l.GeometryTypes = dataTypes
+		}
+		return append(warnings, checkRuleTypes(l, ruleTypes, []mml.GeometryType{l.Type})...)
+	}
+
+	types := dataTypes
+	if len(types) == 0 {
+		types = ruleTypes
+	} else {
+		warnings = append(warnings, checkRuleTypes(l, ruleTypes, dataTypes)...)
+	}
+
+	if len(types) > 0 {
+		l.Type = types[0]
+	}
+	if len(types) > 1 {
+		l.GeometryTypes = types
+	}
+	return warnings
+}
+
+// checkRuleTypes returns warnings for symbolizers that are not
+// compatible with any of the geometry types.
+func checkRuleTypes(l *mml.Layer, ruleTypes, types []mml.GeometryType) []string {
+	var warnings []string
+	for _, rt := range ruleTypes {
+		compatible := false
+		for _, t := range types {
+			// lines are also used for polygon outlines
+			if t == rt || (t == mml.Polygon && rt == mml.LineString) {
+				compatible = true
+			}
+		}
+		if !compatible {
+			warnings = append(warnings, fmt.Sprintf("layer %s: symbolizers for %s do not match geometry %s",
+				l.ID, rt, typeNames(types)))
+		}
+	}
+	return warnings
+}
+
+func containsType(types []mml.GeometryType, t mml.GeometryType) bool {
+	for _, tt := range types {
+		if tt == t {
+			return true
+		}
+	}
+	return false
+}
+
+func typeNames(types []mml.GeometryType) string {
+	names := make([]string, len(types))
+	for i, t := range types {
+		names[i] = string(t)
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,121 @@
+package geomtype
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/omniscale/magnacarto/mml"
+)
+
+// Datasource returns the geometry types of a local Shapefile, GeoJSON or
+// GeoPackage datasource. Relative filenames are resolved to baseDir.
+// It returns nil for all other datasources.
+func Datasource(ds mml.Datasource, baseDir string) ([]mml.GeometryType, error) {
+	resolve := func(fname string) string {
+		if filepath.IsAbs(fname) {
+			return fname
+		}
+		return filepath.Join(baseDir, fname)
+	}
+	switch ds := ds.(type) {
+	case mml.Shapefile:
+		return Shapefile(resolve(ds.Filename))
+	case mml.GeoJson:
+		return GeoJSON(resolve(ds.Filename))
+	case mml.GeoPackage:
+		return GeoPackage(resolve(ds.Filename), ds.Layer)
+	}
+	return nil, nil
+}
+
+// Shapefile returns the geometry type from the header of a .shp file.
+func Shapefile(fname string) ([]mml.GeometryType, error) {
+	if !strings.HasSuffix(strings.ToLower(fname), ".shp") {
+		fname += ".shp"
+	}
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	header := make([]byte, 100)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return nil, fmt.Errorf("reading shapefile header of %s: %v", fname, err)
+	}
+	if binary.BigEndian.Uint32(header[0:4]) != 9994 {
+		return nil, fmt.Errorf("invalid shapefile %s", fname)
+	}
+	switch binary.LittleEndian.Uint32(header[32:36]) {
+	case 1, 8, 11, 18, 21, 28: // (Multi)Point, Z, M
+		return []mml.GeometryType{mml.Point}, nil
+	case 3, 13, 23: // PolyLine, Z, M
+		return []mml.GeometryType{mml.LineString}, nil
+	case 5, 15, 25, 31: // Polygon, Z, M, MultiPatch
+		return []mml.GeometryType{mml.Polygon}, nil
+	}
+	return nil, nil
+}
+
+type geoJSONObject struct {
+	Type       string          `json:"type"`
+	Features   []geoJSONObject `json:"features"`
+	Geometry   *geoJSONObject  `json:"geometry"`
+	Geometries []geoJSONObject `json:"geometries"`
+}
+
+// GeoJSON returns the geometry types of all features of a GeoJSON file.
+func GeoJSON(fname string) ([]mml.GeometryType, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	obj := geoJSONObject{}
+	if err := json.NewDecoder(f).Decode(&obj); err != nil {
+		return nil, fmt.Errorf("decoding GeoJSON %s: %v", fname, err)
+	}
+
+	var types []mml.GeometryType
+	var collect func(o geoJSONObject)
+	collect = func(o geoJSONObject) {
+		switch o.Type {
+		case "FeatureCollection":
+			for _, f := range o.Features {
+				collect(f)
+			}
+		case "Feature":
+			if o.Geometry != nil {
+				collect(*o.Geometry)
+			}
+		case "GeometryCollection":
+			for _, g := range o.Geometries {
+				collect(g)
+			}
+		default:
+			types = append(types, typeFromName(o.Type))
+		}
+	}
+	collect(obj)
+	return Sorted(types), nil
+}
+
+// typeFromName returns the type of OGC geometry type names, like
+// MultiPolygon or LINESTRING.
+func typeFromName(name string) mml.GeometryType {
+	switch strings.ToUpper(name) {
+	case "POINT", "MULTIPOINT":
+		return mml.Point
+	case "LINESTRING", "MULTILINESTRING", "CIRCULARSTRING", "COMPOUNDCURVE", "CURVE", "MULTICURVE":
+		return mml.LineString
+	case "POLYGON", "MULTIPOLYGON", "CURVEPOLYGON", "SURFACE", "MULTISURFACE":
+		return mml.Polygon
+	}
+	return mml.Unknown
+}
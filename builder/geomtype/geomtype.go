@@ -0,0 +1,128 @@
+// Package geomtype determines the geometry types of layers.
+package geomtype
+
+import (
+	"sort"
+
+	"github.com/omniscale/magnacarto/mml"
+	"github.com/omniscale/magnacarto/mss"
+)
+
+var order = map[mml.GeometryType]int{
+	mml.Point:      1,
+	mml.LineString: 2,
+	mml.Polygon:    3,
+	mml.Raster:     4,
+}
+
+// Sorted returns the unique types in the order Point, LineString,
+// Polygon, Raster. Unknown types are dropped.
+func Sorted(types []mml.GeometryType) []mml.GeometryType {
+	seen := make(map[mml.GeometryType]struct{})
+	var result []mml.GeometryType
+	for _, t := range types {
+		if _, ok := order[t]; !ok {
+			continue
+		}
+		if _, ok := seen[t]; ok {
+			continue
+		}
+		seen[t] = struct{}{}
+		result = append(result, t)
+	}
+	sort.Slice(result, func(i, j int) bool { return order[result[i]] < order[result[j]] })
+	return result
+}
+
+var symbolizerPrefixes = []string{"line-", "polygon-", "polygon-pattern-", "text-", "shield-", "marker-", "point-", "building-", "raster-"}
+
+// Rule returns the geometry type the rule is styling. explicit is true
+// if the type is selected by a mapnik::geometry_type filter. Unknown is
+// returned for rules that only contain symbolizers for all geometry types
+// (text, shield, marker) without line placement.
+func Rule(r mss.Rule) (t mml.GeometryType, explicit bool) {
+	for _, f := range r.Filters {
+		if f.Field != "mapnik::geometry_type" || f.CompOp != mss.EQ {
+			continue
+		}
+		switch f.Value {
+		case 1.0:
+			return mml.Point, true
+		case 2.0:
+			return mml.LineString, true
+		case 3.0:
+			return mml.Polygon, true
+		}
+	}
+	if r.Properties == nil {
+		return mml.Unknown, false
+	}
+
+	found := make(map[string]bool)
+	for _, p := range mss.SortedPrefixes(r.Properties, symbolizerPrefixes) {
+		found[p.Name] = true
+	}
+	switch {
+	case found["raster-"]:
+		return mml.Raster, false
+	case found["polygon-"] || found["polygon-pattern-"] || found["building-"]:
+		return mml.Polygon, false
+	case found["line-"]:
+		return mml.LineString, false
+	case found["point-"]:
+		return mml.Point, false
+	}
+	for _, p := range []string{"text-placement", "shield-placement", "marker-placement"} {
+		if v, _ := r.Properties.GetString(p); v == "line" {
+			return mml.LineString, false
+		}
+	}
+	return mml.Unknown, false
+}
+
+// Rules returns the geometry types of a layer, based on the symbolizers
+// and mapnik::geometry_type filters of all rules. Lines are considered as
+// polygon outlines if there are also polygon symbolizers. Returns nil for
+// layers with only markers, texts or shields, as these symbolizers are
+// used for all geometry types.
+func Rules(rules []mss.Rule) []mml.GeometryType {
+	var types []mml.GeometryType
+	explicitLines := false
+	hasPolygon := false
+	for _, r := range rules {
+		t, explicit := Rule(r)
+		switch t {
+		case mml.Unknown:
+			continue
+		case mml.LineString:
+			explicitLines = explicitLines || explicit
+		case mml.Polygon:
+			hasPolygon = true
+		}
+		types = append(types, t)
+	}
+
+	if hasPolygon && !explicitLines {
+		var filtered []mml.GeometryType
+		for _, t := range types {
+			if t != mml.LineString {
+				filtered = append(filtered, t)
+			}
+		}
+		types = filtered
+	}
+	return Sorted(types)
+}
+
+// FilterRules returns all rules that are styling geometries of type t,
+// including rules for all geometry types.
+func FilterRules(rules []mss.Rule, t mml.GeometryType) []mss.Rule {
+	var result []mss.Rule
+	for _, r := range rules {
+		rt, explicit := Rule(r)
+		if rt == t || rt == mml.Unknown || (rt == mml.LineString && t == mml.Polygon && !explicit) {
+			result = append(result, r)
+		}
+	}
+	return result
+}
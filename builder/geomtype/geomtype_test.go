@@ -0,0 +1,93 @@
+package geomtype
+
+import (
+	"testing"
+
+	"github.com/omniscale/magnacarto/mml"
+	"github.com/omniscale/magnacarto/mss"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRules(t *testing.T) {
+	for _, tt := range []struct {
+		rules    []mss.Rule
+		expected []mml.GeometryType
+	}{
+		{nil, nil},
+		{[]mss.Rule{{Properties: mss.NewProperties("line-width", 1.0)}}, []mml.GeometryType{mml.LineString}},
+		{
+			// polygon outlines
+			[]mss.Rule{
+				{Properties: mss.NewProperties("polygon-fill", "red")},
+				{Properties: mss.NewProperties("line-width", 1.0)},
+			},
+			[]mml.GeometryType{mml.Polygon},
+		},
+		{[]mss.Rule{{Properties: mss.NewProperties("text-name", "[name]")}}, nil},
+		{[]mss.Rule{{Properties: mss.NewProperties("text-name", "[name]", "text-placement", "line")}}, []mml.GeometryType{mml.LineString}},
+		{
+			[]mss.Rule{
+				{Properties: mss.NewProperties("building-fill", "red")},
+				{Properties: mss.NewProperties("marker-width", 2.0)},
+			},
+			[]mml.GeometryType{mml.Polygon},
+		},
+		{
+			[]mss.Rule{
+				{Filters: []mss.Filter{{Field: "mapnik::geometry_type", CompOp: mss.EQ, Value: 1.0}}, Properties: mss.NewProperties("marker-width", 2.0)},
+				{Filters: []mss.Filter{{Field: "mapnik::geometry_type", CompOp: mss.EQ, Value: 2.0}}, Properties: mss.NewProperties("line-width", 1.0)},
+				{Properties: mss.NewProperties("polygon-fill", "red")},
+			},
+			[]mml.GeometryType{mml.Point, mml.LineString, mml.Polygon},
+		},
+		{[]mss.Rule{{Properties: mss.NewProperties("raster-opacity", 1.0)}}, []mml.GeometryType{mml.Raster}},
+	} {
+		assert.Equal(t, tt.expected, Rules(tt.rules))
+	}
+}
+
+func TestFilterRules(t *testing.T) {
+	rules := []mss.Rule{
+		{Filters: []mss.Filter{{Field: "mapnik::geometry_type", CompOp: mss.EQ, Value: 1.0}}, Properties: mss.NewProperties("marker-width", 2.0)},
+		{Properties: mss.NewProperties("polygon-fill", "red")},
+		{Properties: mss.NewProperties("line-width", 1.0)},
+		{Properties: mss.NewProperties("text-name", "[name]")},
+	}
+	assert.Equal(t, []mss.Rule{rules[0], rules[3]}, FilterRules(rules, mml.Point))
+	assert.Equal(t, []mss.Rule{rules[1], rules[2], rules[3]}, FilterRules(rules, mml.Polygon))
+}
+
+func TestDatasource(t *testing.T) {
+	types, err := Datasource(mml.Shapefile{Filename: "polygons.shp"}, "tests")
+	assert.NoError(t, err)
+	assert.Equal(t, []mml.GeometryType{mml.Polygon}, types)
+
+	types, err = Datasource(mml.GeoJson{Filename: "mixed.geojson"}, "tests")
+	assert.NoError(t, err)
+	assert.Equal(t, []mml.GeometryType{mml.Point, mml.Polygon}, types)
+
+	types, err = Datasource(mml.GeoPackage{Filename: "test.gpkg", Layer: "buildings"}, "tests")
+	assert.NoError(t, err)
+	assert.Equal(t, []mml.GeometryType{mml.Polygon}, types)
+
+	types, err = Datasource(mml.GeoPackage{Filename: "test.gpkg", Layer: "roads"}, "tests")
+	assert.NoError(t, err)
+	assert.Equal(t, []mml.GeometryType{mml.LineString}, types)
+
+	// table name in overflow pages
+	long := make([]byte, 2000)
+	for i := range long {
+		long[i] = 'x'
+	}
+	types, err = Datasource(mml.GeoPackage{Filename: "test.gpkg", Layer: string(long)}, "tests")
+	assert.NoError(t, err)
+	assert.Equal(t, []mml.GeometryType{mml.Point}, types)
+
+	types, err = Datasource(mml.PostGIS{}, "tests")
+	assert.NoError(t, err)
+	assert.Nil(t, types)
+
+	_, err = Datasource(mml.Shapefile{Filename: "missing.shp"}, "tests")
+	assert.Error(t, err)
+}
@@ -0,0 +1,42 @@
+package geomtype
+
+import (
+	"fmt"
+
+	"github.com/omniscale/magnacarto/internal/sqlite"
+	"github.com/omniscale/magnacarto/mml"
+)
+
+// GeoPackage returns the geometry type of a table from the
+// gpkg_geometry_columns of a GeoPackage. The first table is used if table
+// is empty.
+func GeoPackage(fname string, table string) ([]mml.GeometryType, error) {
+	db, err := sqlite.Open(fname)
+	if err == sqlite.ErrInvalid {
+		return nil, fmt.Errorf("reading GeoPackage %s: %v", fname, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	rows, err := db.Table("gpkg_geometry_columns")
+	if err != nil {
+		return nil, fmt.Errorf("reading GeoPackage %s: %v", fname, err)
+	}
+	for _, row := range rows {
+		// table_name, column_name, geometry_type_name, srs_id, z, m
+		if len(row) < 3 {
+			continue
+		}
+		name, _ := row[0].(string)
+		if table != "" && name != table {
+			continue
+		}
+		typeName, _ := row[2].(string)
+		if t := typeFromName(typeName); t != mml.Unknown {
+			return []mml.GeometryType{t}, nil
+		}
+		return nil, nil
+	}
+	return nil, nil
+}
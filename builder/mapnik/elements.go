@@ -5,13 +5,20 @@ import (
 )
 
 type XMLMap struct {
-	XMLName    xml.Name    `xml:"Map"`
-	SRS        string      `xml:"srs,attr"`
-	BgColor    *string     `xml:"background-color,attr"`
-	Parameters []Parameter `xml:"Parameters>Parameter"`
-	FontSets   []FontSet   `xml:"FontSet"`
-	Styles     []Style     `xml:"Style"`
-	Layers     []Layer     `xml:"Layer"`
+	XMLName        xml.Name    `xml:"Map"`
+	SRS            string      `xml:"srs,attr"`
+	BgColor        *string     `xml:"background-color,attr"`
+	BgImage        *string     `xml:"background-image,attr"`
+	BgImageCompOp  *string     `xml:"background-image-comp-op,attr"`
+	BgImageOpacity *float64    `xml:"background-image-opacity,attr"`
+	BufferSize     *int        `xml:"buffer-size,attr"`
+	MaximumExtent  *string     `xml:"maximum-extent,attr"`
+	FontDirectory  *string     `xml:"font-directory,attr"`
+	Base           *string     `xml:"base,attr"`
+	Parameters     []Parameter `xml:"Parameters>Parameter"`
+	FontSets       []FontSet   `xml:"FontSet"`
+	Styles         []Style     `xml:"Style"`
+	Layers         []Layer     `xml:"Layer"`
 }
 
 type Parameter struct {
@@ -29,11 +36,14 @@ type Font struct {
 }
 
 type Style struct {
-	Name       string   `xml:"name,attr"`
-	FilterMode string   `xml:"filter-mode,attr"`
-	CompOp     *string  `xml:"comp-op,attr"`
-	Opacity    *float64 `xml:"opacity,attr"`
-	Rules      []Rule   `xml:"Rule"`
+	Name                string   `xml:"name,attr"`
+	FilterMode          string   `xml:"filter-mode,attr"`
+	CompOp              *string  `xml:"comp-op,attr"`
+	Opacity             *float64 `xml:"opacity,attr"`
+	ImageFilters        *string  `xml:"image-filters,attr"`
+	ImageFiltersInflate *string  `xml:"image-filters-inflate,attr"`
+	DirectImageFilters  *string  `xml:"direct-image-filters,attr"`
+	Rules               []Rule   `xml:"Rule"`
 }
 
 type Rule struct {
@@ -64,6 +74,8 @@ type Layer struct {
 	GroupBy         string       `xml:"group-by,attr,omitempty"`
 	ClearLabelCache string       `xml:"clear-label-cache,attr,omitempty"`
 	CacheFeatures   string       `xml:"cache-features,attr,omitempty"`
+	BufferSize      *int         `xml:"buffer-size,attr"`
+	MaximumExtent   *string      `xml:"maximum-extent,attr"`
 	StyleNames      []string     `xml:"StyleName"`
 	Datasource      *[]Parameter `xml:"Datasource>Parameter"` // as pointer to prevent empty Datasource tag for layers without datasource
 }
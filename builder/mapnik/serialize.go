@@ -8,11 +8,13 @@ import (
 	"log"
 	"os"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 
 	"github.com/omniscale/magnacarto/builder"
 	"github.com/omniscale/magnacarto/builder/sql"
+	"github.com/omniscale/magnacarto/builder/transform"
 	"github.com/omniscale/magnacarto/color"
 	"github.com/omniscale/magnacarto/config"
 	"github.com/omniscale/magnacarto/mml"
@@ -27,6 +29,7 @@ type Map struct {
 	autoTypeFilter bool
 	zoomScales     []int
 	proj4          bool
+	unsupported    map[string]bool
 }
 
 type maker struct {
@@ -51,6 +54,7 @@ func New(locator config.Locator) *Map {
 		locator:     locator,
 		scaleFactor: 1.0,
 		zoomScales:  webmercZoomScales,
+		unsupported: make(map[string]bool),
 	}
 }
 
@@ -62,6 +66,73 @@ func (m *Map) SetBackgroundColor(c color.Color) {
 	m.XML.BgColor = fmtColor(c, true)
 }
 
+func (m *Map) SetBackgroundImage(file string) {
+	fname := m.locator.Image(file)
+	m.XML.BgImage = &fname
+}
+
+func (m *Map) SetBackgroundImageCompOp(compOp string) {
+	m.XML.BgImageCompOp = &compOp
+}
+
+func (m *Map) SetBackgroundImageOpacity(opacity float64) {
+	m.XML.BgImageOpacity = &opacity
+}
+
+// SetSRS sets the SRS of the map. EPSG codes are converted to +init-style
+// if proj4 is enabled.
+func (m *Map) SetSRS(srs string) {
+	if m.proj4 && strings.HasPrefix(strings.ToLower(srs), "epsg:") {
+		srs = "+init=" + srs
+	}
+	m.XML.SRS = srs
+}
+
+func (m *Map) SetBufferSize(size int) {
+	m.XML.BufferSize = &size
+}
+
+func (m *Map) SetMaximumExtent(extent [4]float64) {
+	m.XML.MaximumExtent = fmtExtent(extent)
+}
+
+func (m *Map) SetFontDirectory(dir string) {
+	m.XML.FontDirectory = &dir
+}
+
+// FontFaces returns all font face names of all font sets.
+func (m *Map) FontFaces() []string {
+	var faces []string
+	seen := make(map[string]struct{})
+	for _, fs := range m.XML.FontSets {
+		for _, f := range fs.Fonts {
+			if _, ok := seen[f.FaceName]; ok {
+				continue
+			}
+			seen[f.FaceName] = struct{}{}
+			faces = append(faces, f.FaceName)
+		}
+	}
+	return faces
+}
+
+func (m *Map) SetBase(base string) {
+	m.XML.Base = &base
+}
+
+// SetParameters sets all Map parameters, sorted by name.
+func (m *Map) SetParameters(params map[string]string) {
+	names := make([]string, 0, len(params))
+	for k := range params {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	m.XML.Parameters = m.XML.Parameters[:0]
+	for _, k := range names {
+		m.XML.Parameters = append(m.XML.Parameters, Parameter{Name: k, Value: params[k]})
+	}
+}
+
 func (m *Map) SetZoomScales(zoomScales []int) {
 	m.zoomScales = zoomScales
 }
@@ -83,6 +154,15 @@ func (m *Map) AddLayer(l mml.Layer, rules []mss.Rule) {
 		m.scaleFactor = l.ScaleFactor
 	}
 	styles := m.newStyles(rules)
+	if l.Opacity != nil {
+		// Mapnik has no layer opacity, set it for all styles without opacity
+		for i := range styles {
+			if styles[i].Opacity == nil {
+				opacity := *l.Opacity
+				styles[i].Opacity = &opacity
+			}
+		}
+	}
 	m.XML.Styles = append(m.XML.Styles, styles...)
 
 	layer := Layer{}
@@ -105,6 +185,13 @@ func (m *Map) AddLayer(l mml.Layer, rules []mss.Rule) {
 	if l.CacheFeatures {
 		layer.CacheFeatures = "true"
 	}
+	if l.BufferSize != 0 {
+		bufferSize := l.BufferSize
+		layer.BufferSize = &bufferSize
+	}
+	if l.MaximumExtent != nil {
+		layer.MaximumExtent = fmtExtent(*l.MaximumExtent)
+	}
 
 	z := mss.RulesZoom(rules)
 	if z != mss.AllZoom {
@@ -118,7 +205,13 @@ func (m *Map) AddLayer(l mml.Layer, rules []mss.Rule) {
 			layer.MinScaleDenom = m.zoomScales[l]
 		}
 	}
-	params := m.newDatasource(l.Datasource, rules)
+	if l.MaxScaleDenom != 0 {
+		layer.MaxScaleDenom = l.MaxScaleDenom
+	}
+	if l.MinScaleDenom != 0 {
+		layer.MinScaleDenom = l.MinScaleDenom
+	}
+	params := m.newDatasource(l, rules)
 	if params != nil {
 		layer.Datasource = &params
 	}
@@ -129,7 +222,12 @@ func (m *Map) AddLayer(l mml.Layer, rules []mss.Rule) {
 }
 
 func (m *Map) UnsupportedFeatures() []string {
-	return nil
+	var features []string
+	for k := range m.unsupported {
+		features = append(features, k)
+	}
+	sort.Strings(features)
+	return features
 }
 
 func (m *Map) Write(w io.Writer) error {
@@ -151,9 +249,9 @@ func (m *Map) WriteFiles(basename string) error {
 // whether a string is a connection (PG:xxx) or filename
 var isOgrConnection = regexp.MustCompile(`^[a-zA-Z]{2,}:`)
 
-func (m *Map) newDatasource(ds mml.Datasource, rules []mss.Rule) []Parameter {
+func (m *Map) newDatasource(l mml.Layer, rules []mss.Rule) []Parameter {
 	var params []Parameter
-	switch ds := ds.(type) {
+	switch ds := l.Datasource.(type) {
 	case mml.PostGIS:
 		ds = m.locator.PostGIS(ds)
 		params = []Parameter{
@@ -164,7 +262,7 @@ func (m *Map) newDatasource(ds mml.Datasource, rules []mss.Rule) []Parameter {
 			{Name: "user", Value: ds.Username},
 			{Name: "password", Value: ds.Password},
 			{Name: "extent", Value: ds.Extent},
-			{Name: "table", Value: pqSelectString(ds.Query, rules, m.autoTypeFilter)},
+			{Name: "table", Value: m.pqSelectString(selectFields(sql.SelectFields, ds.Query, ds.GeometryField, l, rules), rules)},
 			{Name: "srid", Value: ds.SRID},
 			{Name: "type", Value: "postgis"},
 		}
@@ -184,7 +282,7 @@ func (m *Map) newDatasource(ds mml.Datasource, rules []mss.Rule) []Parameter {
 			{Name: "srid", Value: ds.SRID},
 			{Name: "extent", Value: ds.Extent},
 			{Name: "geometry_field", Value: ds.GeometryField},
-			{Name: "table", Value: ds.Query},
+			{Name: "table", Value: m.translateTokens(selectFields(sql.SelectSQLiteFields, ds.Query, ds.GeometryField, l, rules))},
 			{Name: "type", Value: "sqlite"},
 		}
 	case mml.OGR:
@@ -214,6 +312,65 @@ func (m *Map) newDatasource(ds mml.Datasource, rules []mss.Rule) []Parameter {
 			{Name: "file", Value: fname},
 			{Name: "type", Value: "geojson"},
 		}
+	case mml.CSV:
+		file := ""
+		if ds.Filename != "" {
+			file = m.locator.Data(ds.Filename)
+		}
+		params = []Parameter{
+			{Name: "file", Value: file},
+			{Name: "inline", Value: ds.Inline},
+			{Name: "separator", Value: ds.Separator},
+			{Name: "quote", Value: ds.Quote},
+			{Name: "escape", Value: ds.Escape},
+			{Name: "headers", Value: ds.Headers},
+			{Name: "extent", Value: ds.Extent},
+			{Name: "strict", Value: ds.Strict},
+			{Name: "type", Value: "csv"},
+		}
+	case mml.TopoJSON:
+		params = []Parameter{
+			{Name: "file", Value: m.locator.Data(ds.Filename)},
+			{Name: "type", Value: "topojson"},
+		}
+	case mml.PgRaster:
+		if l, ok := m.locator.(config.PgRasterLocator); ok {
+			ds = l.PgRaster(ds)
+		}
+		params = []Parameter{
+			{Name: "host", Value: ds.Host},
+			{Name: "port", Value: ds.Port},
+			{Name: "dbname", Value: ds.Database},
+			{Name: "user", Value: ds.Username},
+			{Name: "password", Value: ds.Password},
+			{Name: "table", Value: ds.Query},
+			{Name: "raster_field", Value: ds.RasterField},
+			{Name: "srid", Value: ds.SRID},
+			{Name: "extent", Value: ds.Extent},
+			{Name: "band", Value: ds.Band},
+			{Name: "use_overviews", Value: ds.UseOverviews},
+			{Name: "prescale_rasters", Value: ds.PrescaleRasters},
+			{Name: "clip_rasters", Value: ds.ClipRasters},
+			{Name: "type", Value: "pgraster"},
+		}
+	case mml.GeoPackage:
+		// Mapnik has no built-in GeoPackage plugin
+		params = []Parameter{
+			{Name: "file", Value: m.locator.Data(ds.Filename)},
+			{Name: "srid", Value: ds.SRID},
+			{Name: "extent", Value: ds.Extent},
+			{Name: "layer", Value: ds.Layer},
+			{Name: "layer_by_sql", Value: ds.Query},
+			{Name: "type", Value: "ogr"},
+		}
+	case mml.FlatGeobuf:
+		params = []Parameter{
+			{Name: "file", Value: m.locator.Data(ds.Filename)},
+			{Name: "srid", Value: ds.SRID},
+			{Name: "extent", Value: ds.Extent},
+			{Name: "layer_by_index", Value: "0"},
+			{Name: "type", Value: "ogr"},
+		}
 	case nil:
 		// datasource might be nil for exports without mml
 	default:
@@ -230,14 +387,35 @@ func (m *Map) newDatasource(ds mml.Datasource, rules []mss.Rule) []Parameter {
 	return result
 }
 
-func pqSelectString(query string, rules []mss.Rule, autoTypeFilter bool) string {
-	if !autoTypeFilter {
+// selectFields limits query to the fields used by the rules with sel
+// (sql.SelectFields or sql.SelectSQLiteFields), if column pruning is
+// enabled for the layer.
+func selectFields(sel func(string, string, []string) string, query, geometryField string, l mml.Layer, rules []mss.Rule) string {
+	if !l.PruneColumns {
+		return query
+	}
+	return sel(query, geometryField, sql.Fields(rules, l.GroupBy, l.LabelItem))
+}
+
+func (m *Map) pqSelectString(query string, rules []mss.Rule) string {
+	query = m.translateTokens(query)
+	if !m.autoTypeFilter {
 		return query
 	}
-	filter := sql.FilterString(rules)
+	filter := sql.ZoomFilterString(rules, m.zoomScales, sql.MapnikScaleDenominator)
 	return sql.WrapWhere(query, filter)
 }
 
+// translateTokens replaces MapServer tokens in query and records tokens
+// that are not supported by Mapnik.
+func (m *Map) translateTokens(query string) string {
+	query, unsupported := sql.TranslateTokens(query, sql.Mapnik)
+	for _, tok := range unsupported {
+		m.unsupported["sql token "+tok] = true
+	}
+	return query
+}
+
 func (m *Map) newStyles(rules []mss.Rule) []Style {
 	styles := []Style{}
 	style := Style{FilterMode: "first"}
@@ -264,6 +442,9 @@ func (m *Map) newStyles(rules []mss.Rule) []Style {
 					if v, ok := r.Properties.GetFloat("opacity"); ok {
 						style.Opacity = &v
 					}
+					style.ImageFilters = fmtImageFilters(r.Properties.GetImageFilters("image-filters"))
+					style.ImageFiltersInflate = fmtBool(r.Properties.GetBool("image-filters-inflate"))
+					style.DirectImageFilters = fmtImageFilters(r.Properties.GetImageFilters("direct-image-filters"))
 				}
 			}
 		}
@@ -352,7 +533,7 @@ func (m *Map) addLineSymbolizer(result *Rule, r mss.Rule) {
 		symb.SimplifyAlgorithm = fmtString(r.Properties.GetString("line-simplify-algorithm"))
 		symb.Smooth = fmtFloat(r.Properties.GetFloat("line-smooth"))
 		symb.CompOp = fmtString(r.Properties.GetString("line-comp-op"))
-		symb.GeometryTransform = fmtString(r.Properties.GetString("line-geometry-transform"))
+		symb.GeometryTransform = m.fmtTransform(r.Properties, "line-geometry-transform")
 		result.Symbolizers = append(result.Symbolizers, &symb)
 	}
 }
@@ -367,7 +548,7 @@ func (m *Map) addLinePatternSymbolizer(result *Rule, r mss.Rule) {
 		symb.Simplify = fmtFloat(r.Properties.GetFloat("line-pattern-simplify"))
 		symb.SimplifyAlgorithm = fmtString(r.Properties.GetString("line-pattern-simplify-algorithm"))
 		symb.Smooth = fmtFloat(r.Properties.GetFloat("line-pattern-smooth"))
-		symb.GeometryTransform = fmtString(r.Properties.GetString("line-pattern-geometry-transform"))
+		symb.GeometryTransform = m.fmtTransform(r.Properties, "line-pattern-geometry-transform")
 		symb.CompOp = fmtString(r.Properties.GetString("line-pattern-comp-op"))
 		symb.Opacity = fmtFloat(r.Properties.GetFloat("line-pattern-opacity"))
 
@@ -386,7 +567,7 @@ func (m *Map) addPolygonSymbolizer(result *Rule, r mss.Rule) {
 		symb.Simplify = fmtFloat(r.Properties.GetFloat("polygon-simplify"))
 		symb.SimplifyAlgorithm = fmtString(r.Properties.GetString("polygon-simplify-algorithm"))
 		symb.Smooth = fmtFloat(r.Properties.GetFloat("polygon-smooth"))
-		symb.GeometryTransform = fmtString(r.Properties.GetString("polygon-geometry-transform"))
+		symb.GeometryTransform = m.fmtTransform(r.Properties, "polygon-geometry-transform")
 		symb.CompOp = fmtString(r.Properties.GetString("polygon-comp-op"))
 
 		result.Symbolizers = append(result.Symbolizers, &symb)
@@ -469,7 +650,7 @@ func (m *Map) convertTextParameters(p *mss.Properties) TextParameters {
 	}
 
 	symb.HaloOpacity = fmtFloat(p.GetFloat("text-halo-opacity"))
-	symb.HaloTransform = fmtString(p.GetString("text-halo-transform"))
+	symb.HaloTransform = m.fmtTransform(p, "text-halo-transform")
 	symb.HaloCompOp = fmtString(p.GetString("text-halo-comp-op"))
 	symb.RepeatWrapCharacter = fmtBool(p.GetBool("text-repeat-wrap-characater"))
 	symb.Margin = fmtFloatProp(p, "text-margin", m.scaleFactor)
@@ -496,7 +677,7 @@ func (m *Map) addShieldSymbolizer(result *Rule, r mss.Rule) {
 		symb.Name = fmtField(r.Properties.GetFieldList("shield-name"))
 		symb.TextOpacity = fmtFloat(r.Properties.GetFloat("shield-text-opacity"))
 		symb.Opacity = fmtFloat(r.Properties.GetFloat("shield-opacity"))
-		symb.Transform = fmtString(r.Properties.GetString("shield-transform"))
+		symb.Transform = m.fmtTransform(r.Properties, "shield-transform")
 		symb.CompOp = fmtString(r.Properties.GetString("shield-comp-op"))
 
 		symb.Placement = fmtString(r.Properties.GetString("shield-placement"))
@@ -534,7 +715,7 @@ func (m *Map) addShieldSymbolizer(result *Rule, r mss.Rule) {
 			symb.FontsetName = m.fontSetName(faceNames)
 		}
 
-		symb.HaloTransform = fmtString(r.Properties.GetString("shield-halo-transform"))
+		symb.HaloTransform = m.fmtTransform(r.Properties, "shield-halo-transform")
 		symb.HaloCompOp = fmtString(r.Properties.GetString("shield-halo-comp-op"))
 		symb.HaloOpacity = fmtFloat(r.Properties.GetFloat("shield-halo-opacity"))
 		symb.LabelPositionTolerance = fmtFloatProp(r.Properties, "shield-label-position-tolerance", m.scaleFactor)
@@ -556,8 +737,8 @@ func (m *Map) addMarkerSymbolizer(result *Rule, r mss.Rule) {
 	symb.FillOpacity = fmtFloat(r.Properties.GetFloat("marker-fill-opacity"))
 	symb.Opacity = fmtFloat(r.Properties.GetFloat("marker-opacity"))
 	symb.Placement = fmtString(r.Properties.GetString("marker-placement"))
-	symb.Transform = fmtString(r.Properties.GetString("marker-transform"))
-	symb.GeometryTransform = fmtString(r.Properties.GetString("marker-geometry-transform"))
+	symb.Transform = m.fmtTransform(r.Properties, "marker-transform")
+	symb.GeometryTransform = m.fmtTransform(r.Properties, "marker-geometry-transform")
 	symb.Spacing = fmtFloatProp(r.Properties, "marker-spacing", m.scaleFactor)
 	symb.Stroke = fmtColor(r.Properties.GetColor("marker-line-color"))
 	symb.StrokeOpacity = fmtFloat(r.Properties.GetFloat("marker-line-opacity"))
@@ -603,7 +784,7 @@ func (m *Map) addPointSymbolizer(result *Rule, r mss.Rule) {
 		symb.File = &fname
 		symb.AllowOverlap = fmtBool(r.Properties.GetBool("point-allow-overlap"))
 		symb.Opacity = fmtFloat(r.Properties.GetFloat("point-opacity"))
-		symb.Transform = fmtString(r.Properties.GetString("point-transform"))
+		symb.Transform = m.fmtTransform(r.Properties, "point-transform")
 		symb.IgnorePlacement = fmtBool(r.Properties.GetBool("point-ignore-placement"))
 		symb.Placement = fmtString(r.Properties.GetString("point-placement"))
 		symb.CompOp = fmtString(r.Properties.GetString("point-comp-op"))
@@ -623,7 +804,7 @@ func (m *Map) addPolygonPatternSymbolizer(result *Rule, r mss.Rule) {
 		symb.Simplify = fmtFloat(r.Properties.GetFloat("polygon-pattern-simplify"))
 		symb.SimplifyAlgorithm = fmtString(r.Properties.GetString("polygon-pattern-simplify-algorithm"))
 		symb.Smooth = fmtFloat(r.Properties.GetFloat("polygon-pattern-smooth"))
-		symb.GeometryTransform = fmtString(r.Properties.GetString("polygon-pattern-geometry-transform"))
+		symb.GeometryTransform = m.fmtTransform(r.Properties, "polygon-pattern-geometry-transform")
 		symb.CompOp = fmtString(r.Properties.GetString("polygon-pattern-comp-op"))
 		result.Symbolizers = append(result.Symbolizers, &symb)
 	}
@@ -748,6 +929,19 @@ func fmtString(v string, ok bool) *string {
 	return &v
 }
 
+// fmtTransform validates the SVG transform of property name. Invalid
+// transforms are reported as unsupported.
+func (m *Map) fmtTransform(p *mss.Properties, name string) *string {
+	v, ok := p.GetString(name)
+	if !ok {
+		return nil
+	}
+	if _, err := transform.Parse(v); err != nil {
+		m.unsupported[fmt.Sprintf("%s: %v", name, err)] = true
+	}
+	return &v
+}
+
 func fmtBool(v bool, ok bool) *string {
 	if !ok {
 		return nil
@@ -769,6 +963,47 @@ func fmtColor(v color.Color, ok bool) *string {
 	return &r
 }
 
+func fmtExtent(extent [4]float64) *string {
+	parts := make([]string, len(extent))
+	for i := range extent {
+		parts[i] = strconv.FormatFloat(extent[i], 'f', -1, 64)
+	}
+	r := strings.Join(parts, ",")
+	return &r
+}
+
+// fmtImageFilters formats image-filters, e.g.
+// agg-stack-blur(2,2),colorize-alpha(#ff0000 0.5,#0000ff).
+func fmtImageFilters(filters []mss.ImageFilter, ok bool) *string {
+	if !ok {
+		return nil
+	}
+	parts := make([]string, len(filters))
+	for i, f := range filters {
+		if len(f.Args) == 0 {
+			parts[i] = f.Name
+			continue
+		}
+		args := make([]string, len(f.Args))
+		for j, a := range f.Args {
+			switch a := a.(type) {
+			case float64:
+				args[j] = strconv.FormatFloat(a, 'f', -1, 64)
+			case color.Color:
+				args[j] = a.String()
+			case mss.Stop:
+				// stop values are percent, Mapnik expects offsets from 0-1
+				args[j] = a.Color.String() + " " + strconv.FormatFloat(float64(a.Value)/100, 'f', -1, 64)
+			default:
+				args[j] = fmt.Sprint(a)
+			}
+		}
+		parts[i] = f.Name + "(" + strings.Join(args, ",") + ")"
+	}
+	r := strings.Join(parts, ",")
+	return &r
+}
+
 func fmtFilters(filters []mss.Filter) string {
 	parts := []string{}
 	for _, f := range filters {
@@ -2,6 +2,8 @@
 package mapserver
 
 import (
+	"encoding/csv"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -9,10 +11,13 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/omniscale/magnacarto/builder"
+	"github.com/omniscale/magnacarto/builder/geomtype"
 	"github.com/omniscale/magnacarto/builder/sql"
+	"github.com/omniscale/magnacarto/builder/transform"
 	"github.com/omniscale/magnacarto/color"
 	"github.com/omniscale/magnacarto/config"
 	"github.com/omniscale/magnacarto/mml"
@@ -40,6 +45,8 @@ type Map struct {
 	Map            Block
 	Layers         Block
 	bgColor        *color.Color
+	srs            string
+	extent         *[4]float64
 	fonts          map[string]string
 	svgSymbols     map[string]symbolOptions
 	pointSymbols   map[string]Block
@@ -48,15 +55,25 @@ type Map struct {
 	noMapBlock     bool
 	scaleFactor    float64
 	zoomScales     []int
+	version        int
 
 	unsupported map[string]bool
 }
 
+// DefaultVersion is the default major version of the target MapServer.
+const DefaultVersion = 8
+
+// defaultWidth and defaultHeight are the SIZE of the MAP.
+const (
+	defaultWidth  = 1600
+	defaultHeight = 800
+)
+
 func New(locator config.Locator) *Map {
 	mapBlock := NewBlock("MAP")
 	mapBlock.Add("Name", quote("map"))
 	mapBlock.Add("Imagetype", "png")
-	mapBlock.Add("Size", "1600 800")
+	mapBlock.Add("Size", fmt.Sprintf("%d %d", defaultWidth, defaultHeight))
 	mapBlock.Add("Units", "meters")
 	mapBlock.Add("Defresolution", "72")
 	mapBlock.Add("Extent", "-20037508.34 -20037508.34 20037508.34 20037508.34")
@@ -86,6 +103,7 @@ func New(locator config.Locator) *Map {
 		locator:     locator,
 		scaleFactor: 1.0,
 		zoomScales:  webmercZoomScales,
+		version:     DefaultVersion,
 		unsupported: make(map[string]bool),
 	}
 }
@@ -94,10 +112,36 @@ func (m *Map) SetBackgroundColor(c color.Color) {
 	m.bgColor = &c
 }
 
+func (m *Map) SetBackgroundImage(file string) {
+	m.unsupported["background-image"] = true
+}
+
+func (m *Map) SetBackgroundImageCompOp(compOp string) {
+	m.unsupported["background-image-comp-op"] = true
+}
+
+// SetBackgroundImageOpacity is a no-op, background-image is not supported.
+func (m *Map) SetBackgroundImageOpacity(opacity float64) {}
+
+func (m *Map) SetSRS(srs string) {
+	m.srs = srs
+}
+
+func (m *Map) SetMaximumExtent(extent [4]float64) {
+	m.extent = &extent
+}
+
 func (m *Map) SetAutoTypeFilter(enable bool) {
 	m.autoTypeFilter = enable
 }
 
+// SetVersion sets the major version of the target MapServer. Some
+// features require newer versions (e.g. CONNECTIONOPTIONS for CSV files
+// with x/y columns requires MapServer 8). Defaults to DefaultVersion.
+func (m *Map) SetVersion(major int) {
+	m.version = major
+}
+
 func (m *Map) SetNoMapBlock(enable bool) {
 	m.noMapBlock = enable
 }
@@ -114,13 +158,47 @@ func (m *Map) String() string {
 	if m.bgColor != nil {
 		m.Map.AddNonNil("ImageColor", fmtColor(*m.bgColor, true))
 	}
+	if !m.noMapBlock {
+		if m.extent != nil {
+			e := *m.extent
+			m.Map.Set("Extent", fmt.Sprintf("%s %s %s %s",
+				*fmtFloat(e[0], true), *fmtFloat(e[1], true), *fmtFloat(e[2], true), *fmtFloat(e[3], true),
+			))
+			// keep aspect ratio of extent, MapServer would adjust the extent otherwise
+			width, height := fitSize(e, defaultWidth)
+			m.Map.Set("Size", fmt.Sprintf("%d %d", width, height))
+		}
+		if m.srs != "" {
+			m.Map.Set("projection", NewBlock("projection", Item{"", fmtProjection(m.srs)}))
+		}
+	}
 	m.Map.Add("", m.Layers)
 	m.addSymbols()
 	return m.Map.String()
 }
 
+// fitSize returns the image size for the extent with the aspect ratio
+// of the extent. The longer side is size pixels.
+func fitSize(extent [4]float64, size int) (int, int) {
+	w, h := extent[2]-extent[0], extent[3]-extent[1]
+	if w <= 0 || h <= 0 {
+		return defaultWidth, defaultHeight
+	}
+	if w >= h {
+		return size, int(math.Max(1, math.Round(float64(size)*h/w)))
+	}
+	return int(math.Max(1, math.Round(float64(size)*w/h))), size
+}
+
 func (m *Map) addSymbols() {
-	for shortName, options := range m.svgSymbols {
+	// sorted for reproducible map files
+	names := make([]string, 0, len(m.svgSymbols))
+	for shortName := range m.svgSymbols {
+		names = append(names, shortName)
+	}
+	sort.Strings(names)
+	for _, shortName := range names {
+		options := m.svgSymbols[shortName]
 		s := NewBlock("SYMBOL")
 		s.Add("name", shortName)
 		s.Add("image", quote(options.fileName))
@@ -191,14 +269,29 @@ func (m *Map) WriteFiles(basename string) error {
 type classGroup struct {
 	name    string
 	classes []Block
-	opacity float64
+	// vertexLabels are classes for labels on each vertex of lines and
+	// polygons
+	vertexLabels []Block
+	opacity      float64
 }
 
 func (m *Map) AddLayer(layer mml.Layer, rules []mss.Rule) {
+	m.addLayer(layer, rules, layer.ID)
+}
+
+// addLayer adds one MapServer layer for each attachment. Layers with
+// names other than group are grouped, so that WMS requests can select
+// all of them by the MML layer ID.
+func (m *Map) addLayer(layer mml.Layer, rules []mss.Rule, group string) {
 	if len(rules) == 0 {
 		return
 	}
 
+	if len(layer.GeometryTypes) > 1 {
+		m.addSplitLayers(layer, rules)
+		return
+	}
+
 	if layer.ScaleFactor != 0.0 {
 		prevScaleFactor := m.scaleFactor
 		defer func() { m.scaleFactor = prevScaleFactor }()
@@ -228,7 +321,7 @@ func (m *Map) AddLayer(layer mml.Layer, rules []mss.Rule) {
 			styleName += "-" + r.Attachment
 		}
 		if style.name != styleName {
-			if len(style.classes) > 0 {
+			if len(style.classes) > 0 || len(style.vertexLabels) > 0 {
 				styles = append(styles, style)
 			}
 			style = classGroup{name: styleName}
@@ -236,51 +329,130 @@ func (m *Map) AddLayer(layer mml.Layer, rules []mss.Rule) {
 		if v, ok := r.Properties.GetFloat("opacity"); ok {
 			style.opacity = v
 		}
+		for _, p := range []string{"image-filters", "direct-image-filters"} {
+			if _, ok := r.Properties.GetImageFilters(p); ok {
+				m.unsupported[p] = true
+			}
+		}
 		c, ok := m.newClass(r, t)
 		if ok {
 			style.classes = append(style.classes, *c)
 		}
+		if t == "LINE" || t == "POLYGON" {
+			if c, ok := m.newVertexLabelClass(r); ok {
+				style.vertexLabels = append(style.vertexLabels, *c)
+			}
+		}
 	}
 
-	if len(style.classes) > 0 {
+	if len(style.classes) > 0 || len(style.vertexLabels) > 0 {
 		styles = append(styles, style)
 	}
 
 	for _, style := range styles {
-		l := NewBlock("LAYER")
-		l.Add("name", style.name)
-
-		z := mss.RulesZoom(rules)
-		if z := z.First(); z > 0 {
-			if z > len(m.zoomScales) {
-				z = len(m.zoomScales)
-			}
-			l.Add("MaxScaleDenom", m.zoomScales[z-1])
+		if len(style.classes) > 0 {
+			m.addLayerBlock(layer, rules, group, style.name, t, style.opacity, style.classes)
 		}
-		if z := z.Last(); z < len(m.zoomScales) {
-			l.Add("MinScaleDenom", m.zoomScales[z])
+		if len(style.vertexLabels) > 0 {
+			// MapServer labels each vertex of lines and polygons in POINT
+			// layers
+			m.addLayerBlock(layer, rules, group, style.name+"-vertices", "POINT", style.opacity, style.vertexLabels)
 		}
+	}
+}
 
-		if style.opacity != 0 {
-			l.AddNonNil("Opacity", fmtFloat(style.opacity*100, true))
-		}
+// addLayerBlock adds a LAYER with the classes.
+func (m *Map) addLayerBlock(layer mml.Layer, rules []mss.Rule, group, name, t string, opacity float64, classes []Block) {
+	l := NewBlock("LAYER")
+	l.Add("name", name)
+	if name != group {
+		l.Add("group", group)
+	}
 
-		if layer.Active {
-			l.Add("status", "ON")
-		} else {
-			l.Add("status", "OFF")
+	z := mss.RulesZoom(rules)
+	if layer.MaxScaleDenom != 0 {
+		l.Add("MaxScaleDenom", layer.MaxScaleDenom)
+	} else if z := z.First(); z > 0 {
+		if z > len(m.zoomScales) {
+			z = len(m.zoomScales)
 		}
-		l.Add("type", t)
+		l.Add("MaxScaleDenom", m.zoomScales[z-1])
+	}
+	if layer.MinScaleDenom != 0 {
+		l.Add("MinScaleDenom", layer.MinScaleDenom)
+	} else if z := z.Last(); z < len(m.zoomScales) {
+		l.Add("MinScaleDenom", m.zoomScales[z])
+	}
+
+	if opacity != 0 {
+		l.AddNonNil("Opacity", fmtFloat(opacity*100, true))
+	} else if layer.Opacity != nil {
+		l.AddNonNil("Opacity", fmtFloat(*layer.Opacity*100, true))
+	}
+
+	if layer.Active {
+		l.Add("status", "ON")
+	} else {
+		l.Add("status", "OFF")
+	}
+	l.Add("type", t)
+
+	if layer.PostLabelCache {
+		l.Add("postlabelcache", "true")
+	}
+	if e := layer.MaximumExtent; e != nil {
+		l.Add("Extent", fmt.Sprintf("%s %s %s %s",
+			*fmtFloat(e[0], true), *fmtFloat(e[1], true), *fmtFloat(e[2], true), *fmtFloat(e[3], true),
+		))
+	}
+	if layer.LabelItem != "" {
+		l.Add("Labelitem", quote(layer.LabelItem))
+	}
+	if layer.Tolerance != nil {
+		l.AddNonNil("Tolerance", fmtFloat(*layer.Tolerance, true))
+	}
+	if layer.ToleranceUnits != "" {
+		l.Add("Toleranceunits", layer.ToleranceUnits)
+	}
+	for _, p := range layer.Processing {
+		l.Add("Processing", quote(p))
+	}
+
+	m.addDatasource(&l, layer, rules)
+	for _, c := range classes {
+		l.Add("", c)
+	}
+	m.Layers.Add("", l)
+}
 
-		if layer.PostLabelCache {
-			l.Add("postlabelcache", "true")
+var geometryDimensions = map[mml.GeometryType]int{mml.Point: 0, mml.LineString: 1, mml.Polygon: 2}
+
+// addSplitLayers adds one layer for each geometry type of layers with
+// mixed geometries, as MapServer layers only support a single type.
+// PostGIS queries are filtered by the dimension of the geometries.
+func (m *Map) addSplitLayers(layer mml.Layer, rules []mss.Rule) {
+	for _, t := range layer.GeometryTypes {
+		suffix := "_" + strings.ToLower(string(t))
+		typeRules := geomtype.FilterRules(rules, t)
+		for i := range typeRules {
+			typeRules[i].Layer += suffix
 		}
 
-		m.addDatasource(&l, layer.Datasource, rules)
-		for _, c := range style.classes {
-			l.Add("", c)
+		l := layer
+		l.ID += suffix
+		l.Type = t
+		l.GeometryTypes = nil
+		if ds, ok := l.Datasource.(mml.PostGIS); ok {
+			if dim, ok := geometryDimensions[t]; ok {
+				geom := ds.GeometryField
+				if geom == "" {
+					geom = "geometry"
+				}
+				ds.Query = sql.WrapWhere(ds.Query, fmt.Sprintf(`ST_Dimension("%s") = %d`, geom, dim))
+				l.Datasource = ds
+			}
 		}
-		m.Layers.Add("", l)
+		m.addLayer(l, typeRules, layer.ID)
 	}
 }
 
@@ -307,8 +479,10 @@ const HaloWidthFactor = 2 * 72 / 90.7 // twice the radius
 // FontFactor is used to adjust differences of font sized between Mapnik and Mapserver.
 const FontFactor = 72 /*dpi*/ / 90.7 /*dpi*/
 
-func (m *Map) newClass(r mss.Rule, layerType string) (b *Block, styled bool) {
-	b = &Block{Name: "CLASS"}
+// classBlock returns a CLASS with the scale denominators and the
+// expression of the rule.
+func (m *Map) classBlock(r mss.Rule) *Block {
+	b := &Block{Name: "CLASS"}
 
 	if r.Zoom != mss.AllZoom {
 		b.Add("", "# "+r.Zoom.String())
@@ -326,6 +500,30 @@ func (m *Map) newClass(r mss.Rule, layerType string) (b *Block, styled bool) {
 	if filter != "" {
 		b.Add("Expression", filter)
 	}
+	return b
+}
+
+// newVertexLabelClass returns a class with all text symbolizers of the
+// rule that are placed on each vertex (text-placement: vertex).
+func (m *Map) newVertexLabelClass(r mss.Rule) (b *Block, styled bool) {
+	b = m.classBlock(r)
+	for _, p := range mss.SortedPrefixes(r.Properties, []string{"text-"}) {
+		r.Properties.SetDefaultInstance(p.Instance)
+		if isVertexPlacement(r) && m.addTextSymbolizer(b, r, false) {
+			styled = true
+		}
+		r.Properties.SetDefaultInstance("")
+	}
+	return
+}
+
+func isVertexPlacement(r mss.Rule) bool {
+	placement, _ := r.Properties.GetString("text-placement")
+	return placement == "vertex"
+}
+
+func (m *Map) newClass(r mss.Rule, layerType string) (b *Block, styled bool) {
+	b = m.classBlock(r)
 
 	prefixes := mss.SortedPrefixes(r.Properties, []string{"line-", "polygon-", "polygon-pattern-", "text-", "shield-", "marker-", "point-", "building-", "raster-"})
 
@@ -347,11 +545,15 @@ func (m *Map) newClass(r mss.Rule, layerType string) (b *Block, styled bool) {
 		case "polygon-pattern-":
 			prefixStyled = m.addPolygonPatternSymbolizer(b, r)
 		case "text-":
+			if isVertexPlacement(r) && (layerType == "LINE" || layerType == "POLYGON") {
+				// added to a separate POINT layer, see newVertexLabelClass
+				break
+			}
 			prefixStyled = m.addTextSymbolizer(b, r, layerType == "LINE")
 		case "shield-":
 			prefixStyled = m.addShieldSymbolizer(b, r)
 		case "marker-":
-			prefixStyled = m.addMarkerSymbolizer(b, r, layerType == "LINE")
+			prefixStyled = m.addMarkerSymbolizer(b, r, layerType)
 		case "point-":
 			prefixStyled = m.addPointSymbolizer(b, r)
 		case "building-":
@@ -397,6 +599,11 @@ func (m *Map) addLineSymbolizer(b *Block, r mss.Rule) (styled, hidden bool) {
 
 		if lineOffset, ok := r.Properties.GetFloat("line-offset"); ok {
 			style.Add("OFFSET", fmt.Sprintf("%.0f -99", lineOffset))
+			if _, ok := r.Properties.GetString("line-geometry-transform"); ok {
+				m.unsupported["line-geometry-transform with line-offset"] = true
+			}
+		} else {
+			m.addGeometryTransform(&style, r, "line-geometry-transform")
 		}
 
 		b.Add("", style)
@@ -412,17 +619,17 @@ func (m *Map) addPolygonOutlineSymbolizer(b *Block, r mss.Rule) (styled, hidden
 		}
 		style := NewBlock("STYLE")
 		style.AddNonNil("Width", fmtFloat(width*LineWidthFactor*m.scaleFactor, true))
-		if c, ok := r.Properties.GetColor("line-color"); ok {
-			if opacity, ok := r.Properties.GetFloat("line-opacity"); ok {
-				c = color.FadeOut(c, 1-opacity)
-			}
-			style.AddNonNil("OutlineColor", fmtColor(c, true))
+		c, ok := r.Properties.GetColor("line-color")
+		if opacity, found := r.Properties.GetFloat("line-opacity"); ok && found {
+			c = color.FadeOut(c, 1-opacity)
 		}
+		style.AddDefault("OutlineColor", fmtColor(c, ok), "0 0 0")
 		if v, ok := r.Properties.GetFloatList("line-dasharray"); ok {
 			style.Add("", fmtPattern(v, m.scaleFactor, true))
 		}
 		style.AddDefault("Linecap", fmtKeyword(r.Properties.GetString("line-cap")), "BUTT")
 		style.AddDefault("Linejoin", fmtKeyword(r.Properties.GetString("line-join")), "MITER")
+		m.addGeometryTransform(&style, r, "line-geometry-transform")
 		b.Add("", style)
 		return true, false
 	}
@@ -436,6 +643,7 @@ func (m *Map) addPolygonSymbolizer(b *Block, r mss.Rule) (styled bool) {
 		if opacity, ok := r.Properties.GetFloat("polygon-opacity"); ok {
 			style.AddNonNil("Opacity", fmtFloat(opacity*100, true))
 		}
+		m.addGeometryTransform(&style, r, "polygon-geometry-transform")
 		b.Add("", style)
 		return true
 	}
@@ -446,6 +654,7 @@ func (m *Map) addPolygonPatternSymbolizer(b *Block, r mss.Rule) (styled bool) {
 	if file, ok := r.Properties.GetString("polygon-pattern-file"); ok {
 		style := NewBlock("STYLE")
 		style.Add("SYMBOL", *m.symbolName(file, symbolOptions{}))
+		m.addGeometryTransform(&style, r, "polygon-pattern-geometry-transform")
 		b.Add("", style)
 		return true
 	}
@@ -496,7 +705,14 @@ func (m *Map) addTextSymbolizer(b *Block, r mss.Rule, isLine bool) (styled bool)
 			}
 		}
 
-		if isLine {
+		placement, _ := r.Properties.GetString("text-placement")
+		// text follows lines, unless placed as point. MapServer places
+		// labels of polygons on an interior point and labels of lines
+		// without FOLLOW in the middle of the line, as Mapnik does for
+		// interior placement
+		follow := isLine && placement != "point" && placement != "interior"
+
+		if follow {
 			dy, ok := r.Properties.GetFloat("text-dy")
 			if ok {
 				style.Add("OFFSET", fmt.Sprintf("%.0f 99", -dy))
@@ -521,10 +737,8 @@ func (m *Map) addTextSymbolizer(b *Block, r mss.Rule, isLine bool) (styled bool)
 		}
 
 		style.Add("Type", "truetype")
-		if isLine {
-			angle, ok := r.Properties.GetString("text-placement")
-
-			if ok && angle == "auto2" {
+		if follow {
+			if placement == "auto2" {
 				style.Add("Angle", "AUTO2")
 			} else {
 				style.Add("Angle", "FOLLOW")
@@ -604,6 +818,19 @@ func (m *Map) addPointSymbolizer(b *Block, r mss.Rule) (styled bool) {
 	if pointFile, ok := r.Properties.GetString("point-file"); ok {
 		style := NewBlock("STYLE")
 
+		if tr, ok := m.symbolTransform(r, "point-transform"); ok {
+			if tr.rotate != 0.0 {
+				style.AddNonNil("Angle", fmtFloat(clipAngle(tr.rotate), true))
+			}
+			if tr.scale != 1.0 {
+				v, _ := r.Properties.GetString("point-transform")
+				m.unsupported[fmt.Sprintf("point-transform %q: scale not supported", v)] = true
+			}
+			// ANCHORPOINT requires the image size, rotations around an
+			// anchor are converted to a rotation around the center and
+			// an OFFSET
+			m.addSymbolOffset(&style, tr.offset)
+		}
 		style.Add("SYMBOL", *m.symbolName(pointFile, symbolOptions{}))
 		style.AddNonNil("Opacity", fmtFloat(r.Properties.GetFloat("point-opacity")))
 		// style.AddNonNil("Force", fmtBool(r.Properties.GetBool("point-allow-overlap")))
@@ -647,7 +874,7 @@ func (m *Map) addBuildingSymbolizer(b *Block, r mss.Rule) (styled bool) {
 	return false
 }
 
-func (m *Map) addMarkerSymbolizer(b *Block, r mss.Rule, isLine bool) (styled bool) {
+func (m *Map) addMarkerSymbolizer(b *Block, r mss.Rule, layerType string) (styled bool) {
 	if markerFile, ok := r.Properties.GetString("marker-file"); ok {
 		style := NewBlock("STYLE")
 
@@ -657,39 +884,40 @@ func (m *Map) addMarkerSymbolizer(b *Block, r mss.Rule, isLine bool) (styled boo
 			style.AddNonNil("Partials", fmtBool(!avoidEdges, true))
 		}
 
-		if placement, ok := r.Properties.GetString("marker-placement"); ok {
-			if placement == "point" {
-				style.Add("Geomtransform", "centroid")
-			}
-		}
+		m.addMarkerPlacement(&style, r, layerType, false)
 
 		symOpts := symbolOptions{}
 
-		if transform, ok := r.Properties.GetString("marker-transform"); ok {
-			width, wOk := r.Properties.GetFloat("marker-width")
-			height, hOk := r.Properties.GetFloat("marker-height")
-			if wOk && hOk {
-				width *= m.scaleFactor
-				height *= m.scaleFactor
-				tr, err := parseTransform(transform)
-				if err != nil {
-					log.Println(err)
-				}
-				if tr.rotate != 0.0 {
-					style.AddNonNil("Angle", fmtFloat(clipAngle(tr.rotate), true))
-				}
-				if sizeOk && tr.scale != 0.0 {
-					size *= tr.scale
-				}
-				if tr.hasRotateAnchor {
-					symOpts.hasAnchor = true
-					symOpts.anchorX = (tr.rotateAnchor[0]*m.scaleFactor + width/2) / width
-					symOpts.anchorY = (tr.rotateAnchor[1]*m.scaleFactor + height/2) / height
+		if tr, ok := m.symbolTransform(r, "marker-transform"); ok {
+			if tr.rotate != 0.0 {
+				style.AddNonNil("Angle", fmtFloat(clipAngle(tr.rotate), true))
+			}
+			if sizeOk {
+				size *= tr.scale
+			}
+			useAnchor := false
+			if tr.hasAnchor {
+				width, wOk := r.Properties.GetFloat("marker-width")
+				height, hOk := r.Properties.GetFloat("marker-height")
+				if wOk && hOk {
+					width *= m.scaleFactor
+					height *= m.scaleFactor
+					anchorX := (tr.anchor[0]*m.scaleFactor + width/2) / width
+					anchorY := (tr.anchor[1]*m.scaleFactor + height/2) / height
+					// ANCHORPOINT needs to be within the symbol, use OFFSET otherwise
+					if anchorX >= 0 && anchorX <= 1 && anchorY >= 0 && anchorY <= 1 {
+						useAnchor = true
+						symOpts.hasAnchor = true
+						symOpts.anchorX = anchorX
+						symOpts.anchorY = anchorY
+					}
 				}
-			} else {
-				log.Println("marker-transform requires marker-width and marker-height")
+			}
+			if !useAnchor {
+				m.addSymbolOffset(&style, tr.offset)
 			}
 		}
+		m.addGeometryTransform(&style, r, "marker-geometry-transform")
 		style.AddNonNil("Size", fmtFloat(size*m.scaleFactor, sizeOk))
 		style.Add("SYMBOL", *m.symbolName(markerFile, symOpts))
 
@@ -734,18 +962,14 @@ func (m *Map) addMarkerSymbolizer(b *Block, r mss.Rule, isLine bool) (styled boo
 			style.AddNonNil("Width", fmtFloat(lineWidth, true))
 		}
 
-		if transform, ok := r.Properties.GetString("marker-transform"); ok {
-			tr, err := parseTransform(transform)
-			if err != nil {
-				log.Println(err)
-			}
+		if tr, ok := m.symbolTransform(r, "marker-transform"); ok {
 			if tr.rotate != 0.0 {
 				style.AddNonNil("Angle", fmtFloat(clipAngle(tr.rotate), true))
 			}
-			if tr.scale != 0.0 {
-				size *= tr.scale
-			}
+			size *= tr.scale
+			m.addSymbolOffset(&style, tr.offset)
 		}
+		m.addGeometryTransform(&style, r, "marker-geometry-transform")
 
 		if width, ok := r.Properties.GetFloat("marker-width"); ok {
 			style.AddNonNil("Size", fmtFloat(width*m.scaleFactor, true))
@@ -753,21 +977,8 @@ func (m *Map) addMarkerSymbolizer(b *Block, r mss.Rule, isLine bool) (styled boo
 			style.AddNonNil("Size", fmtFloat(size*m.scaleFactor, true))
 		}
 
-		if isLine {
-			if spacing, ok := r.Properties.GetFloat("marker-spacing"); ok {
-				style.AddNonNil("Gap", fmtFloat(-spacing*m.scaleFactor, true))
-				style.AddNonNil("InitialGap", fmtFloat(spacing*0.5*m.scaleFactor, true))
-
-			} else {
-				style.AddNonNil("Gap", fmtFloat(-100*m.scaleFactor, true)) // mapnik default
-			}
-		}
-
-		if placement, ok := r.Properties.GetString("marker-placement"); ok {
-			if placement == "point" {
-				style.Add("Geomtransform", "centroid")
-			}
-		}
+		// markers are placed along lines by default
+		m.addMarkerPlacement(&style, r, layerType, layerType == "LINE")
 
 		b.Add("", style)
 		return true
@@ -776,10 +987,116 @@ func (m *Map) addMarkerSymbolizer(b *Block, r mss.Rule, isLine bool) (styled boo
 	return false
 }
 
+// addMarkerPlacement adds GEOMTRANSFORM or GAP/INITIALGAP for
+// marker-placement. defaultLine enables line placement if marker-placement
+// is not set.
+func (m *Map) addMarkerPlacement(style *Block, r mss.Rule, layerType string, defaultLine bool) {
+	placement, ok := r.Properties.GetString("marker-placement")
+	if !ok {
+		if !defaultLine {
+			return
+		}
+		placement = "line"
+	}
+	switch placement {
+	case "point":
+		style.Add("Geomtransform", quote("centroid"))
+	case "interior":
+		if layerType == "POLYGON" {
+			// point inside of the polygon, centroid can be outside
+			style.Add("Geomtransform", quote("labelpoly"))
+		} else if layerType == "LINE" {
+			style.Add("Geomtransform", quote("centroid"))
+		}
+	case "line":
+		if layerType != "LINE" && layerType != "POLYGON" {
+			return
+		}
+		spacing, ok := r.Properties.GetFloat("marker-spacing")
+		if !ok {
+			spacing = 100 // mapnik default
+		}
+		// negative gap rotates markers along the line
+		style.AddNonNil("Gap", fmtFloat(-spacing*m.scaleFactor, true))
+		if ok {
+			style.AddNonNil("InitialGap", fmtFloat(spacing*0.5*m.scaleFactor, true))
+		}
+	case "vertex-first":
+		style.Add("Geomtransform", quote("start"))
+	case "vertex-last":
+		style.Add("Geomtransform", quote("end"))
+	}
+}
+
+// fmtProjection returns the PROJECTION parameter for an SRS
+// (e.g. epsg:3857, +init=epsg:3857 or a Proj4 string).
+func fmtProjection(srs string) string {
+	s := strings.TrimPrefix(strings.ToLower(srs), "+init=")
+	if strings.HasPrefix(s, "epsg:") {
+		return quote("init=" + s)
+	}
+	return quote(strings.TrimSpace(srs))
+}
+
 func clipAngle(a float64) float64 {
 	return math.Mod(a, 360.0)
 }
 
+// parseTransform parses the SVG transform of property. Invalid transforms
+// are reported as unsupported.
+func (m *Map) parseTransform(r mss.Rule, property string) (transform.Transform, bool) {
+	v, ok := r.Properties.GetString(property)
+	if !ok {
+		return nil, false
+	}
+	tr, err := transform.Parse(v)
+	if err != nil {
+		m.unsupported[fmt.Sprintf("%s: %v", property, err)] = true
+		return nil, false
+	}
+	return tr, true
+}
+
+// symbolTransform returns the symbolTransformation of property.
+func (m *Map) symbolTransform(r mss.Rule, property string) (symbolTransformation, bool) {
+	tr, ok := m.parseTransform(r, property)
+	if !ok {
+		return symbolTransformation{}, false
+	}
+	st, err := symbolTransform(tr)
+	if err != nil {
+		m.unsupported[fmt.Sprintf("%s %q: %v", property, tr, err)] = true
+		return symbolTransformation{}, false
+	}
+	return st, true
+}
+
+// addSymbolOffset adds OFFSET for translated symbols.
+func (m *Map) addSymbolOffset(style *Block, offset [2]float64) {
+	if offset[0] == 0 && offset[1] == 0 {
+		return
+	}
+	style.Add("OFFSET", fmt.Sprintf("%s %s",
+		*fmtFloat(offset[0]*m.scaleFactor, true),
+		*fmtFloat(offset[1]*m.scaleFactor, true),
+	))
+}
+
+// addGeometryTransform adds the translation of a *-geometry-transform as
+// OFFSET. Other transformations are reported as unsupported.
+func (m *Map) addGeometryTransform(style *Block, r mss.Rule, property string) {
+	tr, ok := m.parseTransform(r, property)
+	if !ok {
+		return
+	}
+	dx, dy, err := geometryOffset(tr)
+	if err != nil {
+		m.unsupported[fmt.Sprintf("%s %q: %v", property, tr, err)] = true
+		return
+	}
+	m.addSymbolOffset(style, [2]float64{dx, dy})
+}
+
 func (m *Map) addRasterSymbolizer(b *Block, r mss.Rule) (styled bool) {
 	return true
 }
@@ -795,6 +1112,14 @@ func (m *Map) fontNames(fontFaces []string) *string {
 		if m.fonts == nil {
 			m.fonts = make(map[string]string)
 		}
+		if _, ok := m.fonts[fullName]; !ok {
+			file := m.locator.Font(fullName)
+			if strings.EqualFold(filepath.Ext(file), ".ttc") && config.FontIndex(file, fullName) > 0 {
+				// FONTSET entries have no face index, MapServer always
+				// uses the first font of a collection
+				m.unsupported["font "+fullName+" (not the first font of "+filepath.Base(file)+")"] = true
+			}
+		}
 		m.fonts[fullName] = shortName
 		shortNames = append(shortNames, shortName)
 	}
@@ -933,28 +1258,64 @@ func cleanupQuery(query string) (string, bool) {
 	return query, isSubselect
 }
 
-func pqSelectString(query, srid string, rules []mss.Rule, autoTypeFilter bool) string {
+func (m *Map) pqSelectString(query, srid string, rules []mss.Rule) string {
 	/*
 	   (select * from osm_landusages where type in ('forest', 'woods')) as landusages
 	   ->
 	   geometry from (select *, NULL as nullid from (select * from osm_landusages where type in ('forest', 'woods')) as landusages) as nullidq using unique nullid using srid=900913
 	*/
-	query, isSubselect := cleanupQuery(query)
-	query = strings.Replace(query, `!bbox!`, `!BOX!`, -1)
-
-	if autoTypeFilter {
-		filter := sql.FilterString(rules)
+	if m.autoTypeFilter {
+		filter := sql.ZoomFilterString(rules, m.zoomScales, sql.MapServerScaleDenominator)
 		query = sql.WrapWhere(query, filter)
 	}
 
+	query, isSubselect := cleanupQuery(query)
+	query = m.translateTokens(query)
+
 	if isSubselect {
 		return "geometry from (select *, NULL as nullid from \n" + query + "\n) as nullidq using unique nullid using srid=" + srid
 	}
 	return "geometry from " + query
 }
 
-func sqliteSelectString(query, srid string) string {
+// selectFields limits query to the fields used by the rules with sel
+// (sql.SelectFields or sql.SelectSQLiteFields), if column pruning is
+// enabled for the layer.
+func selectFields(sel func(string, string, []string) string, query, geometryField string, l mml.Layer, rules []mss.Rule) string {
+	if !l.PruneColumns {
+		return query
+	}
+	return sel(query, geometryField, sql.Fields(rules, l.GroupBy, l.LabelItem))
+}
+
+// translateTokens replaces Mapnik tokens in query and records tokens
+// that are not supported by MapServer.
+func (m *Map) translateTokens(query string) string {
+	query, unsupported := sql.TranslateTokens(query, sql.MapServer)
+	for _, tok := range unsupported {
+		m.unsupported["sql token "+tok] = true
+	}
+	return query
+}
+
+// addValidation adds the VALIDATION block for all runtime substitutions
+// of data.
+func addValidation(block *Block, data string) {
+	subs := sql.Substitutions(data)
+	if len(subs) == 0 {
+		return
+	}
+	validation := NewBlock("validation")
+	for _, s := range subs {
+		validation.Add("", quote(s.Name)+" "+quote(s.Pattern))
+		validation.Add("", quote("default_"+s.Name)+" "+quote(s.Default))
+	}
+	block.Add("", validation)
+}
+
+func (m *Map) sqliteSelectString(query, srid string) string {
 	query, isSubselect := cleanupQuery(query)
+	query = m.translateTokens(query)
 	if isSubselect {
 		return "select geometry, * from \n" + query + "\n"
 	}
@@ -988,19 +1349,175 @@ func pqConnectionString(pg mml.PostGIS) string {
 	return strings.Join(parts, " ")
 }
 
+// pgRasterConnectionString returns a GDAL PostGISRaster connection string.
+func pgRasterConnectionString(ds mml.PgRaster) string {
+	parts := []string{pqConnectionString(mml.PostGIS{
+		Host:     ds.Host,
+		Port:     ds.Port,
+		Database: ds.Database,
+		Username: ds.Username,
+		Password: ds.Password,
+	})}
+	table := strings.TrimSpace(ds.Query)
+	if idx := strings.Index(table, "."); idx > 0 {
+		parts = append(parts, "schema="+table[:idx])
+		table = table[idx+1:]
+	}
+	parts = append(parts, "table="+table)
+	if ds.RasterField != "" {
+		parts = append(parts, "column="+ds.RasterField)
+	}
+	parts = append(parts, "mode=2")
+	return "PG:" + strings.Join(parts, " ")
+}
+
+func addOGRDatasource(block *Block, connection, layer, query string) {
+	block.Add("connection", quote(connection))
+	if query != "" {
+		block.Add("data", quote(query))
+	} else if layer != "" {
+		block.Add("data", quote(layer))
+	}
+	block.Add("connectiontype", "ogr")
+}
+
+// addProjection adds the PROJECTION of the datasource srid, or of the
+// layer srs if srid is empty. The PROJECTION is omitted if both are
+// empty. MapServer expects the data in the projection of the map then.
+func addProjection(block *Block, srid, srs string) {
+	if srid != "" {
+		block.Add("", NewBlock("projection", Item{"", quote("init=epsg:" + srid)}))
+	} else if srs != "" {
+		block.Add("", NewBlock("projection", Item{"", fmtProjection(srs)}))
+	}
+}
+
+// wgs84Default returns srs, or EPSG:4326 if srs is empty. Mapnik expects
+// CSV and TopoJSON files without layer SRS in WGS84.
+func wgs84Default(srs string) string {
+	if srs == "" {
+		return "epsg:4326"
+	}
+	return srs
+}
+
+// csvXColumns and csvYColumns are the names of the x/y columns that are
+// detected by the Mapnik CSV plugin.
+var (
+	csvXColumns = []string{"x", "lon", "lng", "long", "longitude"}
+	csvYColumns = []string{"y", "lat", "latitude"}
+)
+
+// csvOpenOptions are the OGR open options for the geometry columns that
+// are detected by the Mapnik CSV plugin. CONNECTIONOPTIONS requires
+// MapServer 8.
+var csvOpenOptions = []Item{
+	{"", quote("X_POSSIBLE_NAMES") + " " + quote(strings.Join(csvXColumns, ","))},
+	{"", quote("Y_POSSIBLE_NAMES") + " " + quote(strings.Join(csvYColumns, ","))},
+	{"", `"GEOM_POSSIBLE_NAMES" "wkt,geojson"`},
+}
+
+func isOneOf(s string, list []string) bool {
+	for _, l := range list {
+		if s == l {
+			return true
+		}
+	}
+	return false
+}
+
+// addInlineFeatures adds each row of the inline CSV as FEATURE. Rows
+// require a wkt column or x/y (lon/lat) columns. All other columns are
+// added as ITEMS. Values with ; are not supported. Features are in the
+// projection of the map.
+func addInlineFeatures(block *Block, ds mml.CSV) error {
+	r := csv.NewReader(strings.NewReader(strings.TrimSpace(ds.Inline)))
+	if ds.Separator != "" {
+		r.Comma = rune(ds.Separator[0])
+	}
+	r.TrimLeadingSpace = true
+	rows, err := r.ReadAll()
+	if err != nil {
+		return fmt.Errorf("parsing inline csv: %v", err)
+	}
+	if len(rows) == 0 {
+		return errors.New("empty inline csv")
+	}
+
+	wkt, x, y := -1, -1, -1
+	var items []string
+	var itemCols []int
+	for i, col := range rows[0] {
+		col := strings.ToLower(col)
+		switch {
+		case col == "wkt":
+			wkt = i
+		case isOneOf(col, csvXColumns):
+			x = i
+		case isOneOf(col, csvYColumns):
+			y = i
+		default:
+			items = append(items, col)
+			itemCols = append(itemCols, i)
+		}
+	}
+	if wkt == -1 && (x == -1 || y == -1) {
+		return errors.New("inline csv without wkt or x/y columns")
+	}
+
+	var features []Block
+	for _, row := range rows[1:] {
+		if len(row) != len(rows[0]) {
+			return fmt.Errorf("inline csv row %v does not match headers", row)
+		}
+		f := NewBlock("feature")
+		if wkt != -1 {
+			f.Add("wkt", quote(escapeQuotes(row[wkt])))
+		} else {
+			f.Add("", NewBlock("points", Item{"", row[x] + " " + row[y]}))
+		}
+		if len(items) > 0 {
+			values := make([]string, len(itemCols))
+			for i, c := range itemCols {
+				// ITEMS are separated by ; without escaping
+				if strings.Contains(row[c], ";") {
+					return fmt.Errorf("inline csv value %q contains ';'", row[c])
+				}
+				values[i] = escapeQuotes(row[c])
+			}
+			f.Add("items", quote(strings.Join(values, ";")))
+		}
+		features = append(features, f)
+	}
+
+	if len(items) > 0 {
+		block.Add("processing", quote("ITEMS="+strings.Join(items, ",")))
+	}
+	for _, f := range features {
+		block.Add("", f)
+	}
+	return nil
+}
+
+func escapeQuotes(s string) string {
+	return strings.Replace(s, `"`, `\"`, -1)
+}
+
 // whether a string is a connection (PG:xxx) or filename
 var isOgrConnection = regexp.MustCompile(`^[a-zA-Z]{2,}:`)
 
-func (m *Map) addDatasource(block *Block, ds mml.Datasource, rules []mss.Rule) {
-	switch ds := ds.(type) {
+func (m *Map) addDatasource(block *Block, layer mml.Layer, rules []mss.Rule) {
+	switch ds := layer.Datasource.(type) {
 	case mml.PostGIS:
 		ds = m.locator.PostGIS(ds)
-		block.Add("data", quote(pqSelectString(ds.Query, ds.SRID, rules, m.autoTypeFilter)))
+		data := m.pqSelectString(selectFields(sql.SelectFields, ds.Query, ds.GeometryField, layer, rules), ds.SRID, rules)
+		block.Add("data", quote(data))
 		block.Add("connection", quote(pqConnectionString(ds)))
 		block.Add("connectiontype", "postgis")
 		block.Add("processing", quote("CLOSE_CONNECTION=DEFER"))
 		block.Add("extent", ds.Extent)
 		block.Add("", NewBlock("projection", Item{"", quote("init=epsg:" + ds.SRID)}))
+		addValidation(block, data)
 	// 	return []Parameter{
 	// 		{Name: "host", Value: ds.Host},
 	// 		{Name: "port", Value: ds.Port},
@@ -1021,23 +1538,57 @@ func (m *Map) addDatasource(block *Block, ds mml.Datasource, rules []mss.Rule) {
 	case mml.SQLite:
 		fname := m.locator.SQLite(ds.Filename)
 		block.Add("connection", quote(fname))
-		block.Add("data", quote(sqliteSelectString(ds.Query, ds.SRID)))
+		data := m.sqliteSelectString(selectFields(sql.SelectSQLiteFields, ds.Query, ds.GeometryField, layer, rules), ds.SRID)
+		block.Add("data", quote(data))
 		block.Add("connectiontype", "ogr")
 		block.Add("", NewBlock("projection", Item{"", quote("init=epsg:" + ds.SRID)}))
+		addValidation(block, data)
 	case mml.OGR:
-		if isOgrConnection.MatchString(ds.Filename) {
-			block.Add("connection", quote(ds.Filename))
+		fname := ds.Filename
+		if !isOgrConnection.MatchString(ds.Filename) {
+			fname = m.locator.Shape(ds.Filename)
+		}
+		addOGRDatasource(block, fname, ds.Layer, ds.Query)
+		addProjection(block, ds.SRID, layer.SRS)
+	case mml.GeoPackage:
+		addOGRDatasource(block, m.locator.Data(ds.Filename), ds.Layer, ds.Query)
+		addProjection(block, ds.SRID, layer.SRS)
+	case mml.FlatGeobuf:
+		addOGRDatasource(block, m.locator.Data(ds.Filename), "", "")
+		addProjection(block, ds.SRID, layer.SRS)
+	case mml.TopoJSON:
+		addOGRDatasource(block, m.locator.Data(ds.Filename), "", "")
+		addProjection(block, "", wgs84Default(layer.SRS))
+	case mml.CSV:
+		if ds.Filename == "" {
+			if err := addInlineFeatures(block, ds); err != nil {
+				fmt.Fprintf(os.Stderr, "layer %s: %v\n", layer.ID, err)
+				m.unsupported["csv inline"] = true
+			}
+			return
+		}
+		addOGRDatasource(block, m.locator.Data(ds.Filename), "", "")
+		if m.version >= 8 {
+			block.Add("", NewBlock("connectionoptions", csvOpenOptions...))
 		} else {
-			fname := m.locator.Shape(ds.Filename)
-			block.Add("connection", quote(fname))
+			// OGR only detects WKT columns without open options
+			m.unsupported["csv x/y columns (requires MapServer 8)"] = true
 		}
-		if ds.Query != "" {
-			block.Add("data", quote(ds.Query))
-		} else if ds.Layer != "" {
-			block.Add("data", quote(ds.Layer))
+		addProjection(block, "", wgs84Default(layer.SRS))
+	case mml.PgRaster:
+		if l, ok := m.locator.(config.PgRasterLocator); ok {
+			ds = l.PgRaster(ds)
 		}
-		block.Add("connectiontype", "ogr")
+		if strings.HasPrefix(strings.TrimSpace(ds.Query), "(") {
+			// GDAL PostGISRaster driver only supports tables
+			m.unsupported["pgraster subquery"] = true
+			return
+		}
+		block.Add("data", quote(pgRasterConnectionString(ds)))
 		block.Add("", NewBlock("projection", Item{"", quote("init=epsg:" + ds.SRID)}))
+		if ds.Band != "" {
+			block.Add("processing", quote("BANDS="+ds.Band))
+		}
 	case mml.GDAL:
 		fname := m.locator.Data(ds.Filename)
 		block.Add("data", quote(fname))
@@ -1108,6 +1659,22 @@ func (b *Block) AddDefault(name string, value *string, def string) {
 	}
 }
 
+// Set replaces the first item with name (or the first block with that name),
+// or adds a new item.
+func (b *Block) Set(name string, value interface{}) {
+	for i, item := range b.items {
+		if strings.EqualFold(item.Name, name) {
+			b.items[i].Value = value
+			return
+		}
+		if block, ok := item.Value.(Block); ok && item.Name == "" && strings.EqualFold(block.Name, name) {
+			b.items[i].Value = value
+			return
+		}
+	}
+	b.Add(name, value)
+}
+
 func (b *Block) Len() int {
 	return len(b.items)
 }
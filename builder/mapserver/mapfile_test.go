@@ -1,6 +1,7 @@
 package mapserver
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/omniscale/magnacarto/color"
@@ -245,3 +246,420 @@ func TestMarkerTransformWithRotationPoint(t *testing.T) {
 	assert.Contains(t, result, `ANGLE -345`)
 	assert.Contains(t, result, `SIZE 20`)
 }
+
+func TestMarkerTransformTranslate(t *testing.T) {
+	m := New(&locator)
+	m.SetNoMapBlock(true)
+	m.AddLayer(mml.Layer{ID: "test", SRS: "4326", Type: mml.Point},
+		[]mss.Rule{
+			{Layer: "test", Properties: mss.NewProperties(
+				"marker-file", "/foo/bar.svg",
+				"marker-transform", "translate(5, -10) rotate(90)",
+				"marker-height", 10.0,
+			)},
+		})
+	result := m.String()
+
+	assert.Contains(t, result, `SYMBOL "foo-bar-svg"`)
+	assert.Contains(t, result, `OFFSET 5 -10`)
+	assert.Contains(t, result, `ANGLE -90`)
+	assert.Empty(t, m.UnsupportedFeatures())
+}
+
+func TestGeometryTransform(t *testing.T) {
+	m := New(&locator)
+	m.SetNoMapBlock(true)
+	m.AddLayer(mml.Layer{ID: "test", SRS: "4326", Type: mml.LineString},
+		[]mss.Rule{
+			{Layer: "test", Properties: mss.NewProperties(
+				"line-width", 1.0,
+				"line-geometry-transform", "translate(2 3)",
+			)},
+		})
+	assert.Contains(t, m.String(), `OFFSET 2 3`)
+	assert.Empty(t, m.UnsupportedFeatures())
+
+	m = New(&locator)
+	m.AddLayer(mml.Layer{ID: "test", SRS: "4326", Type: mml.Polygon},
+		[]mss.Rule{
+			{Layer: "test", Properties: mss.NewProperties(
+				"polygon-fill", color.MustParse("red"),
+				"polygon-geometry-transform", "scale(2)",
+			)},
+		})
+	assert.Equal(t, []string{`polygon-geometry-transform "scale(2)": scale not supported`}, m.UnsupportedFeatures())
+
+	// transforms without scale or rotation are translations
+	m = New(&locator)
+	m.SetNoMapBlock(true)
+	m.AddLayer(mml.Layer{ID: "test", SRS: "4326", Type: mml.Polygon},
+		[]mss.Rule{
+			{Layer: "test", Properties: mss.NewProperties(
+				"polygon-fill", color.MustParse("red"),
+				"polygon-geometry-transform", "rotate(90) translate(2 3) rotate(-90) scale(1)",
+			)},
+		})
+	assert.Contains(t, m.String(), `OFFSET -3 2`)
+	assert.Empty(t, m.UnsupportedFeatures())
+}
+
+func TestPointTransform(t *testing.T) {
+	m := New(&locator)
+	m.SetNoMapBlock(true)
+	m.AddLayer(mml.Layer{ID: "test", SRS: "4326", Type: mml.Point},
+		[]mss.Rule{
+			{Layer: "test", Properties: mss.NewProperties(
+				"point-file", "/foo/bar.png",
+				"point-transform", "rotate(90, 2, 0)",
+			)},
+		})
+	assert.Regexp(t, `ANGLE -90\s+OFFSET 2 -2`, m.String())
+	assert.Empty(t, m.UnsupportedFeatures())
+
+	m = New(&locator)
+	m.AddLayer(mml.Layer{ID: "test", SRS: "4326", Type: mml.Point},
+		[]mss.Rule{
+			{Layer: "test", Properties: mss.NewProperties(
+				"point-file", "/foo/bar.png",
+				"point-transform", "translate(1 1) scale(2)",
+			)},
+		})
+	assert.Equal(t, []string{`point-transform "translate(1 1) scale(2)": scale not supported`}, m.UnsupportedFeatures())
+}
+
+func TestInvalidTransform(t *testing.T) {
+	m := New(&locator)
+	m.AddLayer(mml.Layer{ID: "test", SRS: "4326", Type: mml.Point},
+		[]mss.Rule{
+			{Layer: "test", Properties: mss.NewProperties(
+				"marker-file", "/foo/bar.svg",
+				"marker-transform", "rotate(45",
+			)},
+		})
+	assert.Equal(t, []string{`marker-transform: invalid transform "rotate(45": missing ) for rotate`}, m.UnsupportedFeatures())
+}
+
+func TestMarkerPlacement(t *testing.T) {
+	for _, tt := range []struct {
+		placement string
+		geomType  mml.GeometryType
+		expected  []string
+	}{
+		{"point", mml.LineString, []string{`GEOMTRANSFORM "centroid"`}},
+		{"interior", mml.Polygon, []string{`GEOMTRANSFORM "labelpoly"`}},
+		{"interior", mml.LineString, []string{`GEOMTRANSFORM "centroid"`}},
+		{"vertex-first", mml.LineString, []string{`GEOMTRANSFORM "start"`}},
+		{"vertex-last", mml.LineString, []string{`GEOMTRANSFORM "end"`}},
+		{"line", mml.LineString, []string{`GAP -50`, `INITIALGAP 25`}},
+		{"line", mml.Polygon, []string{`GAP -50`, `INITIALGAP 25`}},
+	} {
+		m := New(&locator)
+		m.SetNoMapBlock(true)
+		m.AddLayer(mml.Layer{ID: "test", SRS: "4326", Type: tt.geomType},
+			[]mss.Rule{
+				{Layer: "test", Properties: mss.NewProperties(
+					"marker-file", "/foo/bar.svg",
+					"marker-placement", tt.placement,
+					"marker-spacing", 50.0,
+				)},
+			})
+		result := m.String()
+		for _, e := range tt.expected {
+			assert.Contains(t, result, e, tt.placement)
+		}
+	}
+}
+
+func TestTextPlacement(t *testing.T) {
+	for _, tt := range []struct {
+		placement string
+		follow    bool
+	}{
+		{"", true},
+		{"line", true},
+		{"point", false},
+		{"interior", false},
+	} {
+		m := New(&locator)
+		m.SetNoMapBlock(true)
+		kv := []interface{}{
+			"text-size", 10.0,
+			"text-name", []interface{}{mss.Field("[name]")},
+		}
+		if tt.placement != "" {
+			kv = append(kv, "text-placement", tt.placement)
+		}
+		props := mss.NewProperties(kv...)
+		m.AddLayer(mml.Layer{ID: "test", SRS: "4326", Type: mml.LineString},
+			[]mss.Rule{{Layer: "test", Properties: props}})
+		result := m.String()
+		if tt.follow {
+			assert.Contains(t, result, `ANGLE FOLLOW`, tt.placement)
+		} else {
+			assert.NotContains(t, result, `ANGLE FOLLOW`, tt.placement)
+		}
+	}
+
+	// vertex labels are placed in a separate POINT layer
+	m := New(&locator)
+	m.SetNoMapBlock(true)
+	m.AddLayer(mml.Layer{ID: "test", SRS: "4326", Type: mml.LineString, Active: true},
+		[]mss.Rule{{Layer: "test", Zoom: mss.AllZoom, Properties: mss.NewProperties(
+			"line-width", 1.0,
+			"text-size", 10.0,
+			"text-name", "[name]",
+			"text-placement", "vertex",
+		)}})
+	result := m.String()
+	assert.Regexp(t, `(?s)NAME test\s+STATUS ON\s+TYPE LINE.*WIDTH 1.*NAME test-vertices\s+GROUP test\s+STATUS ON\s+TYPE POINT.*TEXT '\[name\]'.*POSITION cc`, result)
+	assert.Equal(t, 1, strings.Count(result, "LABEL"))
+	assert.Empty(t, m.UnsupportedFeatures())
+}
+
+func TestMapOptions(t *testing.T) {
+	m := New(&locator)
+	m.SetSRS("epsg:25832")
+	m.SetMaximumExtent([4]float64{-100, -25, 100, 25})
+	result := m.String()
+	assert.Contains(t, result, `EXTENT -100 -25 100 25`)
+	assert.Contains(t, result, `SIZE 1600 400`)
+	assert.Regexp(t, `PROJECTION\s+"init=epsg:25832"`, result)
+	assert.NotContains(t, result, `init=epsg:3857`)
+	assert.Empty(t, m.UnsupportedFeatures())
+
+	m = New(&locator)
+	m.SetSRS("+proj=longlat +datum=WGS84")
+	m.SetBackgroundImage("bg.png")
+	assert.Regexp(t, `PROJECTION\s+"\+proj=longlat \+datum=WGS84"`, m.String())
+	assert.Equal(t, []string{"background-image"}, m.UnsupportedFeatures())
+
+	m = New(&locator)
+	m.SetMaximumExtent([4]float64{0, 0, 25, 100})
+	assert.Contains(t, m.String(), `SIZE 400 1600`)
+}
+
+func TestLayerProperties(t *testing.T) {
+	m := New(&locator)
+	m.SetNoMapBlock(true)
+
+	opacity := 0.5
+	tolerance := 5.0
+	m.AddLayer(mml.Layer{
+		ID: "test", SRS: "4326", Type: mml.LineString,
+		MaxScaleDenom: 500000, MinScaleDenom: 1000,
+		MaximumExtent:  &[4]float64{-180, -90, 180, 90},
+		Opacity:        &opacity,
+		LabelItem:      "name",
+		Tolerance:      &tolerance,
+		ToleranceUnits: "meters",
+		Processing:     []string{"LABEL_NO_CLIP=ON"},
+	},
+		[]mss.Rule{
+			{Layer: "test", Properties: mss.NewProperties("line-width", 1.0)},
+		})
+
+	result := m.String()
+	assert.Regexp(t, `MAXSCALEDENOM 500000\s+MINSCALEDENOM 1000\s`, result)
+	assert.Regexp(t, `EXTENT -180 -90 180 90\s`, result)
+	assert.Regexp(t, `LABELITEM "name"\s+TOLERANCE 5\s+TOLERANCEUNITS meters\s+PROCESSING "LABEL_NO_CLIP=ON"\s`, result)
+	assert.Regexp(t, `OPACITY 50\s`, result)
+}
+
+func TestDatasources(t *testing.T) {
+	for _, tt := range []struct {
+		layer       mml.Layer
+		expected    []string
+		notExpected []string
+	}{
+		{
+			mml.Layer{Datasource: mml.GeoPackage{Filename: "/data.gpkg", Layer: "roads", SRID: "3857"}},
+			[]string{`CONNECTION "/data.gpkg"`, `DATA "roads"`, `CONNECTIONTYPE ogr`, `"init=epsg:3857"`},
+			nil,
+		},
+		{
+			mml.Layer{Datasource: mml.GeoPackage{Filename: "/data.gpkg", Layer: "roads"}},
+			[]string{`CONNECTION "/data.gpkg"`},
+			[]string{`PROJECTION`},
+		},
+		{
+			mml.Layer{Datasource: mml.FlatGeobuf{Filename: "/roads.fgb", SRID: "4326"}},
+			[]string{`CONNECTION "/roads.fgb"`, `CONNECTIONTYPE ogr`, `"init=epsg:4326"`},
+			nil,
+		},
+		{
+			mml.Layer{Datasource: mml.FlatGeobuf{Filename: "/roads.fgb"}, SRS: "+init=epsg:25832"},
+			[]string{`CONNECTION "/roads.fgb"`, `"init=epsg:25832"`},
+			nil,
+		},
+		{
+			mml.Layer{Datasource: mml.CSV{Filename: "/points.csv"}},
+			[]string{
+				`CONNECTION "/points.csv"`, `CONNECTIONTYPE ogr`, `"init=epsg:4326"`,
+				`"X_POSSIBLE_NAMES" "x,lon,lng,long,longitude"`,
+				`"Y_POSSIBLE_NAMES" "y,lat,latitude"`,
+				`"GEOM_POSSIBLE_NAMES" "wkt,geojson"`,
+			},
+			nil,
+		},
+		{
+			mml.Layer{Datasource: mml.CSV{Filename: "/points.csv"}, SRS: "+proj=merc +a=6378137 +b=6378137"},
+			[]string{`PROJECTION
+    "+proj=merc +a=6378137 +b=6378137"
+  END`},
+			[]string{`epsg:4326`},
+		},
+		{
+			mml.Layer{Datasource: mml.TopoJSON{Filename: "/countries.topojson"}, SRS: "epsg:3857"},
+			[]string{`CONNECTION "/countries.topojson"`, `"init=epsg:3857"`},
+			[]string{`epsg:4326`},
+		},
+		{
+			mml.Layer{Datasource: mml.PgRaster{Database: "gis", Query: "public.dem", RasterField: "rast", SRID: "3857", Band: "1"}},
+			[]string{`DATA "PG:dbname=gis schema=public table=dem column=rast mode=2"`, `"init=epsg:3857"`, `PROCESSING "BANDS=1"`},
+			nil,
+		},
+	} {
+		m := New(&locator)
+		b := NewBlock("LAYER")
+		m.addDatasource(&b, tt.layer, nil)
+		result := b.String()
+		for _, e := range tt.expected {
+			assert.Contains(t, result, e)
+		}
+		for _, e := range tt.notExpected {
+			assert.NotContains(t, result, e)
+		}
+	}
+
+	m := New(&locator)
+	b := NewBlock("LAYER")
+	m.addDatasource(&b, mml.Layer{Datasource: mml.PgRaster{Query: "(select * from dem) as dem"}}, nil)
+	assert.Equal(t, []string{"pgraster subquery"}, m.UnsupportedFeatures())
+
+	m = New(&locator)
+	m.SetVersion(7)
+	b = NewBlock("LAYER")
+	m.addDatasource(&b, mml.Layer{Datasource: mml.CSV{Filename: "/points.csv"}}, nil)
+	assert.NotContains(t, b.String(), "CONNECTIONOPTIONS")
+	assert.Equal(t, []string{"csv x/y columns (requires MapServer 8)"}, m.UnsupportedFeatures())
+}
+
+func TestInlineFeatures(t *testing.T) {
+	m := New(&locator)
+	b := NewBlock("LAYER")
+	m.addDatasource(&b, mml.Layer{Datasource: mml.CSV{Inline: `wkt,name,type
+"LINESTRING(0 0, 10 10)","Main ""St""",primary
+"POINT(5 5)",Abc,minor`}}, nil)
+	result := b.String()
+	assert.Contains(t, result, `PROCESSING "ITEMS=name,type"`)
+	assert.Regexp(t, `FEATURE\s+WKT "LINESTRING\(0 0, 10 10\)"\s+ITEMS "Main \\"St\\";primary"\s+END`, result)
+	assert.Regexp(t, `FEATURE\s+WKT "POINT\(5 5\)"\s+ITEMS "Abc;minor"\s+END`, result)
+	assert.Empty(t, m.UnsupportedFeatures())
+
+	b = NewBlock("LAYER")
+	m.addDatasource(&b, mml.Layer{Datasource: mml.CSV{Separator: ";", Inline: "x;y\n1;2\n"}}, nil)
+	assert.Regexp(t, `FEATURE\s+POINTS\s+1 2\s+END\s+END`, b.String())
+
+	b = NewBlock("LAYER")
+	m.addDatasource(&b, mml.Layer{Datasource: mml.CSV{Inline: "lng,latitude,name\n1,2,foo\n"}}, nil)
+	assert.Regexp(t, `FEATURE\s+POINTS\s+1 2\s+END\s+ITEMS "foo"\s+END`, b.String())
+	assert.Empty(t, m.UnsupportedFeatures())
+
+	b = NewBlock("LAYER")
+	m.addDatasource(&b, mml.Layer{Datasource: mml.CSV{Inline: "x,y,name\n1,2,foo\n3,4,a;b\n"}}, nil)
+	assert.NotContains(t, b.String(), "FEATURE")
+	assert.NotContains(t, b.String(), "ITEMS")
+	assert.Equal(t, []string{"csv inline"}, m.UnsupportedFeatures())
+
+	m = New(&locator)
+
+	b = NewBlock("LAYER")
+	m.addDatasource(&b, mml.Layer{Datasource: mml.CSV{Inline: "name\nfoo\n"}}, nil)
+	assert.Equal(t, []string{"csv inline"}, m.UnsupportedFeatures())
+}
+
+func TestPruneColumns(t *testing.T) {
+	rules := []mss.Rule{
+		{Layer: "roads", Filters: []mss.Filter{{Field: "type", CompOp: mss.EQ, Value: "primary"}}, Properties: mss.NewProperties("text-name", "[name]")},
+	}
+	layer := mml.Layer{
+		ID:           "roads",
+		Datasource:   mml.PostGIS{Query: "osm_roads", SRID: "3857"},
+		PruneColumns: true,
+	}
+
+	m := New(&locator)
+	b := NewBlock("LAYER")
+	m.addDatasource(&b, layer, rules)
+	assert.Contains(t, b.String(), `(SELECT \"geometry\", \"name\", \"type\" FROM osm_roads) as pruned`)
+	assert.Contains(t, b.String(), `as nullidq using unique nullid using srid=3857"`)
+
+	layer.PruneColumns = false
+	m = New(&locator)
+	b = NewBlock("LAYER")
+	m.addDatasource(&b, layer, rules)
+	assert.Contains(t, b.String(), `DATA "geometry from osm_roads"`)
+}
+
+func TestQueryTokens(t *testing.T) {
+	m := New(&locator)
+	b := NewBlock("LAYER")
+	m.addDatasource(&b, mml.Layer{Datasource: mml.PostGIS{
+		Query: "(SELECT * FROM osm_roads WHERE geometry && !bbox! AND !scale_denominator! < 50000 AND name != '!scale_denominator!') as roads",
+		SRID:  "3857",
+	}}, nil)
+	result := b.String()
+	assert.Contains(t, result, `WHERE geometry && !BOX! AND %scale% < 50000 AND name != '!scale_denominator!') as roads`)
+	assert.Regexp(t, `VALIDATION\s+"scale" "\^\[0-9.\]\+\$"\s+"default_scale" "0"\s+END`, result)
+	assert.Empty(t, m.UnsupportedFeatures())
+
+	m = New(&locator)
+	b = NewBlock("LAYER")
+	m.addDatasource(&b, mml.Layer{Datasource: mml.SQLite{
+		Filename: "/roads.sqlite",
+		Query:    "(SELECT * FROM roads WHERE way_area > !pixel_width! * !pixel_height!) as roads",
+		SRID:     "3857",
+	}}, nil)
+	result = b.String()
+	assert.Contains(t, result, `WHERE way_area > %pixel_width% * %pixel_height%) as roads`)
+	assert.Regexp(t, `VALIDATION\s+"pixel_width" "\^\[0-9.\]\+\$"\s+"default_pixel_width" "0"\s+"pixel_height" "\^\[0-9.\]\+\$"\s+"default_pixel_height" "0"\s+END`, result)
+	assert.Empty(t, m.UnsupportedFeatures())
+}
+
+func TestAutoTypeFilterZoom(t *testing.T) {
+	m := New(&locator)
+	m.SetAutoTypeFilter(true)
+	b := NewBlock("LAYER")
+	m.addDatasource(&b, mml.Layer{Datasource: mml.PostGIS{Query: "osm_roads", SRID: "3857"}}, []mss.Rule{
+		{Layer: "roads", Zoom: mss.NewZoomRange(mss.GTE, 10), Filters: []mss.Filter{{Field: "type", CompOp: mss.EQ, Value: "primary"}}},
+		{Layer: "roads", Filters: []mss.Filter{{Field: "level", CompOp: mss.GTE, Value: 4.0}, {Field: "name", CompOp: mss.REGEX, Value: "^A"}}},
+	})
+	result := b.String()
+	assert.Contains(t, result, `WHERE ((\"type\" = 'primary' AND %scale% < 750000) OR (\"level\"::numeric >= 4 AND \"name\"::text ~ '^(?:^A)$'))) as filtered`)
+	assert.Regexp(t, `VALIDATION\s+"scale" "\^\[0-9.\]\+\$"\s+"default_scale" "0"\s+END`, result)
+	assert.NotContains(t, result, "!scale_denominator!")
+}
+
+func TestSplitGeometryTypes(t *testing.T) {
+	rules := []mss.Rule{
+		{Layer: "pois", Properties: mss.NewProperties("marker-width", 5.0)},
+		{Layer: "pois", Properties: mss.NewProperties("point-file", "poi.png")},
+		{Layer: "pois", Properties: mss.NewProperties("polygon-fill", color.MustParse("red"))},
+	}
+	layer := mml.Layer{
+		ID:            "pois",
+		Type:          mml.Point,
+		GeometryTypes: []mml.GeometryType{mml.Point, mml.Polygon},
+		Datasource:    mml.PostGIS{Query: "osm_pois", SRID: "3857"},
+		Active:        true,
+	}
+
+	m := New(&locator)
+	m.AddLayer(layer, rules)
+	result := m.String()
+	assert.Regexp(t, `NAME pois_point\s+GROUP pois\s+STATUS ON\s+TYPE POINT`, result)
+	assert.Regexp(t, `NAME pois_polygon\s+GROUP pois\s+STATUS ON\s+TYPE POLYGON`, result)
+	assert.Contains(t, result, `FROM osm_pois WHERE ST_Dimension(\"geometry\") = 0) as filtered`)
+	assert.Contains(t, result, `FROM osm_pois WHERE ST_Dimension(\"geometry\") = 2) as filtered`)
+	assert.Equal(t, 2, strings.Count(result, "LAYER\n"))
+}
@@ -2,40 +2,103 @@ package mapserver
 
 import (
 	"fmt"
-	"log"
-	"regexp"
-	"strconv"
+	"math"
+
+	"github.com/omniscale/magnacarto/builder/transform"
 )
 
-type transformation struct {
-	scale           float64
-	rotate          float64
-	hasRotateAnchor bool
-	rotateAnchor    [2]float64
+// symbolTransformation describes a SVG transform of a marker/point symbol
+// in terms of MapServer STYLE parameters.
+type symbolTransformation struct {
+	scale  float64
+	rotate float64 // counter-clockwise, as MapServer ANGLE
+	// hasAnchor is set for transforms that rotate around a point other than the
+	// symbol center. anchor is relative to the symbol center. offset is the
+	// equivalent translation when the symbol is placed at its center.
+	hasAnchor bool
+	anchor    [2]float64
+	offset    [2]float64
 }
 
-var svgTransformRe = regexp.MustCompile(`(\w+)\s*\(((-?\d*\.?\d+),? ?(-?\d*\.?\d+)?,? ?(-?\d*\.?\d+)?)\)`)
-
-func parseTransform(transform string) (transformation, error) {
-	tr := transformation{}
-	for _, match := range svgTransformRe.FindAllStringSubmatch(transform, -1) {
-		switch match[1] {
+// symbolTransform converts a parsed SVG transform into a
+// symbolTransformation. Only translate, rotate and uniform scale can be
+// expressed in MapServer.
+func symbolTransform(tr transform.Transform) (symbolTransformation, error) {
+	st := symbolTransformation{scale: 1.0}
+	angle := 0.0
+	hasCenter := false
+	if tr.HasFields() {
+		return st, fmt.Errorf("feature attributes not supported")
+	}
+	for _, f := range tr {
+		switch f.Name {
+		case "translate":
 		case "rotate":
-			if len(match) == 6 {
-				tr.rotate, _ = strconv.ParseFloat(match[3], 64)
-				tr.rotateAnchor[0], _ = strconv.ParseFloat(match[4], 64)
-				tr.rotateAnchor[1], _ = strconv.ParseFloat(match[5], 64)
-				tr.hasRotateAnchor = true
-			} else {
-				tr.rotate, _ = strconv.ParseFloat(match[2], 64)
+			angle += f.Args[0].Value
+			if len(f.Args) == 3 {
+				hasCenter = true
 			}
-			tr.rotate *= -1
 		case "scale":
-			tr.scale, _ = strconv.ParseFloat(match[2], 64)
+			if len(f.Args) == 2 && f.Args[0].Value != f.Args[1].Value {
+				return st, fmt.Errorf("non-uniform scale not supported")
+			}
+			st.scale *= f.Args[0].Value
 		default:
-			// TODO proper error handling
-			log.Println(fmt.Errorf("unsupported transform function %q in %q", match[1], transform))
+			return st, fmt.Errorf("%s not supported", f.Name)
+		}
+	}
+	if st.scale == 0 {
+		return st, fmt.Errorf("scale of 0 not supported")
+	}
+	m, err := tr.Matrix()
+	if err != nil {
+		return st, err
+	}
+	// SVG rotates clockwise (y axis points down), MapServer counter-clockwise
+	st.rotate = -angle
+
+	tx, ty := m.Translation()
+	st.offset = [2]float64{round(tx), round(ty)}
+	if !hasCenter {
+		return st, nil
+	}
+
+	// Find the anchor point that stays in place, so that the symbol
+	// can be rotated and scaled around the anchor instead of the center.
+	// The transform maps point p to s·R·p + t, with the anchor a we want
+	// s·R·(p - a), thus a = -(s·R)⁻¹·t.
+	sin, cos := math.Sincos(angle * math.Pi / 180)
+	st.hasAnchor = true
+	st.anchor[0] = round(-(cos*tx + sin*ty) / st.scale)
+	st.anchor[1] = round(-(-sin*tx + cos*ty) / st.scale)
+	return st, nil
+}
+
+// geometryOffset returns the pixel offset of a *-geometry-transform.
+// MapServer GEOMTRANSFORM has no affine transformations, so only
+// transforms that result in a translation (e.g. translate, but also
+// rotate(0) or scale(1)) can be expressed with STYLE OFFSET.
+func geometryOffset(tr transform.Transform) (dx, dy float64, err error) {
+	m, err := tr.Matrix()
+	if err != nil {
+		return 0, 0, err
+	}
+	if round(m[0]) != 1 || round(m[1]) != 0 || round(m[2]) != 0 || round(m[3]) != 1 {
+		for _, f := range tr {
+			if f.Name != "translate" {
+				return 0, 0, fmt.Errorf("%s not supported", f.Name)
+			}
 		}
 	}
-	return tr, nil
+	dx, dy = m.Translation()
+	return round(dx), round(dy), nil
+}
+
+// round removes floating point noise from transform calculations.
+func round(v float64) float64 {
+	v = math.Round(v*1e6) / 1e6
+	if v == 0 {
+		return 0 // no negative zero
+	}
+	return v
 }
@@ -0,0 +1,702 @@
+// Package native builds JSON styles for the pure-Go renderer in
+// render/native.
+package native
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/omniscale/magnacarto/builder"
+	"github.com/omniscale/magnacarto/color"
+	"github.com/omniscale/magnacarto/config"
+	"github.com/omniscale/magnacarto/mml"
+	"github.com/omniscale/magnacarto/mss"
+	style "github.com/omniscale/magnacarto/render/native"
+)
+
+type Map struct {
+	style       style.Map
+	locator     config.Locator
+	scaleFactor float64
+	zoomScales  []int
+	unsupported map[string]bool
+}
+
+type maker struct{}
+
+func (m maker) Type() string       { return "native" }
+func (m maker) FileSuffix() string { return ".json" }
+func (m maker) New(locator config.Locator) builder.MapWriter {
+	return New(locator)
+}
+
+var Maker = maker{}
+
+func New(locator config.Locator) *Map {
+	return &Map{
+		style:       style.Map{Layers: []style.Layer{}},
+		locator:     locator,
+		scaleFactor: 1.0,
+		zoomScales:  webmercZoomScales,
+		unsupported: make(map[string]bool),
+	}
+}
+
+func (m *Map) SetBackgroundColor(c color.Color) {
+	m.style.BackgroundColor = newColor(c)
+}
+
+func (m *Map) SetBackgroundImage(file string) {
+	m.unsupported["background-image"] = true
+}
+
+func (m *Map) SetBackgroundImageCompOp(compOp string) {
+	m.unsupported["background-image-comp-op"] = true
+}
+
+// SetBackgroundImageOpacity is a no-op, background-image is not supported.
+func (m *Map) SetBackgroundImageOpacity(opacity float64) {}
+
+// SetSRS is a no-op, maps are rendered in the SRS of the request.
+func (m *Map) SetSRS(srs string) {}
+
+// SetBufferSize is a no-op, the renderer uses a fixed buffer.
+func (m *Map) SetBufferSize(size int) {}
+
+// SetMaximumExtent is a no-op.
+func (m *Map) SetMaximumExtent(extent [4]float64) {}
+
+// SetFontDirectory is a no-op, fonts are resolved by the locator.
+func (m *Map) SetFontDirectory(dir string) {}
+
+// SetBase is a no-op, files are resolved by the locator.
+func (m *Map) SetBase(base string) {}
+
+// SetParameters is a no-op.
+func (m *Map) SetParameters(params map[string]string) {}
+
+func (m *Map) SetZoomScales(zoomScales []int) {
+	m.zoomScales = zoomScales
+}
+
+func (m *Map) AddLayer(l mml.Layer, rules []mss.Rule) {
+	if !l.Active {
+		// not rendered, as with status=off in Mapnik
+		return
+	}
+	if l.ScaleFactor != 0.0 {
+		prevScaleFactor := m.scaleFactor
+		defer func() { m.scaleFactor = prevScaleFactor }()
+		m.scaleFactor = l.ScaleFactor
+	}
+	styles := m.newStyles(rules)
+	if l.Opacity != nil {
+		for i := range styles {
+			if styles[i].Opacity == nil {
+				opacity := *l.Opacity
+				styles[i].Opacity = &opacity
+			}
+		}
+	}
+
+	layer := style.Layer{Name: l.ID, Styles: styles}
+	if code, ok := epsgCode(l.SRS); ok {
+		layer.EPSGCode = code
+		if !style.SupportedEPSG(code) {
+			m.unsupported[fmt.Sprintf("srs EPSG:%d", code)] = true
+		}
+	} else {
+		m.unsupported[fmt.Sprintf("srs '%s'", l.SRS)] = true
+	}
+
+	z := mss.RulesZoom(rules)
+	if z != mss.AllZoom {
+		if l := z.First(); l > 0 {
+			if l > len(m.zoomScales) {
+				l = len(m.zoomScales)
+			}
+			layer.MaxScaleDenom = float64(m.zoomScales[l-1])
+		}
+		if l := z.Last(); l < len(m.zoomScales) {
+			layer.MinScaleDenom = float64(m.zoomScales[l])
+		}
+	}
+	if l.MaxScaleDenom != 0 {
+		layer.MaxScaleDenom = float64(l.MaxScaleDenom)
+	}
+	if l.MinScaleDenom != 0 {
+		layer.MinScaleDenom = float64(l.MinScaleDenom)
+	}
+	layer.Datasource = m.newDatasource(l.Datasource)
+	m.style.Layers = append(m.style.Layers, layer)
+}
+
+func (m *Map) UnsupportedFeatures() []string {
+	var features []string
+	for k := range m.unsupported {
+		features = append(features, k)
+	}
+	sort.Strings(features)
+	return features
+}
+
+func (m *Map) Write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(m.style)
+}
+
+func (m *Map) WriteFiles(basename string) error {
+	f, err := os.Create(basename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return m.Write(f)
+}
+
+// epsgCode returns the EPSG code of an SRS (e.g. epsg:3857,
+// +init=epsg:4326 or Proj4 strings for EPSG:4326 and EPSG:3857). Layers
+// without SRS are in EPSG:4326, as in Mapnik.
+func epsgCode(srs string) (int, bool) {
+	s := strings.TrimPrefix(strings.ToLower(strings.TrimSpace(srs)), "+init=")
+	if s == "" {
+		return 4326, true
+	}
+	if code, err := strconv.Atoi(strings.TrimPrefix(s, "epsg:")); err == nil {
+		return code, true
+	}
+	switch {
+	case strings.Contains(s, "+proj=longlat"):
+		return 4326, true
+	case strings.Contains(s, "+proj=merc") && strings.Contains(s, "+a=6378137") && strings.Contains(s, "+b=6378137"):
+		return 3857, true
+	}
+	return 0, false
+}
+
+// whether a string is a connection (PG:xxx) or filename
+var isOgrConnection = regexp.MustCompile(`^[a-zA-Z]{2,}:`)
+
+// isTableName matches plain table names of SQLite queries.
+var isTableName = regexp.MustCompile(`^\s*"?([a-zA-Z_][a-zA-Z0-9_]*)"?\s*$`)
+
+// newDatasource returns the datasource of the layer. Unsupported
+// datasources are reported and returned without type.
+func (m *Map) newDatasource(ds mml.Datasource) style.Datasource {
+	switch ds := ds.(type) {
+	case mml.Shapefile:
+		return style.Datasource{Type: "shape", File: m.locator.Shape(ds.Filename)}
+	case mml.GeoJson:
+		return style.Datasource{Type: "geojson", File: m.locator.Shape(ds.Filename)}
+	case mml.SQLite:
+		match := isTableName.FindStringSubmatch(ds.Query)
+		if match == nil {
+			m.unsupported["sqlite query"] = true
+			return style.Datasource{}
+		}
+		return style.Datasource{
+			Type:          "sqlite",
+			File:          m.locator.SQLite(ds.Filename),
+			Table:         match[1],
+			GeometryField: ds.GeometryField,
+		}
+	case mml.OGR:
+		if isOgrConnection.MatchString(ds.Filename) {
+			m.unsupported["ogr connection"] = true
+			return style.Datasource{}
+		}
+		if ds.Query != "" {
+			m.unsupported["ogr layer_by_sql"] = true
+			return style.Datasource{}
+		}
+		return m.fileDatasource("ogr", m.locator.Data(ds.Filename), ds.Layer)
+	case mml.GeoPackage:
+		if ds.Query != "" {
+			m.unsupported["gpkg query"] = true
+			return style.Datasource{}
+		}
+		return style.Datasource{Type: "gpkg", File: m.locator.Data(ds.Filename), Table: ds.Layer}
+	case mml.CSV:
+		file := ""
+		if ds.Filename != "" {
+			file = m.locator.Data(ds.Filename)
+		}
+		return style.Datasource{Type: "csv", File: file, Inline: ds.Inline, Separator: ds.Separator}
+	case mml.GDAL:
+		return m.fileDatasource("gdal", m.locator.Data(ds.Filename), "")
+	case mml.PostGIS:
+		m.unsupported["postgis datasource"] = true
+	case mml.PgRaster:
+		m.unsupported["pgraster datasource"] = true
+	case mml.TopoJSON:
+		m.unsupported["topojson datasource"] = true
+	case mml.FlatGeobuf:
+		m.unsupported["flatgeobuf datasource"] = true
+	case nil:
+		// datasource might be nil for exports without mml
+	default:
+		m.unsupported[fmt.Sprintf("datasource %T", ds)] = true
+	}
+	return style.Datasource{}
+}
+
+// fileDatasource returns the datasource for OGR and GDAL files, based on
+// the file suffix.
+func (m *Map) fileDatasource(typ, fname, layer string) style.Datasource {
+	ext := strings.ToLower(filepath.Ext(fname))
+	if typ == "gdal" {
+		switch ext {
+		case ".png", ".jpg", ".jpeg":
+			return style.Datasource{Type: "image", File: fname}
+		}
+	} else {
+		switch ext {
+		case ".geojson", ".json":
+			return style.Datasource{Type: "geojson", File: fname}
+		case ".shp":
+			return style.Datasource{Type: "shape", File: fname}
+		case ".gpkg":
+			return style.Datasource{Type: "gpkg", File: fname, Table: layer}
+		case ".csv":
+			return style.Datasource{Type: "csv", File: fname}
+		}
+	}
+	m.unsupported[fmt.Sprintf("%s %s file", typ, ext)] = true
+	return style.Datasource{}
+}
+
+func (m *Map) newStyles(rules []mss.Rule) []style.Style {
+	styles := []style.Style{}
+	s := style.Style{}
+
+	for _, r := range rules {
+		styleName := r.Layer
+		if r.Attachment != "" {
+			styleName += "-" + r.Attachment
+		}
+		if s.Name != styleName {
+			if len(s.Rules) > 0 {
+				styles = append(styles, s)
+			}
+			s = style.Style{Name: styleName}
+			if v, ok := r.Properties.GetFloat("opacity"); ok {
+				s.Opacity = &v
+			}
+		}
+		m.checkProperties(r.Properties)
+		s.Rules = append(s.Rules, m.newRule(r))
+	}
+	if len(s.Rules) > 0 {
+		styles = append(styles, s)
+	}
+	return styles
+}
+
+func (m *Map) newRule(r mss.Rule) style.Rule {
+	result := style.Rule{Symbolizers: []style.Symbolizer{}}
+
+	if l := r.Zoom.First(); l > 0 {
+		if l > len(m.zoomScales) {
+			l = len(m.zoomScales)
+		}
+		result.MaxScaleDenom = float64(m.zoomScales[l-1])
+	}
+	if l := r.Zoom.Last(); l < len(m.zoomScales) {
+		result.MinScaleDenom = float64(m.zoomScales[l])
+	}
+	for _, f := range r.Filters {
+		result.Filters = append(result.Filters, style.NewFilter(f))
+	}
+
+	prefixes := mss.SortedPrefixes(r.Properties, []string{"line-", "polygon-", "polygon-pattern-", "text-", "marker-", "point-", "building-", "dot-", "raster-"})
+	for _, p := range prefixes {
+		r.Properties.SetDefaultInstance(p.Instance)
+		var symb *style.Symbolizer
+		switch p.Name {
+		case "line-":
+			symb = m.newLineSymbolizer(r.Properties)
+		case "polygon-":
+			symb = m.newPolygonSymbolizer(r.Properties)
+		case "polygon-pattern-":
+			symb = m.newPolygonPatternSymbolizer(r.Properties)
+		case "text-":
+			symb = m.newTextSymbolizer(r.Properties)
+		case "marker-":
+			symb = m.newMarkerSymbolizer(r.Properties)
+		case "point-":
+			symb = m.newPointSymbolizer(r.Properties)
+		case "building-":
+			symb = m.newBuildingSymbolizer(r.Properties)
+		case "dot-":
+			symb = m.newDotSymbolizer(r.Properties)
+		case "raster-":
+			symb = m.newRasterSymbolizer(r.Properties)
+		}
+		if symb != nil {
+			result.Symbolizers = append(result.Symbolizers, *symb)
+		}
+	}
+	r.Properties.SetDefaultInstance("")
+	return result
+}
+
+func (m *Map) newLineSymbolizer(p *mss.Properties) *style.Symbolizer {
+	width, ok := p.GetFloat("line-width")
+	if !ok || width == 0.0 {
+		return nil
+	}
+	symb := &style.Symbolizer{Type: style.LineSymbolizer}
+	symb.Width = m.scaled(width, true)
+	symb.Color = optColor(p.GetColor("line-color"))
+	symb.Opacity = optFloat(p.GetFloat("line-opacity"))
+	if v, ok := p.GetFloatList("line-dasharray"); ok {
+		for _, d := range v {
+			symb.Dasharray = append(symb.Dasharray, d*m.scaleFactor)
+		}
+	}
+	symb.Cap, _ = p.GetString("line-cap")
+	symb.Join, _ = p.GetString("line-join")
+	symb.MiterLimit = optFloat(p.GetFloat("line-miterlimit"))
+	return symb
+}
+
+func (m *Map) newPolygonSymbolizer(p *mss.Properties) *style.Symbolizer {
+	fill, ok := p.GetColor("polygon-fill")
+	if !ok {
+		return nil
+	}
+	return &style.Symbolizer{
+		Type:    style.PolygonSymbolizer,
+		Color:   newColor(fill),
+		Opacity: optFloat(p.GetFloat("polygon-opacity")),
+	}
+}
+
+func (m *Map) newPolygonPatternSymbolizer(p *mss.Properties) *style.Symbolizer {
+	file, ok := p.GetString("polygon-pattern-file")
+	if !ok {
+		return nil
+	}
+	fname, ok := m.image(file, "polygon-pattern-file")
+	if !ok {
+		return nil
+	}
+	return &style.Symbolizer{
+		Type:    style.PolygonPatternSymbolizer,
+		File:    fname,
+		Opacity: optFloat(p.GetFloat("polygon-pattern-opacity")),
+	}
+}
+
+func (m *Map) newTextSymbolizer(p *mss.Properties) *style.Symbolizer {
+	size, ok := p.GetFloat("text-size")
+	if !ok {
+		return nil
+	}
+	symb := &style.Symbolizer{Type: style.TextSymbolizer, Size: size * m.scaleFactor}
+	if name, ok := p.GetFieldList("text-name"); ok {
+		for _, v := range name {
+			switch v := v.(type) {
+			case mss.Field:
+				symb.Text = append(symb.Text, style.TextPart{Field: strings.Trim(string(v), "[]")})
+			case string:
+				if v != "" {
+					symb.Text = append(symb.Text, style.TextPart{Text: v})
+				}
+			}
+		}
+	}
+	if len(symb.Text) == 0 {
+		return nil
+	}
+	if faceNames, ok := p.GetStringList("text-face-name"); ok {
+		for _, name := range faceNames {
+			ff := style.FontFace{Name: name, File: m.locator.Font(name)}
+			if ff.File != "" {
+				ff.Index = config.FontIndex(ff.File, name)
+			}
+			symb.Fonts = append(symb.Fonts, ff)
+		}
+	}
+	symb.Color = optColor(p.GetColor("text-fill"))
+	symb.Opacity = optFloat(p.GetFloat("text-opacity"))
+	symb.HaloFill = optColor(p.GetColor("text-halo-fill"))
+	symb.HaloRadius = m.scaledValue(p, "text-halo-radius")
+	symb.Dx = m.scaledValue(p, "text-dx")
+	symb.Dy = m.scaledValue(p, "text-dy")
+	symb.WrapWidth = m.scaledValue(p, "text-wrap-width")
+	symb.MinDistance = m.scaledValue(p, "text-min-distance")
+	symb.TextTransform, _ = p.GetString("text-transform")
+	symb.HorizontalAlignment, _ = p.GetString("text-horizontal-alignment")
+	symb.AllowOverlap, _ = p.GetBool("text-allow-overlap")
+	symb.AvoidEdges, _ = p.GetBool("text-avoid-edges")
+	if v, ok := p.GetString("text-placement"); ok {
+		switch v {
+		case "point", "interior":
+			symb.Placement = v
+		default:
+			// rendered with point placement
+			m.unsupported["text-placement "+v] = true
+		}
+	}
+	return symb
+}
+
+func (m *Map) newMarkerSymbolizer(p *mss.Properties) *style.Symbolizer {
+	symb := &style.Symbolizer{Type: style.MarkerSymbolizer}
+	symb.Width = m.scaledProp(p, "marker-width")
+	symb.Height = m.scaledProp(p, "marker-height")
+	symb.Color = optColor(p.GetColor("marker-fill"))
+	symb.FillOpacity = optFloat(p.GetFloat("marker-fill-opacity"))
+	symb.Opacity = optFloat(p.GetFloat("marker-opacity"))
+	symb.Spacing = m.scaledProp(p, "marker-spacing")
+	symb.Stroke = optColor(p.GetColor("marker-line-color"))
+	symb.StrokeOpacity = optFloat(p.GetFloat("marker-line-opacity"))
+	symb.StrokeWidth = m.scaledProp(p, "marker-line-width")
+	symb.AllowOverlap, _ = p.GetBool("marker-allow-overlap")
+	symb.IgnorePlacement, _ = p.GetBool("marker-ignore-placement")
+	if v, ok := p.GetString("marker-placement"); ok {
+		switch v {
+		case "point", "interior", "line", "vertex-first", "vertex-last":
+			symb.Placement = v
+		default:
+			m.unsupported["marker-placement "+v] = true
+		}
+	}
+
+	if markerFile, ok := p.GetString("marker-file"); ok {
+		if fname, ok := m.image(markerFile, "marker-file"); ok {
+			symb.File = fname
+			return symb
+		}
+		// unsupported images are rendered with the default marker
+	}
+
+	// carto uses 'ellipse' as default for "marker-type"
+	markerType, ok := p.GetString("marker-type")
+	if !ok {
+		markerType = "ellipse"
+		// default marker type requires at least fill, stroke or strokewidth
+		if symb.Color == nil && symb.Stroke == nil && symb.StrokeWidth == nil {
+			return nil
+		}
+	}
+	if markerType != "ellipse" && markerType != "arrow" {
+		m.unsupported["marker-type "+markerType] = true
+		markerType = "ellipse"
+	}
+	symb.MarkerType = markerType
+	return symb
+}
+
+func (m *Map) newPointSymbolizer(p *mss.Properties) *style.Symbolizer {
+	file, ok := p.GetString("point-file")
+	if !ok {
+		return nil
+	}
+	fname, ok := m.image(file, "point-file")
+	if !ok {
+		return nil
+	}
+	symb := &style.Symbolizer{Type: style.PointSymbolizer, File: fname}
+	symb.Opacity = optFloat(p.GetFloat("point-opacity"))
+	symb.AllowOverlap, _ = p.GetBool("point-allow-overlap")
+	symb.IgnorePlacement, _ = p.GetBool("point-ignore-placement")
+	if v, ok := p.GetString("point-placement"); ok && v == "interior" {
+		symb.Placement = v
+	}
+	return symb
+}
+
+// newBuildingSymbolizer returns a polygon symbolizer, buildings are
+// rendered without height.
+func (m *Map) newBuildingSymbolizer(p *mss.Properties) *style.Symbolizer {
+	fill, ok := p.GetColor("building-fill")
+	if !ok {
+		return nil
+	}
+	return &style.Symbolizer{
+		Type:    style.PolygonSymbolizer,
+		Color:   newColor(fill),
+		Opacity: optFloat(p.GetFloat("building-fill-opacity")),
+	}
+}
+
+func (m *Map) newDotSymbolizer(p *mss.Properties) *style.Symbolizer {
+	fill, ok := p.GetColor("dot-fill")
+	if !ok {
+		return nil
+	}
+	return &style.Symbolizer{
+		Type:    style.DotSymbolizer,
+		Color:   newColor(fill),
+		Opacity: optFloat(p.GetFloat("dot-opacity")),
+		Width:   m.scaledProp(p, "dot-width"),
+		Height:  m.scaledProp(p, "dot-height"),
+	}
+}
+
+func (m *Map) newRasterSymbolizer(p *mss.Properties) *style.Symbolizer {
+	opacity, ok := p.GetFloat("raster-opacity")
+	if ok && opacity == 0.0 {
+		return nil
+	}
+	return &style.Symbolizer{Type: style.RasterSymbolizer, Opacity: optFloat(opacity, ok)}
+}
+
+// image returns the located image file. SVG files are reported as
+// unsupported.
+func (m *Map) image(file, property string) (string, bool) {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".png", ".jpg", ".jpeg":
+		return m.locator.Image(file), true
+	}
+	m.unsupported[property+" "+strings.TrimPrefix(strings.ToLower(filepath.Ext(file)), ".")] = true
+	return "", false
+}
+
+// supportedProperties are all properties evaluated by the native
+// renderer.
+var supportedProperties = map[string]bool{
+	"opacity": true,
+
+	"line-width": true, "line-color": true, "line-opacity": true, "line-dasharray": true,
+	"line-cap": true, "line-join": true, "line-miterlimit": true,
+
+	"polygon-fill": true, "polygon-opacity": true,
+	"polygon-pattern-file": true, "polygon-pattern-opacity": true,
+
+	"text-name": true, "text-size": true, "text-face-name": true, "text-fill": true,
+	"text-opacity": true, "text-halo-fill": true, "text-halo-radius": true,
+	"text-dx": true, "text-dy": true, "text-wrap-width": true, "text-min-distance": true,
+	"text-transform": true, "text-horizontal-alignment": true, "text-allow-overlap": true,
+	"text-avoid-edges": true, "text-placement": true,
+
+	"marker-width": true, "marker-height": true, "marker-fill": true, "marker-fill-opacity": true,
+	"marker-opacity": true, "marker-spacing": true, "marker-line-color": true,
+	"marker-line-opacity": true, "marker-line-width": true, "marker-allow-overlap": true,
+	"marker-ignore-placement": true, "marker-placement": true, "marker-file": true,
+	"marker-type": true,
+
+	"point-file": true, "point-opacity": true, "point-allow-overlap": true,
+	"point-ignore-placement": true, "point-placement": true,
+
+	"building-fill": true, "building-fill-opacity": true,
+
+	"dot-fill": true, "dot-opacity": true, "dot-width": true, "dot-height": true,
+
+	"raster-opacity": true,
+}
+
+// ignoredSuffixes are properties that only affect the rendering quality
+// or performance and that are not reported as unsupported.
+var ignoredSuffixes = []string{
+	"-clip", "-simplify", "-simplify-algorithm", "-smooth", "-gamma", "-gamma-method",
+	"-rasterizer", "-max-error", "-scaling", "-mesh-size", "-filter-factor",
+	"-label-position-tolerance", "-max-char-angle-delta", "-min-path-length",
+	"-min-padding", "-margin", "-repeat-distance", "-largest-bbox-only",
+	"image-filters-inflate",
+}
+
+// unsupportedPrefixes are symbolizers that are not supported. They are
+// reported once instead of each property.
+var unsupportedPrefixes = []string{"shield-", "line-pattern-"}
+
+// checkProperties reports all properties that are not supported by the
+// native renderer.
+func (m *Map) checkProperties(p *mss.Properties) {
+properties:
+	for _, prop := range p.All() {
+		name := prop.Name
+		if supportedProperties[name] {
+			continue
+		}
+		for _, prefix := range unsupportedPrefixes {
+			if strings.HasPrefix(name, prefix) {
+				m.unsupported[prefix+"*"] = true
+				continue properties
+			}
+		}
+		for _, suffix := range ignoredSuffixes {
+			if strings.HasSuffix(name, suffix) {
+				continue properties
+			}
+		}
+		m.unsupported[name] = true
+	}
+}
+
+func (m *Map) scaled(v float64, ok bool) *float64 {
+	if !ok {
+		return nil
+	}
+	v *= m.scaleFactor
+	return &v
+}
+
+func (m *Map) scaledProp(p *mss.Properties, name string) *float64 {
+	return m.scaled(p.GetFloat(name))
+}
+
+func (m *Map) scaledValue(p *mss.Properties, name string) float64 {
+	v, _ := p.GetFloat(name)
+	return v * m.scaleFactor
+}
+
+func optFloat(v float64, ok bool) *float64 {
+	if !ok {
+		return nil
+	}
+	return &v
+}
+
+func optColor(c color.Color, ok bool) *style.Color {
+	if !ok {
+		return nil
+	}
+	return newColor(c)
+}
+
+func newColor(c color.Color) *style.Color {
+	r, g, b := c.ToRgb()
+	return &style.Color{channel(r), channel(g), channel(b), channel(c.A)}
+}
+
+func channel(v float64) uint8 {
+	return uint8(math.Max(0, math.Min(255, math.Floor(v*255+0.5))))
+}
+
+var webmercZoomScales = []int{
+	500000000,
+	200000000,
+	100000000,
+	50000000,
+	25000000,
+	12500000,
+	6500000,
+	3000000,
+	1500000,
+	750000,
+	400000,
+	200000,
+	100000,
+	50000,
+	25000,
+	12500,
+	5000,
+	2500,
+	1500,
+	750,
+	500,
+	250,
+	100,
+}
@@ -0,0 +1,146 @@
+package native
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/omniscale/magnacarto/color"
+	"github.com/omniscale/magnacarto/config"
+	"github.com/omniscale/magnacarto/mml"
+	"github.com/omniscale/magnacarto/mss"
+	style "github.com/omniscale/magnacarto/render/native"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var locator = config.LookupLocator{}
+
+func TestEPSGCode(t *testing.T) {
+	for _, tt := range []struct {
+		srs  string
+		code int
+		ok   bool
+	}{
+		{"", 4326, true},
+		{"epsg:3857", 3857, true},
+		{"+init=epsg:4326", 4326, true},
+		{"31467", 31467, true},
+		{"+proj=longlat +ellps=WGS84 +datum=WGS84 +no_defs", 4326, true},
+		{"+proj=merc +a=6378137 +b=6378137 +lat_ts=0.0 +lon_0=0.0 +x_0=0.0 +y_0=0 +k=1.0 +units=m +nadgrids=@null +wktext +no_defs +over", 3857, true},
+		{"+proj=tmerc +lat_0=0 +lon_0=9 +k=1 +x_0=3500000", 0, false},
+	} {
+		code, ok := epsgCode(tt.srs)
+		assert.Equal(t, tt.code, code, tt.srs)
+		assert.Equal(t, tt.ok, ok, tt.srs)
+	}
+}
+
+func TestZoomScales(t *testing.T) {
+	m := New(&locator)
+	m.AddLayer(mml.Layer{ID: "test_lte2", SRS: "4326", Type: mml.LineString, Active: true},
+		[]mss.Rule{
+			{Zoom: mss.NewZoomRange(mss.LTE, 2), Layer: "test_lte2", Properties: mss.NewProperties("line-width", 1.0)},
+		})
+	m.AddLayer(mml.Layer{ID: "test_3_4_5", SRS: "4326", Type: mml.LineString, Active: true},
+		[]mss.Rule{
+			{Zoom: mss.NewZoomRange(mss.GT, 2) & mss.NewZoomRange(mss.LTE, 5), Layer: "test_3_4_5", Properties: mss.NewProperties("line-width", 1.0)},
+		})
+	m.AddLayer(mml.Layer{ID: "test_override", SRS: "4326", Type: mml.LineString, Active: true, MaxScaleDenom: 5000},
+		[]mss.Rule{
+			{Zoom: mss.NewZoomRange(mss.GT, 2), Layer: "test_override", Properties: mss.NewProperties("line-width", 1.0)},
+		})
+	m.AddLayer(mml.Layer{ID: "inactive", SRS: "4326", Type: mml.LineString},
+		[]mss.Rule{
+			{Layer: "inactive", Properties: mss.NewProperties("line-width", 1.0)},
+		})
+
+	layers := m.style.Layers
+	if assert.Len(t, layers, 3) {
+		assert.Equal(t, 0.0, layers[0].MaxScaleDenom)
+		assert.Equal(t, 100000000.0, layers[0].MinScaleDenom)
+		assert.Equal(t, 100000000.0, layers[1].MaxScaleDenom)
+		assert.Equal(t, 12500000.0, layers[1].MinScaleDenom)
+		assert.Equal(t, 5000.0, layers[2].MaxScaleDenom)
+	}
+}
+
+func TestSymbolizers(t *testing.T) {
+	m := New(&locator)
+	m.AddLayer(mml.Layer{ID: "test", SRS: "epsg:3857", Type: mml.Polygon, Active: true, ScaleFactor: 2.0,
+		Datasource: mml.GeoJson{Filename: "test.geojson"}},
+		[]mss.Rule{
+			{Layer: "test", Filters: []mss.Filter{{Field: "type", CompOp: mss.EQ, Value: "park"}}, Properties: mss.NewProperties(
+				"polygon-fill", color.MustParse("#ff0000"),
+				"line-width", 3.0,
+				"line-color", color.MustParse("#0000ff"),
+				"line-dasharray", []mss.Value{2.0, 4.0},
+				"text-size", 10.0,
+				"text-name", []mss.Value{mss.Field("[name]"), " park"},
+				"text-face-name", []mss.Value{"Missing Font"},
+			)},
+		})
+
+	if !assert.Len(t, m.style.Layers, 1) {
+		return
+	}
+	l := m.style.Layers[0]
+	assert.Equal(t, 3857, l.EPSGCode)
+	assert.Equal(t, style.Datasource{Type: "geojson", File: "test.geojson"}, l.Datasource)
+	if !assert.Len(t, l.Styles, 1) || !assert.Len(t, l.Styles[0].Rules, 1) {
+		return
+	}
+	r := l.Styles[0].Rules[0]
+	assert.Equal(t, []style.Filter{{Field: "type", Op: "=", Value: "park"}}, r.Filters)
+
+	symbolizers := make(map[string]style.Symbolizer)
+	for _, s := range r.Symbolizers {
+		symbolizers[s.Type] = s
+	}
+	assert.Equal(t, &style.Color{255, 0, 0, 255}, symbolizers[style.PolygonSymbolizer].Color)
+	line := symbolizers[style.LineSymbolizer]
+	assert.Equal(t, &style.Color{0, 0, 255, 255}, line.Color)
+	assert.Equal(t, 6.0, *line.Width)
+	assert.Equal(t, []float64{4, 8}, line.Dasharray)
+	text := symbolizers[style.TextSymbolizer]
+	assert.Equal(t, 20.0, text.Size)
+	assert.Equal(t, []style.TextPart{{Field: "name"}, {Text: " park"}}, text.Text)
+	assert.Equal(t, []style.FontFace{{Name: "Missing Font"}}, text.Fonts)
+
+	assert.Empty(t, m.UnsupportedFeatures())
+
+	buf := bytes.Buffer{}
+	assert.NoError(t, m.Write(&buf))
+	assert.Contains(t, buf.String(), `"color": "#ff0000ff"`)
+}
+
+func TestUnsupportedFeatures(t *testing.T) {
+	m := New(&locator)
+	m.AddLayer(mml.Layer{ID: "gk", SRS: "epsg:31467", Type: mml.LineString, Active: true,
+		Datasource: mml.PostGIS{Query: "roads"}},
+		[]mss.Rule{
+			{Layer: "gk", Properties: mss.NewProperties(
+				"line-width", 1.0,
+				"shield-name", "[ref]",
+				"shield-file", "shield.svg",
+				"marker-file", "marker.svg",
+				"text-size", 10.0,
+				"text-name", "[name]",
+				"text-placement", "line",
+			)},
+		})
+	assert.Equal(t, []string{
+		"marker-file svg",
+		"postgis datasource",
+		"shield-*",
+		"srs EPSG:31467",
+		"text-placement line",
+	}, m.UnsupportedFeatures())
+
+	l := m.style.Layers[0]
+	assert.Equal(t, style.Datasource{}, l.Datasource)
+	for _, s := range l.Styles[0].Rules[0].Symbolizers {
+		if s.Type == style.MarkerSymbolizer {
+			assert.Empty(t, s.File)
+		}
+	}
+}
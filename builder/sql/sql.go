@@ -2,71 +2,318 @@
 package sql
 
 import (
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/omniscale/magnacarto/mss"
 )
 
-func filterItems(rules []mss.Rule) map[string]map[string]struct{} {
-	result := make(map[string]map[string]struct{})
+// MapnikScaleDenominator is replaced with the current scale denominator
+// by Mapnik. MapServerScaleDenominator is the runtime substitution of
+// MapServer. It is replaced by the scale request parameter and requires
+// a VALIDATION block (see Substitutions).
+const (
+	MapnikScaleDenominator    = "!scale_denominator!"
+	MapServerScaleDenominator = "%scale%"
+)
+
+// FilterString returns an SQL WHERE statement that pre-filters rows
+// for this set of rules. Each rule is translated into a conjunction of
+// all filters that can be expressed in SQL (comparisons, null checks,
+// regular expressions and modulo). Columns are cast to numeric for
+// comparisons with numbers, as text columns are compared as numbers by
+// Mapnik (e.g. admin_level of osm2pgsql). Untranslatable filters are
+// ignored, so the statement might select more rows than required, but
+// never less.
+//
+// Rules for:
+//
+//	#foo [type='bar'][level=2] {}
+//	#foo [type='baz'] {}
+//
+// will return
+//
+//	(("type" = 'bar' AND "level"::numeric = 2) OR "type" IN ('baz'))
+//
+// Rules for:
+//
+//	#foo [level=2] {}
+//	#foo {}
+//
+// will return an empty string, since any row can match.
+func FilterString(rules []mss.Rule) string {
+	return ZoomFilterString(rules, nil, "")
+}
+
+// ZoomFilterString returns an SQL WHERE statement like FilterString, but
+// it also limits rows to rules that are active at the current scale.
+// scaleToken is replaced by the renderer with the current scale
+// denominator (MapnikScaleDenominator or MapServerScaleDenominator).
+// zoomScales are the scale denominators for each zoom level. Zoom ranges
+// are ignored if zoomScales is empty.
+//
+// MapServer substitutes 0 for requests without scale parameter. The
+// conditions for MapServer are also true for 0, so that these requests
+// are not filtered by zoom.
+func ZoomFilterString(rules []mss.Rule, zoomScales []int, scaleToken string) string {
+	var conds []string
+	seen := make(map[string]struct{})
+	in := make(map[string]map[string]struct{})
+	var inFields []string
+
 	for _, r := range rules {
-		if len(r.Filters) == 0 {
-			return nil
+		parts := filterParts(r.Filters)
+		if len(zoomScales) > 0 && scaleToken != "" {
+			parts = append(parts, zoomParts(r.Zoom, zoomScales, scaleToken)...)
+		}
+		if len(parts) == 0 {
+			// rule matches all rows
+			return ""
 		}
 
-		// rule filters are conjunct (AND), it's ok if we can limit the rows
-		// by matching at least one filter.
-		found := false
-		for _, f := range r.Filters {
-			if f.CompOp != mss.EQ {
-				continue
-			}
-			v, ok := f.Value.(string)
-			if !ok {
+		// group single string equalities to field IN (...)
+		if len(parts) == 1 && len(r.Filters) > 0 {
+			if field, value, ok := stringEquality(r.Filters); ok && parts[0] == quoteIdent(field)+" = "+value {
+				if in[field] == nil {
+					in[field] = make(map[string]struct{})
+					inFields = append(inFields, field)
+				}
+				in[field][value] = struct{}{}
 				continue
 			}
-			found = true
-			if result[f.Field] == nil {
-				result[f.Field] = make(map[string]struct{})
+		}
+
+		cond := strings.Join(parts, " AND ")
+		if len(parts) > 1 {
+			cond = "(" + cond + ")"
+		}
+		if _, ok := seen[cond]; ok {
+			continue
+		}
+		seen[cond] = struct{}{}
+		conds = append(conds, cond)
+	}
+
+	for _, field := range inFields {
+		vals := make([]string, 0, len(in[field]))
+		for v := range in[field] {
+			vals = append(vals, v)
+		}
+		sort.Strings(vals)
+		conds = append(conds, quoteIdent(field)+" IN ("+strings.Join(vals, ", ")+")")
+	}
+
+	if conds == nil {
+		return ""
+	}
+	return "(" + strings.Join(conds, " OR ") + ")"
+}
+
+// stringEquality returns the field and quoted value of the only
+// string equality in filters.
+func stringEquality(filters []mss.Filter) (string, string, bool) {
+	var field, value string
+	found := false
+	for _, f := range filters {
+		if f.CompOp != mss.EQ {
+			continue
+		}
+		v, ok := f.Value.(string)
+		if !ok || found {
+			return "", "", false
+		}
+		field, value, found = f.Field, quoteLiteral(v), true
+	}
+	return field, value, found
+}
+
+func filterParts(filters []mss.Filter) []string {
+	var parts []string
+	for _, f := range filters {
+		if part, ok := filterPart(f); ok {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
+
+func filterPart(f mss.Filter) (string, bool) {
+	if strings.Contains(f.Field, "::") {
+		// mapnik::geometry_type, etc.
+		return "", false
+	}
+	field := quoteIdent(f.Field)
+
+	switch f.CompOp {
+	case mss.EQ, mss.NEQ:
+		if f.Value == nil {
+			if f.CompOp == mss.EQ {
+				return field + " IS NULL", true
 			}
-			result[f.Field][v] = struct{}{}
+			return field + " IS NOT NULL", true
+		}
+		v, isNumber, ok := literal(f.Value)
+		if !ok {
+			return "", false
+		}
+		if isNumber {
+			field += "::numeric"
+		}
+		if f.CompOp == mss.EQ {
+			return field + " = " + v, true
 		}
-		if !found {
-			return nil
+		// NULL != 'foo' is true for Mapnik
+		return field + " IS DISTINCT FROM " + v, true
+	case mss.GT, mss.GTE, mss.LT, mss.LTE:
+		v, isNumber, ok := literal(f.Value)
+		if !ok {
+			return "", false
 		}
+		if isNumber {
+			field += "::numeric"
+		}
+		return field + " " + f.CompOp.String() + " " + v, true
+	case mss.REGEX:
+		v, ok := f.Value.(string)
+		if !ok {
+			return "", false
+		}
+		// Mapnik requires the whole value to match
+		return field + "::text ~ " + quoteLiteral("^(?:"+v+")$"), true
+	case mss.MODULO:
+		m, ok := f.Value.(mss.ModuloComparsion)
+		if !ok {
+			return "", false
+		}
+		op := m.CompOp.String()
+		if m.CompOp == mss.NEQ {
+			op = "<>"
+		}
+		return "(" + field + "::numeric % " + strconv.Itoa(m.Div) + ") " + op + " " + strconv.Itoa(m.Value), true
 	}
-	return result
+	return "", false
 }
 
-// FilterString returns an SQL WHERE statement that pre-filters rows
-// for this set of rules. Only supports "equal strings" filters.
+// zoomParts returns the scale denominator conditions for the zoom range,
+// analog to the MaxScaleDenominator/MinScaleDenominator of the rules.
+func zoomParts(zoom mss.ZoomRange, zoomScales []int, scaleToken string) []string {
+	if zoom == mss.AllZoom || zoom == mss.InvalidZoom {
+		return nil
+	}
+	var parts []string
+	if l := zoom.First(); l > 0 {
+		if l > len(zoomScales) {
+			l = len(zoomScales)
+		}
+		parts = append(parts, scaleToken+" < "+strconv.Itoa(zoomScales[l-1]))
+	}
+	if l := zoom.Last(); l < len(zoomScales) {
+		part := scaleToken + " >= " + strconv.Itoa(zoomScales[l])
+		if scaleToken == MapServerScaleDenominator {
+			// default for requests without scale
+			part = "(" + scaleToken + " = 0 OR " + part + ")"
+		}
+		parts = append(parts, part)
+	}
+	return parts
+}
+
+// literal returns v as SQL literal and whether v is a number.
+func literal(v interface{}) (string, bool, bool) {
+	switch v := v.(type) {
+	case string:
+		return quoteLiteral(v), false, true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true, true
+	case int:
+		return strconv.Itoa(v), true, true
+	}
+	return "", false, false
+}
+
+func quoteLiteral(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+func quoteIdent(s string) string {
+	return "\"" + strings.Replace(s, "\"", "\"\"", -1) + "\""
+}
+
+// Fields returns the sorted names of all fields that are referenced by
+// the filters and properties of the rules, and of the additional fields.
+func Fields(rules []mss.Rule, additional ...string) []string {
+	found := make(map[string]struct{})
+	add := func(f string) {
+		if f != "" && !strings.Contains(f, "::") {
+			found[f] = struct{}{}
+		}
+	}
+	for _, r := range rules {
+		for _, f := range r.Filters {
+			add(f.Field)
+		}
+		if r.Properties != nil {
+			for _, f := range r.Properties.Fields() {
+				add(f)
+			}
+		}
+	}
+	for _, f := range additional {
+		add(f)
+	}
+
+	fields := make([]string, 0, len(found))
+	for f := range found {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// DefaultGeometryField is the geometry column of pruned queries, if the
+// datasource does not name one.
+const DefaultGeometryField = "geometry"
+
+// SelectFields wraps query, so that only the geometry and the fields are
+// selected. geometryField defaults to DefaultGeometryField.
+//
+//	SelectFields("osm_roads", "geometry", []string{"name", "type"})
 //
-// Rules for:
-//   #foo [type='bar'][level=2] {}
-//   #foo [type='baz'][level=2] {}
 // will return
-//   "(type IN ('bar', 'baz'))"
 //
-// Rules for:
-//   #foo [level=2] {}
-//   #foo [type='bar'][level=2] {}
-// will return an empty string, since any 'type' can match.
-func FilterString(rules []mss.Rule) string {
-	var vals, parts []string
+//	(SELECT "geometry", "name", "type" FROM osm_roads) as pruned
+func SelectFields(query, geometryField string, fields []string) string {
+	return selectFields(query, geometryField, nil, fields)
+}
 
-	items := filterItems(rules)
+// SelectSQLiteFields wraps query like SelectFields, but it also keeps the
+// rowid of plain tables. The rowid is required for the spatial index.
+// Subselects are not modified, since their key column is unknown.
+//
+//	SelectSQLiteFields("osm_roads", "geometry", []string{"name"})
+//
+// will return
+//
+//	(SELECT rowid AS rowid, "geometry", "name" FROM osm_roads) as pruned
+func SelectSQLiteFields(query, geometryField string, fields []string) string {
+	if strings.ContainsAny(strings.TrimSpace(query), " \t\n(") {
+		return query
+	}
+	return selectFields(query, geometryField, []string{"rowid AS rowid"}, fields)
+}
 
-	for key, values := range items {
-		vals = vals[:0]
-		for v, _ := range values {
-			vals = append(vals, "'"+v+"'")
-		}
-		parts = append(parts, "\""+key+"\" IN ("+strings.Join(vals, ", ")+")")
+func selectFields(query, geometryField string, cols, fields []string) string {
+	if geometryField == "" {
+		geometryField = DefaultGeometryField
 	}
-	if parts == nil {
-		return ""
+	cols = append(cols, quoteIdent(geometryField))
+	for _, f := range fields {
+		if f != geometryField {
+			cols = append(cols, quoteIdent(f))
+		}
 	}
-	return "(" + strings.Join(parts, " OR ") + ")"
+	return "(SELECT " + strings.Join(cols, ", ") + " FROM " + strings.TrimSpace(query) + ") as pruned"
 }
 
 func WrapWhere(query, where string) string {
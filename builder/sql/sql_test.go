@@ -0,0 +1,162 @@
+package sql
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/omniscale/magnacarto/mss"
+)
+
+func TestFilterString(t *testing.T) {
+	for _, tt := range []struct {
+		rules    []mss.Rule
+		expected string
+	}{
+		{nil, ""},
+		{[]mss.Rule{{}}, ""},
+		{
+			[]mss.Rule{
+				{Filters: []mss.Filter{{Field: "type", CompOp: mss.EQ, Value: "baz"}}},
+				{Filters: []mss.Filter{{Field: "type", CompOp: mss.EQ, Value: "bar"}}},
+			},
+			`("type" IN ('bar', 'baz'))`,
+		},
+		{
+			[]mss.Rule{
+				{Filters: []mss.Filter{{Field: "type", CompOp: mss.EQ, Value: "bar"}, {Field: "level", CompOp: mss.EQ, Value: 2.0}}},
+				{Filters: []mss.Filter{{Field: "type", CompOp: mss.EQ, Value: "baz"}}},
+			},
+			`(("type" = 'bar' AND "level"::numeric = 2) OR "type" IN ('baz'))`,
+		},
+		{
+			[]mss.Rule{
+				{Filters: []mss.Filter{{Field: "level", CompOp: mss.EQ, Value: 2.0}}},
+				{},
+			},
+			"",
+		},
+		{
+			[]mss.Rule{
+				{Filters: []mss.Filter{{Field: "pop", CompOp: mss.GTE, Value: 1000.5}, {Field: "name", CompOp: mss.NEQ, Value: nil}}},
+				{Filters: []mss.Filter{{Field: "name", CompOp: mss.EQ, Value: nil}}},
+				{Filters: []mss.Filter{{Field: "type", CompOp: mss.NEQ, Value: "it's"}}},
+				{Filters: []mss.Filter{{Field: "admin_level", CompOp: mss.NEQ, Value: 2.5}}},
+			},
+			`(("pop"::numeric >= 1000.5 AND "name" IS NOT NULL) OR "name" IS NULL OR "type" IS DISTINCT FROM 'it''s' OR "admin_level"::numeric IS DISTINCT FROM 2.5)`,
+		},
+		{
+			[]mss.Rule{
+				{Filters: []mss.Filter{{Field: "name", CompOp: mss.REGEX, Value: "foo.*"}}},
+				{Filters: []mss.Filter{{Field: "id", CompOp: mss.MODULO, Value: mss.ModuloComparsion{Div: 2, CompOp: mss.NEQ, Value: 0}}}},
+				{Filters: []mss.Filter{{Field: "ref", CompOp: mss.LT, Value: "B"}}},
+			},
+			`("name"::text ~ '^(?:foo.*)$' OR ("id"::numeric % 2) <> 0 OR "ref" < 'B')`,
+		},
+		{
+			// untranslatable filters
+			[]mss.Rule{
+				{Filters: []mss.Filter{{Field: "way_area", CompOp: mss.GT, Value: 1000.0}}},
+				{Filters: []mss.Filter{{Field: "name", CompOp: mss.REGEX, Value: 1.0}}},
+				{Filters: []mss.Filter{{Field: "mapnik::geometry_type", CompOp: mss.EQ, Value: 1.0}}},
+			},
+			"",
+		},
+	} {
+		if actual := FilterString(tt.rules); actual != tt.expected {
+			t.Errorf("%v\n%s\n!=\n%s", tt.rules, actual, tt.expected)
+		}
+	}
+}
+
+func TestZoomFilterString(t *testing.T) {
+	zoomScales := []int{1000000, 500000, 250000, 100000}
+	for _, tt := range []struct {
+		rules    []mss.Rule
+		expected string
+	}{
+		{[]mss.Rule{{Zoom: mss.AllZoom}}, ""},
+		{
+			[]mss.Rule{{Zoom: mss.NewZoomRange(mss.GTE, 2)}},
+			`(!scale_denominator! < 500000)`,
+		},
+		{
+			[]mss.Rule{
+				{Zoom: mss.NewZoomRange(mss.GTE, 1) & mss.NewZoomRange(mss.LTE, 2), Filters: []mss.Filter{{Field: "type", CompOp: mss.EQ, Value: "bar"}}},
+				{Zoom: mss.NewZoomRange(mss.GTE, 3), Filters: []mss.Filter{{Field: "type", CompOp: mss.EQ, Value: "baz"}}},
+			},
+			`(("type" = 'bar' AND !scale_denominator! < 1000000 AND !scale_denominator! >= 250000) OR ("type" = 'baz' AND !scale_denominator! < 250000))`,
+		},
+		{
+			[]mss.Rule{
+				{Zoom: mss.NewZoomRange(mss.GTE, 2)},
+				{Zoom: mss.AllZoom},
+			},
+			"",
+		},
+	} {
+		if actual := ZoomFilterString(tt.rules, zoomScales, MapnikScaleDenominator); actual != tt.expected {
+			t.Errorf("%v\n%s\n!=\n%s", tt.rules, actual, tt.expected)
+		}
+	}
+}
+
+func TestZoomFilterStringMapServer(t *testing.T) {
+	zoomScales := []int{1000000, 500000, 250000, 100000}
+	rules := []mss.Rule{
+		{Zoom: mss.NewZoomRange(mss.GTE, 1) & mss.NewZoomRange(mss.LTE, 2), Filters: []mss.Filter{{Field: "level", CompOp: mss.GT, Value: 4.0}}},
+	}
+	expected := `(("level"::numeric > 4 AND %scale% < 1000000 AND (%scale% = 0 OR %scale% >= 250000)))`
+	if actual := ZoomFilterString(rules, zoomScales, MapServerScaleDenominator); actual != expected {
+		t.Errorf("%s\n!=\n%s", actual, expected)
+	}
+}
+
+func TestFields(t *testing.T) {
+	rules := []mss.Rule{
+		{
+			Filters:    []mss.Filter{{Field: "type", CompOp: mss.EQ, Value: "bar"}, {Field: "mapnik::geometry_type", CompOp: mss.EQ, Value: 1.0}},
+			Properties: mss.NewProperties("text-name", "[name]"),
+		},
+		{
+			Filters:    []mss.Filter{{Field: "level", CompOp: mss.GT, Value: 2.0}},
+			Properties: mss.NewProperties("marker-file", "[type].svg"),
+		},
+	}
+	fields := Fields(rules, "group", "")
+	if !reflect.DeepEqual(fields, []string{"group", "level", "name", "type"}) {
+		t.Error(fields)
+	}
+}
+
+func TestSelectFields(t *testing.T) {
+	for _, tt := range []struct {
+		query    string
+		fields   []string
+		expected string
+	}{
+		{"osm_roads", nil, `(SELECT "geometry" FROM osm_roads) as pruned`},
+		{
+			"(SELECT * FROM osm_roads WHERE geometry && !bbox!) as roads", []string{"geometry", "name", "type"},
+			`(SELECT "geometry", "name", "type" FROM (SELECT * FROM osm_roads WHERE geometry && !bbox!) as roads) as pruned`,
+		},
+	} {
+		if actual := SelectFields(tt.query, "geometry", tt.fields); actual != tt.expected {
+			t.Errorf("%s\n!=\n%s", actual, tt.expected)
+		}
+	}
+}
+
+func TestSelectSQLiteFields(t *testing.T) {
+	for _, tt := range []struct {
+		query    string
+		fields   []string
+		expected string
+	}{
+		{"osm_roads", []string{"name"}, `(SELECT rowid AS rowid, "GEOMETRY", "name" FROM osm_roads) as pruned`},
+		{"(SELECT * FROM osm_roads) as roads", []string{"name"}, `(SELECT * FROM osm_roads) as roads`},
+	} {
+		if actual := SelectSQLiteFields(tt.query, "GEOMETRY", tt.fields); actual != tt.expected {
+			t.Errorf("%s\n!=\n%s", actual, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package sql
+
+import (
+	"strings"
+)
+
+// Dialect of the renderer for token translations.
+type Dialect int
+
+const (
+	Mapnik Dialect = iota
+	MapServer
+)
+
+type token struct {
+	mapnik    string
+	mapserver string
+}
+
+// tokens contains all known tokens. An empty value marks tokens that are
+// not supported by the renderer.
+var tokens = []token{
+	{"!bbox!", "!BOX!"},
+	{MapnikScaleDenominator, MapServerScaleDenominator},
+	{"!pixel_width!", "%pixel_width%"},
+	{"!pixel_height!", "%pixel_height%"},
+}
+
+// Substitution is a MapServer runtime substitution of a query token. The
+// value is passed as request parameter Name. Pattern and Default are
+// required for the VALIDATION block of the layer.
+type Substitution struct {
+	Name    string
+	Pattern string
+	Default string
+}
+
+// substitutions of the MapServer tokens. The defaults of 0 select more
+// rows than required (e.g. !scale_denominator! < 50000 or
+// way_area > 10*!pixel_width!*!pixel_height!) for requests without the
+// parameters.
+var substitutions = []Substitution{
+	{"scale", `^[0-9.]+$`, "0"},
+	{"pixel_width", `^[0-9.]+$`, "0"},
+	{"pixel_height", `^[0-9.]+$`, "0"},
+}
+
+// Substitutions returns the MapServer runtime substitutions that are
+// used by query.
+func Substitutions(query string) []Substitution {
+	var result []Substitution
+	for _, s := range substitutions {
+		if strings.Contains(query, "%"+s.Name+"%") {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// TranslateTokens replaces all known tokens in query with the tokens of
+// the dialect (e.g. !bbox! with !BOX! and !scale_denominator! with
+// %scale% for MapServer). Tokens inside of string literals and quoted
+// identifiers are not replaced. It returns the translated query and all
+// tokens that are not supported by the dialect. Unsupported tokens are
+// not replaced.
+func TranslateTokens(query string, to Dialect) (string, []string) {
+	var unsupported []string
+	seen := make(map[string]struct{})
+	buf := strings.Builder{}
+	var quote byte
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		if quote != 0 {
+			// '' and "" are escaped quotes and toggle twice
+			if c == quote {
+				quote = 0
+			}
+			buf.WriteByte(c)
+			continue
+		}
+		if c == '\'' || c == '"' {
+			quote = c
+			buf.WriteByte(c)
+			continue
+		}
+		if c == '!' || c == '%' {
+			if tok, target, ok := matchToken(query[i:], to); ok {
+				if target == "" {
+					if _, ok := seen[tok]; !ok {
+						seen[tok] = struct{}{}
+						unsupported = append(unsupported, tok)
+					}
+					target = tok
+				}
+				buf.WriteString(target)
+				i += len(tok) - 1
+				continue
+			}
+		}
+		buf.WriteByte(c)
+	}
+	return buf.String(), unsupported
+}
+
+// matchToken returns the known token at the start of s and its
+// translation for the dialect.
+func matchToken(s string, to Dialect) (string, string, bool) {
+	for _, t := range tokens {
+		for _, tok := range []string{t.mapnik, t.mapserver} {
+			if tok == "" || !strings.HasPrefix(s, tok) {
+				continue
+			}
+			if to == MapServer {
+				return tok, t.mapserver, true
+			}
+			return tok, t.mapnik, true
+		}
+	}
+	return "", "", false
+}
@@ -0,0 +1,56 @@
+package sql
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTranslateTokens(t *testing.T) {
+	for _, tt := range []struct {
+		query       string
+		to          Dialect
+		expected    string
+		unsupported []string
+	}{
+		{"osm_roads", MapServer, "osm_roads", nil},
+		{
+			"(SELECT * FROM roads WHERE geometry && !bbox! AND a != b) as r", MapServer,
+			"(SELECT * FROM roads WHERE geometry && !BOX! AND a != b) as r", nil,
+		},
+		{
+			"(SELECT * FROM roads WHERE geometry && !bbox! AND !scale_denominator! < 5000) as r", MapServer,
+			"(SELECT * FROM roads WHERE geometry && !BOX! AND %scale% < 5000) as r", nil,
+		},
+		{
+			// unknown tokens, quoted tokens and identifiers are not replaced
+			"(SELECT ST_Simplify(geometry, !pixel_width!) AS \"!bbox!\" FROM roads WHERE !foo! AND name = 'it''s !bbox!' AND !pixel_height! > 0) as r", MapServer,
+			"(SELECT ST_Simplify(geometry, %pixel_width%) AS \"!bbox!\" FROM roads WHERE !foo! AND name = 'it''s !bbox!' AND %pixel_height% > 0) as r", nil,
+		},
+		{
+			"(SELECT * FROM roads WHERE geometry && !BOX! AND %scale% < 5000 AND name LIKE '%scale%') as r", Mapnik,
+			"(SELECT * FROM roads WHERE geometry && !bbox! AND !scale_denominator! < 5000 AND name LIKE '%scale%') as r", nil,
+		},
+		{
+			"(SELECT ST_Simplify(geometry, %pixel_width%) FROM roads) as r", Mapnik,
+			"(SELECT ST_Simplify(geometry, !pixel_width!) FROM roads) as r", nil,
+		},
+	} {
+		actual, unsupported := TranslateTokens(tt.query, tt.to)
+		if actual != tt.expected {
+			t.Errorf("%s\n!=\n%s", actual, tt.expected)
+		}
+		if !reflect.DeepEqual(unsupported, tt.unsupported) {
+			t.Errorf("unexpected unsupported tokens %v != %v", unsupported, tt.unsupported)
+		}
+	}
+}
+
+func TestSubstitutions(t *testing.T) {
+	subs := Substitutions("(SELECT * FROM roads WHERE %scale% < 5000 AND %pixel_height% > 0) as r")
+	if len(subs) != 2 || subs[0].Name != "scale" || subs[1].Name != "pixel_height" {
+		t.Errorf("unexpected substitutions %v", subs)
+	}
+	if subs := Substitutions("roads"); subs != nil {
+		t.Errorf("unexpected substitutions %v", subs)
+	}
+}
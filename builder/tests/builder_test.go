@@ -70,6 +70,11 @@ func build(t *testing.T, builderType string, mssFilename string, out io.Writer)
 
 	b := builder.New(m)
 	b.AddMSS(mssFilename)
+	// optional MML with the layers and datasources
+	mmlFilename := strings.TrimSuffix(mssFilename, filepath.Ext(mssFilename)) + ".layers.mml"
+	if _, err := os.Stat(mmlFilename); err == nil {
+		b.SetMML(mmlFilename)
+	}
 
 	if err := b.Build(); err != nil {
 		t.Fatal("error building style: ", err)
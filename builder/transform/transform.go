@@ -0,0 +1,321 @@
+// Package transform parses SVG transform lists as used by the *-transform
+// and *-geometry-transform properties.
+package transform
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Arg is a single argument of a transform function. It is either a number
+// or a reference to a feature attribute, e.g. [angle].
+type Arg struct {
+	Value float64
+	Field string
+}
+
+func (a Arg) String() string {
+	if a.Field != "" {
+		return "[" + a.Field + "]"
+	}
+	return strconv.FormatFloat(a.Value, 'f', -1, 64)
+}
+
+// Function is a single transform function, e.g. rotate(45, 0, 10).
+type Function struct {
+	Name string
+	Args []Arg
+}
+
+func (f Function) String() string {
+	args := make([]string, len(f.Args))
+	for i := range f.Args {
+		args[i] = f.Args[i].String()
+	}
+	return f.Name + "(" + strings.Join(args, ", ") + ")"
+}
+
+// hasFields returns whether any argument is an attribute reference.
+func (f Function) hasFields() bool {
+	for _, a := range f.Args {
+		if a.Field != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Transform is a list of transform functions. Functions are applied from
+// right to left, as in SVG.
+type Transform []Function
+
+func (t Transform) String() string {
+	parts := make([]string, len(t))
+	for i := range t {
+		parts[i] = t[i].String()
+	}
+	return strings.Join(parts, " ")
+}
+
+// HasFields returns whether any function depends on feature attributes.
+func (t Transform) HasFields() bool {
+	for _, f := range t {
+		if f.hasFields() {
+			return true
+		}
+	}
+	return false
+}
+
+// argCounts lists the valid number of arguments for each function.
+var argCounts = map[string][]int{
+	"matrix":    {6},
+	"translate": {1, 2},
+	"scale":     {1, 2},
+	"rotate":    {1, 3},
+	"skewX":     {1},
+	"skewY":     {1},
+}
+
+// Parse parses an SVG transform list, e.g. "translate(0, -10) rotate(45)".
+// Arguments can be separated by commas and/or whitespace.
+func Parse(s string) (Transform, error) {
+	p := parser{input: s}
+	var t Transform
+	for {
+		p.skipSeparators()
+		if p.eof() {
+			break
+		}
+		f, err := p.function()
+		if err != nil {
+			return nil, fmt.Errorf("invalid transform %q: %v", s, err)
+		}
+		t = append(t, f)
+	}
+	if len(t) == 0 {
+		return nil, fmt.Errorf("invalid transform %q: no transform functions", s)
+	}
+	return t, nil
+}
+
+type parser struct {
+	input string
+	pos   int
+}
+
+func (p *parser) eof() bool {
+	return p.pos >= len(p.input)
+}
+
+func (p *parser) peek() byte {
+	if p.eof() {
+		return 0
+	}
+	return p.input[p.pos]
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+func (p *parser) skipSpace() {
+	for !p.eof() && isSpace(p.peek()) {
+		p.pos++
+	}
+}
+
+func (p *parser) skipSeparators() {
+	for !p.eof() && (isSpace(p.peek()) || p.peek() == ',') {
+		p.pos++
+	}
+}
+
+func (p *parser) function() (Function, error) {
+	start := p.pos
+	for !p.eof() && (p.peek() >= 'a' && p.peek() <= 'z' || p.peek() >= 'A' && p.peek() <= 'Z') {
+		p.pos++
+	}
+	name := p.input[start:p.pos]
+	if name == "" {
+		return Function{}, fmt.Errorf("expected function name at %d", start)
+	}
+	counts, ok := argCounts[name]
+	if !ok {
+		return Function{}, fmt.Errorf("unknown function %q", name)
+	}
+	p.skipSpace()
+	if p.peek() != '(' {
+		return Function{}, fmt.Errorf("expected ( after %s", name)
+	}
+	p.pos++
+
+	f := Function{Name: name}
+	for {
+		p.skipSpace()
+		if p.peek() == ')' {
+			p.pos++
+			break
+		}
+		if len(f.Args) > 0 {
+			if p.peek() == ',' {
+				p.pos++
+				p.skipSpace()
+			}
+		}
+		if p.eof() {
+			return Function{}, fmt.Errorf("missing ) for %s", name)
+		}
+		arg, err := p.arg()
+		if err != nil {
+			return Function{}, fmt.Errorf("%s: %v", name, err)
+		}
+		f.Args = append(f.Args, arg)
+	}
+
+	for _, n := range counts {
+		if len(f.Args) == n {
+			return f, nil
+		}
+	}
+	return Function{}, fmt.Errorf("%s takes %s arguments, got %d", name, fmtCounts(counts), len(f.Args))
+}
+
+func fmtCounts(counts []int) string {
+	parts := make([]string, len(counts))
+	for i, c := range counts {
+		parts[i] = strconv.Itoa(c)
+	}
+	return strings.Join(parts, " or ")
+}
+
+func (p *parser) arg() (Arg, error) {
+	if p.peek() == '[' {
+		end := strings.IndexByte(p.input[p.pos:], ']')
+		if end < 0 {
+			return Arg{}, errors.New("unterminated attribute reference")
+		}
+		field := p.input[p.pos+1 : p.pos+end]
+		if field == "" {
+			return Arg{}, errors.New("empty attribute reference")
+		}
+		p.pos += end + 1
+		return Arg{Field: field}, nil
+	}
+
+	start := p.pos
+	for !p.eof() {
+		c := p.peek()
+		if c >= '0' && c <= '9' || c == '.' || c == '-' || c == '+' || c == 'e' || c == 'E' {
+			// sign is only allowed at the start or after the exponent
+			if (c == '-' || c == '+') && p.pos != start && p.input[p.pos-1] != 'e' && p.input[p.pos-1] != 'E' {
+				break
+			}
+			p.pos++
+			continue
+		}
+		break
+	}
+	if start == p.pos {
+		return Arg{}, fmt.Errorf("expected number at %d", start)
+	}
+	v, err := strconv.ParseFloat(p.input[start:p.pos], 64)
+	if err != nil {
+		return Arg{}, fmt.Errorf("invalid number %q", p.input[start:p.pos])
+	}
+	return Arg{Value: v}, nil
+}
+
+// Matrix is an affine transformation matrix in SVG order:
+//
+//	| A C E |
+//	| B D F |
+//	| 0 0 1 |
+type Matrix [6]float64
+
+// Identity is the identity matrix.
+var Identity = Matrix{1, 0, 0, 1, 0, 0}
+
+// Multiply returns m·o. The resulting matrix applies o first, then m.
+func (m Matrix) Multiply(o Matrix) Matrix {
+	return Matrix{
+		m[0]*o[0] + m[2]*o[1],
+		m[1]*o[0] + m[3]*o[1],
+		m[0]*o[2] + m[2]*o[3],
+		m[1]*o[2] + m[3]*o[3],
+		m[0]*o[4] + m[2]*o[5] + m[4],
+		m[1]*o[4] + m[3]*o[5] + m[5],
+	}
+}
+
+// Apply transforms the point x, y.
+func (m Matrix) Apply(x, y float64) (float64, float64) {
+	return m[0]*x + m[2]*y + m[4], m[1]*x + m[3]*y + m[5]
+}
+
+// Translation returns the translation part of the matrix.
+func (m Matrix) Translation() (float64, float64) {
+	return m[4], m[5]
+}
+
+func rotation(deg float64) Matrix {
+	rad := deg * math.Pi / 180
+	sin, cos := math.Sincos(rad)
+	return Matrix{cos, sin, -sin, cos, 0, 0}
+}
+
+// Matrix returns the affine matrix of this function.
+// Returns an error if the function depends on feature attributes.
+func (f Function) Matrix() (Matrix, error) {
+	if f.hasFields() {
+		return Identity, fmt.Errorf("%s depends on feature attributes", f)
+	}
+	a := make([]float64, len(f.Args))
+	for i := range f.Args {
+		a[i] = f.Args[i].Value
+	}
+	switch f.Name {
+	case "matrix":
+		return Matrix{a[0], a[1], a[2], a[3], a[4], a[5]}, nil
+	case "translate":
+		if len(a) == 1 {
+			return Matrix{1, 0, 0, 1, a[0], 0}, nil
+		}
+		return Matrix{1, 0, 0, 1, a[0], a[1]}, nil
+	case "scale":
+		if len(a) == 1 {
+			return Matrix{a[0], 0, 0, a[0], 0, 0}, nil
+		}
+		return Matrix{a[0], 0, 0, a[1], 0, 0}, nil
+	case "rotate":
+		r := rotation(a[0])
+		if len(a) == 3 {
+			// rotate around cx, cy: translate(cx, cy) rotate(a) translate(-cx, -cy)
+			r = Matrix{1, 0, 0, 1, a[1], a[2]}.Multiply(r).Multiply(Matrix{1, 0, 0, 1, -a[1], -a[2]})
+		}
+		return r, nil
+	case "skewX":
+		return Matrix{1, 0, math.Tan(a[0] * math.Pi / 180), 1, 0, 0}, nil
+	case "skewY":
+		return Matrix{1, math.Tan(a[0] * math.Pi / 180), 0, 1, 0, 0}, nil
+	default:
+		return Identity, fmt.Errorf("unknown function %q", f.Name)
+	}
+}
+
+// Matrix returns the combined affine matrix of all functions.
+// Returns an error if any function depends on feature attributes.
+func (t Transform) Matrix() (Matrix, error) {
+	m := Identity
+	for _, f := range t {
+		fm, err := f.Matrix()
+		if err != nil {
+			return Identity, err
+		}
+		m = m.Multiply(fm)
+	}
+	return m, nil
+}
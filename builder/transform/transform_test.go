@@ -0,0 +1,90 @@
+package transform
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	for _, tt := range []struct {
+		input    string
+		expected string
+	}{
+		{"rotate(45)", "rotate(45)"},
+		{"rotate(45, 0, 10)", "rotate(45, 0, 10)"},
+		{"rotate(45 0 10)", "rotate(45, 0, 10)"},
+		{"scale(0.8) rotate(180)", "scale(0.8) rotate(180)"},
+		{"translate(0.000, -10.000) scale(1.000) rotate(45.000, 0.000, 10.000)", "translate(0, -10) scale(1) rotate(45, 0, 10)"},
+		{"translate(10),scale(2 3)", "translate(10) scale(2, 3)"},
+		{"matrix(1,0,0,1,-5,5e1)", "matrix(1, 0, 0, 1, -5, 50)"},
+		{"  skewX( 30 ) skewY(-.5)  ", "skewX(30) skewY(-0.5)"},
+		{"rotate([angle])", "rotate([angle])"},
+		{"translate(1-2)", "translate(1, -2)"},
+	} {
+		tr, err := Parse(tt.input)
+		if err != nil {
+			t.Errorf("unexpected error for %q: %v", tt.input, err)
+			continue
+		}
+		assert.Equal(t, tt.expected, tr.String(), tt.input)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, input := range []string{
+		"",
+		"foo(1)",
+		"rotate(1, 2)",
+		"matrix(1, 2, 3)",
+		"scale()",
+		"scale(1",
+		"scale 1",
+		"rotate(a)",
+		"rotate([angle)",
+		"translate(1..2)",
+		"(1)",
+	} {
+		if _, err := Parse(input); err == nil {
+			t.Errorf("expected error for %q", input)
+		}
+	}
+}
+
+func assertMatrix(t *testing.T, expected, actual Matrix) {
+	t.Helper()
+	for i := range expected {
+		if math.Abs(expected[i]-actual[i]) > 1e-9 {
+			t.Errorf("%v != %v", expected, actual)
+			return
+		}
+	}
+}
+
+func TestMatrix(t *testing.T) {
+	tr, _ := Parse("translate(10, 20) scale(2)")
+	m, err := tr.Matrix()
+	assert.NoError(t, err)
+	assertMatrix(t, Matrix{2, 0, 0, 2, 10, 20}, m)
+	x, y := m.Apply(1, 1)
+	assert.Equal(t, 12.0, x)
+	assert.Equal(t, 22.0, y)
+
+	// rotation center stays in place
+	tr, _ = Parse("rotate(90, 5, 5)")
+	m, err = tr.Matrix()
+	assert.NoError(t, err)
+	x, y = m.Apply(5, 5)
+	assert.InDelta(t, 5.0, x, 1e-9)
+	assert.InDelta(t, 5.0, y, 1e-9)
+	// rotates clockwise with y-axis pointing down
+	x, y = m.Apply(10, 5)
+	assert.InDelta(t, 5.0, x, 1e-9)
+	assert.InDelta(t, 10.0, y, 1e-9)
+
+	tr, _ = Parse("rotate([angle])")
+	_, err = tr.Matrix()
+	assert.Error(t, err)
+	assert.True(t, tr.HasFields())
+}
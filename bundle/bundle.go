@@ -0,0 +1,244 @@
+// Package bundle creates self-contained archives of styles with all
+// referenced fonts, images and data files.
+package bundle
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/omniscale/magnacarto/config"
+)
+
+// Directories of the files in the bundle.
+const (
+	FontDir   = "fonts"
+	ImageDir  = "images"
+	ShapeDir  = "shapes"
+	SQLiteDir = "sqlite"
+	DataDir   = "data"
+)
+
+// ManifestName is the name of the manifest in the bundle.
+const ManifestName = "manifest.json"
+
+// shapefileExts are the extensions of all files that belong to a shapefile.
+var shapefileExts = []string{".shp", ".shx", ".dbf", ".prj", ".cpg", ".qix", ".sbn", ".sbx", ".index"}
+
+// Locator wraps a config.Locator and records all located files. It
+// returns the path of each file in the bundle, relative to the style.
+type Locator struct {
+	config.Locator
+	files map[string]string // source -> path in bundle
+	paths map[string]string // path in bundle -> source
+}
+
+// NewLocator returns a Locator that looks up files with l.
+func NewLocator(l config.Locator) *Locator {
+	// absolute paths are required to copy the files
+	l.UseRelPaths(false)
+	return &Locator{
+		Locator: l,
+		files:   make(map[string]string),
+		paths:   make(map[string]string),
+	}
+}
+
+// UseRelPaths is a no-op, paths are always relative to the style.
+func (l *Locator) UseRelPaths(bool) {}
+
+func (l *Locator) Font(name string) string {
+	return l.add(l.Locator.Font(name), FontDir)
+}
+
+func (l *Locator) SQLite(name string) string {
+	return l.add(l.Locator.SQLite(name), SQLiteDir)
+}
+
+func (l *Locator) Shape(name string) string {
+	return l.add(l.Locator.Shape(name), ShapeDir)
+}
+
+func (l *Locator) Image(name string) string {
+	return l.add(l.Locator.Image(name), ImageDir)
+}
+
+func (l *Locator) Data(name string) string {
+	return l.add(l.Locator.Data(name), DataDir)
+}
+
+var _ config.Locator = &Locator{}
+
+// add registers the located file src and returns its path in dir of the
+// bundle. Files that were not found are returned unchanged.
+func (l *Locator) add(src, dir string) string {
+	if src == "" {
+		return src
+	}
+	if _, err := os.Stat(src); err != nil {
+		// missing file, reported by MissingFiles
+		return src
+	}
+	if p, ok := l.files[src]; ok {
+		return p
+	}
+
+	ext := filepath.Ext(src)
+	stem := strings.TrimSuffix(filepath.Base(src), ext)
+	p := path.Join(dir, stem+ext)
+	for i := 2; ; i++ {
+		if _, ok := l.paths[p]; !ok {
+			break
+		}
+		p = path.Join(dir, stem+"-"+strconv.Itoa(i)+ext)
+	}
+	l.files[src] = p
+	l.paths[p] = src
+
+	if strings.ToLower(ext) == ".shp" {
+		base := strings.TrimSuffix(src, ext)
+		pBase := strings.TrimSuffix(p, ext)
+		for _, e := range shapefileExts[1:] {
+			for _, e := range []string{e, strings.ToUpper(e)} {
+				if _, err := os.Stat(base + e); err == nil {
+					l.files[base+e] = pBase + e
+					l.paths[pBase+e] = base + e
+				}
+			}
+		}
+	}
+	return p
+}
+
+// Files returns the sources of all located files, mapped to their paths
+// in the bundle.
+func (l *Locator) Files() map[string]string {
+	return l.files
+}
+
+// Manifest lists all files of a bundle.
+type Manifest struct {
+	Style string         `json:"style"`
+	Files []ManifestFile `json:"files"`
+}
+
+// ManifestFile is a single file of a bundle.
+type ManifestFile struct {
+	Path   string `json:"path"`
+	Source string `json:"source,omitempty"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// WriteArchive writes a tar.gz archive with all files of styleDir, all
+// located files and a manifest with the checksums of all files. style is
+// the name of the main style file in styleDir.
+func (l *Locator) WriteArchive(w io.Writer, styleDir, style string) error {
+	type entry struct {
+		path, src string
+		located   bool
+	}
+	var entries []entry
+
+	styleFiles, err := filepath.Glob(filepath.Join(styleDir, "*"))
+	if err != nil {
+		return err
+	}
+	for _, f := range styleFiles {
+		entries = append(entries, entry{path: filepath.Base(f), src: f})
+	}
+	var located []string
+	for p := range l.paths {
+		located = append(located, p)
+	}
+	sort.Strings(located)
+	for _, p := range located {
+		err := filepath.Walk(l.paths[p], func(src string, fi os.FileInfo, err error) error {
+			if err != nil || fi.IsDir() {
+				return err
+			}
+			rel, err := filepath.Rel(l.paths[p], src)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, entry{path: path.Join(p, filepath.ToSlash(rel)), src: src, located: true})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	manifest := Manifest{Style: style}
+	for _, e := range entries {
+		mf, err := addFile(tw, e.path, e.src)
+		if err != nil {
+			return err
+		}
+		if e.located {
+			mf.Source = e.src
+		}
+		manifest.Files = append(manifest.Files, mf)
+	}
+
+	buf, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	buf = append(buf, '\n')
+	if err := tw.WriteHeader(&tar.Header{Name: ManifestName, Mode: 0644, Size: int64(len(buf))}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(buf); err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// addFile copies src as name into the archive.
+func addFile(tw *tar.Writer, name, src string) (ManifestFile, error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return ManifestFile{}, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return ManifestFile{}, err
+	}
+
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return ManifestFile{}, err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tw, h), f); err != nil {
+		return ManifestFile{}, err
+	}
+	return ManifestFile{
+		Path:   name,
+		Size:   fi.Size(),
+		SHA256: hex.EncodeToString(h.Sum(nil)),
+	}, nil
+}
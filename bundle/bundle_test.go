@@ -0,0 +1,130 @@
+package bundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/omniscale/magnacarto/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeFiles(t *testing.T, dir string, names ...string) {
+	for _, name := range names {
+		fname := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fname, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLocator(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "magnacarto-bundle-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	writeFiles(t, tmp,
+		"a/marker.svg", "b/marker.svg",
+		"shapes/roads.shp", "shapes/roads.shx", "shapes/roads.dbf", "shapes/roads.prj",
+		"fonts/DejaVuSans.ttf",
+	)
+
+	inner := &config.LookupLocator{}
+	inner.AddImageDir(filepath.Join(tmp, "a"))
+	inner.AddShapeDir(filepath.Join(tmp, "shapes"))
+	inner.AddFontDir(filepath.Join(tmp, "fonts"))
+	inner.SetBaseDir(tmp)
+	l := NewLocator(inner)
+	l.UseRelPaths(false)
+
+	assert.Equal(t, "images/marker.svg", l.Image("marker.svg"))
+	assert.Equal(t, "images/marker.svg", l.Image("marker.svg"))
+	assert.Equal(t, "images/marker-2.svg", l.Image(filepath.Join(tmp, "b/marker.svg")))
+	assert.Equal(t, "shapes/roads.shp", l.Shape("roads.shp"))
+	assert.Equal(t, "fonts/DejaVuSans.ttf", l.Font("DejaVu Sans"))
+	assert.Nil(t, l.MissingFiles())
+
+	assert.Equal(t, map[string]string{
+		filepath.Join(tmp, "a/marker.svg"):         "images/marker.svg",
+		filepath.Join(tmp, "b/marker.svg"):         "images/marker-2.svg",
+		filepath.Join(tmp, "shapes/roads.shp"):     "shapes/roads.shp",
+		filepath.Join(tmp, "shapes/roads.shx"):     "shapes/roads.shx",
+		filepath.Join(tmp, "shapes/roads.dbf"):     "shapes/roads.dbf",
+		filepath.Join(tmp, "shapes/roads.prj"):     "shapes/roads.prj",
+		filepath.Join(tmp, "fonts/DejaVuSans.ttf"): "fonts/DejaVuSans.ttf",
+	}, l.Files())
+
+	l.Image("missing.png")
+	assert.Equal(t, []string{"missing.png"}, l.MissingFiles())
+}
+
+func TestWriteArchive(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "magnacarto-bundle-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	writeFiles(t, tmp, "style/style.map", "style/style.map-fonts.lst", "data/marker.svg")
+
+	inner := &config.LookupLocator{}
+	inner.SetBaseDir(filepath.Join(tmp, "data"))
+	l := NewLocator(inner)
+	l.Image("marker.svg")
+
+	buf := bytes.Buffer{}
+	if err := l.WriteArchive(&buf, filepath.Join(tmp, "style"), "style.map"); err != nil {
+		t.Fatal(err)
+	}
+
+	gz, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	contents := make(map[string]string)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents[hdr.Name] = string(b)
+	}
+
+	assert.Equal(t, "style/style.map", contents["style.map"])
+	assert.Equal(t, "style/style.map-fonts.lst", contents["style.map-fonts.lst"])
+	assert.Equal(t, "data/marker.svg", contents["images/marker.svg"])
+
+	var manifest Manifest
+	if err := json.Unmarshal([]byte(contents[ManifestName]), &manifest); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "style.map", manifest.Style)
+	assert.Len(t, manifest.Files, 3)
+	for _, f := range manifest.Files {
+		if f.Path == "images/marker.svg" {
+			assert.Equal(t, filepath.Join(tmp, "data/marker.svg"), f.Source)
+			assert.Equal(t, int64(len("data/marker.svg")), f.Size)
+			// sha256 of "data/marker.svg"
+			assert.Equal(t, "53f5556907fd0541485bb2b6a5fe4bf9a1cdee95d49a5790d17eeaa2f9c42a56", f.SHA256)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/omniscale/magnacarto/builder"
+	"github.com/omniscale/magnacarto/builder/mapnik"
+	"github.com/omniscale/magnacarto/builder/mapserver"
+	"github.com/omniscale/magnacarto/bundle"
+	"github.com/omniscale/magnacarto/config"
+)
+
+// bundleStyle builds a style and writes it with all referenced fonts,
+// images and data files into a tar.gz archive.
+func bundleStyle(args []string) {
+	flags := flag.NewFlagSet("bundle", flag.ExitOnError)
+	mmlFile := flags.String("mml", "", "mml file")
+	var mssFilenames files
+	flags.Var(&mssFilenames, "mss", "mss file")
+	confFile := flags.String("config", "", "config")
+	builderType := flags.String("builder", "mapnik3", "builder type {mapnik3,mapnik3-proj4,mapserver}")
+	outFile := flags.String("o", "", "out file (.tar.gz)")
+	flags.Parse(args)
+
+	if *outFile == "" {
+		log.Fatal("bundle requires -o")
+	}
+
+	conf := config.Magnacarto{}
+	if *confFile != "" {
+		if err := conf.Load(*confFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	// The bundle locator does not use the relative paths of the config
+	// locator. Files are copied into the directories of the bundle and
+	// all paths are relative to the style in the archive.
+	locator := bundle.NewLocator(conf.Locator())
+	if *mmlFile != "" {
+		locator.SetBaseDir(filepath.Dir(*mmlFile))
+	}
+
+	// exit after writeBundle to remove all temporary files
+	if err := writeBundle(locator, *builderType, *mmlFile, mssFilenames, *outFile); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func writeBundle(locator *bundle.Locator, builderType, mmlFile string, mssFilenames []string, outFile string) error {
+	var m builder.MapWriter
+	style := "style.xml"
+	switch builderType {
+	case "mapserver":
+		m = mapserver.New(locator)
+		style = "style.map"
+	case "mapnik3":
+		m = mapnik.New(locator)
+	case "mapnik3-proj4":
+		mm := mapnik.New(locator)
+		mm.SetProj4(true)
+		m = mm
+	default:
+		return fmt.Errorf("unknown -builder %s", builderType)
+	}
+
+	b := builder.New(m)
+	b.SetMML(mmlFile)
+	for _, mss := range mssFilenames {
+		b.AddMSS(mss)
+	}
+	if err := b.Build(); err != nil {
+		return fmt.Errorf("error building style: %v", err)
+	}
+	for _, w := range b.Warnings() {
+		log.Println("warning:", w)
+	}
+	if unsupported := m.UnsupportedFeatures(); unsupported != nil {
+		return fmt.Errorf("not all features supported by -builder %s: %v", builderType, unsupported)
+	}
+
+	if mm, ok := m.(*mapnik.Map); ok && locateFonts(mm, locator) {
+		mm.SetFontDirectory(bundle.FontDir)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "magnacarto-bundle")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// MapServer looks up fonts while writing the fontset
+	if err := m.WriteFiles(filepath.Join(tmpDir, style)); err != nil {
+		return fmt.Errorf("error writing style: %v", err)
+	}
+
+	if mf := locator.MissingFiles(); mf != nil {
+		for _, f := range mf {
+			log.Println("File not found:", f)
+		}
+		return fmt.Errorf("%d files not found", len(mf))
+	}
+
+	f, err := os.Create(outFile)
+	if err != nil {
+		return err
+	}
+	if err := locator.WriteArchive(f, tmpDir, style); err != nil {
+		f.Close()
+		os.Remove(outFile)
+		return fmt.Errorf("error writing bundle: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(outFile)
+		return err
+	}
+	return nil
+}
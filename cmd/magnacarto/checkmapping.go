@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/omniscale/magnacarto/builder"
+	"github.com/omniscale/magnacarto/imposm"
+)
+
+// checkMapping compares the PostGIS layers and filters of a style with an
+// imposm3 mapping.
+func checkMapping(args []string) {
+	flags := flag.NewFlagSet("check-mapping", flag.ExitOnError)
+	mmlFile := flags.String("mml", "", "mml file")
+	var mssFilenames files
+	flags.Var(&mssFilenames, "mss", "mss file")
+	mappingFile := flags.String("mapping", "", "imposm3 mapping file")
+	tablePrefix := flags.String("table-prefix", imposm.DefaultTablePrefix, "prefix of all imposm3 tables")
+	flags.Parse(args)
+
+	if *mmlFile == "" || *mappingFile == "" {
+		log.Fatal("check-mapping requires -mml and -mapping")
+	}
+
+	f, err := os.Open(*mappingFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	mapping, err := imposm.ParseMapping(f)
+	f.Close()
+	if err != nil {
+		log.Fatal("error parsing mapping: ", err)
+	}
+
+	c := &builder.Collector{}
+	b := builder.New(c)
+	b.SetMML(*mmlFile)
+	for _, mss := range mssFilenames {
+		b.AddMSS(mss)
+	}
+	if err := b.Build(); err != nil {
+		log.Fatal("error building style: ", err)
+	}
+
+	warnings := imposm.Check(mapping, *tablePrefix, c.Layers)
+	for _, w := range warnings {
+		fmt.Println(w)
+	}
+	if len(warnings) > 0 {
+		os.Exit(1)
+	}
+}
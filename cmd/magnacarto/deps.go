@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/omniscale/magnacarto/builder"
+	"github.com/omniscale/magnacarto/builder/mapnik"
+	"github.com/omniscale/magnacarto/config"
+)
+
+// dependencies returns all input files of the last build: the MML, all
+// MSS files and all files found by the locator.
+func dependencies(b *builder.Builder, locator config.Locator) []string {
+	var located []string
+	if l, ok := locator.(config.LocatedFilesLocator); ok {
+		located = l.LocatedFiles()
+	}
+	var deps []string
+	seen := make(map[string]struct{})
+	for _, files := range [][]string{b.InputFiles(), located} {
+		for _, f := range files {
+			if _, ok := seen[f]; ok {
+				continue
+			}
+			seen[f] = struct{}{}
+			deps = append(deps, f)
+		}
+	}
+	return deps
+}
+
+// missingNames returns the names of all missing files, or the missing
+// paths if the locator does not report names.
+func missingNames(locator config.Locator) []string {
+	if l, ok := locator.(config.MissingNamesLocator); ok {
+		return l.MissingNames()
+	}
+	return locator.MissingFiles()
+}
+
+// locateFonts looks up all fonts of Mapnik maps with the locator. Mapnik
+// itself looks up fonts by face name in the font-directory. MapServer maps
+// look up fonts while writing the fontset. Returns whether the map
+// uses any fonts.
+func locateFonts(m builder.MapWriter, locator config.Locator) bool {
+	mm, ok := m.(*mapnik.Map)
+	if !ok {
+		return false
+	}
+	faces := mm.FontFaces()
+	for _, face := range faces {
+		locator.Font(face)
+	}
+	return len(faces) > 0
+}
+
+// writeDeps writes all dependencies, one per line. Missing files are
+// marked with (missing).
+func writeDeps(w io.Writer, deps, missing []string) error {
+	for _, d := range deps {
+		if _, err := fmt.Fprintln(w, d); err != nil {
+			return err
+		}
+	}
+	for _, m := range missing {
+		if _, err := fmt.Fprintln(w, m, "(missing)"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createDepfile writes the depfile for target to fname.
+func createDepfile(fname, target string, deps []string) {
+	f, err := os.Create(fname)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := writeDepfile(f, target, deps); err != nil {
+		log.Fatal("error writing depfile: ", err)
+	}
+	if err := f.Close(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// writeDepfile writes a Make/Ninja compatible depfile with a single rule
+// for target.
+func writeDepfile(w io.Writer, target string, deps []string) error {
+	line := escapeDepfile(target) + ":"
+	for _, d := range deps {
+		line += " \\\n  " + escapeDepfile(d)
+	}
+	_, err := fmt.Fprintln(w, line)
+	return err
+}
+
+var depfileEscaper = strings.NewReplacer(" ", `\ `, "#", `\#`, "$", "$$")
+
+func escapeDepfile(fname string) string {
+	return depfileEscaper.Replace(fname)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/omniscale/magnacarto/builder"
+	"github.com/omniscale/magnacarto/mss"
+)
+
+type fieldUsage struct {
+	Field     string   `json:"field"`
+	Positions []string `json:"positions"`
+}
+
+type layerFields struct {
+	Layer  string       `json:"layer"`
+	Zoom   int          `json:"zoom"`
+	Fields []fieldUsage `json:"fields"`
+}
+
+// fields reports all fields used by each layer and zoom level.
+func fields(args []string) {
+	flags := flag.NewFlagSet("fields", flag.ExitOnError)
+	mmlFile := flags.String("mml", "", "mml file")
+	var mssFilenames files
+	flags.Var(&mssFilenames, "mss", "mss file")
+	format := flags.String("format", "json", "output format {json,csv}")
+	minZoom := flags.Int("minzoom", 0, "first zoom level")
+	maxZoom := flags.Int("maxzoom", 22, "last zoom level")
+	flags.Parse(args)
+
+	if *format != "json" && *format != "csv" {
+		log.Fatal("unknown -format ", *format)
+	}
+
+	c := &builder.Collector{}
+	b := builder.New(c)
+	b.SetMML(*mmlFile)
+	for _, mss := range mssFilenames {
+		b.AddMSS(mss)
+	}
+	if err := b.Build(); err != nil {
+		log.Fatal("error building style: ", err)
+	}
+
+	report := fieldReport(b.MSS(), c.Layers, *minZoom, *maxZoom)
+
+	var err error
+	if *format == "csv" {
+		err = writeFieldsCSV(os.Stdout, report)
+	} else {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// fieldReport returns the fields of all rules that are active for each
+// layer and zoom level. Layers and zoom levels without any fields are
+// omitted.
+func fieldReport(style *mss.MSS, layers []builder.LayerRules, minZoom, maxZoom int) []layerFields {
+	report := []layerFields{}
+	for _, l := range layers {
+		for z := minZoom; z <= maxZoom; z++ {
+			positions := make(map[string]map[mss.Position]struct{})
+			add := func(field string, pos mss.Position) {
+				if strings.Contains(field, "::") {
+					// mapnik::geometry_type, etc.
+					return
+				}
+				if positions[field] == nil {
+					positions[field] = make(map[mss.Position]struct{})
+				}
+				positions[field][pos] = struct{}{}
+			}
+			for _, r := range l.Rules {
+				if !r.Zoom.ValidFor(z) {
+					continue
+				}
+				for _, f := range r.Filters {
+					for _, pos := range style.FilterPositions(l.Layer.ID, f, l.Layer.Classes...) {
+						add(f.Field, pos)
+					}
+				}
+				if r.Properties != nil {
+					for _, ref := range r.Properties.FieldRefs() {
+						add(ref.Field, ref.Pos)
+					}
+				}
+			}
+			if len(positions) == 0 {
+				continue
+			}
+
+			lf := layerFields{Layer: l.Layer.ID, Zoom: z}
+			for field, pos := range positions {
+				sorted := make([]mss.Position, 0, len(pos))
+				for p := range pos {
+					sorted = append(sorted, p)
+				}
+				sort.Slice(sorted, func(i, j int) bool { return sorted[i].Less(sorted[j]) })
+				fu := fieldUsage{Field: field}
+				for _, p := range sorted {
+					fu.Positions = append(fu.Positions, p.String())
+				}
+				lf.Fields = append(lf.Fields, fu)
+			}
+			sort.Slice(lf.Fields, func(i, j int) bool { return lf.Fields[i].Field < lf.Fields[j].Field })
+			report = append(report, lf)
+		}
+	}
+	return report
+}
+
+// writeFieldsCSV writes one row for each reference of a field.
+func writeFieldsCSV(w io.Writer, report []layerFields) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"layer", "zoom", "field", "position"})
+	for _, lf := range report {
+		for _, f := range lf.Fields {
+			for _, pos := range f.Positions {
+				cw.Write([]string{lf.Layer, strconv.Itoa(lf.Zoom), f.Field, pos})
+			}
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/omniscale/magnacarto/builder"
+	"github.com/omniscale/magnacarto/builder/mapnik"
+	"github.com/omniscale/magnacarto/builder/mapserver"
+	nativeBuilder "github.com/omniscale/magnacarto/builder/native"
+	"github.com/omniscale/magnacarto/config"
+	"github.com/omniscale/magnacarto/legend"
+	"github.com/omniscale/magnacarto/render"
+	"github.com/omniscale/magnacarto/render/native"
+)
+
+// legendCmd writes the legend of a style as PNG, JSON or HTML.
+func legendCmd(args []string) {
+	flags := flag.NewFlagSet("legend", flag.ExitOnError)
+	mmlFile := flags.String("mml", "", "mml file")
+	confFile := flags.String("config", "", "config")
+	zoom := flags.Int("zoom", -1, "zoom level (default zoom of the mml center)")
+	layers := flags.String("layers", "", "comma separated list of layers (default all layers)")
+	format := flags.String("format", "png", "output format {png,json,html}")
+	builderType := flags.String("builder", "mapnik3", "builder type {mapnik3,mapnik3-proj4,mapserver,native}")
+	scaleFactor := flags.Float64("scale-factor", 1, "scale factor for high-resolution legends")
+	outFile := flags.String("o", "", "out file (default stdout)")
+	flags.Parse(args)
+
+	if *mmlFile == "" {
+		log.Fatal("legend requires -mml")
+	}
+	if *format != "png" && *format != "json" && *format != "html" {
+		log.Fatal("unknown -format ", *format)
+	}
+
+	conf := config.Magnacarto{}
+	if *confFile != "" {
+		if err := conf.Load(*confFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	locator := conf.Locator()
+	locator.SetBaseDir(filepath.Dir(*mmlFile))
+	locator.UseRelPaths(false)
+
+	var maker builder.MapMaker
+	var renderFunc legend.RenderFunc
+	switch *builderType {
+	case "mapserver":
+		maker = mapserver.Maker
+		r, err := render.NewMapServer()
+		if err != nil {
+			log.Fatal("MapServer plugin: ", err)
+		}
+		renderFunc = func(styleFile string, req render.Request, w io.Writer) error {
+			req.Format = "image/png; mode=24bit"
+			_, err := r.Render(styleFile, w, req)
+			return err
+		}
+	case "mapnik3", "mapnik3-proj4":
+		maker = mapnik.Maker3
+		if *builderType == "mapnik3-proj4" {
+			maker = mapnik.Maker3Proj4
+		}
+		r, err := render.NewMapnik()
+		if err != nil {
+			log.Fatal("Mapnik plugin: ", err)
+		}
+		defer r.Close()
+		for _, fontDir := range conf.Mapnik.FontDirs {
+			r.RegisterFonts(fontDir)
+		}
+		renderFunc = func(styleFile string, req render.Request, w io.Writer) error {
+			req.Format = "png32"
+			return r.Render(styleFile, w, req)
+		}
+	case "native":
+		maker = nativeBuilder.Maker
+		r := native.New()
+		renderFunc = func(styleFile string, req render.Request, w io.Writer) error {
+			req.Format = "image/png"
+			_, err := r.Render(styleFile, w, req)
+			return err
+		}
+	default:
+		log.Fatal("unknown -builder ", *builderType)
+	}
+
+	var layerIDs []string
+	if *layers != "" {
+		layerIDs = strings.Split(*layers, ",")
+	}
+	l, err := legend.Load(*mmlFile, *zoom, layerIDs)
+	if err != nil {
+		log.Fatal("error loading legend: ", err)
+	}
+
+	out := os.Stdout
+	if *outFile != "" {
+		out, err = os.Create(*outFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	opts := legend.Options{ScaleFactor: *scaleFactor}
+	if *format == "png" {
+		var data []byte
+		if data, err = l.Image(maker, locator, opts, renderFunc); err == nil {
+			_, err = out.Write(data)
+		}
+	} else if err = l.RenderSwatches(maker, locator, opts, renderFunc); err == nil {
+		if *format == "html" {
+			err = l.WriteHTML(out)
+		} else {
+			err = l.WriteJSON(out)
+		}
+	}
+	if err == nil && out != os.Stdout {
+		err = out.Close()
+	}
+	if err != nil {
+		log.Fatal("error writing legend: ", err)
+	}
+}
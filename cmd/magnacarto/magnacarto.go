@@ -4,6 +4,7 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
@@ -13,6 +14,7 @@ import (
 	"github.com/omniscale/magnacarto/builder"
 	"github.com/omniscale/magnacarto/builder/mapnik"
 	"github.com/omniscale/magnacarto/builder/mapserver"
+	"github.com/omniscale/magnacarto/builder/native"
 	"github.com/omniscale/magnacarto/config"
 )
 
@@ -28,6 +30,29 @@ func (f *files) Set(value string) error {
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "check-mapping":
+			checkMapping(os.Args[2:])
+			return
+		case "fields":
+			fields(os.Args[2:])
+			return
+		case "bundle":
+			bundleStyle(os.Args[2:])
+			return
+		case "legend":
+			legendCmd(os.Args[2:])
+			return
+		case "render":
+			renderCmd(os.Args[2:])
+			return
+		case "visual-diff":
+			visualDiffCmd(os.Args[2:])
+			return
+		}
+	}
+
 	mmlFile := flag.String("mml", "", "mml file")
 	var mssFilenames files
 
@@ -39,14 +64,17 @@ func main() {
 	fontDir := flag.String("font-dir", "", "fonts directory")
 	dataDir := flag.String("data-dir", "", "data directory for OGR/GDAL files, also fallback for sqlite/shape/image/font-dir")
 	dumpRules := flag.Bool("dumprules", false, "print calculated rules to stderr")
-	builderType := flag.String("builder", "mapnik3", "builder type {mapnik3,mapnik3-proj4,mapserver}")
+	builderType := flag.String("builder", "mapnik3", "builder type {mapnik3,mapnik3-proj4,mapserver,native}")
 	outFile := flag.String("out", "", "out file")
 	relPaths := flag.Bool("relpaths", false, "use relative paths in output style")
 	version := flag.Bool("version", false, "print version and exit")
+	listDeps := flag.Bool("deps", false, "list all input files and exit")
+	depFile := flag.String("M", "", "write Make/Ninja depfile for -out")
 
 	cpuprofile := flag.String("cpuprofile", "", "write cpu profile to file")
 
 	msNoMapBlock := flag.Bool("ms-no-map-block", false, "hide MAP block, only output layers/symbols for INCLUDE")
+	msVersion := flag.Int("ms-version", mapserver.DefaultVersion, "major version of the target MapServer")
 
 	flag.Parse()
 
@@ -64,6 +92,10 @@ func main() {
 		os.Exit(0)
 	}
 
+	if *depFile != "" && (*outFile == "" || *outFile == "-") {
+		log.Fatal("-M requires -out")
+	}
+
 	conf := config.Magnacarto{}
 	if *confFile != "" {
 		if err := conf.Load(*confFile); err != nil {
@@ -110,6 +142,7 @@ func main() {
 	case "mapserver":
 		mm := mapserver.New(locator)
 		mm.SetNoMapBlock(*msNoMapBlock)
+		mm.SetVersion(*msVersion)
 		m = mm
 	case "mapnik3":
 		m = mapnik.New(locator)
@@ -117,6 +150,8 @@ func main() {
 		mm := mapnik.New(locator)
 		mm.SetProj4(true)
 		m = mm
+	case "native":
+		m = native.New(locator)
 	default:
 		log.Fatal("unknown -builder ", *builderType)
 	}
@@ -133,11 +168,38 @@ func main() {
 	if err := b.Build(); err != nil {
 		log.Fatal("error building style: ", err)
 	}
+	for _, w := range b.Warnings() {
+		log.Println("warning:", w)
+	}
 
 	if unsupported := m.UnsupportedFeatures(); unsupported != nil {
 		log.Fatalf("not all features supported by -builder %s: %v", *builderType, unsupported)
 	}
 
+	if *listDeps || *depFile != "" {
+		locateFonts(m, locator)
+	}
+
+	if *listDeps {
+		// write to temp dir to locate all files (e.g. MapServer fonts)
+		tmpDir, err := ioutil.TempDir("", "magnacarto-deps")
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = m.WriteFiles(filepath.Join(tmpDir, "style"))
+		os.RemoveAll(tmpDir)
+		if err != nil {
+			log.Fatal("error writing style: ", err)
+		}
+		if err := writeDeps(os.Stdout, dependencies(b, locator), missingNames(locator)); err != nil {
+			log.Fatal(err)
+		}
+		if *depFile != "" {
+			createDepfile(*depFile, *outFile, dependencies(b, locator))
+		}
+		return
+	}
+
 	if *outFile == "" || *outFile == "-" {
 		if err := m.Write(os.Stdout); err != nil {
 			log.Fatal("error writing style to stdout: ", err)
@@ -148,6 +210,10 @@ func main() {
 		}
 	}
 
+	if *depFile != "" {
+		createDepfile(*depFile, *outFile, dependencies(b, locator))
+	}
+
 	if mf := locator.MissingFiles(); mf != nil {
 		for _, f := range mf {
 			log.Println("File not found:", f)
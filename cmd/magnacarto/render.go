@@ -0,0 +1,519 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/omniscale/magnacarto/builder"
+	"github.com/omniscale/magnacarto/builder/mapnik"
+	"github.com/omniscale/magnacarto/builder/mapserver"
+	nativeBuilder "github.com/omniscale/magnacarto/builder/native"
+	"github.com/omniscale/magnacarto/config"
+	"github.com/omniscale/magnacarto/mml"
+	"github.com/omniscale/magnacarto/render"
+	"github.com/omniscale/magnacarto/render/native"
+)
+
+// view is a single image of the render command. Views of a -views file
+// use the command line options for all missing values.
+type view struct {
+	Name string `json:"name"`
+	// BBOX in the SRS of the view.
+	BBOX []float64 `json:"bbox"`
+	// Center in EPSG:4326.
+	Center      []float64 `json:"center"`
+	Zoom        *float64  `json:"zoom"`
+	Size        string    `json:"size"`
+	ScaleFactor float64   `json:"scale_factor"`
+	Format      string    `json:"format"`
+	SRS         string    `json:"srs"`
+	Layers      []string  `json:"layers"`
+	Output      string    `json:"output"`
+}
+
+// withDefaults returns the view with all missing values from d.
+func (v view) withDefaults(d view) view {
+	if v.BBOX == nil && v.Center == nil {
+		v.BBOX, v.Center = d.BBOX, d.Center
+	}
+	if v.Zoom == nil {
+		v.Zoom = d.Zoom
+	}
+	if v.Size == "" {
+		v.Size = d.Size
+	}
+	if v.ScaleFactor == 0 {
+		v.ScaleFactor = d.ScaleFactor
+	}
+	if v.Format == "" && v.Output == "" {
+		v.Format = d.Format
+	}
+	if v.SRS == "" {
+		v.SRS = d.SRS
+	}
+	if v.Layers == nil {
+		v.Layers = d.Layers
+	}
+	return v
+}
+
+// format returns the output format (png, jpeg, pdf or svg), either
+// from Format or from the suffix of Output.
+func (v view) format() (string, error) {
+	f := strings.ToLower(v.Format)
+	if f == "" {
+		f = strings.TrimPrefix(strings.ToLower(filepath.Ext(v.Output)), ".")
+	}
+	switch f {
+	case "", "png":
+		return "png", nil
+	case "jpeg", "jpg":
+		return "jpeg", nil
+	case "pdf", "svg":
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown format '%s'", f)
+}
+
+// webMercatorZoom0Res is the resolution in meters per pixel of zoom level
+// 0 with 256 pixel tiles.
+const webMercatorZoom0Res = 156543.03392804097
+
+// metersPerDegree at the equator.
+const metersPerDegree = 2 * math.Pi * 6378137 / 360
+
+// maxImageSize limits the width and height of rendered images.
+const maxImageSize = 20000
+
+// request returns the render request of the view. The extent is defined
+// by bbox and size, by bbox and zoom or by center, zoom and size. For a
+// bbox with zoom and size, only the center of the bbox is used. Zoom
+// levels are Web Mercator zoom levels and the resolution is divided by
+// the scale factor, so that higher scale factors render the same extent
+// with more pixels.
+func (v view) request() (render.Request, error) {
+	req := render.Request{ScaleFactor: v.ScaleFactor}
+	if req.ScaleFactor <= 0 {
+		req.ScaleFactor = 1
+	}
+	code, err := parseEPSG(v.SRS)
+	if err != nil {
+		return req, err
+	}
+	req.EPSGCode = code
+
+	if v.Size != "" {
+		if req.Width, req.Height, err = parseSize(v.Size); err != nil {
+			return req, err
+		}
+	}
+
+	var res float64
+	if v.Zoom != nil {
+		res = webMercatorZoom0Res / math.Pow(2, *v.Zoom) / req.ScaleFactor
+		switch code {
+		case 3857, 900913:
+		case 4326:
+			res /= metersPerDegree
+		default:
+			return req, fmt.Errorf("zoom requires EPSG:3857 or EPSG:4326, not EPSG:%d", code)
+		}
+	}
+
+	var cx, cy float64
+	switch {
+	case len(v.BBOX) == 4:
+		b := v.BBOX
+		if b[2] <= b[0] || b[3] <= b[1] {
+			return req, fmt.Errorf("invalid bbox %v", b)
+		}
+		switch {
+		case req.Width > 0 && v.Zoom == nil:
+			copy(req.BBOX[:], b)
+			return req, checkSize(req)
+		case req.Width == 0 && v.Zoom != nil:
+			copy(req.BBOX[:], b)
+			req.Width = int(math.Floor((b[2]-b[0])/res + 0.5))
+			req.Height = int(math.Floor((b[3]-b[1])/res + 0.5))
+			return req, checkSize(req)
+		case req.Width == 0:
+			return req, errors.New("bbox requires size or zoom")
+		}
+		cx, cy = (b[0]+b[2])/2, (b[1]+b[3])/2
+	case v.BBOX != nil:
+		return req, fmt.Errorf("invalid bbox %v", v.BBOX)
+	case len(v.Center) == 2:
+		if v.Zoom == nil || req.Width == 0 {
+			return req, errors.New("center requires zoom and size")
+		}
+		cx, cy = v.Center[0], v.Center[1]
+		if code != 4326 {
+			cx, cy = lonLatToMerc(cx, cy)
+		}
+	default:
+		return req, errors.New("missing bbox or center")
+	}
+
+	w, h := float64(req.Width)*res/2, float64(req.Height)*res/2
+	req.BBOX = [4]float64{cx - w, cy - h, cx + w, cy + h}
+	return req, checkSize(req)
+}
+
+func checkSize(req render.Request) error {
+	if req.Width <= 0 || req.Height <= 0 || req.Width > maxImageSize || req.Height > maxImageSize {
+		return fmt.Errorf("invalid image size %dx%d", req.Width, req.Height)
+	}
+	return nil
+}
+
+func lonLatToMerc(lon, lat float64) (float64, float64) {
+	x := lon * metersPerDegree
+	y := math.Log(math.Tan((90+lat)*math.Pi/360)) * 6378137
+	return x, y
+}
+
+// parseEPSG parses EPSG codes like EPSG:3857 or 3857. Empty SRS is
+// EPSG:3857.
+func parseEPSG(srs string) (int, error) {
+	if srs == "" {
+		return 3857, nil
+	}
+	s := srs
+	if len(s) > 5 && strings.EqualFold(s[:5], "epsg:") {
+		s = s[5:]
+	}
+	code, err := strconv.Atoi(s)
+	if err != nil || code <= 0 {
+		return 0, fmt.Errorf("invalid srs '%s'", srs)
+	}
+	return code, nil
+}
+
+// parseSize parses sizes like 800x600.
+func parseSize(size string) (int, int, error) {
+	parts := strings.Split(strings.ToLower(size), "x")
+	if len(parts) == 2 {
+		w, errW := strconv.Atoi(strings.TrimSpace(parts[0]))
+		h, errH := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if errW == nil && errH == nil && w > 0 && h > 0 {
+			return w, h, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("invalid size '%s', expected WIDTHxHEIGHT", size)
+}
+
+// parseFloats parses comma separated numbers. It returns nil for an
+// empty string.
+func parseFloats(s string) ([]float64, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var result []float64
+	for _, part := range strings.Split(s, ",") {
+		v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number '%s'", part)
+		}
+		result = append(result, v)
+	}
+	return result, nil
+}
+
+// loadViews reads a JSON list of views.
+func loadViews(fname string) ([]view, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var views []view
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&views); err != nil {
+		return nil, fmt.Errorf("decoding %s: %v", fname, err)
+	}
+	return views, nil
+}
+
+// mmlCenter returns the lon/lat and zoom of the center parameter of the
+// MML.
+func mmlCenter(mmlFile string) ([]float64, *float64, error) {
+	r, err := os.Open(mmlFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer r.Close()
+	m, err := mml.Parse(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	center, err := parseFloats(m.Parameters["center"])
+	if err != nil || len(center) != 3 {
+		return nil, nil, nil
+	}
+	return center[:2], &center[2], nil
+}
+
+// formatRenderFunc renders the style file with the request as the
+// format (png, jpeg, pdf or svg) into w.
+type formatRenderFunc func(styleFile string, req render.Request, format string, w io.Writer) error
+
+// renderCmd renders one or more views of a style as PNG, JPEG, PDF or
+// SVG.
+func renderCmd(args []string) {
+	flags := flag.NewFlagSet("render", flag.ExitOnError)
+	mmlFile := flags.String("mml", "", "mml file")
+	confFile := flags.String("config", "", "config")
+	builderType := flags.String("builder", "mapnik3", "builder type {mapnik3,mapnik3-proj4,mapserver,native}")
+	bbox := flags.String("bbox", "", "minx,miny,maxx,maxy in -srs (with -zoom and -size only the center is used)")
+	center := flags.String("center", "", "lon,lat of the center (default center of the mml)")
+	zoom := flags.Float64("zoom", -1, "zoom level (default zoom of the mml center if -bbox is not set)")
+	size := flags.String("size", "", "image size in pixels, e.g. 2000x1500")
+	scaleFactor := flags.Float64("scale-factor", 1, "scale factor for high-resolution or print output")
+	format := flags.String("format", "", "output format {png,jpeg,pdf,svg} (default suffix of -o or png)")
+	srs := flags.String("srs", "EPSG:3857", "srs of the map and -bbox")
+	layers := flags.String("layers", "", "comma separated list of layers (default all layers)")
+	viewsFile := flags.String("views", "", "JSON file with a list of views to render")
+	outFile := flags.String("o", "", "out file (default stdout), or out directory for -views")
+	flags.Parse(args)
+
+	if *mmlFile == "" {
+		log.Fatal("render requires -mml")
+	}
+
+	defaults := view{Size: *size, ScaleFactor: *scaleFactor, Format: *format, SRS: *srs}
+	var err error
+	if defaults.BBOX, err = parseFloats(*bbox); err != nil {
+		log.Fatal("invalid -bbox: ", err)
+	}
+	if defaults.Center, err = parseFloats(*center); err != nil {
+		log.Fatal("invalid -center: ", err)
+	}
+	if *zoom >= 0 {
+		defaults.Zoom = zoom
+	}
+	if *layers != "" {
+		defaults.Layers = strings.Split(*layers, ",")
+	}
+	if defaults.BBOX == nil && defaults.Center == nil {
+		c, z, err := mmlCenter(*mmlFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defaults.Center = c
+		if defaults.Zoom == nil {
+			defaults.Zoom = z
+		}
+	}
+
+	views := []view{{Output: *outFile, Format: *format}}
+	outDir := ""
+	if *viewsFile != "" {
+		if views, err = loadViews(*viewsFile); err != nil {
+			log.Fatal(err)
+		}
+		outDir = *outFile
+		if outDir == "" {
+			outDir = "."
+		}
+		if err := os.MkdirAll(outDir, 0755); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	conf := config.Magnacarto{}
+	if *confFile != "" {
+		if err := conf.Load(*confFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if err := renderViews(*builderType, conf, *mmlFile, views, defaults, outDir); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// renderViews builds the style into a temporary directory and renders
+// all views. The temporary directory and the renderer are released
+// before renderViews returns, also on errors.
+func renderViews(builderType string, conf config.Magnacarto, mmlFile string, views []view, defaults view, outDir string) error {
+	maker, backend := renderer(builderType, conf)
+	defer backend.Close()
+
+	dir, err := ioutil.TempDir("", "magnacarto-render")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	styleFile := filepath.Join(dir, "style"+maker.FileSuffix())
+	if err := buildStyle(maker, builderType, conf, mmlFile, styleFile); err != nil {
+		return err
+	}
+
+	failed := 0
+	for i, v := range views {
+		if err := renderView(styleFile, v.withDefaults(defaults), outDir, backend.render); err != nil {
+			name := v.Name
+			if name == "" {
+				name = strconv.Itoa(i + 1)
+			}
+			log.Printf("error rendering view %s: %v", name, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d views failed", failed, len(views))
+	}
+	return nil
+}
+
+// buildStyle builds the MML file and writes the result to styleFile.
+// Warnings and unsupported features are logged.
+func buildStyle(maker builder.MapMaker, builderType string, conf config.Magnacarto, mmlFile, styleFile string) error {
+	locator := conf.Locator()
+	locator.SetBaseDir(filepath.Dir(mmlFile))
+	locator.UseRelPaths(false)
+
+	m := maker.New(locator)
+	b := builder.New(m)
+	b.SetMML(mmlFile)
+	if err := b.Build(); err != nil {
+		return fmt.Errorf("error building style %s: %v", mmlFile, err)
+	}
+	for _, w := range b.Warnings() {
+		log.Println("warning:", w)
+	}
+	for _, f := range m.UnsupportedFeatures() {
+		log.Printf("warning: %s not supported by -builder %s", f, builderType)
+	}
+	if err := m.WriteFiles(styleFile); err != nil {
+		return fmt.Errorf("error writing style: %v", err)
+	}
+	return nil
+}
+
+// renderView renders a single view into its output file, or to stdout.
+// Views of a -views file are written to outDir, as <name>.<format> if
+// they have no output.
+func renderView(styleFile string, v view, outDir string, renderFunc formatRenderFunc) error {
+	format, err := v.format()
+	if err != nil {
+		return err
+	}
+	req, err := v.request()
+	if err != nil {
+		return err
+	}
+	req.Layers = v.Layers
+
+	out := v.Output
+	if outDir != "" {
+		if out == "" {
+			if v.Name == "" {
+				return errors.New("missing name or output")
+			}
+			out = v.Name + "." + format
+		}
+		if !filepath.IsAbs(out) {
+			out = filepath.Join(outDir, out)
+		}
+	}
+
+	buf := bytes.Buffer{}
+	if err := renderFunc(styleFile, req, format, &buf); err != nil {
+		return err
+	}
+	if out == "" || out == "-" {
+		_, err = os.Stdout.Write(buf.Bytes())
+		return err
+	}
+	return ioutil.WriteFile(out, buf.Bytes(), 0644)
+}
+
+// renderBackend renders styles of a builder.
+type renderBackend struct {
+	render formatRenderFunc
+	close  func() error
+}
+
+func (r renderBackend) Close() error {
+	if r.close == nil {
+		return nil
+	}
+	return r.close()
+}
+
+// renderer returns the map maker and the render backend of the builder
+// type.
+func renderer(builderType string, conf config.Magnacarto) (builder.MapMaker, renderBackend) {
+	switch builderType {
+	case "mapserver":
+		r, err := render.NewMapServer()
+		if err != nil {
+			log.Fatal("MapServer plugin: ", err)
+		}
+		formats := map[string]string{
+			"png":  "image/png; mode=24bit",
+			"jpeg": "image/jpeg",
+			"pdf":  "application/x-pdf",
+			"svg":  "image/svg+xml",
+		}
+		return mapserver.Maker, renderBackend{render: func(styleFile string, req render.Request, format string, w io.Writer) error {
+			req.Format = formats[format]
+			_, err := r.Render(styleFile, w, req)
+			return err
+		}}
+	case "mapnik3", "mapnik3-proj4":
+		maker := mapnik.Maker3
+		if builderType == "mapnik3-proj4" {
+			maker = mapnik.Maker3Proj4
+		}
+		r, err := render.NewMapnik()
+		if err != nil {
+			log.Fatal("Mapnik plugin: ", err)
+		}
+		for _, fontDir := range conf.Mapnik.FontDirs {
+			r.RegisterFonts(fontDir)
+		}
+		// pdf and svg are rendered with Cairo
+		formats := map[string]string{
+			"png":  "png32",
+			"jpeg": "jpeg85",
+			"pdf":  "pdf",
+			"svg":  "svg",
+		}
+		return maker, renderBackend{
+			render: func(styleFile string, req render.Request, format string, w io.Writer) error {
+				req.Format = formats[format]
+				return r.Render(styleFile, w, req)
+			},
+			close: r.Close,
+		}
+	case "native":
+		r := native.New()
+		return nativeBuilder.Maker, renderBackend{render: func(styleFile string, req render.Request, format string, w io.Writer) error {
+			if format != "png" && format != "jpeg" {
+				return fmt.Errorf("%s not supported by the native renderer", format)
+			}
+			req.Format = "image/" + format
+			warnings, err := r.Render(styleFile, w, req)
+			for _, w := range warnings {
+				log.Println("warning:", w)
+			}
+			return err
+		}}
+	}
+	log.Fatal("unknown -builder ", builderType)
+	return nil, renderBackend{}
+}
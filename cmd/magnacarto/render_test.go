@@ -0,0 +1,82 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestViewRequest(t *testing.T) {
+	zoom := func(z float64) *float64 { return &z }
+	for _, tt := range []struct {
+		v             view
+		width, height int
+		bbox          [4]float64
+		epsg          int
+	}{
+		// bbox and size
+		{view{BBOX: []float64{0, 0, 1000, 500}, Size: "200x100"}, 200, 100, [4]float64{0, 0, 1000, 500}, 3857},
+		// bbox and zoom, zoom 10 has a resolution of ~152.87m
+		{view{BBOX: []float64{0, 0, 15287, 7644}, Zoom: zoom(10)}, 100, 50, [4]float64{0, 0, 15287, 7644}, 3857},
+		// bbox, zoom and size only uses the center of the bbox
+		{view{BBOX: []float64{-10, -10, 10, 10}, Zoom: zoom(10), Size: "200x100"}, 200, 100, [4]float64{-15287.4, -7643.7, 15287.4, 7643.7}, 3857},
+		// higher scale factor renders the same extent with more pixels
+		{view{BBOX: []float64{-10, -10, 10, 10}, Zoom: zoom(10), Size: "400x200", ScaleFactor: 2}, 400, 200, [4]float64{-15287.4, -7643.7, 15287.4, 7643.7}, 3857},
+		{view{Center: []float64{0, 0}, Zoom: zoom(0), Size: "256x256", SRS: "EPSG:4326"}, 256, 256, [4]float64{-180, -180, 180, 180}, 4326},
+		{view{Center: []float64{180, 0}, Zoom: zoom(1), Size: "256x256", SRS: "epsg:3857"}, 256, 256, [4]float64{10018754.2, -10018754.2, 30056262.5, 10018754.2}, 3857},
+	} {
+		req, err := tt.v.request()
+		if err != nil {
+			t.Errorf("%v: %v", tt.v, err)
+			continue
+		}
+		if req.Width != tt.width || req.Height != tt.height || req.EPSGCode != tt.epsg {
+			t.Errorf("%v: unexpected request %v", tt.v, req)
+		}
+		for i := range tt.bbox {
+			if math.Abs(req.BBOX[i]-tt.bbox[i]) > 0.1 {
+				t.Errorf("%v: unexpected bbox %v", tt.v, req.BBOX)
+				break
+			}
+		}
+	}
+
+	for _, v := range []view{
+		{},
+		{BBOX: []float64{0, 0, 1000, 500}},
+		{BBOX: []float64{0, 0, 1000}, Size: "200x100"},
+		{BBOX: []float64{10, 0, 0, 10}, Size: "200x100"},
+		{BBOX: []float64{0, 0, 1000, 500}, Size: "200"},
+		{Center: []float64{0, 0}, Size: "200x100"},
+		{Center: []float64{0, 0}, Zoom: zoom(10), Size: "200x100", SRS: "EPSG:31467"},
+		{BBOX: []float64{0, 0, 1e7, 1e7}, Zoom: zoom(18)},
+	} {
+		if _, err := v.request(); err == nil {
+			t.Errorf("%v: expected error", v)
+		}
+	}
+}
+
+func TestViewFormat(t *testing.T) {
+	for _, tt := range []struct {
+		v      view
+		format string
+	}{
+		{view{}, "png"},
+		{view{Output: "out.PDF"}, "pdf"},
+		{view{Output: "out.jpg"}, "jpeg"},
+		{view{Output: "out.png", Format: "svg"}, "svg"},
+	} {
+		if f, err := tt.v.format(); err != nil || f != tt.format {
+			t.Errorf("%v: unexpected format %s (%v)", tt.v, f, err)
+		}
+	}
+	if _, err := (view{Format: "tiff"}).format(); err == nil {
+		t.Error("expected error for tiff")
+	}
+
+	// format of the output file has precedence over the default format
+	v := view{Output: "out.pdf"}.withDefaults(view{Format: "png", Size: "10x10"})
+	if f, _ := v.format(); f != "pdf" || v.Size != "10x10" {
+		t.Errorf("unexpected view %v", v)
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/omniscale/magnacarto/config"
+	"github.com/omniscale/magnacarto/imgdiff"
+	"github.com/omniscale/magnacarto/render"
+	"github.com/omniscale/magnacarto/visualdiff"
+)
+
+// visualDiffCmd renders the same views with two versions of a style and
+// writes an HTML report with the before, after and diff images and all
+// changed rules.
+func visualDiffCmd(args []string) {
+	flags := flag.NewFlagSet("visual-diff", flag.ExitOnError)
+	pathA := flags.String("a", "", "old version (mml file or directory)")
+	pathB := flags.String("b", "", "new version (mml file or directory)")
+	mmlName := flags.String("mml", "", "name of the mml file in -a and -b directories (default the only mml file)")
+	confFile := flags.String("config", "", "config")
+	builderType := flags.String("builder", "mapnik3", "builder type {mapnik3,mapnik3-proj4,mapserver,native}")
+	bbox := flags.String("bbox", "", "minx,miny,maxx,maxy in -srs (with -zoom and -size only the center is used)")
+	center := flags.String("center", "", "lon,lat of the center (default center of the new mml)")
+	zoom := flags.Float64("zoom", -1, "zoom level (default zoom of the mml center if -bbox is not set)")
+	size := flags.String("size", "800x600", "image size in pixels")
+	scaleFactor := flags.Float64("scale-factor", 1, "scale factor for high-resolution output")
+	srs := flags.String("srs", "EPSG:3857", "srs of the map and -bbox")
+	viewsFile := flags.String("views", "", "JSON file with a list of views to compare (see render command)")
+	fuzz := flags.Float64("fuzz", 0, "color distance in percent up to which pixels are equal")
+	outDir := flags.String("o", "visual-diff", "out directory for the report and images")
+	flags.Parse(args)
+
+	opts := visualDiffOptions{
+		pathA:       *pathA,
+		pathB:       *pathB,
+		mmlName:     *mmlName,
+		confFile:    *confFile,
+		builderType: *builderType,
+		bbox:        *bbox,
+		center:      *center,
+		zoom:        *zoom,
+		size:        *size,
+		scaleFactor: *scaleFactor,
+		srs:         *srs,
+		viewsFile:   *viewsFile,
+		fuzz:        *fuzz,
+		outDir:      *outDir,
+	}
+	if err := runVisualDiff(opts); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// visualDiffOptions are the command line options of visual-diff.
+type visualDiffOptions struct {
+	pathA, pathB string
+	mmlName      string
+	confFile     string
+	builderType  string
+	bbox         string
+	center       string
+	zoom         float64
+	size         string
+	scaleFactor  float64
+	srs          string
+	viewsFile    string
+	fuzz         float64
+	outDir       string
+}
+
+// runVisualDiff builds both styles, compares all views and writes the
+// report. The temporary styles and the renderer are released before it
+// returns, also on errors.
+func runVisualDiff(o visualDiffOptions) error {
+	if o.pathA == "" || o.pathB == "" {
+		return errors.New("visual-diff requires -a and -b")
+	}
+	mmlA, err := findMML(o.pathA, o.mmlName)
+	if err != nil {
+		return err
+	}
+	mmlB, err := findMML(o.pathB, o.mmlName)
+	if err != nil {
+		return err
+	}
+
+	defaults := view{Size: o.size, ScaleFactor: o.scaleFactor, SRS: o.srs}
+	if defaults.BBOX, err = parseFloats(o.bbox); err != nil {
+		return fmt.Errorf("invalid -bbox: %v", err)
+	}
+	if defaults.Center, err = parseFloats(o.center); err != nil {
+		return fmt.Errorf("invalid -center: %v", err)
+	}
+	if o.zoom >= 0 {
+		zoom := o.zoom
+		defaults.Zoom = &zoom
+	}
+	if defaults.BBOX == nil && defaults.Center == nil {
+		c, z, err := mmlCenter(mmlB)
+		if err != nil {
+			return err
+		}
+		defaults.Center = c
+		if defaults.Zoom == nil {
+			defaults.Zoom = z
+		}
+	}
+
+	views := []view{{Name: "default"}}
+	if o.viewsFile != "" {
+		if views, err = loadViews(o.viewsFile); err != nil {
+			return err
+		}
+	}
+
+	conf := config.Magnacarto{}
+	if o.confFile != "" {
+		if err := conf.Load(o.confFile); err != nil {
+			return err
+		}
+	}
+
+	maker, backend := renderer(o.builderType, conf)
+	defer backend.Close()
+
+	dir, err := ioutil.TempDir("", "magnacarto-visual-diff")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	styleA := filepath.Join(dir, "style-a"+maker.FileSuffix())
+	styleB := filepath.Join(dir, "style-b"+maker.FileSuffix())
+	if err := buildStyle(maker, o.builderType, conf, mmlA, styleA); err != nil {
+		return err
+	}
+	if err := buildStyle(maker, o.builderType, conf, mmlB, styleB); err != nil {
+		return err
+	}
+
+	report := visualdiff.Report{A: mmlA, B: mmlB}
+	if report.Rules, err = visualdiff.ChangedRules(mmlA, mmlB); err != nil {
+		return fmt.Errorf("error comparing rules: %v", err)
+	}
+
+	if err := os.MkdirAll(o.outDir, 0755); err != nil {
+		return err
+	}
+	renderFunc := func(styleFile string, req render.Request, w io.Writer) error {
+		return backend.render(styleFile, req, "png", w)
+	}
+	diffOpts := imgdiff.Options{Fuzz: o.fuzz}
+	for i, v := range views {
+		if v.Name == "" {
+			v.Name = "view-" + strconv.Itoa(i+1)
+		}
+		result := compareView(styleA, styleB, v.withDefaults(defaults), o.outDir, renderFunc, diffOpts)
+		if result.Err != nil {
+			log.Printf("error comparing view %s: %v", v.Name, result.Err)
+		}
+		report.Views = append(report.Views, result)
+	}
+
+	reportFile := filepath.Join(o.outDir, "index.html")
+	f, err := os.Create(reportFile)
+	if err != nil {
+		return err
+	}
+	if err := report.WriteHTML(f); err != nil {
+		f.Close()
+		return fmt.Errorf("error writing report: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error writing report: %v", err)
+	}
+	log.Printf("%d of %d views changed, %d changed rules, report written to %s",
+		report.ChangedViews(), len(report.Views), len(report.Rules), reportFile)
+	return nil
+}
+
+// compareView renders a view with both styles and writes the images as
+// <name>-a.png, <name>-b.png and <name>-diff.png into outDir.
+func compareView(styleA, styleB string, v view, outDir string, renderFunc visualdiff.RenderFunc, opts imgdiff.Options) visualdiff.ViewResult {
+	result := visualdiff.ViewResult{Name: v.Name}
+	if format, err := v.format(); err != nil {
+		result.Err = err
+		return result
+	} else if format != "png" {
+		result.Err = fmt.Errorf("%s not supported by visual-diff, only png", format)
+		return result
+	}
+	req, err := v.request()
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	req.Layers = v.Layers
+
+	imgs, err := visualdiff.CompareView(styleA, styleB, req, renderFunc, opts)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	diff, err := imgs.DiffPNG()
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	result.A, result.B, result.Diff = v.Name+"-a.png", v.Name+"-b.png", v.Name+"-diff.png"
+	for _, img := range []struct {
+		name string
+		data []byte
+	}{{result.A, imgs.A}, {result.B, imgs.B}, {result.Diff, diff}} {
+		if err := ioutil.WriteFile(filepath.Join(outDir, img.name), img.data, 0644); err != nil {
+			result.Err = err
+			return result
+		}
+	}
+	result.Result = imgs.Result
+	return result
+}
+
+// findMML returns path if it is a file, otherwise the file name in the
+// directory path, or the only .mml file of the directory if name is
+// empty.
+func findMML(path, name string) (string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if !fi.IsDir() {
+		return path, nil
+	}
+	if name != "" {
+		return filepath.Join(path, name), nil
+	}
+	matches, err := filepath.Glob(filepath.Join(path, "*.mml"))
+	if err != nil {
+		return "", err
+	}
+	if len(matches) != 1 {
+		return "", fmt.Errorf("found %d mml files in %s, select one with -mml", len(matches), path)
+	}
+	return matches[0], nil
+}
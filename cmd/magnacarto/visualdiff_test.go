@@ -0,0 +1,34 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestFindMML(t *testing.T) {
+	dir := "../../regression/cases/021-polygons"
+	for _, tt := range []struct {
+		path, name string
+		expected   string
+		err        bool
+	}{
+		{dir, "", filepath.Join(dir, "test.mml"), false},
+		{dir, "other.mml", filepath.Join(dir, "other.mml"), false},
+		{filepath.Join(dir, "test.mml"), "ignored.mml", filepath.Join(dir, "test.mml"), false},
+		{"../../regression/cases", "", "", true},
+		{"missing", "", "", true},
+	} {
+		mml, err := findMML(tt.path, tt.name)
+		if tt.err {
+			if err == nil {
+				t.Errorf("expected error for %s, got %s", tt.path, mml)
+			}
+			continue
+		}
+		if err != nil {
+			t.Error(err)
+		} else if mml != tt.expected {
+			t.Errorf("unexpected mml %s for %s %s", mml, tt.path, tt.name)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/omniscale/magnacarto/builder/mapserver"
+	"github.com/omniscale/magnacarto/imgdiff"
+	"github.com/omniscale/magnacarto/maps"
+)
+
+type compareResult struct {
+	Pixels      int                  `json:"pixels"`
+	Similarity  float64              `json:"similarity"`
+	RMSE        float64              `json:"rmse"`
+	PSNR        *float64             `json:"psnr,omitempty"` // missing for equal images
+	SSIM        float64              `json:"ssim"`
+	Unsupported []unsupportedFeature `json:"unsupported"`
+}
+
+// unsupportedFeature is a feature of the style that is not supported by
+// the builders of Renderers.
+type unsupportedFeature struct {
+	Feature   string   `json:"feature"`
+	Renderers []string `json:"renderers"`
+}
+
+// compare renders a map request (with the same mml, mss and base
+// parameters as the map handler) with Mapnik and with MapServer and
+// compares both images. Returns the similarity and the merged unsupported
+// features of both builders as JSON, or a single image for IMAGE=mapnik,
+// mapserver, diff or composite (Mapnik and MapServer side by side).
+func (s *magnaserv) compare(w http.ResponseWriter, r *http.Request) {
+	mapReq, err := maps.ParseMapRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	mml, mss := s.styleParams(r)
+	if mml == "" {
+		http.Error(w, "missing mml param", http.StatusBadRequest)
+		return
+	}
+	output := strings.ToLower(mapReq.Query.Get("IMAGE"))
+	switch output {
+	case "", "mapnik", "mapserver", "diff", "composite":
+	default:
+		http.Error(w, "invalid IMAGE param, expected mapnik, mapserver, diff or composite", http.StatusBadRequest)
+		return
+	}
+	opts := imgdiff.Options{}
+	if fuzz := mapReq.Query.Get("FUZZ"); fuzz != "" {
+		if opts.Fuzz, err = strconv.ParseFloat(fuzz, 64); err != nil || opts.Fuzz < 0 {
+			http.Error(w, "invalid FUZZ param", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if s.mapnikRenderer == nil || s.mapserverRenderer == nil {
+		http.Error(w, "comparison requires the Mapnik and MapServer plugins", http.StatusNotImplemented)
+		return
+	}
+
+	unsupported := make(map[string][]string)
+	var imgs []image.Image
+	var data [][]byte
+	for _, renderer := range []string{"mapnik", "mapserver"} {
+		maker := s.mapnikMaker
+		if renderer == "mapserver" {
+			maker = mapserver.Maker
+		}
+		styleFile, err := s.builderCache.StyleFile(maker, mml, mss)
+		if err != nil {
+			s.internalError(w, r, err)
+			return
+		}
+		features, err := s.builderCache.UnsupportedFeatures(maker, mml, mss)
+		if err != nil {
+			s.internalError(w, r, err)
+			return
+		}
+		for _, f := range features {
+			unsupported[f] = append(unsupported[f], renderer)
+		}
+
+		buf := bytes.Buffer{}
+		if err := s.pngRenderFunc(renderer)(styleFile, renderReq(mapReq), &buf); err != nil {
+			s.internalError(w, r, err)
+			return
+		}
+		img, err := png.Decode(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			s.internalError(w, r, fmt.Errorf("decoding %s image: %v", renderer, err))
+			return
+		}
+		imgs = append(imgs, img)
+		data = append(data, buf.Bytes())
+	}
+
+	res, err := imgdiff.Compare(imgs[0], imgs[1], opts)
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+
+	if output != "" {
+		w.Header().Set("Content-Type", "image/png")
+		switch output {
+		case "mapnik":
+			w.Write(data[0])
+		case "mapserver":
+			w.Write(data[1])
+		case "diff":
+			err = png.Encode(w, res.Diff)
+		default:
+			err = png.Encode(w, sideBySide(imgs[0], imgs[1]))
+		}
+		if err != nil {
+			log.Print(err)
+		}
+		return
+	}
+
+	result := compareResult{
+		Pixels:      res.Pixels,
+		Similarity:  res.Similarity(),
+		RMSE:        res.RMSE,
+		SSIM:        res.SSIM,
+		Unsupported: mergeUnsupported(unsupported),
+	}
+	if !math.IsInf(res.PSNR, 0) {
+		result.PSNR = &res.PSNR
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(result); err != nil {
+		log.Print(err)
+	}
+}
+
+// mergeUnsupported returns the unsupported features sorted by name.
+func mergeUnsupported(features map[string][]string) []unsupportedFeature {
+	result := []unsupportedFeature{}
+	for f, renderers := range features {
+		result = append(result, unsupportedFeature{Feature: f, Renderers: renderers})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Feature < result[j].Feature })
+	return result
+}
+
+// sideBySide returns a single image with a on the left and b on the
+// right side.
+func sideBySide(a, b image.Image) image.Image {
+	ba, bb := a.Bounds(), b.Bounds()
+	h := ba.Dy()
+	if bb.Dy() > h {
+		h = bb.Dy()
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, ba.Dx()+bb.Dx(), h))
+	draw.Draw(dst, image.Rect(0, 0, ba.Dx(), ba.Dy()), a, ba.Min, draw.Src)
+	draw.Draw(dst, image.Rect(ba.Dx(), 0, ba.Dx()+bb.Dx(), bb.Dy()), b, bb.Min, draw.Src)
+	return dst
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/omniscale/magnacarto/config"
+)
+
+func TestCompareErrors(t *testing.T) {
+	s := &magnaserv{config: &config.Magnacarto{StylesDir: "../../regression/cases"}}
+	query := "SRS=EPSG:4326&BBOX=8,53,9,54&WIDTH=20&HEIGHT=10"
+	for _, tt := range []struct {
+		query string
+		code  int
+	}{
+		{"mml=test.mml", 400},
+		{"base=021-polygons&" + query, 400},
+		{"base=021-polygons&mml=test.mml&IMAGE=foo&" + query, 400},
+		{"base=021-polygons&mml=test.mml&FUZZ=x&" + query, 400},
+		// renderers are not available in tests
+		{"base=021-polygons&mml=test.mml&" + query, 501},
+	} {
+		w := httptest.NewRecorder()
+		s.compare(w, httptest.NewRequest("GET", "/compare?"+tt.query, nil))
+		if w.Code != tt.code {
+			t.Errorf("unexpected status %d for %s: %s", w.Code, tt.query, w.Body.String())
+		}
+	}
+}
+
+func TestMergeUnsupported(t *testing.T) {
+	if f := mergeUnsupported(nil); f == nil || len(f) != 0 {
+		t.Error("expected empty list", f)
+	}
+	f := mergeUnsupported(map[string][]string{
+		"background-image":        {"mapserver"},
+		"sql token !scale_denom!": {"mapnik", "mapserver"},
+		"comp-op":                 {"mapserver"},
+	})
+	expected := []unsupportedFeature{
+		{"background-image", []string{"mapserver"}},
+		{"comp-op", []string{"mapserver"}},
+		{"sql token !scale_denom!", []string{"mapnik", "mapserver"}},
+	}
+	if !reflect.DeepEqual(f, expected) {
+		t.Error("unexpected features", f)
+	}
+}
+
+func TestSideBySide(t *testing.T) {
+	a := image.NewRGBA(image.Rect(0, 0, 4, 3))
+	a.Set(3, 2, color.RGBA{255, 0, 0, 255})
+	b := image.NewRGBA(image.Rect(10, 10, 12, 14))
+	b.Set(10, 10, color.RGBA{0, 0, 255, 255})
+
+	img := sideBySide(a, b)
+	if img.Bounds() != image.Rect(0, 0, 6, 4) {
+		t.Fatal("unexpected bounds", img.Bounds())
+	}
+	if r, _, _, _ := img.At(3, 2).RGBA(); r != 0xffff {
+		t.Error("missing pixel of a")
+	}
+	if _, _, b, _ := img.At(4, 0).RGBA(); b != 0xffff {
+		t.Error("missing pixel of b")
+	}
+	if _, _, _, a := img.At(0, 3).RGBA(); a != 0 {
+		t.Error("expected transparent pixel below a")
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/omniscale/magnacarto/imgdiff"
+	"github.com/omniscale/magnacarto/maps"
+	"github.com/omniscale/magnacarto/visualdiff"
+)
+
+type diffResult struct {
+	A          string                  `json:"a"`
+	B          string                  `json:"b"`
+	Pixels     int                     `json:"pixels"`
+	Similarity float64                 `json:"similarity"`
+	RMSE       float64                 `json:"rmse"`
+	PSNR       *float64                `json:"psnr,omitempty"` // missing for equal images
+	SSIM       float64                 `json:"ssim"`
+	Images     diffImages              `json:"images"`
+	Rules      []visualdiff.RuleChange `json:"rules"`
+}
+
+type diffImages struct {
+	A    string `json:"a"`
+	B    string `json:"b"`
+	Diff string `json:"diff"`
+}
+
+// diff compares the project (B) with another project (A, the BASE
+// parameter), e.g. a checkout of the previous version in the styles dir.
+// Both are rendered with the BBOX, WIDTH, HEIGHT, SRS and LAYERS of the
+// request. Returns the pixel diff with all images as data URIs and the
+// changed rules as JSON, or a single image for IMAGE=a, b or diff.
+func (s *magnaserv) diff(w http.ResponseWriter, r *http.Request) {
+	mapReq, err := maps.ParseMapRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	base := mapReq.Query.Get("BASE")
+	if base == "" {
+		http.Error(w, "missing BASE param", http.StatusBadRequest)
+		return
+	}
+	image := strings.ToLower(mapReq.Query.Get("IMAGE"))
+	if image != "" && image != "a" && image != "b" && image != "diff" {
+		http.Error(w, "invalid IMAGE param, expected a, b or diff", http.StatusBadRequest)
+		return
+	}
+	opts := imgdiff.Options{}
+	if fuzz := mapReq.Query.Get("FUZZ"); fuzz != "" {
+		if opts.Fuzz, err = strconv.ParseFloat(fuzz, 64); err != nil || opts.Fuzz < 0 {
+			http.Error(w, "invalid FUZZ param", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// mux returns safe path (e.g no /-root or ../ tricks), clean BASE
+	// for the same result
+	project := mux.Vars(r)["project"]
+	base = strings.TrimPrefix(path.Clean("/"+base), "/")
+	mmlA := filepath.Join(s.config.StylesDir, filepath.FromSlash(base)+".mml")
+	mmlB := filepath.Join(s.config.StylesDir, filepath.FromSlash(project)+".mml")
+	for _, f := range []string{mmlA, mmlB} {
+		if _, err := os.Stat(f); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+	}
+
+	maker, renderer := s.mapMaker(mapReq.Query.Get("RENDERER"))
+	styleA, err := s.builderCache.StyleFile(maker, mmlA, nil)
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	styleB, err := s.builderCache.StyleFile(maker, mmlB, nil)
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+
+	imgs, err := visualdiff.CompareView(styleA, styleB, renderReq(mapReq), s.pngRenderFunc(renderer), opts)
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	diff, err := imgs.DiffPNG()
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+
+	if image != "" {
+		w.Header().Set("Content-Type", "image/png")
+		switch image {
+		case "a":
+			w.Write(imgs.A)
+		case "b":
+			w.Write(imgs.B)
+		default:
+			w.Write(diff)
+		}
+		return
+	}
+
+	rules, err := visualdiff.ChangedRules(mmlA, mmlB)
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	res := imgs.Result
+	result := diffResult{
+		A:          base,
+		B:          project,
+		Pixels:     res.Pixels,
+		Similarity: res.Similarity(),
+		RMSE:       res.RMSE,
+		SSIM:       res.SSIM,
+		Images: diffImages{
+			A:    dataURI(imgs.A),
+			B:    dataURI(imgs.B),
+			Diff: dataURI(diff),
+		},
+		Rules: rules,
+	}
+	if !math.IsInf(res.PSNR, 0) {
+		result.PSNR = &res.PSNR
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(result); err != nil {
+		log.Print(err)
+	}
+}
+
+func dataURI(png []byte) string {
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(png)
+}
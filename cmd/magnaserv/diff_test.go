@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"github.com/omniscale/magnacarto/builder"
+	"github.com/omniscale/magnacarto/builder/mapnik"
+	"github.com/omniscale/magnacarto/config"
+	"github.com/omniscale/magnacarto/render/native"
+)
+
+func diffHandler() (http.Handler, func()) {
+	conf := &config.Magnacarto{StylesDir: "../../regression/cases"}
+	s := &magnaserv{
+		config:         conf,
+		builderCache:   builder.NewCache(conf.Locator),
+		defaultMaker:   mapnik.Maker3,
+		nativeRenderer: native.New(),
+	}
+	r := mux.NewRouter()
+	r.HandleFunc("/diff/{project:.*}", s.diff)
+	return r, s.builderCache.ClearAll
+}
+
+const diffQuery = "SRS=EPSG:4326&BBOX=8.21,53.148,8.222,53.154&WIDTH=200&HEIGHT=100&RENDERER=native"
+
+func TestDiff(t *testing.T) {
+	h, clear := diffHandler()
+	defer clear()
+
+	for _, tt := range []struct {
+		base     string
+		expected string
+		changed  bool
+	}{
+		{"021-polygons/test", "021-polygons/test", false},
+		{"/../021-polygons/test", "021-polygons/test", false},
+		{"020-polygons-default/test", "020-polygons-default/test", true},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/diff/021-polygons/test?BASE="+tt.base+"&"+diffQuery, nil))
+		if w.Code != 200 {
+			t.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Error("unexpected content type", ct)
+		}
+		result := diffResult{}
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+		if result.A != tt.expected || result.B != "021-polygons/test" {
+			t.Error("unexpected projects", result.A, result.B)
+		}
+		if tt.changed {
+			if result.Pixels == 0 || result.Similarity == 1 || result.PSNR == nil || len(result.Rules) == 0 {
+				t.Errorf("expected changes %+v", result)
+			}
+		} else {
+			if result.Pixels != 0 || result.Similarity != 1 || result.SSIM != 1 || result.PSNR != nil || len(result.Rules) != 0 {
+				t.Errorf("unexpected changes %+v", result)
+			}
+		}
+		if result.Images.A == "" || result.Images.Diff == "" || !tt.changed && result.Images.A != result.Images.B {
+			t.Error("unexpected images")
+		}
+	}
+}
+
+func TestDiffImage(t *testing.T) {
+	h, clear := diffHandler()
+	defer clear()
+
+	for _, image := range []string{"a", "b", "diff"} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/diff/021-polygons/test?BASE=020-polygons-default/test&IMAGE="+image+"&"+diffQuery, nil))
+		if ct := w.Header().Get("Content-Type"); ct != "image/png" {
+			t.Fatalf("unexpected content type %s: %s", ct, w.Body.String())
+		}
+		img, err := png.Decode(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size := img.Bounds().Size(); size.X != 200 || size.Y != 100 {
+			t.Error("unexpected image size", size)
+		}
+	}
+}
+
+func TestDiffErrors(t *testing.T) {
+	h, clear := diffHandler()
+	defer clear()
+
+	for _, tt := range []struct {
+		url  string
+		code int
+	}{
+		{"/diff/021-polygons/test?" + diffQuery, 400},
+		{"/diff/021-polygons/test?BASE=021-polygons/test&IMAGE=foo&" + diffQuery, 400},
+		{"/diff/021-polygons/test?BASE=021-polygons/test&FUZZ=-1&" + diffQuery, 400},
+		{"/diff/021-polygons/test?BASE=021-polygons/test&RENDERER=native", 400},
+		{"/diff/021-polygons/test?BASE=missing&" + diffQuery, 404},
+		{"/diff/missing?BASE=021-polygons/test&" + diffQuery, 404},
+		// renderer is not available in tests
+		{"/diff/021-polygons/test?BASE=021-polygons/test&SRS=EPSG:4326&BBOX=8,53,9,54&WIDTH=20&HEIGHT=10", 500},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", tt.url, nil))
+		if w.Code != tt.code {
+			t.Errorf("unexpected status %d for %s: %s", w.Code, tt.url, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/omniscale/magnacarto/mml"
+	mssPkg "github.com/omniscale/magnacarto/mss"
+)
+
+// inspectRequest is the JSON body of POST inspect requests. Attributes
+// can be passed directly, or as a GeoJSON feature (e.g. from a
+// GetFeatureInfo response).
+type inspectRequest struct {
+	Layers     []string               `json:"layers"`
+	Layer      string                 `json:"layer"`
+	Zoom       *int                   `json:"zoom"`
+	Attributes map[string]interface{} `json:"attributes"`
+	Feature    *struct {
+		Properties map[string]interface{} `json:"properties"`
+		Geometry   *struct {
+			Type string `json:"type"`
+		} `json:"geometry"`
+	} `json:"feature"`
+}
+
+type inspectResult struct {
+	Zoom   int                `json:"zoom"`
+	Layers []inspectLayerRule `json:"layers"`
+}
+
+type inspectLayerRule struct {
+	Layer string        `json:"layer"`
+	Rules []inspectRule `json:"rules"`
+}
+
+type inspectRule struct {
+	Attachment string            `json:"attachment,omitempty"`
+	Class      string            `json:"class,omitempty"`
+	Zoom       string            `json:"zoom"`
+	Filters    []inspectFilter   `json:"filters"`
+	Properties []inspectProperty `json:"properties"`
+}
+
+type inspectFilter struct {
+	Filter    string   `json:"filter"`
+	Positions []string `json:"positions"`
+}
+
+type inspectProperty struct {
+	Name     string `json:"name"`
+	Instance string `json:"instance,omitempty"`
+	Value    string `json:"value"`
+	Position string `json:"position"`
+}
+
+// inspect returns the rules that style a feature with the given
+// attributes, with the resulting properties and the positions of all
+// filters and properties in the MSS files.
+//
+// Attributes are passed as JSON (POST) or as attr.<name> query
+// parameters in GetFeatureInfo-style requests with QUERY_LAYERS and
+// ZOOM or BBOX/WIDTH in EPSG:3857.
+func (s *magnaserv) inspect(w http.ResponseWriter, r *http.Request) {
+	var layers []string
+	var zoom int
+	var attrs map[string]interface{}
+	var err error
+	if r.Method == "POST" {
+		layers, zoom, attrs, err = parseInspectJSON(r)
+	} else {
+		layers, zoom, attrs, err = parseInspectQuery(r)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// mux returns safe path (e.g no /-root or ../ tricks)
+	project := mux.Vars(r)["project"]
+	mmlFile := filepath.Join(s.config.StylesDir, filepath.FromSlash(project)+".mml")
+	m, style, err := loadStyle(mmlFile)
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	result, err := inspectRules(m, style, layers, zoom, attrs, filepath.Dir(mmlFile))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(result)
+}
+
+// loadStyle parses the MML and all MSS files of the MML.
+func loadStyle(mmlFile string) (*mml.MML, *mssPkg.MSS, error) {
+	f, err := os.Open(mmlFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	m, err := mml.Parse(f)
+	f.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+	carto := mssPkg.New()
+	for _, mss := range m.Stylesheets {
+		if err := carto.ParseFile(filepath.Join(filepath.Dir(mmlFile), mss)); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := carto.Evaluate(); err != nil {
+		return nil, nil, err
+	}
+	return m, carto.MSS(), nil
+}
+
+// inspectRules returns the matching rules of each layer. Positions are
+// relative to baseDir.
+func inspectRules(m *mml.MML, style *mssPkg.MSS, layers []string, zoom int, attrs map[string]interface{}, baseDir string) (*inspectResult, error) {
+	mmlLayers := make(map[string]mml.Layer, len(m.Layers))
+	for _, l := range m.Layers {
+		mmlLayers[l.ID] = l
+	}
+
+	posString := func(p mssPkg.Position) string {
+		if rel, err := filepath.Rel(baseDir, p.Filename); err == nil {
+			p.Filename = filepath.ToSlash(rel)
+		}
+		return p.String()
+	}
+
+	result := &inspectResult{Zoom: zoom, Layers: []inspectLayerRule{}}
+	for _, id := range layers {
+		l, ok := mmlLayers[id]
+		if !ok {
+			return nil, fmt.Errorf("unknown layer '%s'", id)
+		}
+		lr := inspectLayerRule{Layer: id, Rules: []inspectRule{}}
+		for _, r := range mssPkg.MatchingRules(style.LayerRules(l.ID, l.Classes...), attrs, zoom) {
+			ir := inspectRule{
+				Attachment: r.Attachment,
+				Class:      r.Class,
+				Zoom:       r.Zoom.String(),
+				Filters:    []inspectFilter{},
+				Properties: []inspectProperty{},
+			}
+			for _, f := range r.Filters {
+				filter := inspectFilter{Filter: f.String(), Positions: []string{}}
+				for _, p := range style.FilterPositions(l.ID, f, l.Classes...) {
+					filter.Positions = append(filter.Positions, posString(p))
+				}
+				ir.Filters = append(ir.Filters, filter)
+			}
+			for _, p := range r.Properties.All() {
+				ir.Properties = append(ir.Properties, inspectProperty{
+					Name:     p.Name,
+					Instance: p.Instance,
+					Value:    fmt.Sprint(p.Value),
+					Position: posString(p.Pos),
+				})
+			}
+			lr.Rules = append(lr.Rules, ir)
+		}
+		result.Layers = append(result.Layers, lr)
+	}
+	return result, nil
+}
+
+func parseInspectJSON(r *http.Request) ([]string, int, map[string]interface{}, error) {
+	req := inspectRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, 0, nil, fmt.Errorf("invalid request: %v", err)
+	}
+	layers := req.Layers
+	if req.Layer != "" {
+		layers = append(layers, req.Layer)
+	}
+	if len(layers) == 0 {
+		return nil, 0, nil, errors.New("missing layer")
+	}
+	if req.Zoom == nil {
+		return nil, 0, nil, errors.New("missing zoom")
+	}
+
+	attrs := req.Attributes
+	if req.Feature != nil {
+		attrs = req.Feature.Properties
+		if req.Feature.Geometry != nil {
+			if attrs == nil {
+				attrs = make(map[string]interface{})
+			}
+			if t, ok := geometryTypes[strings.ToLower(req.Feature.Geometry.Type)]; ok {
+				attrs[geometryTypeField] = t
+			}
+		}
+	}
+	return layers, *req.Zoom, attrs, nil
+}
+
+// geometryTypeField is set to the geometry type of GeoJSON features, as
+// filters on this field are added for layers with mixed geometries.
+const geometryTypeField = "mapnik::geometry_type"
+
+var geometryTypes = map[string]float64{
+	"point":           1,
+	"multipoint":      1,
+	"linestring":      2,
+	"multilinestring": 2,
+	"polygon":         3,
+	"multipolygon":    3,
+}
+
+// parseInspectQuery parses GetFeatureInfo-style requests. Attributes are
+// passed as attr.<name>=<value>. Numeric values are converted to numbers.
+func parseInspectQuery(r *http.Request) ([]string, int, map[string]interface{}, error) {
+	var layers []string
+	var zoom int = -1
+	attrs := make(map[string]interface{})
+	for k, vs := range r.URL.Query() {
+		v := vs[0]
+		switch strings.ToUpper(k) {
+		case "QUERY_LAYERS", "LAYERS", "LAYER":
+			for _, l := range strings.Split(v, ",") {
+				if l = strings.TrimSpace(l); l != "" {
+					layers = append(layers, l)
+				}
+			}
+		case "ZOOM":
+			z, err := strconv.ParseUint(v, 10, 8)
+			if err != nil {
+				return nil, 0, nil, fmt.Errorf("invalid zoom '%s'", v)
+			}
+			zoom = int(z)
+		case "GEOMETRY_TYPE":
+			t, ok := geometryTypes[strings.ToLower(v)]
+			if !ok {
+				return nil, 0, nil, fmt.Errorf("invalid geometry_type '%s'", v)
+			}
+			attrs[geometryTypeField] = t
+		default:
+			if len(k) > 5 && strings.EqualFold(k[:5], "attr.") {
+				attrs[k[5:]] = queryValue(v)
+			}
+		}
+	}
+	if len(layers) == 0 {
+		return nil, 0, nil, errors.New("missing QUERY_LAYERS")
+	}
+	if zoom < 0 {
+		var err error
+		if zoom, err = bboxZoom(r); err != nil {
+			return nil, 0, nil, err
+		}
+	}
+	return layers, zoom, attrs, nil
+}
+
+func queryValue(v string) interface{} {
+	if f, err := strconv.ParseFloat(v, 64); err == nil {
+		return f
+	}
+	return v
+}
+
+// webMercatorZoom0Res is the resolution in meters per pixel of zoom level
+// 0 with 256 pixel tiles.
+const webMercatorZoom0Res = 156543.03392804097
+
+// bboxZoom returns the nearest zoom level for the BBOX and WIDTH of a
+// request in EPSG:3857.
+func bboxZoom(r *http.Request) (int, error) {
+	q := r.URL.Query()
+	get := func(param string) string {
+		for k, vs := range q {
+			if strings.EqualFold(k, param) {
+				return vs[0]
+			}
+		}
+		return ""
+	}
+	bbox, width := get("BBOX"), get("WIDTH")
+	if bbox == "" || width == "" {
+		return 0, errors.New("missing ZOOM or BBOX and WIDTH")
+	}
+	srs := get("CRS")
+	if srs == "" {
+		srs = get("SRS")
+	}
+	if srs != "" && !strings.EqualFold(srs, "EPSG:3857") && !strings.EqualFold(srs, "EPSG:900913") {
+		return 0, fmt.Errorf("unsupported SRS '%s' for BBOX, use ZOOM", srs)
+	}
+	b, ok := parseBounds(bbox)
+	w, err := strconv.ParseFloat(width, 64)
+	if !ok || err != nil || w <= 0 || b.MaxX <= b.MinX {
+		return 0, errors.New("invalid BBOX or WIDTH")
+	}
+	res := (b.MaxX - b.MinX) / w
+	zoom := int(math.Floor(math.Log2(webMercatorZoom0Res/res) + 0.5))
+	if zoom < 0 {
+		zoom = 0
+	}
+	return zoom, nil
+}
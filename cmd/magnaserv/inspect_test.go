@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"github.com/omniscale/magnacarto/config"
+)
+
+func inspectHandler() http.Handler {
+	s := &magnaserv{config: &config.Magnacarto{StylesDir: "../../regression/cases"}}
+	r := mux.NewRouter()
+	r.HandleFunc("/inspect/{project:.*}", s.inspect)
+	return r
+}
+
+func inspect(t *testing.T, r *http.Request) (int, *inspectResult) {
+	w := httptest.NewRecorder()
+	inspectHandler().ServeHTTP(w, r)
+	if w.Code != 200 {
+		return w.Code, nil
+	}
+	result := &inspectResult{}
+	if err := json.Unmarshal(w.Body.Bytes(), result); err != nil {
+		t.Fatal(err)
+	}
+	return w.Code, result
+}
+
+func TestInspect(t *testing.T) {
+	code, result := inspect(t, httptest.NewRequest("GET", "/inspect/010-linestrings-default/test?QUERY_LAYERS=test&ZOOM=10&attr.id=1", nil))
+	if code != 200 {
+		t.Fatal("unexpected status", code)
+	}
+	if result.Zoom != 10 || len(result.Layers) != 1 || len(result.Layers[0].Rules) != 1 {
+		t.Fatal("unexpected result", result)
+	}
+	rule := result.Layers[0].Rules[0]
+	if len(rule.Filters) != 1 || rule.Filters[0].Filter != "id = 1" {
+		t.Error("unexpected filters", rule.Filters)
+	}
+	if len(rule.Filters[0].Positions) != 1 || rule.Filters[0].Positions[0] != "test.mss:6:6" {
+		t.Error("unexpected filter positions", rule.Filters[0].Positions)
+	}
+	if len(rule.Properties) != 3 {
+		t.Fatal("unexpected properties", rule.Properties)
+	}
+	if p := rule.Properties[0]; p.Name != "line-color" || p.Position != "test.mss:8:9" {
+		t.Error("unexpected property", p)
+	}
+	if p := rule.Properties[1]; p.Name != "line-opacity" || p.Value != "0.3" {
+		t.Error("unexpected property", p)
+	}
+	if p := rule.Properties[2]; p.Name != "line-width" || p.Position != "test.mss:4:5" {
+		t.Error("unexpected property", p)
+	}
+
+	// zoom from bbox
+	code, result = inspect(t, httptest.NewRequest("GET", "/inspect/010-linestrings-default/test?REQUEST=GetFeatureInfo&QUERY_LAYERS=test&CRS=EPSG:3857&BBOX=0,0,4891.97,2445.98&WIDTH=256&HEIGHT=128&attr.id=2", nil))
+	if code != 200 {
+		t.Fatal("unexpected status", code)
+	}
+	if result.Zoom != 13 {
+		t.Error("unexpected zoom", result.Zoom)
+	}
+	if rule := result.Layers[0].Rules[0]; len(rule.Filters) != 0 || len(rule.Properties) != 1 {
+		t.Error("unexpected rule", rule)
+	}
+
+	// string is not equal to number
+	body := `{"layer": "test", "zoom": 10, "feature": {"type": "Feature", "properties": {"id": "1"}, "geometry": {"type": "LineString", "coordinates": []}}}`
+	code, result = inspect(t, httptest.NewRequest("POST", "/inspect/010-linestrings-default/test", strings.NewReader(body)))
+	if code != 200 {
+		t.Fatal("unexpected status", code)
+	}
+	if rule := result.Layers[0].Rules[0]; len(rule.Filters) != 0 {
+		t.Error("unexpected rule", rule)
+	}
+
+	for _, tt := range []struct {
+		r    *http.Request
+		code int
+	}{
+		{httptest.NewRequest("GET", "/inspect/010-linestrings-default/test?ZOOM=10", nil), 400},
+		{httptest.NewRequest("GET", "/inspect/010-linestrings-default/test?QUERY_LAYERS=test", nil), 400},
+		{httptest.NewRequest("GET", "/inspect/010-linestrings-default/test?QUERY_LAYERS=test&SRS=EPSG:4326&BBOX=8,53,9,54&WIDTH=100", nil), 400},
+		{httptest.NewRequest("GET", "/inspect/010-linestrings-default/test?QUERY_LAYERS=unknown&ZOOM=10", nil), 400},
+		{httptest.NewRequest("POST", "/inspect/010-linestrings-default/test", strings.NewReader(`{"layer": "test"}`)), 400},
+		{httptest.NewRequest("GET", "/inspect/missing?QUERY_LAYERS=test&ZOOM=10", nil), 404},
+	} {
+		if code, _ := inspect(t, tt.r); code != tt.code {
+			t.Error("unexpected status", code, "for", tt.r.URL)
+		}
+	}
+}
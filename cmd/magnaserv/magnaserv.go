@@ -28,10 +28,14 @@ import (
 	"github.com/omniscale/magnacarto/builder"
 	mapnikBuilder "github.com/omniscale/magnacarto/builder/mapnik"
 	"github.com/omniscale/magnacarto/builder/mapserver"
+	nativeBuilder "github.com/omniscale/magnacarto/builder/native"
 	"github.com/omniscale/magnacarto/config"
+	"github.com/omniscale/magnacarto/legend"
 	"github.com/omniscale/magnacarto/maps"
 	mssPkg "github.com/omniscale/magnacarto/mss"
 	"github.com/omniscale/magnacarto/render"
+	"github.com/omniscale/magnacarto/render/native"
+	"github.com/omniscale/magnacarto/tiles"
 
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
@@ -44,6 +48,9 @@ type magnaserv struct {
 	defaultMaker      builder.MapMaker
 	mapnikRenderer    *render.Mapnik
 	mapserverRenderer *render.MapServer
+	nativeRenderer    *native.Renderer
+	tileRenderer      *tiles.Renderer
+	legendStyles      *legend.StyleCache
 
 	// feedbackChan maps random websocket IDs (wsID) to channels
 	feedbackChans   map[string]chan feedback
@@ -88,19 +95,7 @@ func (s *magnaserv) render(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var maker builder.MapMaker
-	renderer := mapReq.Query.Get("RENDERER")
-	switch renderer {
-	case "mapnik":
-		maker = s.mapnikMaker
-	case "mapserver":
-		maker = mapserver.Maker
-	default:
-		maker = s.defaultMaker
-		if mapserver.Maker == s.defaultMaker {
-			renderer = "mapserver"
-		}
-	}
+	maker, renderer := s.mapMaker(mapReq.Query.Get("RENDERER"))
 
 	wsID := mapReq.Query.Get("WSID")
 	styleFile := mapReq.Query.Get("FILE")
@@ -123,13 +118,18 @@ func (s *magnaserv) render(w http.ResponseWriter, r *http.Request) {
 	}
 	var warnings []string
 	w.Header().Add("Content-Type", "image/png")
-	if renderer == "mapserver" {
+	switch renderer {
+	case "mapserver":
 		mapReq.Format = mapReq.Query.Get("FORMAT") // use requested format, not internal mapnik format
 		if s.mapserverRenderer == nil {
 			err = errors.New("mapserver not initialized")
+		} else {
+			warnings, err = s.mapserverRenderer.Render(styleFile, w, renderReq(mapReq))
 		}
-		warnings, err = s.mapserverRenderer.Render(styleFile, w, renderReq(mapReq))
-	} else {
+	case "native":
+		mapReq.Format = mapReq.Query.Get("FORMAT")
+		warnings, err = s.nativeRenderer.Render(styleFile, w, renderReq(mapReq))
+	default:
 		if s.mapnikRenderer == nil {
 			err = errors.New("mapnik not initialized")
 		} else {
@@ -147,6 +147,106 @@ func (s *magnaserv) render(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// mapMaker returns the maker for the requested renderer (mapnik,
+// mapserver or native) and the name of the renderer. Returns the default
+// maker for all other renderers.
+func (s *magnaserv) mapMaker(renderer string) (builder.MapMaker, string) {
+	switch renderer {
+	case "mapnik":
+		return s.mapnikMaker, renderer
+	case "mapserver":
+		return mapserver.Maker, renderer
+	case "native":
+		return nativeBuilder.Maker, renderer
+	}
+	switch s.defaultMaker {
+	case mapserver.Maker:
+		return s.defaultMaker, "mapserver"
+	case nativeBuilder.Maker:
+		return s.defaultMaker, "native"
+	}
+	return s.defaultMaker, "mapnik"
+}
+
+// tile renders XYZ tiles of a project in Web Mercator.
+func (s *magnaserv) tile(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	t := tiles.Tile{}
+	var err error
+	for _, v := range []struct {
+		dst  *int
+		name string
+	}{{&t.Z, "z"}, {&t.X, "x"}, {&t.Y, "y"}} {
+		if *v.dst, err = strconv.Atoi(vars[v.name]); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+	}
+	if !t.Valid() {
+		http.NotFound(w, r)
+		return
+	}
+	scale := 1
+	if vars["scale"] == "@2x" {
+		scale = 2
+	}
+
+	// mux returns safe path (e.g no /-root or ../ tricks)
+	mmlFile := filepath.Join(s.config.StylesDir, filepath.FromSlash(vars["project"])+".mml")
+	if _, err := os.Stat(mmlFile); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	maker, renderer := s.mapMaker(r.FormValue("renderer"))
+	styleFile, err := s.builderCache.StyleFile(maker, mmlFile, nil)
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	styleKey, err := tiles.StyleKey(styleFile, renderer)
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+
+	renderPNG := s.pngRenderFunc(renderer)
+	data, err := s.tileRenderer.Tile(styleKey, t, scale, func(req render.Request, w io.Writer) error {
+		return renderPNG(styleFile, req, w)
+	})
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	w.Header().Add("Content-Type", "image/png")
+	w.Write(data)
+}
+
+// pngRenderFunc returns a function that renders style files of the
+// renderer (mapnik, mapserver or native) as PNG.
+func (s *magnaserv) pngRenderFunc(renderer string) func(styleFile string, req render.Request, w io.Writer) error {
+	return func(styleFile string, req render.Request, w io.Writer) error {
+		if renderer == "mapserver" {
+			if s.mapserverRenderer == nil {
+				return errors.New("mapserver not initialized")
+			}
+			req.Format = "image/png; mode=24bit"
+			_, err := s.mapserverRenderer.Render(styleFile, w, req)
+			return err
+		}
+		if renderer == "native" {
+			req.Format = "image/png"
+			_, err := s.nativeRenderer.Render(styleFile, w, req)
+			return err
+		}
+		if s.mapnikRenderer == nil {
+			return errors.New("mapnik not initialized")
+		}
+		req.Format = "png32"
+		return s.mapnikRenderer.Render(styleFile, w, req)
+	}
+}
+
 func (s *magnaserv) sendFeedback(wsID string, err error, warnings []string, mml string, mss []string) {
 	s.feedbackChansMu.Lock()
 	defer s.feedbackChansMu.Unlock()
@@ -325,6 +425,7 @@ func renderReq(r *maps.Request) render.Request {
 	result.EPSGCode = r.EPSGCode
 	result.Format = r.Format
 	result.ScaleFactor = r.ScaleFactor
+	result.Layers = r.Layers
 	return result
 }
 
@@ -345,17 +446,7 @@ func (s *magnaserv) changes(ws *websocket.Conn) {
 		return
 	}
 
-	var maker builder.MapMaker
-
-	renderer := ws.Request().Form.Get("renderer")
-	switch renderer {
-	case "mapnik":
-		maker = s.mapnikMaker
-	case "mapserver":
-		maker = mapserver.Maker
-	default:
-		maker = s.defaultMaker
-	}
+	maker, _ := s.mapMaker(ws.Request().Form.Get("renderer"))
 
 	closeNotify := make(chan struct{})
 
@@ -505,6 +596,18 @@ func findAppDir() string {
 
 const DefaultConfigFile = "magnaserv.tml"
 
+// pruneInterval returns how often the disk tile cache with maxAge is pruned.
+func pruneInterval(maxAge time.Duration) time.Duration {
+	d := maxAge / 4
+	if d < time.Minute {
+		d = time.Minute
+	}
+	if d > time.Hour {
+		d = time.Hour
+	}
+	return d
+}
+
 func main() {
 	if os.Getenv("GOMAXPROCS") == "" {
 		runtime.GOMAXPROCS(runtime.NumCPU())
@@ -512,8 +615,12 @@ func main() {
 
 	var listenAddr = flag.String("listen", "localhost:7070", "listen address")
 	var configFile = flag.String("config", DefaultConfigFile, "config")
-	var builderType = flag.String("builder", "mapnik", "builder type {mapnik,mapnik3-proj4,mapserver}")
+	var builderType = flag.String("builder", "mapnik", "builder type {mapnik,mapnik3-proj4,mapserver,native}")
 	var version = flag.Bool("version", false, "print version and exit")
+	var tileCacheDir = flag.String("tile-cache-dir", "", "cache tiles in this directory, instead of memory")
+	var tileCacheMaxAge = flag.Duration("tile-cache-max-age", 24*time.Hour, "remove cached tiles from -tile-cache-dir after this duration (0 keeps all tiles)")
+	var metaTileSize = flag.Int("metatile-size", 4, "render tiles as metatiles of NxN tiles")
+	var metaTileBuffer = flag.Int("metatile-buffer", 64, "render metatiles with a buffer of N pixels")
 
 	flag.Parse()
 
@@ -537,27 +644,56 @@ func main() {
 		builderCache.SetDestination(conf.OutDir)
 	}
 
+	legendStyles := legend.NewStyleCache(conf.OutDir)
+
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 	go func() {
 		for _ = range c {
 			builderCache.ClearAll()
+			legendStyles.ClearAll()
 			os.Exit(1)
 		}
 	}()
 
+	var tileCache tiles.Cache = tiles.NewMemoryCache(4096)
+	if *tileCacheDir != "" {
+		diskCache := tiles.NewDiskCache(*tileCacheDir, *tileCacheMaxAge)
+		if *tileCacheMaxAge > 0 {
+			go func() {
+				for {
+					if err := diskCache.Prune(); err != nil {
+						log.Print("pruning tile cache: ", err)
+					}
+					time.Sleep(pruneInterval(*tileCacheMaxAge))
+				}
+			}()
+		}
+		tileCache = diskCache
+	}
+
 	r := mux.NewRouter()
-	handler := magnaserv{config: conf, builderCache: builderCache}
+	handler := magnaserv{config: conf, builderCache: builderCache, legendStyles: legendStyles}
+	handler.tileRenderer = tiles.NewRenderer(tileCache, *metaTileSize, *metaTileBuffer)
 	handler.mapnikMaker = mapnikBuilder.Maker3
 	if *builderType == "mapnik3-proj4" {
 		handler.mapnikMaker = mapnikBuilder.Maker3Proj4
 	}
 
-	mapnikRenderer, err := render.NewMapnik()
+	healthCheckInterval := conf.Mapnik.HealthCheckInterval
+	if healthCheckInterval == 0 {
+		// also without config file
+		healthCheckInterval = config.DefaultHealthCheckInterval
+	}
+	mapnikRenderer, err := render.NewMapnikPool(render.MapnikOptions{
+		Size:                conf.Mapnik.PoolSize,
+		Timeout:             conf.Mapnik.CallTimeout,
+		HealthCheckInterval: healthCheckInterval,
+	})
 	if err != nil {
 		log.Print("Mapnik plugin: ", err)
 	} else {
-		log.Print("Mapnik plugin available")
+		log.Printf("Mapnik plugin available (%d processes)", mapnikRenderer.Size())
 		mapnikRenderer.CacheLoadedMap(conf.Mapnik.CacheWaitTimeout)
 		for _, fontDir := range conf.Mapnik.FontDirs {
 			mapnikRenderer.RegisterFonts(fontDir)
@@ -573,17 +709,27 @@ func main() {
 		handler.mapserverRenderer = mapserverRenderer
 	}
 
+	// the native renderer is always available
+	handler.nativeRenderer = native.New()
+
 	switch *builderType {
 	case "mapnik", "mapnik3", "mapnik3-proj4":
 		handler.defaultMaker = handler.mapnikMaker
 	case "mapserver":
 		handler.defaultMaker = mapserver.Maker
+	case "native":
+		handler.defaultMaker = nativeBuilder.Maker
 	default:
 		log.Fatal("unknown -builder ", *builderType)
 	}
 
 	v1 := r.PathPrefix("/api/v1").Subrouter()
 	v1.HandleFunc("/map", handler.render)
+	v1.HandleFunc("/compare", handler.compare)
+	v1.HandleFunc("/wms/{project:.*}", handler.wms)
+	v1.HandleFunc("/inspect/{project:.*}", handler.inspect)
+	v1.HandleFunc("/diff/{project:.*}", handler.diff)
+	v1.HandleFunc("/tiles/{project:.*?}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}{scale:(?:@2x)?}.png", handler.tile)
 	v1.HandleFunc("/projects/{path:.*?}.mml", handler.mml)
 	v1.HandleFunc("/projects/{path:.*?}.mcp", handler.mcp)
 	v1.HandleFunc("/projects", handler.projects)
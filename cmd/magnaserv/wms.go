@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/omniscale/magnacarto/legend"
+	"github.com/omniscale/magnacarto/maps"
+	"github.com/omniscale/magnacarto/mml"
+)
+
+// wmsEPSGCodes are always advertised in the capabilities, in addition to
+// the SRS of the MML. Both renderers support all EPSG codes of the
+// installed proj.
+var wmsEPSGCodes = []int{4326, 3857}
+
+var epsgRegexp = regexp.MustCompile(`(?i)epsg:(\d+)`)
+
+// worldBBOX is the extent of Web Mercator in EPSG:4326.
+var worldBBOX = maps.BBOX{MinX: -180, MinY: -85.0511287798, MaxX: 180, MaxY: 85.0511287798}
+
+// wms serves a WMS 1.1.1/1.3.0 for a project. All layers of the MML are
+// available as named layers. GetLegendGraphic returns the legend of a
+// single layer.
+func (s *magnaserv) wms(w http.ResponseWriter, r *http.Request) {
+	wmsReq, err := maps.ParseWMSRequest(r)
+	if err != nil {
+		maps.WriteServiceException(w, wmsReq.Version, err)
+		return
+	}
+
+	// mux returns safe path (e.g no /-root or ../ tricks)
+	project := mux.Vars(r)["project"]
+	mmlFile := filepath.Join(s.config.StylesDir, filepath.FromSlash(project)+".mml")
+	f, err := os.Open(mmlFile)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	m, err := mml.Parse(f)
+	f.Close()
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+
+	if wmsReq.Request == "GetCapabilities" {
+		title := m.Name
+		if title == "" {
+			title = project
+		}
+		if wmsReq.Version == maps.WMS111 {
+			w.Header().Set("Content-Type", "application/vnd.ogc.wms_xml")
+		} else {
+			w.Header().Set("Content-Type", "text/xml")
+		}
+		if err := maps.WriteCapabilities(w, wmsReq.Version, wmsCapabilities(m, title, serviceURL(r))); err != nil {
+			log.Print(err)
+		}
+		return
+	}
+
+	if wmsReq.Request == "GetLegendGraphic" {
+		s.legendGraphic(w, wmsReq, m, mmlFile)
+		return
+	}
+
+	mapReq := wmsReq.Map
+	if err := checkLayers(m, mapReq.Layers); err != nil {
+		maps.WriteServiceException(w, wmsReq.Version, err)
+		return
+	}
+
+	maker, renderer := s.mapMaker(mapReq.Query.Get("RENDERER"))
+	styleFile, err := s.builderCache.StyleFile(maker, mmlFile, nil)
+	if err != nil {
+		log.Print(err)
+		maps.WriteServiceException(w, wmsReq.Version, err)
+		return
+	}
+
+	buf := bytes.Buffer{}
+	if renderer == "mapserver" {
+		mapReq.Format = mapReq.Query.Get("FORMAT") // use requested format, not internal mapnik format
+		if s.mapserverRenderer == nil {
+			err = errors.New("mapserver not initialized")
+		} else {
+			_, err = s.mapserverRenderer.Render(styleFile, &buf, renderReq(mapReq))
+		}
+	} else if renderer == "native" {
+		mapReq.Format = mapReq.Query.Get("FORMAT")
+		_, err = s.nativeRenderer.Render(styleFile, &buf, renderReq(mapReq))
+	} else {
+		if s.mapnikRenderer == nil {
+			err = errors.New("mapnik not initialized")
+		} else {
+			err = s.mapnikRenderer.Render(styleFile, &buf, renderReq(mapReq))
+		}
+	}
+	if err != nil {
+		log.Print(err)
+		maps.WriteServiceException(w, wmsReq.Version, err)
+		return
+	}
+
+	contentType := "image/png"
+	if mapReq.Format == "jpeg" || strings.HasPrefix(mapReq.Format, "image/jpeg") {
+		contentType = "image/jpeg"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write(buf.Bytes())
+}
+
+// legendGraphic renders the legend of a single layer as PNG, JSON or
+// HTML. The zoom level defaults to the center of the MML.
+func (s *magnaserv) legendGraphic(w http.ResponseWriter, wmsReq *maps.WMSRequest, m *mml.MML, mmlFile string) {
+	legendReq := wmsReq.Legend
+	if err := checkLayers(m, []string{legendReq.Layer}); err != nil {
+		maps.WriteServiceException(w, wmsReq.Version, err)
+		return
+	}
+	l, err := legend.Load(mmlFile, legendReq.Zoom, []string{legendReq.Layer})
+	if err != nil {
+		log.Print(err)
+		maps.WriteServiceException(w, wmsReq.Version, err)
+		return
+	}
+
+	maker, renderer := s.mapMaker(legendReq.Query.Get("RENDERER"))
+	locator := s.config.Locator()
+	locator.SetBaseDir(filepath.Dir(mmlFile))
+	locator.UseRelPaths(false)
+	opts := legend.Options{ScaleFactor: legendReq.ScaleFactor, StyleCache: s.legendStyles}
+	renderFunc := s.pngRenderFunc(renderer)
+
+	if legendReq.Format == "png" {
+		data, err := l.Image(maker, locator, opts, renderFunc)
+		if err != nil {
+			log.Print(err)
+			maps.WriteServiceException(w, wmsReq.Version, err)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(data)
+		return
+	}
+
+	if err := l.RenderSwatches(maker, locator, opts, renderFunc); err != nil {
+		log.Print(err)
+		maps.WriteServiceException(w, wmsReq.Version, err)
+		return
+	}
+	if legendReq.Format == "html" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err = l.WriteHTML(w)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		err = l.WriteJSON(w)
+	}
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+// wmsCapabilities returns the capabilities with all layers of the MML.
+// Layers without extent use the bounds of the MML or the whole world.
+func wmsCapabilities(m *mml.MML, title, url string) maps.Capabilities {
+	c := maps.Capabilities{
+		Title:     title,
+		URL:       url,
+		EPSGCodes: append([]int(nil), wmsEPSGCodes...),
+		BBOX:      worldBBOX,
+	}
+	addSRS := func(srs string) {
+		match := epsgRegexp.FindStringSubmatch(srs)
+		if match == nil {
+			return
+		}
+		code, _ := strconv.Atoi(match[1])
+		for _, existing := range c.EPSGCodes {
+			if existing == code {
+				return
+			}
+		}
+		c.EPSGCodes = append(c.EPSGCodes, code)
+	}
+	addSRS(m.Map.SRS)
+	if b, ok := parseBounds(m.Parameters["bounds"]); ok {
+		c.BBOX = b
+	}
+	for _, l := range m.Layers {
+		addSRS(l.SRS)
+		layer := maps.CapabilitiesLayer{Name: l.ID, Title: l.ID, BBOX: c.BBOX}
+		if e := l.Extent; e != nil {
+			layer.BBOX = maps.BBOX{MinX: e[0], MinY: e[1], MaxX: e[2], MaxY: e[3]}
+		}
+		c.Layers = append(c.Layers, layer)
+	}
+	return c
+}
+
+// parseBounds parses "minx,miny,maxx,maxy" bounds of MML parameters.
+func parseBounds(bounds string) (maps.BBOX, bool) {
+	parts := strings.Split(bounds, ",")
+	if len(parts) != 4 {
+		return maps.BBOX{}, false
+	}
+	var f [4]float64
+	for i, p := range parts {
+		var err error
+		if f[i], err = strconv.ParseFloat(strings.TrimSpace(p), 64); err != nil {
+			return maps.BBOX{}, false
+		}
+	}
+	return maps.BBOX{MinX: f[0], MinY: f[1], MaxX: f[2], MaxY: f[3]}, true
+}
+
+// checkLayers returns a LayerNotDefined exception if any layer is not
+// in the MML.
+func checkLayers(m *mml.MML, layers []string) error {
+	ids := make(map[string]struct{}, len(m.Layers))
+	for _, l := range m.Layers {
+		ids[l.ID] = struct{}{}
+	}
+	for _, l := range layers {
+		if _, ok := ids[l]; !ok {
+			return &maps.ServiceException{Code: "LayerNotDefined", Msg: fmt.Sprintf("unknown layer '%s'", l)}
+		}
+	}
+	return nil
+}
+
+// serviceURL returns the URL of the request without query, for the
+// OnlineResource of the capabilities.
+func serviceURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host + r.URL.Path + "?"
+}
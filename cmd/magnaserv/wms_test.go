@@ -0,0 +1,169 @@
+package main
+
+import (
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"github.com/omniscale/magnacarto/builder"
+	"github.com/omniscale/magnacarto/builder/mapnik"
+	"github.com/omniscale/magnacarto/config"
+	"github.com/omniscale/magnacarto/maps"
+	"github.com/omniscale/magnacarto/mml"
+	"github.com/omniscale/magnacarto/render/native"
+)
+
+func wmsHandler() http.Handler {
+	s := &magnaserv{config: &config.Magnacarto{StylesDir: "../../regression/cases"}, defaultMaker: mapnik.Maker3}
+	r := mux.NewRouter()
+	r.HandleFunc("/wms/{project:.*}", s.wms)
+	return r
+}
+
+func TestWMSCapabilities(t *testing.T) {
+	for _, tt := range []struct {
+		query       string
+		contentType string
+		contains    []string
+	}{
+		{
+			"SERVICE=WMS&REQUEST=GetCapabilities",
+			"text/xml",
+			[]string{
+				`<WMS_Capabilities version="1.3.0"`,
+				`<OnlineResource xlink:href="http://example.org/wms/010-linestrings-default/test?"/>`,
+				`<Name>test</Name>`,
+				`<westBoundLongitude>-180</westBoundLongitude>`,
+				`<CRS>EPSG:3857</CRS>`,
+			},
+		},
+		{
+			"SERVICE=WMS&REQUEST=GetCapabilities&VERSION=1.1.1",
+			"application/vnd.ogc.wms_xml",
+			[]string{
+				`<WMT_MS_Capabilities version="1.1.1">`,
+				`<Name>test</Name>`,
+				`<LatLonBoundingBox minx="9.8876" miny="53.4926" maxx="10.0895" maxy="53.5913"/>`,
+			},
+		},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "http://example.org/wms/010-linestrings-default/test?"+tt.query, nil)
+		wmsHandler().ServeHTTP(w, r)
+
+		if w.Code != 200 {
+			t.Fatal("unexpected status", w.Code)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != tt.contentType {
+			t.Error("unexpected content type", ct)
+		}
+		for _, c := range tt.contains {
+			if !strings.Contains(w.Body.String(), c) {
+				t.Errorf("%s not found in %s", c, w.Body.String())
+			}
+		}
+	}
+}
+
+func TestWMSExceptions(t *testing.T) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/wms/010-linestrings-default/test?SERVICE=WMS&REQUEST=GetMap&VERSION=1.1.1&LAYERS=test,unknown&STYLES=&SRS=EPSG:4326&BBOX=8,53,10,54&WIDTH=200&HEIGHT=100&FORMAT=image/png", nil)
+	wmsHandler().ServeHTTP(w, r)
+	if ct := w.Header().Get("Content-Type"); ct != "application/vnd.ogc.se_xml" {
+		t.Error("unexpected content type", ct)
+	}
+	if !strings.Contains(w.Body.String(), `<ServiceException code="LayerNotDefined">unknown layer &#39;unknown&#39;</ServiceException>`) {
+		t.Error("unexpected exception", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/wms/missing?SERVICE=WMS&REQUEST=GetCapabilities", nil)
+	wmsHandler().ServeHTTP(w, r)
+	if w.Code != 404 {
+		t.Error("unexpected status for missing project", w.Code)
+	}
+}
+
+func TestWMSLegendGraphic(t *testing.T) {
+	for _, tt := range []struct {
+		query    string
+		contains string
+	}{
+		{"LAYER=unknown", `<ServiceException code="LayerNotDefined">`},
+		{"LAYER=test&FORMAT=image/gif", `<ServiceException code="InvalidFormat">`},
+		// renderer is not available in tests
+		{"LAYER=test&ZOOM=14", `<ServiceException>mapnik not initialized</ServiceException>`},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/wms/010-linestrings-default/test?SERVICE=WMS&REQUEST=GetLegendGraphic&"+tt.query, nil)
+		wmsHandler().ServeHTTP(w, r)
+		if !strings.Contains(w.Body.String(), tt.contains) {
+			t.Errorf("%s not found in %s", tt.contains, w.Body.String())
+		}
+	}
+}
+
+func TestWMSGetMapNative(t *testing.T) {
+	conf := &config.Magnacarto{StylesDir: "../../regression/cases"}
+	s := &magnaserv{
+		config:         conf,
+		builderCache:   builder.NewCache(conf.Locator),
+		defaultMaker:   mapnik.Maker3,
+		nativeRenderer: native.New(),
+	}
+	defer s.builderCache.ClearAll()
+	r := mux.NewRouter()
+	r.HandleFunc("/wms/{project:.*}", s.wms)
+
+	for _, tt := range []struct {
+		query string
+		size  [2]int
+	}{
+		{"REQUEST=GetMap&VERSION=1.1.1&LAYERS=test&STYLES=&SRS=EPSG:4326&BBOX=9.9,53.5,10.0,53.6&WIDTH=200&HEIGHT=100&FORMAT=image/png&RENDERER=native", [2]int{200, 100}},
+		{"REQUEST=GetLegendGraphic&LAYER=test&ZOOM=14&FORMAT=image/png&RENDERER=native", [2]int{0, 0}},
+	} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/wms/010-linestrings-default/test?SERVICE=WMS&"+tt.query, nil)
+		r.ServeHTTP(w, req)
+		if ct := w.Header().Get("Content-Type"); ct != "image/png" {
+			t.Fatalf("unexpected content type %s: %s", ct, w.Body.String())
+		}
+		img, err := png.Decode(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size := img.Bounds().Size(); tt.size[0] != 0 && (size.X != tt.size[0] || size.Y != tt.size[1]) {
+			t.Error("unexpected image size", size)
+		}
+	}
+}
+
+func TestWMSCapabilitiesSRS(t *testing.T) {
+	f, err := os.Open("../../regression/cases/010-linestrings-default/test.mml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := mml.Parse(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Map.SRS = "+init=epsg:25832"
+	m.Layers[0].SRS = "EPSG:4326"
+
+	c := wmsCapabilities(m, "test", "http://localhost/")
+	if len(c.EPSGCodes) != 3 || c.EPSGCodes[2] != 25832 {
+		t.Error("unexpected EPSG codes", c.EPSGCodes)
+	}
+	if c.BBOX != (maps.BBOX{MinX: 9.8876, MinY: 53.4926, MaxX: 10.0895, MaxY: 53.5913}) {
+		t.Error("unexpected bbox", c.BBOX)
+	}
+	if c.Layers[0].BBOX.MinX != -179.999999974944 {
+		t.Error("unexpected layer bbox", c.Layers[0].BBOX)
+	}
+}
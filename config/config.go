@@ -2,6 +2,7 @@
 package config
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
 	"sort"
@@ -21,10 +22,20 @@ type Magnacarto struct {
 	BaseDir     string
 }
 
+// DefaultHealthCheckInterval is used for Mapnik.HealthCheckInterval if it
+// is not set.
+const DefaultHealthCheckInterval = 30 * time.Second
+
 type Mapnik struct {
 	PluginDirs       []string      `toml:"plugin_dirs"`
 	FontDirs         []string      `toml:"font_dirs"`
 	CacheWaitTimeout time.Duration `toml:"cache_wait_timeout"`
+	// PoolSize is the number of Mapnik plugin processes of magnaserv.
+	PoolSize    int           `toml:"pool_size"`
+	CallTimeout time.Duration `toml:"call_timeout"`
+	// HealthCheckInterval defaults to DefaultHealthCheckInterval.
+	// Negative intervals disable the health check.
+	HealthCheckInterval time.Duration `toml:"health_check_interval"`
 }
 
 type Datasource struct {
@@ -57,6 +68,24 @@ type Locator interface {
 	MissingFiles() []string
 }
 
+// PgRasterLocator is implemented by Locators that set the connection
+// parameters of PostGIS raster datasources.
+type PgRasterLocator interface {
+	PgRaster(mml.PgRaster) mml.PgRaster
+}
+
+// MissingNamesLocator is implemented by Locators that report the names
+// of missing files, as they were referenced by the style.
+type MissingNamesLocator interface {
+	MissingNames() []string
+}
+
+// LocatedFilesLocator is implemented by Locators that report all files
+// they found.
+type LocatedFilesLocator interface {
+	LocatedFiles() []string
+}
+
 func Load(fileName string) (*Magnacarto, error) {
 	config := Magnacarto{}
 	config.BaseDir = filepath.Dir(fileName)
@@ -77,6 +106,12 @@ func Load(fileName string) (*Magnacarto, error) {
 	if config.Mapnik.CacheWaitTimeout == 0 {
 		config.Mapnik.CacheWaitTimeout = 5 * time.Second
 	}
+	if config.Mapnik.PoolSize == 0 {
+		config.Mapnik.PoolSize = 1
+	}
+	if config.Mapnik.HealthCheckInterval == 0 {
+		config.Mapnik.HealthCheckInterval = DefaultHealthCheckInterval
+	}
 
 	return &config, nil
 }
@@ -129,16 +164,19 @@ func (m *Magnacarto) Locator() Locator {
 }
 
 type LookupLocator struct {
-	fontDirs   []string
-	sqliteDirs []string
-	shapeDirs  []string
-	imageDirs  []string
-	dataDirs   []string
-	pgConfig   *PostGIS
-	baseDir    string
-	outDir     string
-	relative   bool
-	missing    map[string]struct{}
+	fontDirs     []string
+	sqliteDirs   []string
+	shapeDirs    []string
+	imageDirs    []string
+	dataDirs     []string
+	pgConfig     *PostGIS
+	baseDir      string
+	outDir       string
+	relative     bool
+	missing      map[string]struct{}
+	located      map[string]struct{}
+	fontIndex    *fontIndex
+	similarFonts map[string][]string // similar fonts of missing fonts
 }
 
 func (l *LookupLocator) SetBaseDir(dir string) {
@@ -206,8 +244,14 @@ func (l *LookupLocator) find(basename string, dirs []string) (string, bool) {
 		if err == nil {
 			fname = absfname
 		}
+		l.addLocated(fname)
 	}
+	return l.outPath(fname), ok
+}
 
+// outPath returns fname relative to the outDir for relative paths, or
+// as an absolute path.
+func (l *LookupLocator) outPath(fname string) string {
 	if l.relative {
 		relfname, err := filepath.Rel(l.outDir, fname)
 		if err == nil {
@@ -218,12 +262,19 @@ func (l *LookupLocator) find(basename string, dirs []string) (string, bool) {
 			fname = filepath.Join(l.outDir, fname)
 		}
 	}
-	return fname, ok
+	return fname
+}
 
+func (l *LookupLocator) addLocated(fname string) {
+	if l.located == nil {
+		l.located = make(map[string]struct{})
+	}
+	l.located[fname] = struct{}{}
 }
 
 func (l *LookupLocator) AddFontDir(dir string) {
 	l.fontDirs = append(l.fontDirs, dir)
+	l.fontIndex = nil
 }
 func (l *LookupLocator) AddSQLiteDir(dir string) {
 	l.sqliteDirs = append(l.sqliteDirs, dir)
@@ -241,7 +292,22 @@ func (l *LookupLocator) SetPGConfig(pgConfig PostGIS) {
 	l.pgConfig = &pgConfig
 }
 
+// Font returns the file of the font with the face name (e.g. "DejaVu Sans
+// Book"). The names of all fonts in the font dirs are indexed on first
+// use. Fonts that are not indexed are looked up by guessing filenames
+// from the face name.
 func (l *LookupLocator) Font(basename string) string {
+	if l.fontIndex == nil {
+		l.fontIndex = newFontIndex(l.fontDirs)
+	}
+	if file, ok := l.fontIndex.Lookup(basename); ok {
+		if absfile, err := filepath.Abs(file); err == nil {
+			file = absfile
+		}
+		l.addLocated(file)
+		return l.outPath(file)
+	}
+
 	for _, variation := range fontVariations(basename, ".ttf") {
 		if file, ok := l.find(variation, l.fontDirs); ok {
 			return file
@@ -251,6 +317,12 @@ func (l *LookupLocator) Font(basename string) string {
 		}
 	}
 	l.missing[basename] = struct{}{}
+	if similar := l.fontIndex.Similar(basename, 3); len(similar) > 0 {
+		if l.similarFonts == nil {
+			l.similarFonts = make(map[string][]string)
+		}
+		l.similarFonts[basename] = similar
+	}
 	return ""
 }
 
@@ -298,7 +370,39 @@ func (l *LookupLocator) PostGIS(ds mml.PostGIS) mml.PostGIS {
 	return ds
 }
 
+// PgRaster sets the connection parameters like PostGIS.
+func (l *LookupLocator) PgRaster(ds mml.PgRaster) mml.PgRaster {
+	pg := l.PostGIS(mml.PostGIS{
+		Host:     ds.Host,
+		Port:     ds.Port,
+		Database: ds.Database,
+		Username: ds.Username,
+		Password: ds.Password,
+		SRID:     ds.SRID,
+	})
+	ds.Host = pg.Host
+	ds.Port = pg.Port
+	ds.Database = pg.Database
+	ds.Username = pg.Username
+	ds.Password = pg.Password
+	ds.SRID = pg.SRID
+	return ds
+}
+
+// MissingFiles returns all files that were not found. Missing fonts
+// include the names of similar fonts.
 func (l *LookupLocator) MissingFiles() []string {
+	files := l.MissingNames()
+	for i, f := range files {
+		if similar, ok := l.similarFonts[f]; ok {
+			files[i] = fmt.Sprintf("%s (similar fonts: %s)", f, strings.Join(similar, ", "))
+		}
+	}
+	return files
+}
+
+// MissingNames returns the names of all files that were not found.
+func (l *LookupLocator) MissingNames() []string {
 	if len(l.missing) == 0 {
 		return nil
 	}
@@ -310,6 +414,19 @@ func (l *LookupLocator) MissingFiles() []string {
 	return files
 }
 
+// LocatedFiles returns the absolute paths of all files that were found.
+func (l *LookupLocator) LocatedFiles() []string {
+	if len(l.located) == 0 {
+		return nil
+	}
+	files := make([]string, 0, len(l.located))
+	for f := range l.located {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+	return files
+}
+
 var _ Locator = &LookupLocator{}
 
 func fontVariations(font, suffix string) []string {
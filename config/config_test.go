@@ -7,6 +7,7 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestFontVariations(t *testing.T) {
@@ -189,6 +190,31 @@ func TestLookupLocator_AbsPaths(t *testing.T) {
 }
 
 // tmpDirTree creates a temporary directory with (empty) test files
+func TestLookupLocator_LocatedFiles(t *testing.T) {
+	d := newtmpDirTree(t)
+	defer d.remove()
+	d.addFile("img/test.png")
+	d.addFile("shp/file.shp")
+
+	l := LookupLocator{baseDir: d.dir}
+	l.AddImageDir(filepath.Join(d.dir, "img"))
+	if files := l.LocatedFiles(); files != nil {
+		t.Errorf("unexpected located files %v", files)
+	}
+	l.Image("test.png")
+	l.Image("test.png")
+	l.Shape("shp/file.shp")
+	l.Shape("missing.shp")
+
+	expected := []string{filepath.Join(d.dir, "img/test.png"), filepath.Join(d.dir, "shp/file.shp")}
+	if files := l.LocatedFiles(); !reflect.DeepEqual(files, expected) {
+		t.Errorf("unexpected located files %v != %v", files, expected)
+	}
+	if files := l.MissingFiles(); !reflect.DeepEqual(files, []string{"missing.shp"}) {
+		t.Errorf("unexpected missing files %v", files)
+	}
+}
+
 type tmpDirTree struct {
 	dir string
 	t   *testing.T
@@ -219,3 +245,51 @@ func (d *tmpDirTree) remove() {
 		d.t.Fatal("unable to remove tmp dir", err)
 	}
 }
+
+func TestLoad_Mapnik(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magnacarto-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fileName := filepath.Join(dir, "magnacarto.tml")
+	if err := ioutil.WriteFile(fileName, []byte("[mapnik]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := Load(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Mapnik.PoolSize != 1 || conf.Mapnik.CallTimeout != 0 || conf.Mapnik.HealthCheckInterval != 30*time.Second {
+		t.Errorf("unexpected defaults %#v", conf.Mapnik)
+	}
+
+	if err := ioutil.WriteFile(fileName, []byte(`[mapnik]
+pool_size = 4
+call_timeout = "1m"
+health_check_interval = "10s"
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	conf, err = Load(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Mapnik.PoolSize != 4 || conf.Mapnik.CallTimeout != time.Minute || conf.Mapnik.HealthCheckInterval != 10*time.Second {
+		t.Errorf("unexpected config %#v", conf.Mapnik)
+	}
+
+	if err := ioutil.WriteFile(fileName, []byte(`[mapnik]
+health_check_interval = "-1s"
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	conf, err = Load(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Mapnik.HealthCheckInterval >= 0 {
+		t.Errorf("health check not disabled %#v", conf.Mapnik)
+	}
+}
@@ -0,0 +1,384 @@
+package config
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
+
+	"github.com/omniscale/magnacarto/internal/sfnt"
+)
+
+// fontInfo contains the names of a single font from the name table.
+type fontInfo struct {
+	Family           string // name ID 1
+	Subfamily        string // name ID 2
+	FullName         string // name ID 4
+	TypographicName  string // name ID 16
+	TypographicStyle string // name ID 17
+}
+
+// Names returns all names the font can be referenced by (e.g. "Noto Sans
+// CJK JP Bold"). The first name is family and subfamily.
+func (f fontInfo) Names() []string {
+	var names []string
+	add := func(parts ...string) {
+		name := normalizeFontName(strings.Join(parts, " "))
+		if name == "" {
+			return
+		}
+		for _, n := range names {
+			if n == name {
+				return
+			}
+		}
+		names = append(names, name)
+	}
+	if f.Family != "" {
+		add(f.Family, f.Subfamily)
+	}
+	if f.TypographicName != "" {
+		style := f.TypographicStyle
+		if style == "" {
+			style = f.Subfamily
+		}
+		add(f.TypographicName, style)
+	}
+	add(f.FullName)
+	return names
+}
+
+// normalizeFontName returns the name in lower case with single spaces.
+func normalizeFontName(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
+
+var errInvalidFont = sfnt.ErrInvalid
+
+// fontCache caches the fonts of each font file and the index of each set
+// of font dirs, as scanning all fonts is slow and Locators are created
+// for each build (e.g. by magnaserv). Entries are invalidated when the
+// modification time or size of a font file changes.
+var fontCache = struct {
+	sync.Mutex
+	files   map[string]cachedFontFile
+	indexes map[string]cachedFontIndex
+}{
+	files:   make(map[string]cachedFontFile),
+	indexes: make(map[string]cachedFontIndex),
+}
+
+type cachedFontFile struct {
+	modTime time.Time
+	size    int64
+	fonts   []fontInfo
+	err     error
+}
+
+type cachedFontIndex struct {
+	stamp string // paths, modification times and sizes of all files
+	idx   *fontIndex
+}
+
+// readFontFile returns the names of all fonts in a TTF, OTF or TTC file.
+func readFontFile(fname string) ([]fontInfo, error) {
+	fi, err := os.Stat(fname)
+	if err != nil {
+		return nil, err
+	}
+	return cachedReadFontFile(fname, fi)
+}
+
+// cachedReadFontFile returns the fonts of fname from the fontCache, if
+// the file was not modified since it was read.
+func cachedReadFontFile(fname string, fi os.FileInfo) ([]fontInfo, error) {
+	fontCache.Lock()
+	c, ok := fontCache.files[fname]
+	fontCache.Unlock()
+	if ok && c.modTime.Equal(fi.ModTime()) && c.size == fi.Size() {
+		return c.fonts, c.err
+	}
+
+	fonts, err := parseFontFile(fname)
+	fontCache.Lock()
+	fontCache.files[fname] = cachedFontFile{modTime: fi.ModTime(), size: fi.Size(), fonts: fonts, err: err}
+	fontCache.Unlock()
+	return fonts, err
+}
+
+func parseFontFile(fname string) ([]fontInfo, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fonts, err := readFonts(f)
+	if err != nil {
+		return nil, fmt.Errorf("reading font %s: %v", fname, err)
+	}
+	return fonts, nil
+}
+
+// FontIndex returns the index of the font with the face name in a font
+// file, as returned by Locator.Font. It returns 0 for single fonts or if
+// the name is not found.
+func FontIndex(fname, faceName string) int {
+	fonts, err := readFontFile(fname)
+	if err != nil {
+		return 0
+	}
+	name := normalizeFontName(faceName)
+	for i, f := range fonts {
+		for _, n := range f.Names() {
+			if n == name {
+				return i
+			}
+		}
+	}
+	return 0
+}
+
+// readFonts returns the names of all fonts of a TrueType/OpenType font
+// or collection.
+func readFonts(r io.ReaderAt) ([]fontInfo, error) {
+	num, err := sfnt.NumFonts(r)
+	if err != nil {
+		return nil, err
+	}
+	var fonts []fontInfo
+	for i := 0; i < num; i++ {
+		font, err := sfnt.Open(r, i)
+		if err != nil {
+			return nil, err
+		}
+		buf, err := font.Table("name", 1<<20)
+		if err != nil {
+			return nil, err
+		}
+		f, err := parseNameTable(buf)
+		if err != nil {
+			return nil, err
+		}
+		fonts = append(fonts, f)
+	}
+	return fonts, nil
+}
+
+// parseNameTable returns the names of the font. English names from the
+// Windows platform are preferred.
+func parseNameTable(buf []byte) (fontInfo, error) {
+	if len(buf) < 6 {
+		return fontInfo{}, errInvalidFont
+	}
+	count := int(binary.BigEndian.Uint16(buf[2:4]))
+	strOff := int(binary.BigEndian.Uint16(buf[4:6]))
+	if 6+12*count > len(buf) {
+		return fontInfo{}, errInvalidFont
+	}
+
+	names := make(map[uint16]string)
+	prio := make(map[uint16]int)
+	for i := 0; i < count; i++ {
+		rec := buf[6+12*i:]
+		platform := binary.BigEndian.Uint16(rec[0:2])
+		encoding := binary.BigEndian.Uint16(rec[2:4])
+		lang := binary.BigEndian.Uint16(rec[4:6])
+		nameID := binary.BigEndian.Uint16(rec[6:8])
+		length := int(binary.BigEndian.Uint16(rec[8:10]))
+		start := strOff + int(binary.BigEndian.Uint16(rec[10:12]))
+
+		switch nameID {
+		case 1, 2, 4, 16, 17:
+		default:
+			continue
+		}
+		if start+length > len(buf) {
+			continue
+		}
+		data := buf[start : start+length]
+
+		var name string
+		var p int
+		switch {
+		case platform == 3 && (encoding == 0 || encoding == 1 || encoding == 10):
+			name = decodeUTF16BE(data)
+			p = 2
+			if lang == 0x0409 { // en-US
+				p = 4
+			}
+		case platform == 0:
+			name = decodeUTF16BE(data)
+			p = 3
+		case platform == 1 && encoding == 0 && lang == 0: // Mac Roman, English
+			name = decodeLatin1(data)
+			p = 1
+		default:
+			continue
+		}
+		if prio[nameID] >= p {
+			continue
+		}
+		prio[nameID] = p
+		names[nameID] = strings.TrimSpace(name)
+	}
+
+	return fontInfo{
+		Family:           names[1],
+		Subfamily:        names[2],
+		FullName:         names[4],
+		TypographicName:  names[16],
+		TypographicStyle: names[17],
+	}, nil
+}
+
+func decodeUTF16BE(b []byte) string {
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = binary.BigEndian.Uint16(b[i*2:])
+	}
+	return string(utf16.Decode(u))
+}
+
+func decodeLatin1(b []byte) string {
+	r := make([]rune, len(b))
+	for i, c := range b {
+		r[i] = rune(c)
+	}
+	return string(r)
+}
+
+// fontIndex maps the names of all fonts in a list of directories to
+// their files.
+type fontIndex struct {
+	files map[string]string // normalized name -> file
+	names []string          // name (family and subfamily) of all fonts
+}
+
+var fontExts = map[string]bool{".ttf": true, ".otf": true, ".ttc": true}
+
+// newFontIndex scans all dirs (recursive) for font files. Fonts of
+// earlier dirs take precedence. Files that can't be parsed are ignored.
+// The index is cached until a font file is added, removed or modified.
+func newFontIndex(dirs []string) *fontIndex {
+	type fontFile struct {
+		path string
+		fi   os.FileInfo
+	}
+	var files []fontFile
+	stamp := strings.Builder{}
+	for _, dir := range dirs {
+		filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+			if err != nil || fi.IsDir() || !fontExts[strings.ToLower(filepath.Ext(path))] {
+				return nil
+			}
+			files = append(files, fontFile{path, fi})
+			fmt.Fprintf(&stamp, "%s\x00%d\x00%d\n", path, fi.ModTime().UnixNano(), fi.Size())
+			return nil
+		})
+	}
+
+	key := strings.Join(dirs, "\x00")
+	fontCache.Lock()
+	c, ok := fontCache.indexes[key]
+	fontCache.Unlock()
+	if ok && c.stamp == stamp.String() {
+		return c.idx
+	}
+
+	idx := &fontIndex{files: make(map[string]string)}
+	seen := make(map[string]struct{})
+	for _, file := range files {
+		fonts, err := cachedReadFontFile(file.path, file.fi)
+		if err != nil {
+			continue
+		}
+		for _, f := range fonts {
+			names := f.Names()
+			for _, name := range names {
+				if _, ok := idx.files[name]; !ok {
+					idx.files[name] = file.path
+				}
+			}
+			if len(names) > 0 {
+				if _, ok := seen[names[0]]; !ok {
+					seen[names[0]] = struct{}{}
+					idx.names = append(idx.names, strings.TrimSpace(f.Family+" "+f.Subfamily))
+				}
+			}
+		}
+	}
+	sort.Strings(idx.names)
+
+	fontCache.Lock()
+	fontCache.indexes[key] = cachedFontIndex{stamp: stamp.String(), idx: idx}
+	fontCache.Unlock()
+	return idx
+}
+
+// Lookup returns the file of the font with the face name.
+func (idx *fontIndex) Lookup(name string) (string, bool) {
+	fname, ok := idx.files[normalizeFontName(name)]
+	return fname, ok
+}
+
+// Similar returns up to n font names that are most similar to name.
+func (idx *fontIndex) Similar(name string, n int) []string {
+	name = normalizeFontName(name)
+	type candidate struct {
+		name string
+		dist int
+	}
+	var candidates []candidate
+	for _, c := range idx.names {
+		d := levenshtein(name, normalizeFontName(c))
+		// ignore names that share (almost) nothing
+		if d > len(name)/2+len(c)/2 {
+			continue
+		}
+		candidates = append(candidates, candidate{c, d})
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].dist < candidates[j].dist })
+	var result []string
+	for i := 0; i < len(candidates) && i < n; i++ {
+		result = append(result, candidates[i].name)
+	}
+	return result
+}
+
+// levenshtein returns the edit distance between a and b.
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
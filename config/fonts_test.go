@@ -0,0 +1,171 @@
+package config
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf16"
+)
+
+// testFont returns a minimal font with only a name table. names maps name
+// IDs to Windows/Unicode names.
+func testFont(names map[uint16]string, tableOff int) []byte {
+	var strs bytes.Buffer
+	var recs bytes.Buffer
+	ids := []uint16{1, 2, 4, 16, 17}
+	count := 0
+	for _, id := range ids {
+		name, ok := names[id]
+		if !ok {
+			continue
+		}
+		u := utf16.Encode([]rune(name))
+		binary.Write(&recs, binary.BigEndian, []uint16{3, 1, 0x0409, id, uint16(len(u) * 2), uint16(strs.Len())})
+		binary.Write(&strs, binary.BigEndian, u)
+		count++
+	}
+	var table bytes.Buffer
+	binary.Write(&table, binary.BigEndian, []uint16{0, uint16(count), uint16(6 + 12*count)})
+	table.Write(recs.Bytes())
+	table.Write(strs.Bytes())
+
+	var buf bytes.Buffer
+	buf.WriteString("\x00\x01\x00\x00")
+	binary.Write(&buf, binary.BigEndian, []uint16{1, 16, 0, 0})
+	buf.WriteString("name")
+	binary.Write(&buf, binary.BigEndian, []uint32{0, uint32(tableOff + 12 + 16), uint32(table.Len())})
+	buf.Write(table.Bytes())
+	return buf.Bytes()
+}
+
+// ttc returns a font collection of fonts with the given names.
+func ttc(fonts ...map[uint16]string) []byte {
+	hdrLen := 12 + 4*len(fonts)
+	var body bytes.Buffer
+	var offsets []uint32
+	for _, names := range fonts {
+		offsets = append(offsets, uint32(hdrLen+body.Len()))
+		body.Write(testFont(names, hdrLen+body.Len()))
+	}
+	var buf bytes.Buffer
+	buf.WriteString("ttcf")
+	binary.Write(&buf, binary.BigEndian, []uint16{1, 0})
+	binary.Write(&buf, binary.BigEndian, uint32(len(fonts)))
+	binary.Write(&buf, binary.BigEndian, offsets)
+	buf.Write(body.Bytes())
+	return buf.Bytes()
+}
+
+func TestReadFonts(t *testing.T) {
+	fonts, err := readFontFile("../regression/NotoSans-Regular.ttf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fonts) != 1 || fonts[0].Family != "Noto Sans" || fonts[0].Subfamily != "Regular" {
+		t.Errorf("unexpected fonts %#v", fonts)
+	}
+
+	fonts, err = readFonts(bytes.NewReader(ttc(
+		map[uint16]string{1: "Noto Sans CJK JP", 2: "Regular"},
+		map[uint16]string{1: "Noto Sans CJK JP Bold", 2: "Regular", 16: "Noto Sans CJK JP", 17: "Bold"},
+	)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fonts) != 2 {
+		t.Fatalf("unexpected fonts %#v", fonts)
+	}
+	if names := fonts[1].Names(); !reflect.DeepEqual(names, []string{"noto sans cjk jp bold regular", "noto sans cjk jp bold"}) {
+		t.Errorf("unexpected names %v", names)
+	}
+
+	if _, err := readFonts(bytes.NewReader([]byte("not a font file"))); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestLookupLocator_Font(t *testing.T) {
+	d := newtmpDirTree(t)
+	defer d.remove()
+	d.addFile("fonts/cjk/NotoSansCJK.ttc")
+	d.addFile("fonts/DejaVuSans-Bold.ttf")
+	err := ioutil.WriteFile(filepath.Join(d.dir, "fonts/cjk/NotoSansCJK.ttc"), ttc(
+		map[uint16]string{1: "Noto Sans CJK JP", 2: "Regular"},
+		map[uint16]string{1: "Noto Sans CJK JP Bold", 2: "Regular", 16: "Noto Sans CJK JP", 17: "Bold"},
+	), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := LookupLocator{outDir: d.dir}
+	l.AddFontDir(filepath.Join(d.dir, "fonts"))
+	l.AddFontDir("../regression")
+
+	for i, name := range []string{"noto sans  cjk jp regular", "Noto Sans CJK JP Bold"} {
+		f := l.Font(name)
+		if f != filepath.Join(d.dir, "fonts/cjk/NotoSansCJK.ttc") {
+			t.Errorf("unexpected file %q for %q", f, name)
+		}
+		if idx := FontIndex(f, name); idx != i {
+			t.Errorf("unexpected index %d for %q", idx, name)
+		}
+	}
+	if f := l.Font("Noto Sans Regular"); !strings.HasSuffix(f, "regression/NotoSans-Regular.ttf") {
+		t.Errorf("unexpected file %q", f)
+	}
+	// not indexed, found by filename
+	if f := l.Font("DejaVu Sans Bold"); f != filepath.Join(d.dir, "fonts/DejaVuSans-Bold.ttf") {
+		t.Errorf("unexpected file %q", f)
+	}
+
+	if f := l.Font("Noto Sans CJK JP Black"); f != "" {
+		t.Errorf("unexpected file %q", f)
+	}
+	expected := []string{"Noto Sans CJK JP Black (similar fonts: Noto Sans CJK JP Regular, Noto Sans CJK JP Bold Regular, Noto Sans Regular)"}
+	if missing := l.MissingFiles(); !reflect.DeepEqual(missing, expected) {
+		t.Errorf("unexpected missing files %v", missing)
+	}
+	if missing := l.MissingNames(); !reflect.DeepEqual(missing, []string{"Noto Sans CJK JP Black"}) {
+		t.Errorf("unexpected missing names %v", missing)
+	}
+}
+
+func TestFontIndexCache(t *testing.T) {
+	d := newtmpDirTree(t)
+	defer d.remove()
+	fname := filepath.Join(d.dir, "Foo.ttf")
+	if err := ioutil.WriteFile(fname, testFont(map[uint16]string{1: "Foo", 2: "Regular"}, 0), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	idx := newFontIndex([]string{d.dir})
+	if _, ok := idx.Lookup("Foo Regular"); !ok {
+		t.Fatal("Foo Regular not indexed")
+	}
+	if newFontIndex([]string{d.dir}) != idx {
+		t.Error("index not cached")
+	}
+
+	if err := ioutil.WriteFile(fname, testFont(map[uint16]string{1: "Bar", 2: "Regular"}, 0), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// modification time might not change within the resolution of the
+	// file system
+	mtime := time.Now().Add(time.Minute)
+	if err := os.Chtimes(fname, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	idx = newFontIndex([]string{d.dir})
+	if _, ok := idx.Lookup("Bar Regular"); !ok {
+		t.Error("modified font not indexed")
+	}
+	if _, ok := idx.Lookup("Foo Regular"); ok {
+		t.Error("index contains font of previous version")
+	}
+}
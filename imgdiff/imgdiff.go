@@ -0,0 +1,235 @@
+// Package imgdiff compares rendered map images. It counts different
+// pixels (comparable to the AE metric of ImageMagick compare),
+// calculates RMSE, PSNR and SSIM and creates diff images.
+package imgdiff
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/jpeg"
+	"image/png"
+	"math"
+	"os"
+)
+
+// Options for Compare.
+type Options struct {
+	// Fuzz is the color distance in percent up to which pixels are
+	// equal. The distance is the Euclidean distance of the premultiplied
+	// RGBA values, with 100 percent for the full range of one channel.
+	// It is comparable to the -fuzz option of ImageMagick, but results
+	// can differ for transparent pixels.
+	Fuzz float64
+}
+
+// Result of Compare.
+type Result struct {
+	Width, Height int
+	// Pixels is the number of different pixels.
+	Pixels int
+	// RMSE is the root mean squared error of all channels (0-1).
+	RMSE float64
+	// PSNR is the peak signal-to-noise ratio in dB. It is +Inf for
+	// equal images.
+	PSNR float64
+	// SSIM is the mean structural similarity of the luminance (-1-1).
+	// It is 1 for equal images and is closer to the perceived
+	// difference than Pixels or RMSE.
+	SSIM float64
+	// Diff shows all different pixels in red on a faded gray copy of
+	// the first image.
+	Diff *image.NRGBA
+}
+
+// Similarity returns the ratio of equal pixels (0-1).
+func (r *Result) Similarity() float64 {
+	total := r.Width * r.Height
+	if total == 0 {
+		return 1
+	}
+	return 1 - float64(r.Pixels)/float64(total)
+}
+
+// WriteDiff writes the diff image as PNG.
+func (r *Result) WriteDiff(fname string) error {
+	f, err := os.Create(fname)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(f, r.Diff); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+var highlight = color.NRGBA{255, 0, 0, 255}
+
+// Compare compares two images of the same size.
+func Compare(a, b image.Image, opts Options) (*Result, error) {
+	ra, rb := toRGBA(a), toRGBA(b)
+	w, h := ra.Rect.Dx(), ra.Rect.Dy()
+	if w != rb.Rect.Dx() || h != rb.Rect.Dy() {
+		return nil, fmt.Errorf("image sizes differ (%dx%d and %dx%d)", w, h, rb.Rect.Dx(), rb.Rect.Dy())
+	}
+
+	res := &Result{Width: w, Height: h, Diff: image.NewNRGBA(image.Rect(0, 0, w, h))}
+	fuzz := opts.Fuzz / 100
+	sumSq := 0.0
+	for y := 0; y < h; y++ {
+		pa := ra.Pix[y*ra.Stride : y*ra.Stride+w*4]
+		pb := rb.Pix[y*rb.Stride : y*rb.Stride+w*4]
+		for x := 0; x < w; x++ {
+			sq := 0.0
+			for c := 0; c < 4; c++ {
+				d := (float64(pa[x*4+c]) - float64(pb[x*4+c])) / 255
+				sq += d * d
+			}
+			sumSq += sq / 4
+			if sq > 0 && math.Sqrt(sq) > fuzz {
+				res.Pixels++
+				res.Diff.SetNRGBA(x, y, highlight)
+			} else {
+				// faded luminance of a, like the lowlight of compare
+				v := uint8(255 - (255-luminance(pa[x*4:x*4+4]))*0.2)
+				res.Diff.SetNRGBA(x, y, color.NRGBA{v, v, v, 255})
+			}
+		}
+	}
+
+	if n := float64(w * h); n > 0 {
+		res.RMSE = math.Sqrt(sumSq / n)
+	}
+	if res.RMSE == 0 {
+		res.PSNR = math.Inf(1)
+	} else {
+		res.PSNR = 20 * math.Log10(1/res.RMSE)
+	}
+	res.SSIM = ssim(ra, rb)
+	return res, nil
+}
+
+// CompareFiles compares two PNG or JPEG files.
+func CompareFiles(fileA, fileB string, opts Options) (*Result, error) {
+	a, err := Load(fileA)
+	if err != nil {
+		return nil, err
+	}
+	b, err := Load(fileB)
+	if err != nil {
+		return nil, err
+	}
+	res, err := Compare(a, b, opts)
+	if err != nil {
+		return nil, fmt.Errorf("comparing %s and %s: %v", fileA, fileB, err)
+	}
+	return res, nil
+}
+
+// Load decodes a PNG or JPEG file.
+func Load(fname string) (image.Image, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("decoding %s: %v", fname, err)
+	}
+	return img, nil
+}
+
+func toRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok && rgba.Rect.Min == (image.Point{}) {
+		return rgba
+	}
+	b := img.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Rect, img, b.Min, draw.Src)
+	return rgba
+}
+
+// luminance returns the luminance (0-255) of a premultiplied RGBA pixel
+// on a white background.
+func luminance(p []uint8) float64 {
+	bg := 255 - float64(p[3])
+	return 0.299*(float64(p[0])+bg) + 0.587*(float64(p[1])+bg) + 0.114*(float64(p[2])+bg)
+}
+
+const (
+	ssimWindow = 8
+	ssimStep   = 4
+	ssimC1     = 0.01 * 0.01
+	ssimC2     = 0.03 * 0.03
+)
+
+// ssim returns the mean SSIM of the luminance of both images for
+// overlapping 8x8 windows.
+func ssim(a, b *image.RGBA) float64 {
+	w, h := a.Rect.Dx(), a.Rect.Dy()
+	if w == 0 || h == 0 {
+		return 1
+	}
+	la, lb := lumaPlane(a), lumaPlane(b)
+	win := ssimWindow
+	if w < win || h < win {
+		win = min(w, h)
+	}
+
+	sum, count := 0.0, 0
+	for y0 := 0; y0+win <= h; y0 += ssimStep {
+		for x0 := 0; x0+win <= w; x0 += ssimStep {
+			var ma, mb, va, vb, cov float64
+			for y := y0; y < y0+win; y++ {
+				for x := x0; x < x0+win; x++ {
+					ma += la[y*w+x]
+					mb += lb[y*w+x]
+				}
+			}
+			n := float64(win * win)
+			ma /= n
+			mb /= n
+			for y := y0; y < y0+win; y++ {
+				for x := x0; x < x0+win; x++ {
+					da, db := la[y*w+x]-ma, lb[y*w+x]-mb
+					va += da * da
+					vb += db * db
+					cov += da * db
+				}
+			}
+			va /= n
+			vb /= n
+			cov /= n
+			sum += ((2*ma*mb + ssimC1) * (2*cov + ssimC2)) / ((ma*ma + mb*mb + ssimC1) * (va + vb + ssimC2))
+			count++
+			if win < ssimWindow {
+				// single window for small images
+				return sum
+			}
+		}
+	}
+	return sum / float64(count)
+}
+
+// lumaPlane returns the luminance (0-1) of all pixels.
+func lumaPlane(img *image.RGBA) []float64 {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	l := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			off := y*img.Stride + x*4
+			l[y*w+x] = luminance(img.Pix[off:off+4]) / 255
+		}
+	}
+	return l
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,122 @@
+package imgdiff
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func uniform(w, h int, c color.Color) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(img, img.Rect, image.NewUniform(c), image.Point{}, draw.Src)
+	return img
+}
+
+func TestCompareEqual(t *testing.T) {
+	a := uniform(20, 10, color.NRGBA{10, 200, 30, 255})
+	res, err := Compare(a, uniform(20, 10, color.NRGBA{10, 200, 30, 255}), Options{})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, res.Pixels)
+	assert.Equal(t, 0.0, res.RMSE)
+	assert.True(t, math.IsInf(res.PSNR, 1))
+	assert.InDelta(t, 1.0, res.SSIM, 1e-9)
+	assert.Equal(t, 1.0, res.Similarity())
+
+	// fully transparent pixels are equal, regardless of the color
+	res, err = Compare(uniform(4, 4, color.NRGBA{255, 0, 0, 0}), uniform(4, 4, color.NRGBA{0, 0, 255, 0}), Options{})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, res.Pixels)
+}
+
+func TestCompareDifferent(t *testing.T) {
+	a := uniform(20, 10, color.White)
+	b := uniform(20, 10, color.White)
+	// small difference in 4 pixels
+	for x := 0; x < 4; x++ {
+		b.SetNRGBA(x, 0, color.NRGBA{250, 250, 250, 255})
+	}
+	// large difference in 2 pixels
+	b.SetNRGBA(10, 5, color.NRGBA{0, 0, 0, 255})
+	b.SetNRGBA(11, 5, color.NRGBA{0, 0, 0, 255})
+
+	res, err := Compare(a, b, Options{})
+	assert.NoError(t, err)
+	assert.Equal(t, 6, res.Pixels)
+	assert.InDelta(t, 0.97, res.Similarity(), 1e-9)
+	assert.True(t, res.PSNR > 10 && res.PSNR < 100, "%f", res.PSNR)
+	assert.True(t, res.SSIM < 1)
+	assert.Equal(t, highlight, res.Diff.NRGBAAt(10, 5))
+	assert.Equal(t, color.NRGBA{255, 255, 255, 255}, res.Diff.NRGBAAt(15, 5))
+
+	res, err = Compare(a, b, Options{Fuzz: 5})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, res.Pixels)
+
+	// distance of 8 in each color channel is sqrt(3)*8/255 (5.4%)
+	b.SetNRGBA(0, 0, color.NRGBA{247, 247, 247, 255})
+	res, err = Compare(a, b, Options{Fuzz: 5})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, res.Pixels)
+	res, err = Compare(a, b, Options{Fuzz: 6})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, res.Pixels)
+
+	_, err = Compare(a, uniform(10, 10, color.White), Options{})
+	assert.Error(t, err)
+}
+
+func TestSSIM(t *testing.T) {
+	// SSIM of a shifted pattern is lower than of a pattern with slightly
+	// different colors, although more pixels differ in the latter
+	pattern := func(offset int, c color.NRGBA) *image.NRGBA {
+		img := uniform(64, 64, color.White)
+		for y := 0; y < 64; y++ {
+			for x := 0; x < 64; x++ {
+				if (x+offset)/4%2 == 0 {
+					img.SetNRGBA(x, y, c)
+				}
+			}
+		}
+		return img
+	}
+	a := pattern(0, color.NRGBA{0, 0, 0, 255})
+	shifted, err := Compare(a, pattern(4, color.NRGBA{0, 0, 0, 255}), Options{})
+	assert.NoError(t, err)
+	tinted, err := Compare(a, pattern(0, color.NRGBA{30, 30, 30, 255}), Options{})
+	assert.NoError(t, err)
+	assert.True(t, tinted.Pixels > 0 && shifted.Pixels > 0)
+	assert.True(t, shifted.SSIM < 0.5, "%f", shifted.SSIM)
+	assert.True(t, tinted.SSIM > 0.9, "%f", tinted.SSIM)
+
+	// small images are compared as single window
+	res, err := Compare(uniform(3, 3, color.White), uniform(3, 3, color.Black), Options{})
+	assert.NoError(t, err)
+	assert.True(t, res.SSIM < 0.1, "%f", res.SSIM)
+}
+
+func TestCompareFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imgdiff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	res, err := Compare(uniform(4, 4, color.White), uniform(4, 4, color.Black), Options{})
+	assert.NoError(t, err)
+	fname := filepath.Join(dir, "diff.png")
+	assert.NoError(t, res.WriteDiff(fname))
+
+	res, err = CompareFiles(fname, fname, Options{})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, res.Pixels)
+
+	_, err = CompareFiles(fname, filepath.Join(dir, "missing.png"), Options{})
+	assert.Error(t, err)
+}
@@ -0,0 +1,314 @@
+package imposm
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/omniscale/magnacarto/builder"
+	"github.com/omniscale/magnacarto/builder/sql"
+	"github.com/omniscale/magnacarto/mml"
+	"github.com/omniscale/magnacarto/mss"
+)
+
+// DefaultTablePrefix is the prefix imposm3 uses for all tables.
+const DefaultTablePrefix = "osm_"
+
+var queryTable = regexp.MustCompile(`(?i)\b(?:from|join)\s+("?[a-zA-Z_][a-zA-Z0-9_]*"?(?:\."?[a-zA-Z_][a-zA-Z0-9_]*"?)?)`)
+
+// queryWord matches identifiers and other words of a query.
+var queryWord = regexp.MustCompile(`\w+`)
+
+// inQuery returns whether field is a word of the query, e.g. a column
+// that is selected or calculated by the query. words are all queryWord
+// matches of query.
+func inQuery(field, query string, words map[string]struct{}) bool {
+	if queryWord.FindString(field) == field {
+		_, ok := words[field]
+		return ok
+	}
+	// fields with other characters (e.g. name:en) are quoted in queries
+	return strings.Contains(query, field)
+}
+
+// queryTables returns the names of all tables the query selects from,
+// without schema.
+func queryTables(query string) []string {
+	var tables []string
+	seen := make(map[string]struct{})
+	for _, m := range queryTable.FindAllStringSubmatch(query, -1) {
+		name := m[1]
+		if idx := strings.LastIndex(name, "."); idx >= 0 {
+			name = name[idx+1:]
+		}
+		name = strings.Trim(name, `"`)
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		seen[name] = struct{}{}
+		tables = append(tables, name)
+	}
+	if len(tables) == 0 {
+		// query is a plain table name
+		name := strings.TrimSpace(query)
+		if idx := strings.LastIndex(name, "."); idx >= 0 {
+			name = name[idx+1:]
+		}
+		name = strings.Trim(name, `"`)
+		if name != "" && !strings.ContainsAny(name, " ()") {
+			tables = append(tables, name)
+		}
+	}
+	return tables
+}
+
+// Checker compares layers with a mapping.
+type Checker struct {
+	mapping     *Mapping
+	prefix      string
+	warnings    []string
+	usedTables  map[string]struct{}
+	usedValues  map[string]map[string]map[string]struct{} // table/column/value
+	allUsed     map[string]map[string]struct{}            // table/column
+	seenWarning map[string]struct{}
+}
+
+// NewChecker returns a Checker for the mapping. prefix is the prefix
+// of all imposm tables in the database.
+func NewChecker(m *Mapping, prefix string) *Checker {
+	return &Checker{
+		mapping:     m,
+		prefix:      prefix,
+		usedTables:  make(map[string]struct{}),
+		usedValues:  make(map[string]map[string]map[string]struct{}),
+		allUsed:     make(map[string]map[string]struct{}),
+		seenWarning: make(map[string]struct{}),
+	}
+}
+
+// Check compares all PostGIS layers with the mapping and returns
+// warnings for unknown tables and columns, filters that never match and
+// mapping entries that are not used by any layer.
+func Check(m *Mapping, prefix string, layers []builder.LayerRules) []string {
+	c := NewChecker(m, prefix)
+	for _, l := range layers {
+		c.CheckLayer(l.Layer, l.Rules)
+	}
+	return append(c.Warnings(), c.Unused()...)
+}
+
+// Warnings returns all warnings of the checked layers.
+func (c *Checker) Warnings() []string {
+	return c.warnings
+}
+
+func (c *Checker) warn(format string, args ...interface{}) {
+	w := fmt.Sprintf(format, args...)
+	if _, ok := c.seenWarning[w]; ok {
+		return
+	}
+	c.seenWarning[w] = struct{}{}
+	c.warnings = append(c.warnings, w)
+}
+
+// CheckLayer compares the query, the fields and the filters of a layer
+// with the mapping.
+func (c *Checker) CheckLayer(l mml.Layer, rules []mss.Rule) {
+	ds, ok := l.Datasource.(mml.PostGIS)
+	if !ok {
+		return
+	}
+
+	// mapping tables of this layer (source tables for generalized tables)
+	var tables []string
+	onlyMapped := true
+	for _, name := range queryTables(ds.Query) {
+		if !strings.HasPrefix(name, c.prefix) {
+			onlyMapped = false
+			continue
+		}
+		source, ok := c.mapping.source(strings.TrimPrefix(name, c.prefix))
+		if !ok {
+			c.warn("layer %s: table %s not in mapping", l.ID, name)
+			onlyMapped = false
+			continue
+		}
+		c.usedTables[strings.TrimPrefix(name, c.prefix)] = struct{}{}
+		c.usedTables[source] = struct{}{}
+		if !containsString(tables, source) {
+			tables = append(tables, source)
+		}
+	}
+	if len(tables) == 0 {
+		return
+	}
+
+	if onlyMapped {
+		queryWords := make(map[string]struct{})
+		for _, w := range queryWord.FindAllString(ds.Query, -1) {
+			queryWords[w] = struct{}{}
+		}
+		for _, field := range sql.Fields(rules, l.GroupBy) {
+			if c.hasColumn(tables, field) {
+				continue
+			}
+			if inQuery(field, ds.Query, queryWords) {
+				// selected/calculated in query
+				continue
+			}
+			c.warn("layer %s: field %q is not a column of %s", l.ID, field, c.tableNames(tables))
+		}
+	}
+
+	for _, t := range tables {
+		table := c.mapping.Tables[t]
+		for _, col := range table.Columns {
+			values, any, ok := table.columnValues(col.Name)
+			if !ok {
+				continue
+			}
+			if any {
+				c.markAllUsed(t, col.Name)
+				continue
+			}
+			// values in query (e.g. WHERE type IN ('motorway', ...))
+			for _, v := range values {
+				if strings.Contains(ds.Query, "'"+v+"'") {
+					c.markUsed(t, col.Name, v)
+				}
+			}
+			for _, r := range rules {
+				filtered := false
+				for _, f := range r.Filters {
+					v, ok := f.Value.(string)
+					if f.Field != col.Name || f.CompOp != mss.EQ || !ok {
+						continue
+					}
+					filtered = true
+					c.markUsed(t, col.Name, v)
+				}
+				if !filtered {
+					c.markAllUsed(t, col.Name)
+				}
+			}
+		}
+	}
+
+	c.checkFilters(l, tables, rules)
+}
+
+// checkFilters warns about filters that compare with values that are
+// not in the mapping of any table.
+func (c *Checker) checkFilters(l mml.Layer, tables []string, rules []mss.Rule) {
+	for _, r := range rules {
+		for _, f := range r.Filters {
+			v, ok := f.Value.(string)
+			if f.CompOp != mss.EQ || !ok {
+				continue
+			}
+			matches := false
+			known := false
+			for _, t := range tables {
+				values, any, ok := c.mapping.Tables[t].columnValues(f.Field)
+				if !ok {
+					if c.mapping.Tables[t].hasColumn(f.Field) {
+						// column with arbitrary values
+						matches = true
+					}
+					continue
+				}
+				known = true
+				if any || containsString(values, v) {
+					matches = true
+				}
+			}
+			if known && !matches {
+				c.warn("layer %s: filter [%s='%s'] never matches, value not in mapping of %s", l.ID, f.Field, v, c.tableNames(tables))
+			}
+		}
+	}
+}
+
+// Unused returns warnings for all tables and mapping values that are not
+// used by any checked layer.
+func (c *Checker) Unused() []string {
+	var warnings []string
+	var names []string
+	for name := range c.mapping.Tables {
+		names = append(names, name)
+	}
+	for name := range c.mapping.GeneralizedTables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if _, ok := c.usedTables[name]; !ok {
+			warnings = append(warnings, fmt.Sprintf("mapping: table %s%s not used by any layer", c.prefix, name))
+			continue
+		}
+		table, ok := c.mapping.Tables[name]
+		if !ok {
+			continue
+		}
+		for _, col := range table.Columns {
+			values, any, ok := table.columnValues(col.Name)
+			if !ok || any {
+				continue
+			}
+			if _, ok := c.allUsed[name][col.Name]; ok {
+				continue
+			}
+			for _, v := range values {
+				if _, ok := c.usedValues[name][col.Name][v]; !ok {
+					warnings = append(warnings, fmt.Sprintf("mapping: value %q of %s%s.%s not used by any layer", v, c.prefix, name, col.Name))
+				}
+			}
+		}
+	}
+	return warnings
+}
+
+func (c *Checker) markUsed(table, column, value string) {
+	if c.usedValues[table] == nil {
+		c.usedValues[table] = make(map[string]map[string]struct{})
+	}
+	if c.usedValues[table][column] == nil {
+		c.usedValues[table][column] = make(map[string]struct{})
+	}
+	c.usedValues[table][column][value] = struct{}{}
+}
+
+func (c *Checker) markAllUsed(table, column string) {
+	if c.allUsed[table] == nil {
+		c.allUsed[table] = make(map[string]struct{})
+	}
+	c.allUsed[table][column] = struct{}{}
+}
+
+func (c *Checker) hasColumn(tables []string, column string) bool {
+	for _, t := range tables {
+		if c.mapping.Tables[t].hasColumn(column) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Checker) tableNames(tables []string) string {
+	names := make([]string, len(tables))
+	for i, t := range tables {
+		names[i] = c.prefix + t
+	}
+	return strings.Join(names, ", ")
+}
+
+func containsString(l []string, s string) bool {
+	for _, e := range l {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
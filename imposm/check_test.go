@@ -0,0 +1,98 @@
+package imposm
+
+import (
+	"os"
+	"testing"
+
+	"github.com/omniscale/magnacarto/builder"
+	"github.com/omniscale/magnacarto/mml"
+	"github.com/omniscale/magnacarto/mss"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func loadMapping(t *testing.T) *Mapping {
+	f, err := os.Open("tests/mapping.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	m, err := ParseMapping(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestParseMapping(t *testing.T) {
+	m := loadMapping(t)
+	assert.Len(t, m.Tables, 3)
+
+	values, any, ok := m.Tables["roads"].columnValues("type")
+	assert.Equal(t, []string{"motorway", "primary", "rail", "residential"}, values)
+	assert.False(t, any)
+	assert.True(t, ok)
+
+	values, _, _ = m.Tables["roads"].columnValues("class")
+	assert.Equal(t, []string{"highway", "railway"}, values)
+
+	_, any, _ = m.Tables["buildings"].columnValues("type")
+	assert.True(t, any)
+
+	// yes is parsed as bool by YAML
+	values, _, _ = m.Tables["amenities"].columnValues("type")
+	assert.Equal(t, []string{"school", "yes"}, values)
+
+	_, _, ok = m.Tables["roads"].columnValues("name")
+	assert.False(t, ok)
+
+	source, ok := m.source("roads_gen0")
+	assert.True(t, ok)
+	assert.Equal(t, "roads", source)
+}
+
+func TestQueryTables(t *testing.T) {
+	assert.Equal(t, []string{"osm_roads"}, queryTables("osm_roads"))
+	assert.Equal(t, []string{"osm_roads"}, queryTables(`public."osm_roads"`))
+	assert.Equal(t,
+		[]string{"osm_roads", "osm_roads_gen0", "labels"},
+		queryTables("(SELECT * FROM public.osm_roads UNION ALL SELECT * FROM osm_roads_gen0 r JOIN labels l ON r.id = l.id) AS roads"),
+	)
+}
+
+func TestCheck(t *testing.T) {
+	m := loadMapping(t)
+
+	layers := []builder.LayerRules{
+		{
+			Layer: mml.Layer{ID: "roads", Datasource: mml.PostGIS{Query: "(SELECT * FROM osm_roads WHERE type != 'rail') AS roads"}},
+			Rules: []mss.Rule{
+				{Filters: []mss.Filter{{Field: "type", CompOp: mss.EQ, Value: "motorway"}}, Properties: mss.NewProperties("text-name", "[name]")},
+				{Filters: []mss.Filter{{Field: "type", CompOp: mss.EQ, Value: "trunk"}}, Properties: mss.NewProperties("text-name", "[ref]")},
+			},
+		},
+		{
+			Layer: mml.Layer{ID: "roads_low", Datasource: mml.PostGIS{Query: "osm_roads_gen0"}},
+			Rules: []mss.Rule{
+				{Filters: []mss.Filter{{Field: "type", CompOp: mss.EQ, Value: "primary"}, {Field: "tunnel", CompOp: mss.EQ, Value: "yes"}}},
+			},
+		},
+		{
+			Layer: mml.Layer{ID: "landuse", Datasource: mml.PostGIS{Query: "osm_landusages"}},
+			Rules: []mss.Rule{{}},
+		},
+		{
+			Layer: mml.Layer{ID: "shape", Datasource: mml.Shapefile{Filename: "foo.shp"}},
+			Rules: []mss.Rule{{}},
+		},
+	}
+
+	assert.Equal(t, []string{
+		`layer roads: field "ref" is not a column of osm_roads`,
+		`layer roads: filter [type='trunk'] never matches, value not in mapping of osm_roads`,
+		`layer landuse: table osm_landusages not in mapping`,
+		`mapping: table osm_amenities not used by any layer`,
+		`mapping: table osm_buildings not used by any layer`,
+		`mapping: value "residential" of osm_roads.type not used by any layer`,
+	}, Check(m, DefaultTablePrefix, layers))
+}
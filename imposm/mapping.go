@@ -0,0 +1,176 @@
+// Package imposm compares styles with imposm3 mappings.
+package imposm
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+)
+
+// AnyValue matches all values or keys in a mapping.
+const AnyValue = "__any__"
+
+// Mapping is an imposm3 mapping.
+type Mapping struct {
+	Tables            map[string]*Table            `yaml:"tables"`
+	GeneralizedTables map[string]*GeneralizedTable `yaml:"generalized_tables"`
+}
+
+type Table struct {
+	Type         string
+	Columns      []Column
+	Mapping      map[string]Values
+	Mappings     map[string]SubMapping
+	TypeMappings map[string]map[string]Values `yaml:"type_mappings"`
+}
+
+type SubMapping struct {
+	Mapping map[string]Values
+}
+
+type Column struct {
+	Name string
+	Key  string
+	Type string
+}
+
+type GeneralizedTable struct {
+	Source    string
+	SQLFilter string `yaml:"sql_filter"`
+	Tolerance float64
+}
+
+// Values is a list of tag values. YAML booleans (yes/no) are converted
+// back to strings.
+type Values []string
+
+func (v *Values) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var raw []interface{}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	for _, r := range raw {
+		switch r := r.(type) {
+		case bool:
+			if r {
+				*v = append(*v, "yes")
+			} else {
+				*v = append(*v, "no")
+			}
+		default:
+			*v = append(*v, fmt.Sprintf("%v", r))
+		}
+	}
+	return nil
+}
+
+// ParseMapping parses an imposm3 mapping in YAML or JSON.
+func ParseMapping(r io.Reader) (*Mapping, error) {
+	input, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	m := Mapping{}
+	if err := yaml.Unmarshal(input, &m); err != nil {
+		return nil, err
+	}
+	for name, g := range m.GeneralizedTables {
+		if _, ok := m.source(name); !ok {
+			return nil, fmt.Errorf("unknown source %q for generalized table %q", g.Source, name)
+		}
+	}
+	return &m, nil
+}
+
+// source returns the name of the (non-generalized) table.
+func (m *Mapping) source(name string) (string, bool) {
+	for i := 0; i <= len(m.GeneralizedTables); i++ {
+		if _, ok := m.Tables[name]; ok {
+			return name, true
+		}
+		g, ok := m.GeneralizedTables[name]
+		if !ok {
+			return "", false
+		}
+		name = g.Source
+	}
+	// cyclic generalized tables
+	return "", false
+}
+
+// tags returns all mapped keys and values of the table.
+func (t *Table) tags() map[string]map[string]struct{} {
+	result := make(map[string]map[string]struct{})
+	add := func(mapping map[string]Values) {
+		for k, vals := range mapping {
+			if result[k] == nil {
+				result[k] = make(map[string]struct{})
+			}
+			for _, v := range vals {
+				result[k][v] = struct{}{}
+			}
+		}
+	}
+	add(t.Mapping)
+	for _, m := range t.Mappings {
+		add(m.Mapping)
+	}
+	for _, m := range t.TypeMappings {
+		add(m)
+	}
+	return result
+}
+
+// columnValues returns all possible values of a mapping_key or
+// mapping_value column. ok is false for all other column types and any is
+// true if the column can contain any value.
+func (t *Table) columnValues(name string) (values []string, any bool, ok bool) {
+	var col *Column
+	for i := range t.Columns {
+		if t.Columns[i].Name == name {
+			col = &t.Columns[i]
+			break
+		}
+	}
+	if col == nil {
+		return nil, false, false
+	}
+
+	found := make(map[string]struct{})
+	switch col.Type {
+	case "mapping_key":
+		for k := range t.tags() {
+			found[k] = struct{}{}
+		}
+	case "mapping_value":
+		for _, vals := range t.tags() {
+			for v := range vals {
+				found[v] = struct{}{}
+			}
+		}
+	default:
+		return nil, false, false
+	}
+
+	if _, ok := found[AnyValue]; ok {
+		any = true
+		delete(found, AnyValue)
+	}
+	for v := range found {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+	return values, any, true
+}
+
+func (t *Table) hasColumn(name string) bool {
+	for _, c := range t.Columns {
+		if c.Name == name {
+			return true
+		}
+	}
+	return false
+}
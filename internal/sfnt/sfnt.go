@@ -0,0 +1,127 @@
+// Package sfnt reads the table directory of TrueType and OpenType fonts
+// and font collections (TTC). It only locates the tables; parsing of the
+// table contents is left to the caller.
+package sfnt
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrInvalid is returned for files that are not valid fonts.
+var ErrInvalid = errors.New("invalid font file")
+
+// maxFonts limits the number of fonts of a collection.
+const maxFonts = 1024
+
+// Font is a single font of a font file.
+type Font struct {
+	r       io.ReaderAt
+	version string
+	tables  map[string]table
+}
+
+type table struct {
+	offset int64
+	length int64
+}
+
+// NumFonts returns the number of fonts in r. It is 1 for single fonts.
+func NumFonts(r io.ReaderAt) (int, error) {
+	hdr := make([]byte, 12)
+	if _, err := r.ReadAt(hdr, 0); err != nil {
+		return 0, err
+	}
+	if string(hdr[:4]) != "ttcf" {
+		return 1, nil
+	}
+	num := int(binary.BigEndian.Uint32(hdr[8:12]))
+	if num > maxFonts {
+		return 0, ErrInvalid
+	}
+	return num, nil
+}
+
+// Open reads the table directory of the font with the index in r. The
+// index is ignored for single fonts.
+func Open(r io.ReaderAt, index int) (*Font, error) {
+	hdr := make([]byte, 12)
+	if _, err := r.ReadAt(hdr, 0); err != nil {
+		return nil, err
+	}
+	off := int64(0)
+	if string(hdr[:4]) == "ttcf" {
+		num := int(binary.BigEndian.Uint32(hdr[8:12]))
+		if num > maxFonts {
+			return nil, ErrInvalid
+		}
+		if index < 0 || index >= num {
+			return nil, fmt.Errorf("font index %d not found", index)
+		}
+		buf := make([]byte, 4)
+		if _, err := r.ReadAt(buf, 12+4*int64(index)); err != nil {
+			return nil, err
+		}
+		off = int64(binary.BigEndian.Uint32(buf))
+		if _, err := r.ReadAt(hdr, off); err != nil {
+			return nil, err
+		}
+	}
+
+	f := &Font{r: r, version: string(hdr[:4]), tables: make(map[string]table)}
+	switch f.version {
+	case "\x00\x01\x00\x00", "OTTO", "true":
+	default:
+		return nil, ErrInvalid
+	}
+
+	numTables := int(binary.BigEndian.Uint16(hdr[4:6]))
+	dir := make([]byte, 16*numTables)
+	if _, err := r.ReadAt(dir, off+12); err != nil {
+		return nil, err
+	}
+	for i := 0; i < numTables; i++ {
+		rec := dir[i*16 : i*16+16]
+		// table offsets are relative to the start of the file, also
+		// for collections
+		f.tables[string(rec[:4])] = table{
+			offset: int64(binary.BigEndian.Uint32(rec[8:12])),
+			length: int64(binary.BigEndian.Uint32(rec[12:16])),
+		}
+	}
+	return f, nil
+}
+
+// CFF returns whether the font has CFF (PostScript) outlines instead of
+// TrueType outlines.
+func (f *Font) CFF() bool {
+	return f.version == "OTTO"
+}
+
+// HasTable returns whether the font contains the table.
+func (f *Font) HasTable(tag string) bool {
+	_, ok := f.tables[tag]
+	return ok
+}
+
+// Table reads the table with the tag. Tables larger than maxLen are
+// rejected with ErrInvalid.
+func (f *Font) Table(tag string, maxLen int64) ([]byte, error) {
+	t, ok := f.tables[tag]
+	if !ok {
+		return nil, fmt.Errorf("missing %s table", tag)
+	}
+	if t.length > maxLen {
+		return nil, ErrInvalid
+	}
+	buf := make([]byte, t.length)
+	if _, err := f.r.ReadAt(buf, t.offset); err != nil {
+		if err == io.EOF {
+			return nil, ErrInvalid
+		}
+		return nil, err
+	}
+	return buf, nil
+}
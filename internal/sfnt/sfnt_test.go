@@ -0,0 +1,73 @@
+package sfnt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// testFont returns a font with a single table at tableOff.
+func testFont(version, tag, data string, tableOff int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(version)
+	binary.Write(&buf, binary.BigEndian, []uint16{1, 16, 0, 0})
+	buf.WriteString(tag)
+	binary.Write(&buf, binary.BigEndian, []uint32{0, uint32(tableOff + 12 + 16), uint32(len(data))})
+	buf.WriteString(data)
+	return buf.Bytes()
+}
+
+func TestOpen(t *testing.T) {
+	f, err := Open(bytes.NewReader(testFont("true", "name", "foo", 0)), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.CFF() || !f.HasTable("name") || f.HasTable("glyf") {
+		t.Errorf("unexpected font %#v", f)
+	}
+	if buf, err := f.Table("name", 100); err != nil || string(buf) != "foo" {
+		t.Errorf("unexpected table %q %v", buf, err)
+	}
+	if _, err := f.Table("name", 2); err != ErrInvalid {
+		t.Errorf("expected ErrInvalid for large table, got %v", err)
+	}
+	if _, err := f.Table("glyf", 100); err == nil {
+		t.Error("expected error for missing table")
+	}
+
+	if _, err := Open(bytes.NewReader([]byte("not a font file")), 0); err != ErrInvalid {
+		t.Errorf("expected ErrInvalid, got %v", err)
+	}
+}
+
+func TestOpenCollection(t *testing.T) {
+	hdrLen := 12 + 4*2
+	a := testFont("\x00\x01\x00\x00", "name", "a", hdrLen)
+	b := testFont("OTTO", "name", "b", hdrLen+len(a))
+	var buf bytes.Buffer
+	buf.WriteString("ttcf")
+	binary.Write(&buf, binary.BigEndian, []uint16{1, 0})
+	binary.Write(&buf, binary.BigEndian, []uint32{2, uint32(hdrLen), uint32(hdrLen + len(a))})
+	buf.Write(a)
+	buf.Write(b)
+	r := bytes.NewReader(buf.Bytes())
+
+	if n, err := NumFonts(r); err != nil || n != 2 {
+		t.Fatalf("unexpected number of fonts %d %v", n, err)
+	}
+	for i, expected := range []string{"a", "b"} {
+		f, err := Open(r, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data, err := f.Table("name", 100); err != nil || string(data) != expected {
+			t.Errorf("unexpected table of font %d: %q %v", i, data, err)
+		}
+		if f.CFF() != (i == 1) {
+			t.Errorf("unexpected CFF for font %d", i)
+		}
+	}
+	if _, err := Open(r, 2); err == nil {
+		t.Error("expected error for missing font")
+	}
+}
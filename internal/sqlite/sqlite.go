@@ -0,0 +1,445 @@
+// Package sqlite is a minimal read-only parser for SQLite database files.
+// It only supports reading all rows of tables, which is sufficient for
+// small tables (e.g. gpkg_geometry_columns of GeoPackages), without
+// requiring cgo. Pages are read on demand, so large files are not
+// loaded into memory.
+package sqlite
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+)
+
+// File is a parsed SQLite database file.
+type File struct {
+	r        io.ReaderAt
+	size     int64
+	closer   io.Closer
+	pageSize int
+	usable   int
+}
+
+// ErrInvalid is returned for files that are not valid SQLite databases.
+var ErrInvalid = errors.New("invalid SQLite file")
+
+// Open opens the SQLite database fname. The file needs to be closed
+// after use.
+func Open(fname string) (*File, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	db, err := NewReader(f, fi.Size())
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	db.closer = f
+	return db, nil
+}
+
+// New returns the SQLite database from buf.
+func New(buf []byte) (*File, error) {
+	return NewReader(bytes.NewReader(buf), int64(len(buf)))
+}
+
+// NewReader returns the SQLite database from r with size bytes.
+func NewReader(r io.ReaderAt, size int64) (*File, error) {
+	hdr := make([]byte, 100)
+	if size < 100 {
+		return nil, ErrInvalid
+	}
+	if _, err := r.ReadAt(hdr, 0); err != nil {
+		return nil, err
+	}
+	if string(hdr[:16]) != "SQLite format 3\x00" {
+		return nil, ErrInvalid
+	}
+	pageSize := int(binary.BigEndian.Uint16(hdr[16:18]))
+	if pageSize == 1 {
+		pageSize = 65536
+	}
+	return &File{
+		r:        r,
+		size:     size,
+		pageSize: pageSize,
+		usable:   pageSize - int(hdr[20]),
+	}, nil
+}
+
+// Close closes the file of Open.
+func (s *File) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
+
+// Table returns all rows of the table. Integers are returned as int64,
+// floats as float64, texts as string and blobs as []byte. Rows contain a
+// value for each column of Columns, INTEGER PRIMARY KEY columns contain
+// the rowid.
+func (s *File) Table(name string) ([][]interface{}, error) {
+	root, sql, err := s.schema(name)
+	if err != nil {
+		return nil, err
+	}
+	cols := parseColumns(sql)
+	rows, err := s.rows(root)
+	if err != nil {
+		return nil, err
+	}
+	for i, row := range rows {
+		// rows from before an ALTER TABLE ADD COLUMN are shorter
+		for len(row.values) < len(cols) {
+			row.values = append(row.values, nil)
+		}
+		for j, c := range cols {
+			if c.rowid && row.values[j] == nil {
+				row.values[j] = row.rowid
+			}
+		}
+		rows[i] = row
+	}
+	result := make([][]interface{}, len(rows))
+	for i := range rows {
+		result[i] = rows[i].values
+	}
+	return result, nil
+}
+
+// Columns returns the column names of the table.
+func (s *File) Columns(name string) ([]string, error) {
+	_, sql, err := s.schema(name)
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for _, c := range parseColumns(sql) {
+		result = append(result, c.name)
+	}
+	return result, nil
+}
+
+// schema returns the root page and the CREATE statement of the table.
+func (s *File) schema(name string) (int, string, error) {
+	master, err := s.rows(1)
+	if err != nil {
+		return 0, "", err
+	}
+	for _, row := range master {
+		// type, name, tbl_name, rootpage, sql
+		if len(row.values) < 5 {
+			continue
+		}
+		if t, _ := row.values[0].(string); t != "table" {
+			continue
+		}
+		if n, _ := row.values[1].(string); !strings.EqualFold(n, name) {
+			continue
+		}
+		root, ok := row.values[3].(int64)
+		if !ok {
+			return 0, "", ErrInvalid
+		}
+		sql, _ := row.values[4].(string)
+		return int(root), sql, nil
+	}
+	return 0, "", fmt.Errorf("table %s not found", name)
+}
+
+type column struct {
+	name  string
+	rowid bool
+}
+
+// parseColumns returns the columns of a CREATE TABLE statement.
+func parseColumns(sql string) []column {
+	start := strings.Index(sql, "(")
+	end := strings.LastIndex(sql, ")")
+	if start < 0 || end < start {
+		return nil
+	}
+	var defs []string
+	depth := 0
+	var quote byte
+	last := start + 1
+	for i := start + 1; i < end; i++ {
+		c := sql[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'' || c == '`':
+			quote = c
+		case c == '[':
+			quote = ']'
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == ',' && depth == 0:
+			defs = append(defs, sql[last:i])
+			last = i + 1
+		}
+	}
+	defs = append(defs, sql[last:end])
+
+	var result []column
+	for _, def := range defs {
+		def = strings.TrimSpace(def)
+		if def == "" {
+			continue
+		}
+		var name, rest string
+		if end := map[byte]byte{'"': '"', '\'': '\'', '`': '`', '[': ']'}[def[0]]; end != 0 {
+			// quoted names can contain spaces
+			i := strings.IndexByte(def[1:], end)
+			if i < 0 {
+				continue
+			}
+			name, rest = def[1:i+1], def[i+2:]
+		} else {
+			fields := strings.Fields(def)
+			switch strings.ToUpper(fields[0]) {
+			case "CONSTRAINT", "PRIMARY", "UNIQUE", "CHECK", "FOREIGN":
+				continue
+			}
+			name, rest = fields[0], def[len(fields[0]):]
+		}
+		rest = strings.ToUpper(strings.Join(strings.Fields(rest), " "))
+		result = append(result, column{
+			name:  name,
+			rowid: strings.HasPrefix(rest, "INTEGER") && strings.Contains(rest, "PRIMARY KEY"),
+		})
+	}
+	return result
+}
+
+type row struct {
+	rowid  int64
+	values []interface{}
+}
+
+func (s *File) page(n int) ([]byte, error) {
+	start := int64(n-1) * int64(s.pageSize)
+	if n < 1 || start+int64(s.pageSize) > s.size {
+		return nil, ErrInvalid
+	}
+	page := make([]byte, s.pageSize)
+	if _, err := s.r.ReadAt(page, start); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// rows returns all records of the table b-tree with the root page n.
+func (s *File) rows(n int) ([]row, error) {
+	var result []row
+	var walk func(n int, depth int) error
+	walk = func(n int, depth int) error {
+		if depth > 64 {
+			return ErrInvalid
+		}
+		page, err := s.page(n)
+		if err != nil {
+			return err
+		}
+		hdr := 0
+		if n == 1 {
+			hdr = 100
+		}
+		if hdr+8 > len(page) {
+			return ErrInvalid
+		}
+		numCells := int(binary.BigEndian.Uint16(page[hdr+3 : hdr+5]))
+		switch page[hdr] {
+		case 0x05: // interior table
+			if hdr+12+numCells*2 > len(page) {
+				return ErrInvalid
+			}
+			for i := 0; i < numCells; i++ {
+				off := int(binary.BigEndian.Uint16(page[hdr+12+i*2:]))
+				if off+4 > len(page) {
+					return ErrInvalid
+				}
+				if err := walk(int(binary.BigEndian.Uint32(page[off:])), depth+1); err != nil {
+					return err
+				}
+			}
+			return walk(int(binary.BigEndian.Uint32(page[hdr+8:])), depth+1)
+		case 0x0d: // leaf table
+			if hdr+8+numCells*2 > len(page) {
+				return ErrInvalid
+			}
+			for i := 0; i < numCells; i++ {
+				off := int(binary.BigEndian.Uint16(page[hdr+8+i*2:]))
+				rowid, payload, err := s.payload(page, off)
+				if err != nil {
+					return err
+				}
+				rec, err := record(payload)
+				if err != nil {
+					return err
+				}
+				result = append(result, row{rowid: rowid, values: rec})
+			}
+			return nil
+		}
+		return ErrInvalid
+	}
+	if err := walk(n, 0); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// payload returns the rowid and the payload of the leaf cell at off,
+// including all overflow pages.
+func (s *File) payload(page []byte, off int) (int64, []byte, error) {
+	if off >= len(page) {
+		return 0, nil, ErrInvalid
+	}
+	size, n := varint(page[off:])
+	off += n
+	if off >= len(page) {
+		return 0, nil, ErrInvalid
+	}
+	rowid, n := varint(page[off:])
+	off += n
+
+	p := int(size)
+	maxLocal := s.usable - 35
+	local := p
+	if p > maxLocal {
+		minLocal := ((s.usable-12)*32)/255 - 23
+		local = minLocal + (p-minLocal)%(s.usable-4)
+		if local > maxLocal {
+			local = minLocal
+		}
+	}
+	if off+local > len(page) {
+		return 0, nil, ErrInvalid
+	}
+	payload := append([]byte{}, page[off:off+local]...)
+	if local == p {
+		return rowid, payload, nil
+	}
+
+	if off+local+4 > len(page) {
+		return 0, nil, ErrInvalid
+	}
+	next := int(binary.BigEndian.Uint32(page[off+local:]))
+	for len(payload) < p && next != 0 {
+		ovfl, err := s.page(next)
+		if err != nil {
+			return 0, nil, err
+		}
+		next = int(binary.BigEndian.Uint32(ovfl))
+		end := s.usable
+		if rest := p - len(payload); rest < end-4 {
+			end = rest + 4
+		}
+		payload = append(payload, ovfl[4:end]...)
+	}
+	if len(payload) != p {
+		return 0, nil, ErrInvalid
+	}
+	return rowid, payload, nil
+}
+
+// record decodes all values of a record. Integers are returned as int64,
+// floats as float64, texts as string and blobs as []byte.
+func record(buf []byte) ([]interface{}, error) {
+	hdrSize, n := varint(buf)
+	if n == 0 || int(hdrSize) > len(buf) {
+		return nil, ErrInvalid
+	}
+	var types []int64
+	for pos := n; pos < int(hdrSize); {
+		t, n := varint(buf[pos:hdrSize])
+		if n == 0 {
+			return nil, ErrInvalid
+		}
+		types = append(types, t)
+		pos += n
+	}
+
+	values := make([]interface{}, 0, len(types))
+	pos := int(hdrSize)
+	for _, t := range types {
+		var size int
+		switch {
+		case t == 0, t == 8, t == 9:
+			size = 0
+		case t >= 1 && t <= 4:
+			size = int(t)
+		case t == 5:
+			size = 6
+		case t == 6, t == 7:
+			size = 8
+		case t >= 12:
+			size = int(t-12) / 2
+		default:
+			return nil, ErrInvalid
+		}
+		if pos+size > len(buf) {
+			return nil, ErrInvalid
+		}
+		data := buf[pos : pos+size]
+		pos += size
+
+		switch {
+		case t == 0:
+			values = append(values, nil)
+		case t == 8:
+			values = append(values, int64(0))
+		case t == 9:
+			values = append(values, int64(1))
+		case t == 7:
+			values = append(values, math.Float64frombits(binary.BigEndian.Uint64(data)))
+		case t <= 6:
+			var v int64
+			for _, b := range data {
+				v = v<<8 | int64(b)
+			}
+			// sign extend
+			shift := uint(64 - 8*size)
+			values = append(values, v<<shift>>shift)
+		case t%2 == 0:
+			values = append(values, data)
+		default:
+			values = append(values, string(data))
+		}
+	}
+	return values, nil
+}
+
+// varint decodes an SQLite varint. Returns the value and the number of
+// bytes read (0 for invalid varints).
+func varint(buf []byte) (int64, int) {
+	var v uint64
+	for i := 0; i < 9 && i < len(buf); i++ {
+		if i == 8 {
+			v = v<<8 | uint64(buf[i])
+			return int64(v), 9
+		}
+		v = v<<7 | uint64(buf[i]&0x7f)
+		if buf[i]&0x80 == 0 {
+			return int64(v), i + 1
+		}
+	}
+	return 0, 0
+}
@@ -0,0 +1,91 @@
+package sqlite
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTable(t *testing.T) {
+	db, err := Open("tests/test.sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cols, err := db.Columns("items")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cols, []string{"id", "the name", "value", "count", "data"}) {
+		t.Errorf("unexpected columns %v", cols)
+	}
+
+	rows, err := db.Table("Items")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 {
+		t.Fatalf("unexpected rows %v", rows)
+	}
+	if !reflect.DeepEqual(rows[0], []interface{}{int64(1), "first", 1.5, int64(42), []byte{0, 1, 2}}) {
+		t.Errorf("unexpected row %#v", rows[0])
+	}
+	// text stored in overflow pages
+	if rows[1][0] != int64(7) || rows[1][1] != strings.Repeat("x", 5000) || rows[1][2] != nil || rows[1][3] != int64(-3) {
+		t.Errorf("unexpected row %.80v", rows[1])
+	}
+	if rows[2][0] != int64(8) || rows[2][1] != "third" {
+		t.Errorf("unexpected row %#v", rows[2])
+	}
+
+	if _, err := db.Table("missing"); err == nil {
+		t.Error("expected error for missing table")
+	}
+}
+
+type countingReader struct {
+	r io.ReaderAt
+	n int
+}
+
+func (c *countingReader) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.r.ReadAt(p, off)
+	c.n += n
+	return n, err
+}
+
+func TestNewReader_ReadsOnlyRequiredPages(t *testing.T) {
+	buf, err := ioutil.ReadFile("tests/test.sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &countingReader{r: bytes.NewReader(buf)}
+	db, err := NewReader(r, int64(len(buf)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Columns("items"); err != nil {
+		t.Fatal(err)
+	}
+	// header and schema page
+	if r.n != 100+db.pageSize || r.n >= len(buf) {
+		t.Errorf("read %d bytes of %d", r.n, len(buf))
+	}
+}
+
+func TestNew_Invalid(t *testing.T) {
+	if _, err := New([]byte("not a sqlite file")); err != ErrInvalid {
+		t.Errorf("expected ErrInvalid, got %v", err)
+	}
+}
+
+func TestParseColumns(t *testing.T) {
+	cols := parseColumns(`CREATE TABLE "t" (fid INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL, [geom] POLYGON, name TEXT(10, 2) DEFAULT 'a,b', PRIMARY KEY (fid))`)
+	expected := []column{{"fid", true}, {"geom", false}, {"name", false}}
+	if !reflect.DeepEqual(cols, expected) {
+		t.Errorf("unexpected columns %v", cols)
+	}
+}
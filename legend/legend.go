@@ -0,0 +1,226 @@
+// Package legend generates legends from the rules of a style.
+//
+// Each distinct filter of a layer is a legend entry. Entries are rendered
+// as swatches with synthetic point, line or polygon geometries, using
+// all rules (attachments) of the filter.
+package legend
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/omniscale/magnacarto/builder/geomtype"
+	"github.com/omniscale/magnacarto/mml"
+	"github.com/omniscale/magnacarto/mss"
+)
+
+// Legend contains the entries of all layers at a single zoom level.
+type Legend struct {
+	Zoom   int
+	Layers []Layer
+}
+
+// Layer is a layer with all entries in the order of the rules.
+type Layer struct {
+	ID      string
+	Entries []Entry
+}
+
+// Entry is a legend entry for a distinct filter of a layer. Rules
+// contains one rule for each attachment, in drawing order.
+type Entry struct {
+	Name  string
+	Type  mml.GeometryType
+	Rules []mss.Rule
+	// Image is the PNG encoded swatch, see Legend.RenderSwatches.
+	Image []byte
+}
+
+// Load parses the MML file and all MSS files of the MML and returns the
+// legend at zoom, or at the CenterZoom of the MML if zoom is negative. The
+// legend is limited to layers, if not empty.
+func Load(mmlFile string, zoom int, layers []string) (*Legend, error) {
+	r, err := os.Open(mmlFile)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	m, err := mml.Parse(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if zoom < 0 {
+		zoom = CenterZoom(m)
+	}
+
+	carto := mss.New()
+	for _, s := range m.Stylesheets {
+		if err := carto.ParseFile(filepath.Join(filepath.Dir(mmlFile), s)); err != nil {
+			return nil, err
+		}
+	}
+	if err := carto.Evaluate(); err != nil {
+		return nil, err
+	}
+	return New(m, carto.MSS(), zoom, layers)
+}
+
+// New returns the legend of the MML layers at zoom. The legend is limited
+// to layers, if not empty.
+func New(m *mml.MML, style *mss.MSS, zoom int, layers []string) (*Legend, error) {
+	mmlLayers := make(map[string]mml.Layer, len(m.Layers))
+	for _, l := range m.Layers {
+		mmlLayers[l.ID] = l
+	}
+	if len(layers) == 0 {
+		for _, l := range m.Layers {
+			layers = append(layers, l.ID)
+		}
+	}
+
+	legend := &Legend{Zoom: zoom}
+	for _, id := range layers {
+		l, ok := mmlLayers[id]
+		if !ok {
+			return nil, fmt.Errorf("unknown layer %s", id)
+		}
+		if !visible(l, zoom) {
+			continue
+		}
+		rules := style.LayerZoomRules(l.ID, mss.NewZoomRange(mss.EQ, int64(zoom)), l.Classes...)
+		entries := newEntries(l, rules)
+		if len(entries) == 0 {
+			continue
+		}
+		legend.Layers = append(legend.Layers, Layer{ID: l.ID, Entries: entries})
+	}
+	return legend, nil
+}
+
+// DefaultZoom is used by CenterZoom for MMLs without center.
+const DefaultZoom = 10
+
+// CenterZoom returns the zoom level of the center parameter
+// ("lon,lat,zoom") of the MML, or DefaultZoom.
+func CenterZoom(m *mml.MML) int {
+	parts := strings.Split(m.Parameters["center"], ",")
+	if len(parts) != 3 {
+		return DefaultZoom
+	}
+	zoom, err := strconv.Atoi(strings.TrimSpace(parts[2]))
+	if err != nil || zoom < 0 {
+		return DefaultZoom
+	}
+	return zoom
+}
+
+// Entries returns all entries of all layers.
+func (l *Legend) Entries() []*Entry {
+	var entries []*Entry
+	for i := range l.Layers {
+		for j := range l.Layers[i].Entries {
+			entries = append(entries, &l.Layers[i].Entries[j])
+		}
+	}
+	return entries
+}
+
+// visible returns whether the minzoom/maxzoom properties of the layer
+// include zoom.
+func visible(l mml.Layer, zoom int) bool {
+	if minZoom, ok := l.Properties["minzoom"].(int); ok && zoom < minZoom {
+		return false
+	}
+	if maxZoom, ok := l.Properties["maxzoom"].(int); ok && zoom > maxZoom {
+		return false
+	}
+	return true
+}
+
+// newEntries groups rules by their filters. Entries are in the order of
+// the rules, i.e. more specific filters first. Rules without symbolizers and raster rules
+// are ignored.
+func newEntries(l mml.Layer, rules []mss.Rule) []Entry {
+	var entries []Entry
+	index := make(map[string]int)
+	for _, r := range rules {
+		if !hasSymbolizer(r) {
+			continue
+		}
+		key := filterKey(r.Filters)
+		i, ok := index[key]
+		if !ok {
+			i = len(entries)
+			index[key] = i
+			entries = append(entries, Entry{})
+		}
+		entries[i].Rules = append(entries[i].Rules, r)
+	}
+
+	var result []Entry
+	for _, e := range entries {
+		e.Type = entryType(l, e.Rules)
+		if e.Type == mml.Raster {
+			continue
+		}
+		e.Name = entryName(l, e.Rules)
+		result = append(result, e)
+	}
+	return result
+}
+
+// symbolizerPrefixes are all properties that are rendered in swatches.
+var symbolizerPrefixes = []string{"line-", "polygon-", "polygon-pattern-", "line-pattern-", "text-", "shield-", "marker-", "point-", "building-", "dot-"}
+
+func hasSymbolizer(r mss.Rule) bool {
+	if r.Properties == nil {
+		return false
+	}
+	return len(mss.SortedPrefixes(r.Properties, symbolizerPrefixes)) > 0
+}
+
+func filterKey(filters []mss.Filter) string {
+	parts := make([]string, len(filters))
+	for i, f := range filters {
+		parts[i] = f.String()
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// entryType returns the geometry type of the symbolizers, or the type of
+// the layer.
+func entryType(l mml.Layer, rules []mss.Rule) mml.GeometryType {
+	if types := geomtype.Rules(rules); len(types) > 0 {
+		return types[0]
+	}
+	if l.Type != mml.Unknown && l.Type != "" {
+		return l.Type
+	}
+	return mml.Point
+}
+
+// entryName returns the legend-name of the rules, or the filters
+// (without mapnik::geometry_type), or the layer ID for rules without
+// filters.
+func entryName(l mml.Layer, rules []mss.Rule) string {
+	for _, r := range rules {
+		if name, ok := r.Properties.GetString("legend-name"); ok {
+			return name
+		}
+	}
+	var parts []string
+	for _, f := range rules[0].Filters {
+		if f.Field == "mapnik::geometry_type" {
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("%s %s %v", f.Field, f.CompOp, f.Value))
+	}
+	if len(parts) == 0 {
+		return l.ID
+	}
+	return strings.Join(parts, " and ")
+}
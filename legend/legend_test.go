@@ -0,0 +1,218 @@
+package legend
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/omniscale/magnacarto/builder/mapnik"
+	"github.com/omniscale/magnacarto/builder/mapserver"
+	"github.com/omniscale/magnacarto/config"
+	"github.com/omniscale/magnacarto/mml"
+	"github.com/omniscale/magnacarto/mss"
+	"github.com/omniscale/magnacarto/render"
+	"github.com/stretchr/testify/assert"
+)
+
+const testMML = `
+Layer:
+  - id: landuse
+    geometry: polygon
+  - id: roads
+    geometry: linestring
+  - id: places
+    geometry: point
+    properties:
+      minzoom: 10
+`
+
+const testMSS = `
+#landuse[type='forest'] { polygon-fill: green; legend-name: 'Forest'; }
+#landuse[type='park'] { polygon-fill: lightgreen; }
+#roads {
+  ::casing[type='primary'] { line-width: 5; line-color: black; }
+  [type='primary'] { line-width: 3; line-color: orange; }
+  [type='minor'][zoom>=12] { line-width: 1; line-color: grey; }
+}
+#places { text-name: [name]; text-size: 10; text-face-name: 'Noto Sans Regular'; }
+`
+
+func testLegend(t *testing.T, zoom int, layers []string) *Legend {
+	m, err := mml.Parse(strings.NewReader(testMML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	carto := mss.New()
+	if err := carto.ParseString(testMSS); err != nil {
+		t.Fatal(err)
+	}
+	if err := carto.Evaluate(); err != nil {
+		t.Fatal(err)
+	}
+	l, err := New(m, carto.MSS(), zoom, layers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestNew(t *testing.T) {
+	l := testLegend(t, 12, nil)
+	assert.Equal(t, 12, l.Zoom)
+	assert.Len(t, l.Layers, 3)
+
+	landuse := l.Layers[0]
+	assert.Equal(t, "landuse", landuse.ID)
+	assert.Len(t, landuse.Entries, 2)
+	// in order of the rules (most specific first)
+	assert.Equal(t, "type = park", landuse.Entries[0].Name)
+	assert.Equal(t, "Forest", landuse.Entries[1].Name)
+	assert.Equal(t, mml.Polygon, landuse.Entries[1].Type)
+
+	roads := l.Layers[1]
+	assert.Len(t, roads.Entries, 2)
+	assert.Equal(t, "type = minor", roads.Entries[0].Name)
+	assert.Equal(t, "type = primary", roads.Entries[1].Name)
+	assert.Equal(t, mml.LineString, roads.Entries[1].Type)
+	// casing and fill
+	assert.Len(t, roads.Entries[1].Rules, 2)
+
+	places := l.Layers[2]
+	assert.Equal(t, "places", places.Entries[0].Name)
+	assert.Equal(t, mml.Point, places.Entries[0].Type)
+	assert.Equal(t, "Noto Sans Regular", l.firstFont())
+
+	// minor roads start at 12, places at 10
+	l = testLegend(t, 9, nil)
+	assert.Len(t, l.Layers, 2)
+	assert.Len(t, l.Layers[1].Entries, 1)
+
+	l = testLegend(t, 12, []string{"roads"})
+	assert.Len(t, l.Layers, 1)
+	assert.Len(t, l.Entries(), 2)
+
+	m, _ := mml.Parse(strings.NewReader(testMML))
+	_, err := New(m, mss.New().MSS(), 12, []string{"unknown"})
+	assert.Error(t, err)
+}
+
+func TestCenterZoom(t *testing.T) {
+	assert.Equal(t, DefaultZoom, CenterZoom(&mml.MML{}))
+	assert.Equal(t, 12, CenterZoom(&mml.MML{Parameters: map[string]string{"center": "8.5,53.1,12"}}))
+	assert.Equal(t, DefaultZoom, CenterZoom(&mml.MML{Parameters: map[string]string{"center": "8.5,53.1"}}))
+}
+
+func TestMap(t *testing.T) {
+	l := testLegend(t, 12, []string{"roads", "places"})
+	locator := &config.LookupLocator{}
+
+	m, req, err := l.Map(mapnik.Maker3, locator, Options{}, true)
+	assert.NoError(t, err)
+	// 3 rows of 24px, swatch and label
+	assert.Equal(t, render.Request{Width: 240, Height: 72, BBOX: [4]float64{0, 0, 240, 72}, EPSGCode: 3857, ScaleFactor: 1}, req)
+
+	buf := bytes.Buffer{}
+	assert.NoError(t, m.Write(&buf))
+	xml := buf.String()
+	assert.Contains(t, xml, `<Layer name="legend-0"`)
+	assert.Contains(t, xml, `<Layer name="legend-labels"`)
+	assert.Contains(t, xml, "LINESTRING(5 58, 35 58)")
+	assert.Contains(t, xml, "wkt,name&#xA;POINT(20 10),Abc")
+	assert.Contains(t, xml, "POINT(40 58),type = minor")
+	assert.NotContains(t, xml, "[type] = 'primary'")
+
+	m, req, err = l.Map(mapserver.Maker, locator, Options{ScaleFactor: 2, SwatchWidth: 40}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 96, req.Width)
+	assert.Equal(t, 144, req.Height)
+	buf.Reset()
+	assert.NoError(t, m.Write(&buf))
+	assert.Contains(t, buf.String(), `WKT "POINT(24 10)"`)
+	assert.NotContains(t, buf.String(), "legend-labels")
+}
+
+func TestRenderSwatches(t *testing.T) {
+	l := testLegend(t, 12, []string{"roads"})
+	var reqs []render.Request
+	renderFunc := func(styleFile string, req render.Request, w io.Writer) error {
+		reqs = append(reqs, req)
+		assert.True(t, strings.HasSuffix(styleFile, "legend.xml"))
+		img := image.NewNRGBA(image.Rect(0, 0, req.Width, req.Height))
+		// color second row
+		for y := 24; y < 48; y++ {
+			for x := 0; x < req.Width; x++ {
+				img.Set(x, y, color.NRGBA{255, 0, 0, 255})
+			}
+		}
+		return png.Encode(w, img)
+	}
+	err := l.RenderSwatches(mapnik.Maker3, &config.LookupLocator{}, Options{}, renderFunc)
+	assert.NoError(t, err)
+	assert.Len(t, reqs, 1)
+
+	entries := l.Entries()
+	img, err := png.Decode(bytes.NewReader(entries[1].Image))
+	assert.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 32, 20), img.Bounds())
+	assert.Equal(t, color.NRGBA{255, 0, 0, 255}, color.NRGBAModel.Convert(img.At(0, 0)))
+	img, _ = png.Decode(bytes.NewReader(entries[0].Image))
+	assert.Equal(t, color.NRGBA{}, color.NRGBAModel.Convert(img.At(0, 0)))
+
+	data, err := l.Image(mapnik.Maker3, &config.LookupLocator{}, Options{}, renderFunc)
+	assert.NoError(t, err)
+	img, _ = png.Decode(bytes.NewReader(data))
+	assert.Equal(t, image.Rect(0, 0, 240, 48), img.Bounds())
+
+	buf := bytes.Buffer{}
+	assert.NoError(t, l.WriteJSON(&buf))
+	var doc struct {
+		Zoom   int
+		Layers []struct {
+			ID      string
+			Entries []struct{ Name, Type, Image string }
+		}
+	}
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &doc))
+	assert.Equal(t, 12, doc.Zoom)
+	assert.Equal(t, "roads", doc.Layers[0].ID)
+	assert.Equal(t, "LineString", doc.Layers[0].Entries[0].Type)
+	assert.True(t, strings.HasPrefix(doc.Layers[0].Entries[0].Image, "data:image/png;base64,"))
+
+	buf.Reset()
+	assert.NoError(t, l.WriteHTML(&buf))
+	assert.Contains(t, buf.String(), "<h3>roads</h3>")
+	assert.Contains(t, buf.String(), `<img src="data:image/png;base64,`)
+	assert.Contains(t, buf.String(), "<td>type = minor</td>")
+}
+
+func TestStyleCache(t *testing.T) {
+	c := NewStyleCache("")
+	defer c.ClearAll()
+
+	var files []string
+	renderFunc := func(styleFile string, req render.Request, w io.Writer) error {
+		files = append(files, styleFile)
+		return png.Encode(w, image.NewNRGBA(image.Rect(0, 0, req.Width, req.Height)))
+	}
+	opts := Options{StyleCache: c}
+	for _, layer := range []string{"roads", "roads", "landuse"} {
+		l := testLegend(t, 12, []string{layer})
+		_, err := l.Image(mapserver.Maker, &config.LookupLocator{}, opts, renderFunc)
+		assert.NoError(t, err)
+	}
+	assert.Len(t, files, 3)
+	assert.Equal(t, files[0], files[1])
+	assert.NotEqual(t, files[0], files[2])
+	_, err := os.Stat(files[0])
+	assert.NoError(t, err)
+
+	c.ClearAll()
+	_, err = os.Stat(files[0])
+	assert.True(t, os.IsNotExist(err))
+}
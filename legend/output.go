@@ -0,0 +1,87 @@
+package legend
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"html/template"
+	"io"
+)
+
+type jsonLegend struct {
+	Zoom   int         `json:"zoom"`
+	Layers []jsonLayer `json:"layers"`
+}
+
+type jsonLayer struct {
+	ID      string      `json:"id"`
+	Entries []jsonEntry `json:"entries"`
+}
+
+type jsonEntry struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Image string `json:"image,omitempty"`
+}
+
+func dataURI(png []byte) string {
+	if png == nil {
+		return ""
+	}
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(png)
+}
+
+func (l *Legend) jsonLegend() jsonLegend {
+	result := jsonLegend{Zoom: l.Zoom, Layers: []jsonLayer{}}
+	for _, layer := range l.Layers {
+		jl := jsonLayer{ID: layer.ID}
+		for _, e := range layer.Entries {
+			jl.Entries = append(jl.Entries, jsonEntry{
+				Name:  e.Name,
+				Type:  string(e.Type),
+				Image: dataURI(e.Image),
+			})
+		}
+		result.Layers = append(result.Layers, jl)
+	}
+	return result
+}
+
+// WriteJSON writes the legend as JSON. Swatches are included as data URIs,
+// if rendered with RenderSwatches.
+func (l *Legend) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(l.jsonLegend())
+}
+
+// WriteHTML writes the legend as HTML document, with one table for each
+// layer. Swatches are included as data URIs, if rendered with
+// RenderSwatches.
+func (l *Legend) WriteHTML(w io.Writer) error {
+	return htmlTemplate.Execute(w, l.jsonLegend())
+}
+
+var htmlTemplate = template.Must(template.New("legend").Funcs(template.FuncMap{
+	"uri": func(s string) template.URL { return template.URL(s) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Legend</title>
+<style>
+  body { font-family: sans-serif; font-size: 13px; }
+  td { padding: 2px 6px; vertical-align: middle; }
+</style>
+</head>
+<body>
+{{- range .Layers}}
+<h3>{{.ID}}</h3>
+<table>
+{{- range .Entries}}
+  <tr><td>{{if .Image}}<img src="{{uri .Image}}" alt="">{{end}}</td><td>{{.Name}}</td></tr>
+{{- end}}
+</table>
+{{- end}}
+</body>
+</html>
+`))
@@ -0,0 +1,413 @@
+package legend
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/draw"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/omniscale/magnacarto/builder"
+	"github.com/omniscale/magnacarto/config"
+	"github.com/omniscale/magnacarto/mml"
+	"github.com/omniscale/magnacarto/mss"
+	"github.com/omniscale/magnacarto/render"
+)
+
+// Options for rendering legends. All sizes are in pixels and multiplied
+// by ScaleFactor.
+type Options struct {
+	SwatchWidth  int
+	SwatchHeight int
+	Padding      int
+	LabelWidth   int
+	// Font is the face name of all labels. Defaults to the first
+	// text-face-name of the legend rules.
+	Font        string
+	ScaleFactor float64
+	// StyleCache reuses the style files of previous legends. Each
+	// legend is written to a new temporary style file if nil.
+	StyleCache *StyleCache
+}
+
+// DefaultOptions are used for all zero values of Options.
+var DefaultOptions = Options{
+	SwatchWidth:  32,
+	SwatchHeight: 20,
+	Padding:      4,
+	LabelWidth:   200,
+	Font:         "DejaVu Sans Book",
+	ScaleFactor:  1,
+}
+
+func (o Options) withDefaults(l *Legend) Options {
+	if o.SwatchWidth <= 0 {
+		o.SwatchWidth = DefaultOptions.SwatchWidth
+	}
+	if o.SwatchHeight <= 0 {
+		o.SwatchHeight = DefaultOptions.SwatchHeight
+	}
+	if o.Padding <= 0 {
+		o.Padding = DefaultOptions.Padding
+	}
+	if o.LabelWidth <= 0 {
+		o.LabelWidth = DefaultOptions.LabelWidth
+	}
+	if o.ScaleFactor <= 0 {
+		o.ScaleFactor = DefaultOptions.ScaleFactor
+	}
+	if o.Font == "" {
+		o.Font = l.firstFont()
+	}
+	if o.Font == "" {
+		o.Font = DefaultOptions.Font
+	}
+	return o
+}
+
+// RenderFunc renders the style file with the request as PNG into w. The
+// Format of the request is empty and needs to be set to a PNG format of
+// the renderer.
+type RenderFunc func(styleFile string, req render.Request, w io.Writer) error
+
+// Image renders all entries with labels as a single PNG image.
+func (l *Legend) Image(maker builder.MapMaker, locator config.Locator, opts Options, renderFunc RenderFunc) ([]byte, error) {
+	opts = opts.withDefaults(l)
+	img, err := l.render(maker, locator, opts, true, renderFunc)
+	if err != nil {
+		return nil, err
+	}
+	buf := bytes.Buffer{}
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// RenderSwatches renders all entries and sets the Image of each entry to
+// the PNG encoded swatch.
+func (l *Legend) RenderSwatches(maker builder.MapMaker, locator config.Locator, opts Options, renderFunc RenderFunc) error {
+	if len(l.Entries()) == 0 {
+		return nil
+	}
+	opts = opts.withDefaults(l)
+	img, err := l.render(maker, locator, opts, false, renderFunc)
+	if err != nil {
+		return err
+	}
+	for i, e := range l.Entries() {
+		x0, y0 := scaled(opts.Padding, opts), scaled(i*rowHeight(opts)+opts.Padding, opts)
+		swatch := image.NewNRGBA(image.Rect(0, 0, scaled(opts.SwatchWidth, opts), scaled(opts.SwatchHeight, opts)))
+		draw.Draw(swatch, swatch.Bounds(), img, image.Pt(img.Bounds().Min.X+x0, img.Bounds().Min.Y+y0), draw.Src)
+		buf := bytes.Buffer{}
+		if err := png.Encode(&buf, swatch); err != nil {
+			return err
+		}
+		e.Image = buf.Bytes()
+	}
+	return nil
+}
+
+func (l *Legend) render(maker builder.MapMaker, locator config.Locator, opts Options, labels bool, renderFunc RenderFunc) (image.Image, error) {
+	if len(l.Entries()) == 0 {
+		return nil, fmt.Errorf("no legend entries for zoom %d", l.Zoom)
+	}
+	m, req, err := l.Map(maker, locator, opts, labels)
+	if err != nil {
+		return nil, err
+	}
+
+	var styleFile string
+	if opts.StyleCache != nil {
+		styleFile, err = opts.StyleCache.styleFile(maker, m)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		dir, err := ioutil.TempDir("", "magnacarto-legend")
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(dir)
+		styleFile = filepath.Join(dir, "legend"+maker.FileSuffix())
+		if err := m.WriteFiles(styleFile); err != nil {
+			return nil, err
+		}
+	}
+
+	buf := bytes.Buffer{}
+	if err := renderFunc(styleFile, req, &buf); err != nil {
+		return nil, err
+	}
+	img, err := png.Decode(&buf)
+	if err != nil {
+		return nil, fmt.Errorf("decoding legend: %v", err)
+	}
+	return img, nil
+}
+
+const legendPrefix = "magnacarto-legend-"
+
+// StyleCache keeps the style files of rendered legends. Legends with the
+// same style are rendered from the same file, so that renderers can keep
+// the loaded map in their cache.
+type StyleCache struct {
+	mu   sync.Mutex
+	dir  string
+	tmp  bool
+	dirs map[string]bool
+}
+
+// NewStyleCache returns a cache that stores the style files in dir, or in
+// a new temp dir if dir is empty.
+func NewStyleCache(dir string) *StyleCache {
+	return &StyleCache{dir: dir, dirs: make(map[string]bool)}
+}
+
+// styleFile writes the style of m and returns the file of a previous
+// legend with the same style, if available. Each style is stored in its
+// own directory, as some builders write additional files next to the
+// style (e.g. font lists).
+func (c *StyleCache) styleFile(maker builder.MapMaker, m builder.MapWriter) (string, error) {
+	c.mu.Lock()
+	if c.dir == "" {
+		tmp, err := ioutil.TempDir("", "magnacarto-legends")
+		if err != nil {
+			c.mu.Unlock()
+			return "", err
+		}
+		c.dir = tmp
+		c.tmp = true
+	}
+	dir := c.dir
+	c.mu.Unlock()
+
+	stage, err := ioutil.TempDir(dir, legendPrefix+"tmp-")
+	if err != nil {
+		return "", err
+	}
+	name := "legend" + maker.FileSuffix()
+	if err := m.WriteFiles(filepath.Join(stage, name)); err != nil {
+		os.RemoveAll(stage)
+		return "", err
+	}
+	data, err := ioutil.ReadFile(filepath.Join(stage, name))
+	if err != nil {
+		os.RemoveAll(stage)
+		return "", err
+	}
+	h := fnv.New64a()
+	h.Write([]byte(maker.Type()))
+	h.Write(data)
+	styleDir := filepath.Join(dir, fmt.Sprintf("%s%016x", legendPrefix, h.Sum64()))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := os.Stat(styleDir); err == nil {
+		// keep existing file and its modification time
+		os.RemoveAll(stage)
+	} else if err := os.Rename(stage, styleDir); err != nil {
+		os.RemoveAll(stage)
+		return "", err
+	}
+	c.dirs[styleDir] = true
+	return filepath.Join(styleDir, name), nil
+}
+
+// ClearAll removes all style files of the cache.
+func (c *StyleCache) ClearAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.tmp {
+		os.RemoveAll(c.dir)
+		c.dir = ""
+		c.tmp = false
+	} else {
+		for dir := range c.dirs {
+			os.RemoveAll(dir)
+		}
+	}
+	c.dirs = make(map[string]bool)
+}
+
+// Map returns a map with one layer for each entry and the request to
+// render all entries. Each entry is rendered in a row with synthetic
+// geometries. Labels are added next to each swatch if labels is true.
+// Map units are pixels.
+func (l *Legend) Map(maker builder.MapMaker, locator config.Locator, opts Options, labels bool) (builder.MapWriter, render.Request, error) {
+	opts = opts.withDefaults(l)
+	entries := l.Entries()
+	width := opts.Padding + opts.SwatchWidth + opts.Padding
+	if labels {
+		width += opts.LabelWidth
+	}
+	height := len(entries) * rowHeight(opts)
+
+	m := maker.New(locator)
+	var labelRows [][]string
+	for i, e := range entries {
+		id := fmt.Sprintf("legend-%d", i)
+		cy := float64(height - i*rowHeight(opts) - opts.Padding - opts.SwatchHeight/2)
+		rules := swatchRules(id, e.Rules)
+		m.AddLayer(mml.Layer{
+			ID:         id,
+			Type:       e.Type,
+			SRS:        "epsg:3857",
+			Active:     true,
+			Datasource: mml.CSV{Inline: featureCSV(swatchGeometry(e.Type, cy, opts), e.Rules)},
+		}, rules)
+		labelRows = append(labelRows, []string{
+			fmt.Sprintf("POINT(%d %g)", 2*opts.Padding+opts.SwatchWidth, cy),
+			e.Name,
+		})
+	}
+
+	if labels {
+		rules, err := labelRules(opts.Font)
+		if err != nil {
+			return nil, render.Request{}, err
+		}
+		m.AddLayer(mml.Layer{
+			ID:         "legend-labels",
+			Type:       mml.Point,
+			SRS:        "epsg:3857",
+			Active:     true,
+			Datasource: mml.CSV{Inline: csvString(append([][]string{{"wkt", "label"}}, labelRows...))},
+		}, rules)
+	}
+
+	req := render.Request{
+		Width:       scaled(width, opts),
+		Height:      scaled(height, opts),
+		BBOX:        [4]float64{0, 0, float64(width), float64(height)},
+		EPSGCode:    3857,
+		ScaleFactor: opts.ScaleFactor,
+	}
+	return m, req, nil
+}
+
+func rowHeight(opts Options) int {
+	return opts.SwatchHeight + opts.Padding
+}
+
+func scaled(v int, opts Options) int {
+	return int(float64(v)*opts.ScaleFactor + 0.5)
+}
+
+// swatchRules returns the rules for a single swatch layer. Filters are
+// removed, as the synthetic features have no attributes to match.
+func swatchRules(layer string, rules []mss.Rule) []mss.Rule {
+	result := make([]mss.Rule, len(rules))
+	for i, r := range rules {
+		r.Layer = layer
+		r.Filters = nil
+		r.Zoom = mss.AllZoom
+		result[i] = r
+	}
+	return result
+}
+
+// swatchGeometry returns the WKT of a point in the center, a horizontal
+// line, or a rectangle within the swatch.
+func swatchGeometry(t mml.GeometryType, cy float64, opts Options) string {
+	x0 := float64(opts.Padding + 1)
+	x1 := float64(opts.Padding + opts.SwatchWidth - 1)
+	switch t {
+	case mml.LineString:
+		return fmt.Sprintf("LINESTRING(%g %g, %g %g)", x0, cy, x1, cy)
+	case mml.Polygon:
+		y0 := cy - float64(opts.SwatchHeight)/2 + 1
+		y1 := cy + float64(opts.SwatchHeight)/2 - 1
+		return fmt.Sprintf("POLYGON((%g %g, %g %g, %g %g, %g %g, %g %g))", x0, y0, x1, y0, x1, y1, x0, y1, x0, y0)
+	default:
+		return fmt.Sprintf("POINT(%g %g)", (x0+x1)/2, cy)
+	}
+}
+
+// sampleValue is used for all referenced fields without filter value.
+const sampleValue = "Abc"
+
+// featureCSV returns an inline CSV with the geometry and all fields of
+// the rules. Fields are set to the value of equal filters, or to
+// sampleValue.
+func featureCSV(wkt string, rules []mss.Rule) string {
+	filterValues := make(map[string]string)
+	for _, r := range rules {
+		for _, f := range r.Filters {
+			if f.CompOp == mss.EQ {
+				filterValues[f.Field] = fmt.Sprint(f.Value)
+			}
+		}
+	}
+
+	values := make(map[string]string)
+	var fields []string
+	for _, r := range rules {
+		for _, f := range r.Properties.Fields() {
+			if _, ok := values[f]; ok {
+				continue
+			}
+			values[f] = sampleValue
+			if v, ok := filterValues[f]; ok {
+				values[f] = v
+			}
+			fields = append(fields, f)
+		}
+	}
+	header := []string{"wkt"}
+	row := []string{wkt}
+	for _, f := range fields {
+		header = append(header, f)
+		row = append(row, values[f])
+	}
+	return csvString([][]string{header, row})
+}
+
+func csvString(rows [][]string) string {
+	buf := bytes.Buffer{}
+	w := csv.NewWriter(&buf)
+	w.WriteAll(rows)
+	return buf.String()
+}
+
+func labelRules(font string) ([]mss.Rule, error) {
+	carto := mss.New()
+	err := carto.ParseString(fmt.Sprintf(`#legend-labels {
+  text-name: [label];
+  text-face-name: "%s";
+  text-size: 11;
+  text-fill: #222;
+  text-placement: point;
+  text-horizontal-alignment: right;
+  text-allow-overlap: true;
+}`, strings.Replace(font, `"`, "", -1)))
+	if err != nil {
+		return nil, err
+	}
+	if err := carto.Evaluate(); err != nil {
+		return nil, err
+	}
+	return carto.MSS().LayerRules("legend-labels"), nil
+}
+
+// firstFont returns the first text-face-name of all rules.
+func (l *Legend) firstFont() string {
+	for _, e := range l.Entries() {
+		for _, r := range e.Rules {
+			for _, p := range []string{"text-face-name", "shield-face-name"} {
+				if faces, ok := r.Properties.GetStringList(p); ok && len(faces) > 0 {
+					return faces[0]
+				}
+			}
+		}
+	}
+	return ""
+}
@@ -21,6 +21,8 @@ type Request struct {
 	EPSGCode    int
 	Format      string
 	ScaleFactor float64
+	// Layers contains the requested layers of WMS requests.
+	Layers []string
 }
 
 type MissingParamError struct {
@@ -154,9 +156,14 @@ func parseBBOX(q url.Values) (BBOX, error) {
 }
 
 func parseEPSGCode(q url.Values) (int, error) {
-	srsStr := q.Get("SRS")
+	return parseSRS(q, "SRS")
+}
+
+// parseSRS parses the EPSG code of param (SRS or CRS for WMS 1.3.0).
+func parseSRS(q url.Values, param string) (int, error) {
+	srsStr := q.Get(param)
 	if srsStr == "" {
-		return 0, &MissingParamError{"SRS"}
+		return 0, &MissingParamError{param}
 	}
 
 	if srsStr == "CRS:84" {
@@ -165,16 +172,16 @@ func parseEPSGCode(q url.Values) (int, error) {
 
 	srsParts := strings.Split(srsStr, ":")
 	if len(srsParts) != 2 {
-		return 0, &InvalidParamError{Param: "SRS", Value: srsStr}
+		return 0, &InvalidParamError{Param: param, Value: srsStr}
 	}
 
 	if !strings.HasPrefix(strings.ToUpper(srsStr), "EPSG") {
-		return 0, &InvalidParamError{Param: "SRS", Value: srsStr}
+		return 0, &InvalidParamError{Param: param, Value: srsStr}
 	}
 
 	epsgCode, err := strconv.ParseUint(srsParts[1], 10, 32)
 	if err != nil {
-		return 0, &InvalidParamError{Param: "SRS", Value: srsStr}
+		return 0, &InvalidParamError{Param: param, Value: srsStr}
 	}
 
 	if epsgCode == 900913 {
@@ -0,0 +1,422 @@
+package maps
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// Supported WMS versions.
+const (
+	WMS111 = "1.1.1"
+	WMS130 = "1.3.0"
+)
+
+// WMSRequest is a parsed WMS request.
+type WMSRequest struct {
+	// Request is GetCapabilities, GetMap or GetLegendGraphic.
+	Request string
+	// Version is the negotiated version (WMS111 or WMS130).
+	Version string
+	// Map is the parsed GetMap request.
+	Map *Request
+	// Legend is the parsed GetLegendGraphic request.
+	Legend *LegendRequest
+}
+
+// LegendRequest is a parsed GetLegendGraphic request.
+type LegendRequest struct {
+	Query url.Values
+	Layer string
+	// Format is png, json or html.
+	Format string
+	// Zoom is the zoom level from the ZOOM or SCALE parameter, or -1 if
+	// neither is set.
+	Zoom        int
+	ScaleFactor float64
+}
+
+// ServiceException is a WMS error with an optional exception code
+// (e.g. InvalidSRS or LayerNotDefined).
+type ServiceException struct {
+	Code string
+	Msg  string
+}
+
+func (e *ServiceException) Error() string {
+	if e.Code != "" {
+		return e.Code + ": " + e.Msg
+	}
+	return e.Msg
+}
+
+// ParseWMSRequest parses WMS 1.1.1 and 1.3.0 GetCapabilities, GetMap and
+// GetLegendGraphic requests. Returns a *ServiceException for invalid requests. The version
+// of the returned WMSRequest is also set for errors, so that the
+// exception can be reported in the requested version.
+func ParseWMSRequest(r *http.Request) (*WMSRequest, error) {
+	query, err := parseQueryUpper(r.URL.RawQuery)
+	if err != nil {
+		return &WMSRequest{Version: WMS130}, &ServiceException{Msg: err.Error()}
+	}
+
+	req := &WMSRequest{
+		Request: query.Get("REQUEST"),
+		Version: negotiateVersion(query),
+	}
+
+	if service := query.Get("SERVICE"); service != "" && !strings.EqualFold(service, "WMS") {
+		return req, &ServiceException{Msg: fmt.Sprintf("unsupported service '%s'", service)}
+	}
+
+	switch strings.ToLower(req.Request) {
+	case "getcapabilities", "capabilities":
+		req.Request = "GetCapabilities"
+		return req, nil
+	case "getmap", "map":
+		req.Request = "GetMap"
+	case "getlegendgraphic":
+		req.Request = "GetLegendGraphic"
+		req.Legend, err = parseGetLegendGraphic(query)
+		if err != nil {
+			return req, err
+		}
+		return req, nil
+	case "":
+		return req, &ServiceException{Msg: (&MissingParamError{"REQUEST"}).Error()}
+	default:
+		return req, &ServiceException{Code: "OperationNotSupported", Msg: fmt.Sprintf("unsupported request '%s'", req.Request)}
+	}
+
+	req.Map, err = parseGetMap(r, query, req.Version)
+	if err != nil {
+		return req, err
+	}
+	return req, nil
+}
+
+// negotiateVersion returns WMS111 for all requested 1.1.x versions and
+// WMS130 otherwise.
+func negotiateVersion(q url.Values) string {
+	v := q.Get("VERSION")
+	if v == "" {
+		v = q.Get("WMTVER")
+	}
+	if strings.HasPrefix(v, "1.1") || strings.HasPrefix(v, "1.0") {
+		return WMS111
+	}
+	return WMS130
+}
+
+func parseGetMap(r *http.Request, q url.Values, version string) (*Request, error) {
+	req := &Request{
+		HTTP:  r,
+		Query: q,
+	}
+
+	var err error
+	if req.Layers, err = parseLayers(q); err != nil {
+		return nil, &ServiceException{Msg: err.Error()}
+	}
+
+	if req.Width, req.Height, err = parseSize(q); err != nil {
+		return nil, &ServiceException{Msg: err.Error()}
+	}
+
+	if req.BBOX, err = parseBBOX(q); err != nil {
+		return nil, &ServiceException{Msg: err.Error()}
+	}
+
+	srsParam := "SRS"
+	if version == WMS130 {
+		srsParam = "CRS"
+	}
+	if req.EPSGCode, err = parseSRS(q, srsParam); err != nil {
+		code := "InvalidSRS"
+		if version == WMS130 {
+			code = "InvalidCRS"
+		}
+		return nil, &ServiceException{Code: code, Msg: err.Error()}
+	}
+	if version == WMS130 && q.Get("CRS") != "CRS:84" && latLonAxisOrder(req.EPSGCode) {
+		// WMS 1.3.0 uses the axis order of the CRS
+		b := req.BBOX
+		req.BBOX = BBOX{MinX: b.MinY, MinY: b.MinX, MaxX: b.MaxY, MaxY: b.MaxX}
+	}
+
+	if req.Format, err = parseFormat(q); err != nil {
+		return nil, &ServiceException{Code: "InvalidFormat", Msg: err.Error()}
+	}
+
+	if req.ScaleFactor, err = parseScaleFactor(q); err != nil {
+		return nil, &ServiceException{Msg: err.Error()}
+	}
+	return req, nil
+}
+
+func parseGetLegendGraphic(q url.Values) (*LegendRequest, error) {
+	req := &LegendRequest{Query: q, Zoom: -1}
+
+	if req.Layer = q.Get("LAYER"); req.Layer == "" {
+		return nil, &ServiceException{Msg: (&MissingParamError{"LAYER"}).Error()}
+	}
+
+	switch format := q.Get("FORMAT"); {
+	case format == "" || strings.HasPrefix(format, "image/png"):
+		req.Format = "png"
+	case format == "application/json":
+		req.Format = "json"
+	case format == "text/html":
+		req.Format = "html"
+	default:
+		return nil, &ServiceException{Code: "InvalidFormat", Msg: (&InvalidParamError{Param: "FORMAT", Value: format}).Error()}
+	}
+
+	if v := q.Get("ZOOM"); v != "" {
+		zoom, err := strconv.ParseUint(v, 10, 32)
+		if err != nil || zoom > maxLegendZoom {
+			return nil, &ServiceException{Msg: (&InvalidParamError{Param: "ZOOM", Value: v}).Error()}
+		}
+		req.Zoom = int(zoom)
+	} else if v := q.Get("SCALE"); v != "" {
+		scale, err := strconv.ParseFloat(v, 64)
+		if err != nil || scale <= 0 {
+			return nil, &ServiceException{Msg: (&InvalidParamError{Param: "SCALE", Value: v}).Error()}
+		}
+		req.Zoom = scaleZoom(scale)
+	}
+
+	var err error
+	if req.ScaleFactor, err = parseScaleFactor(q); err != nil {
+		return nil, &ServiceException{Msg: err.Error()}
+	}
+	return req, nil
+}
+
+const maxLegendZoom = 30
+
+// zoom0ScaleDenom is the scale denominator of zoom level 0 in Web
+// Mercator (with 0.28mm pixels).
+const zoom0ScaleDenom = 559082264.028
+
+// scaleZoom returns the nearest zoom level for the scale denominator.
+func scaleZoom(scale float64) int {
+	zoom := int(math.Floor(math.Log2(zoom0ScaleDenom/scale) + 0.5))
+	if zoom < 0 {
+		return 0
+	}
+	if zoom > maxLegendZoom {
+		return maxLegendZoom
+	}
+	return zoom
+}
+
+// latLonAxisOrder returns whether the EPSG code is a geographic CRS with
+// latitude as the first axis.
+func latLonAxisOrder(epsgCode int) bool {
+	switch epsgCode {
+	case 4326, 4258, 4269, 4267:
+		return true
+	}
+	return false
+}
+
+func parseLayers(q url.Values) ([]string, error) {
+	layersStr := q.Get("LAYERS")
+	if layersStr == "" {
+		return nil, &MissingParamError{"LAYERS"}
+	}
+	var layers []string
+	for _, l := range strings.Split(layersStr, ",") {
+		if l = strings.TrimSpace(l); l != "" {
+			layers = append(layers, l)
+		}
+	}
+	if len(layers) == 0 {
+		return nil, &InvalidParamError{Param: "LAYERS", Value: layersStr}
+	}
+	return layers, nil
+}
+
+// WriteServiceException writes err as a WMS ServiceExceptionReport for
+// the version and sets the content type. Errors other than
+// *ServiceException are reported without exception code.
+func WriteServiceException(w http.ResponseWriter, version string, err error) {
+	exc, ok := err.(*ServiceException)
+	if !ok {
+		exc = &ServiceException{Msg: err.Error()}
+	}
+	if version == WMS111 {
+		w.Header().Set("Content-Type", "application/vnd.ogc.se_xml")
+	} else {
+		w.Header().Set("Content-Type", "text/xml")
+	}
+	// WMS clients expect exceptions with status 200
+	exceptionTemplate.Execute(w, struct {
+		Version string
+		Code    string
+		Msg     string
+	}{version, exc.Code, exc.Msg})
+}
+
+// CapabilitiesLayer is a named layer in the capabilities document.
+type CapabilitiesLayer struct {
+	Name  string
+	Title string
+	// BBOX in EPSG:4326 (lon/lat).
+	BBOX BBOX
+}
+
+// Capabilities describes a WMS service.
+type Capabilities struct {
+	Title string
+	// URL of the service, used as OnlineResource for all operations.
+	URL string
+	// EPSGCodes of all supported projections.
+	EPSGCodes []int
+	// BBOX of the root layer in EPSG:4326 (lon/lat).
+	BBOX   BBOX
+	Layers []CapabilitiesLayer
+}
+
+// WriteCapabilities writes the capabilities document for the version.
+func WriteCapabilities(w io.Writer, version string, c Capabilities) error {
+	if version == WMS111 {
+		return capabilities111Template.Execute(w, c)
+	}
+	return capabilities130Template.Execute(w, c)
+}
+
+var templateFuncs = template.FuncMap{
+	"xml": template.HTMLEscapeString,
+	"coord": func(f float64) string {
+		return fmt.Sprintf("%.8g", f)
+	},
+}
+
+var exceptionTemplate = template.Must(template.New("exception").Funcs(templateFuncs).Parse(
+	`<?xml version="1.0" encoding="UTF-8"?>
+{{if eq .Version "1.1.1" -}}
+<!DOCTYPE ServiceExceptionReport SYSTEM "http://schemas.opengis.net/wms/1.1.1/exception_1_1_1.dtd">
+<ServiceExceptionReport version="1.1.1">
+{{- else -}}
+<ServiceExceptionReport version="1.3.0" xmlns="http://www.opengis.net/ogc" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" xsi:schemaLocation="http://www.opengis.net/ogc http://schemas.opengis.net/wms/1.3.0/exceptions_1_3_0.xsd">
+{{- end}}
+  <ServiceException{{if .Code}} code="{{xml .Code}}"{{end}}>{{xml .Msg}}</ServiceException>
+</ServiceExceptionReport>
+`))
+
+var capabilities111Template = template.Must(template.New("capabilities111").Funcs(templateFuncs).Parse(
+	`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE WMT_MS_Capabilities SYSTEM "http://schemas.opengis.net/wms/1.1.1/WMS_MS_Capabilities.dtd">
+<WMT_MS_Capabilities version="1.1.1">
+  <Service>
+    <Name>OGC:WMS</Name>
+    <Title>{{xml .Title}}</Title>
+    <OnlineResource xmlns:xlink="http://www.w3.org/1999/xlink" xlink:href="{{xml .URL}}"/>
+  </Service>
+  <Capability>
+    <Request>
+      <GetCapabilities>
+        <Format>application/vnd.ogc.wms_xml</Format>
+        <DCPType><HTTP><Get><OnlineResource xmlns:xlink="http://www.w3.org/1999/xlink" xlink:href="{{xml .URL}}"/></Get></HTTP></DCPType>
+      </GetCapabilities>
+      <GetMap>
+        <Format>image/png</Format>
+        <Format>image/png; mode=24bit</Format>
+        <Format>image/jpeg</Format>
+        <DCPType><HTTP><Get><OnlineResource xmlns:xlink="http://www.w3.org/1999/xlink" xlink:href="{{xml .URL}}"/></Get></HTTP></DCPType>
+      </GetMap>
+      <GetLegendGraphic>
+        <Format>image/png</Format>
+        <Format>application/json</Format>
+        <Format>text/html</Format>
+        <DCPType><HTTP><Get><OnlineResource xmlns:xlink="http://www.w3.org/1999/xlink" xlink:href="{{xml .URL}}"/></Get></HTTP></DCPType>
+      </GetLegendGraphic>
+    </Request>
+    <Exception>
+      <Format>application/vnd.ogc.se_xml</Format>
+    </Exception>
+    <Layer>
+      <Title>{{xml .Title}}</Title>
+{{- range .EPSGCodes}}
+      <SRS>EPSG:{{.}}</SRS>
+{{- end}}
+      <LatLonBoundingBox minx="{{coord .BBOX.MinX}}" miny="{{coord .BBOX.MinY}}" maxx="{{coord .BBOX.MaxX}}" maxy="{{coord .BBOX.MaxY}}"/>
+{{- range .Layers}}
+      <Layer queryable="0">
+        <Name>{{xml .Name}}</Name>
+        <Title>{{xml .Title}}</Title>
+        <LatLonBoundingBox minx="{{coord .BBOX.MinX}}" miny="{{coord .BBOX.MinY}}" maxx="{{coord .BBOX.MaxX}}" maxy="{{coord .BBOX.MaxY}}"/>
+      </Layer>
+{{- end}}
+    </Layer>
+  </Capability>
+</WMT_MS_Capabilities>
+`))
+
+var capabilities130Template = template.Must(template.New("capabilities130").Funcs(templateFuncs).Parse(
+	`<?xml version="1.0" encoding="UTF-8"?>
+<WMS_Capabilities version="1.3.0" xmlns="http://www.opengis.net/wms" xmlns:xlink="http://www.w3.org/1999/xlink" xmlns:sld="http://www.opengis.net/sld" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" xsi:schemaLocation="http://www.opengis.net/wms http://schemas.opengis.net/wms/1.3.0/capabilities_1_3_0.xsd">
+  <Service>
+    <Name>WMS</Name>
+    <Title>{{xml .Title}}</Title>
+    <OnlineResource xlink:href="{{xml .URL}}"/>
+  </Service>
+  <Capability>
+    <Request>
+      <GetCapabilities>
+        <Format>text/xml</Format>
+        <DCPType><HTTP><Get><OnlineResource xlink:href="{{xml .URL}}"/></Get></HTTP></DCPType>
+      </GetCapabilities>
+      <GetMap>
+        <Format>image/png</Format>
+        <Format>image/png; mode=24bit</Format>
+        <Format>image/jpeg</Format>
+        <DCPType><HTTP><Get><OnlineResource xlink:href="{{xml .URL}}"/></Get></HTTP></DCPType>
+      </GetMap>
+      <sld:GetLegendGraphic>
+        <Format>image/png</Format>
+        <Format>application/json</Format>
+        <Format>text/html</Format>
+        <DCPType><HTTP><Get><OnlineResource xlink:href="{{xml .URL}}"/></Get></HTTP></DCPType>
+      </sld:GetLegendGraphic>
+    </Request>
+    <Exception>
+      <Format>XML</Format>
+    </Exception>
+    <Layer>
+      <Title>{{xml .Title}}</Title>
+      <CRS>CRS:84</CRS>
+{{- range .EPSGCodes}}
+      <CRS>EPSG:{{.}}</CRS>
+{{- end}}
+      <EX_GeographicBoundingBox>
+        <westBoundLongitude>{{coord .BBOX.MinX}}</westBoundLongitude>
+        <eastBoundLongitude>{{coord .BBOX.MaxX}}</eastBoundLongitude>
+        <southBoundLatitude>{{coord .BBOX.MinY}}</southBoundLatitude>
+        <northBoundLatitude>{{coord .BBOX.MaxY}}</northBoundLatitude>
+      </EX_GeographicBoundingBox>
+      <BoundingBox CRS="CRS:84" minx="{{coord .BBOX.MinX}}" miny="{{coord .BBOX.MinY}}" maxx="{{coord .BBOX.MaxX}}" maxy="{{coord .BBOX.MaxY}}"/>
+{{- range .Layers}}
+      <Layer queryable="0">
+        <Name>{{xml .Name}}</Name>
+        <Title>{{xml .Title}}</Title>
+        <EX_GeographicBoundingBox>
+          <westBoundLongitude>{{coord .BBOX.MinX}}</westBoundLongitude>
+          <eastBoundLongitude>{{coord .BBOX.MaxX}}</eastBoundLongitude>
+          <southBoundLatitude>{{coord .BBOX.MinY}}</southBoundLatitude>
+          <northBoundLatitude>{{coord .BBOX.MaxY}}</northBoundLatitude>
+        </EX_GeographicBoundingBox>
+        <BoundingBox CRS="CRS:84" minx="{{coord .BBOX.MinX}}" miny="{{coord .BBOX.MinY}}" maxx="{{coord .BBOX.MaxX}}" maxy="{{coord .BBOX.MaxY}}"/>
+      </Layer>
+{{- end}}
+    </Layer>
+  </Capability>
+</WMS_Capabilities>
+`))
@@ -0,0 +1,159 @@
+package maps
+
+import (
+	"bytes"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func wmsRequest(t *testing.T, query string) (*WMSRequest, error) {
+	r, err := http.NewRequest("GET", "/wms?"+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ParseWMSRequest(r)
+}
+
+func TestParseWMSRequest(t *testing.T) {
+	req, err := wmsRequest(t, "service=WMS&request=GetCapabilities")
+	assert.NoError(t, err)
+	assert.Equal(t, "GetCapabilities", req.Request)
+	assert.Equal(t, WMS130, req.Version)
+
+	req, err = wmsRequest(t, "SERVICE=WMS&REQUEST=GetMap&VERSION=1.1.1&LAYERS=roads,landuse&STYLES=&SRS=EPSG:4326&BBOX=8,53,10,54&WIDTH=200&HEIGHT=100&FORMAT=image/png")
+	assert.NoError(t, err)
+	assert.Equal(t, WMS111, req.Version)
+	assert.Equal(t, []string{"roads", "landuse"}, req.Map.Layers)
+	assert.Equal(t, BBOX{8, 53, 10, 54}, req.Map.BBOX)
+	assert.Equal(t, 4326, req.Map.EPSGCode)
+	assert.Equal(t, 200, req.Map.Width)
+	assert.Equal(t, "png256", req.Map.Format)
+
+	// lat/lon axis order in 1.3.0
+	req, err = wmsRequest(t, "SERVICE=WMS&REQUEST=GetMap&VERSION=1.3.0&LAYERS=roads&STYLES=&CRS=EPSG:4326&BBOX=53,8,54,10&WIDTH=200&HEIGHT=100&FORMAT=image/png")
+	assert.NoError(t, err)
+	assert.Equal(t, BBOX{8, 53, 10, 54}, req.Map.BBOX)
+
+	req, err = wmsRequest(t, "SERVICE=WMS&REQUEST=GetMap&VERSION=1.3.0&LAYERS=roads&STYLES=&CRS=CRS:84&BBOX=8,53,10,54&WIDTH=200&HEIGHT=100&FORMAT=image/png")
+	assert.NoError(t, err)
+	assert.Equal(t, BBOX{8, 53, 10, 54}, req.Map.BBOX)
+	assert.Equal(t, 4326, req.Map.EPSGCode)
+
+	req, err = wmsRequest(t, "SERVICE=WMS&REQUEST=GetMap&VERSION=1.3.0&LAYERS=roads&STYLES=&CRS=EPSG:3857&BBOX=0,0,1000,500&WIDTH=200&HEIGHT=100&FORMAT=image/png")
+	assert.NoError(t, err)
+	assert.Equal(t, BBOX{0, 0, 1000, 500}, req.Map.BBOX)
+}
+
+func TestParseGetLegendGraphic(t *testing.T) {
+	req, err := wmsRequest(t, "SERVICE=WMS&REQUEST=GetLegendGraphic&VERSION=1.1.1&LAYER=roads&FORMAT=image/png")
+	assert.NoError(t, err)
+	assert.Equal(t, "GetLegendGraphic", req.Request)
+	assert.Equal(t, "roads", req.Legend.Layer)
+	assert.Equal(t, "png", req.Legend.Format)
+	assert.Equal(t, -1, req.Legend.Zoom)
+	assert.Equal(t, 1.0, req.Legend.ScaleFactor)
+
+	req, err = wmsRequest(t, "SERVICE=WMS&REQUEST=GetLegendGraphic&LAYER=roads&FORMAT=application/json&SCALE=34942641")
+	assert.NoError(t, err)
+	assert.Equal(t, "json", req.Legend.Format)
+	assert.Equal(t, 4, req.Legend.Zoom)
+
+	req, err = wmsRequest(t, "SERVICE=WMS&REQUEST=GetLegendGraphic&LAYER=roads&FORMAT=text/html&ZOOM=12&SCALE=34942641")
+	assert.NoError(t, err)
+	assert.Equal(t, "html", req.Legend.Format)
+	assert.Equal(t, 12, req.Legend.Zoom)
+
+	_, err = wmsRequest(t, "SERVICE=WMS&REQUEST=GetLegendGraphic&FORMAT=image/png")
+	assert.Error(t, err)
+	_, err = wmsRequest(t, "SERVICE=WMS&REQUEST=GetLegendGraphic&LAYER=roads&ZOOM=-1")
+	assert.Error(t, err)
+	_, err = wmsRequest(t, "SERVICE=WMS&REQUEST=GetLegendGraphic&LAYER=roads&FORMAT=image/gif")
+	if assert.Error(t, err) {
+		assert.Equal(t, "InvalidFormat", err.(*ServiceException).Code)
+	}
+
+	assert.Equal(t, 0, scaleZoom(1e10))
+	assert.Equal(t, 10, scaleZoom(545978))
+	assert.Equal(t, 10, scaleZoom(500000))
+}
+
+func TestParseWMSRequestErrors(t *testing.T) {
+	for _, tt := range []struct {
+		query   string
+		version string
+		code    string
+	}{
+		{"SERVICE=WMS&VERSION=1.1.1", WMS111, ""},
+		{"SERVICE=WMS&REQUEST=GetFeatureInfo", WMS130, "OperationNotSupported"},
+		{"SERVICE=WMS&REQUEST=GetMap&VERSION=1.3.0&STYLES=&CRS=EPSG:4326&BBOX=53,8,54,10&WIDTH=200&HEIGHT=100", WMS130, ""},
+		{"SERVICE=WMS&REQUEST=GetMap&VERSION=1.1.1&LAYERS=roads&SRS=FOO&BBOX=8,53,10,54&WIDTH=200&HEIGHT=100", WMS111, "InvalidSRS"},
+		{"SERVICE=WMS&REQUEST=GetMap&VERSION=1.3.0&LAYERS=roads&SRS=EPSG:4326&BBOX=8,53,10,54&WIDTH=200&HEIGHT=100", WMS130, "InvalidCRS"},
+		{"SERVICE=WMS&REQUEST=GetMap&VERSION=1.1.1&LAYERS=roads&SRS=EPSG:4326&BBOX=8,53,10,54&WIDTH=200&HEIGHT=100&FORMAT=image/gif", WMS111, "InvalidFormat"},
+	} {
+		req, err := wmsRequest(t, tt.query)
+		if assert.Error(t, err, tt.query) {
+			assert.Equal(t, tt.version, req.Version, tt.query)
+			assert.Equal(t, tt.code, err.(*ServiceException).Code, tt.query)
+		}
+	}
+}
+
+func TestWriteServiceException(t *testing.T) {
+	w := httptest.NewRecorder()
+	WriteServiceException(w, WMS111, &ServiceException{Code: "LayerNotDefined", Msg: "unknown layer <foo>"})
+	assert.Equal(t, "application/vnd.ogc.se_xml", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), `<ServiceExceptionReport version="1.1.1">`)
+	assert.Contains(t, w.Body.String(), `<ServiceException code="LayerNotDefined">unknown layer &lt;foo&gt;</ServiceException>`)
+
+	w = httptest.NewRecorder()
+	WriteServiceException(w, WMS130, &MissingParamError{"LAYERS"})
+	assert.Equal(t, "text/xml", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), `xmlns="http://www.opengis.net/ogc"`)
+	assert.Contains(t, w.Body.String(), `<ServiceException>Missing parameter &#39;LAYERS&#39;</ServiceException>`)
+}
+
+func TestWriteCapabilities(t *testing.T) {
+	c := Capabilities{
+		Title:     "osm & more",
+		URL:       "http://localhost/wms/osm?",
+		EPSGCodes: []int{4326, 3857},
+		BBOX:      BBOX{-180, -85.05112878, 180, 85.05112878},
+		Layers: []CapabilitiesLayer{
+			{Name: "roads", Title: "roads", BBOX: BBOX{8, 53, 10, 54}},
+		},
+	}
+
+	for _, version := range []string{WMS111, WMS130} {
+		buf := bytes.Buffer{}
+		assert.NoError(t, WriteCapabilities(&buf, version, c))
+
+		var doc struct {
+			Version    string `xml:"version,attr"`
+			Capability struct {
+				Layer struct {
+					Title  string
+					SRS    []string
+					CRS    []string
+					Layers []struct {
+						Name string
+					} `xml:"Layer"`
+				}
+			}
+		}
+		assert.NoError(t, xml.Unmarshal(buf.Bytes(), &doc), buf.String())
+		assert.Equal(t, version, doc.Version)
+		assert.Equal(t, "osm & more", doc.Capability.Layer.Title)
+		assert.Equal(t, "roads", doc.Capability.Layer.Layers[0].Name)
+		if version == WMS111 {
+			assert.Equal(t, []string{"EPSG:4326", "EPSG:3857"}, doc.Capability.Layer.SRS)
+			assert.Contains(t, buf.String(), `<LatLonBoundingBox minx="8" miny="53" maxx="10" maxy="54"/>`)
+		} else {
+			assert.Equal(t, []string{"CRS:84", "EPSG:4326", "EPSG:3857"}, doc.Capability.Layer.CRS)
+			assert.Contains(t, buf.String(), `<westBoundLongitude>8</westBoundLongitude>`)
+		}
+	}
+}
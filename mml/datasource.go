@@ -52,4 +52,56 @@ type GeoJson struct {
 	Filename string
 }
 
+type CSV struct {
+	Id        string
+	Filename  string
+	Inline    string
+	Separator string
+	Quote     string
+	Escape    string
+	Headers   string
+	Extent    string
+	Strict    string
+}
+
+type TopoJSON struct {
+	Id       string
+	Filename string
+}
+
+type PgRaster struct {
+	Id              string
+	Host            string
+	Port            string
+	Database        string
+	Username        string
+	Password        string
+	Query           string
+	RasterField     string
+	SRID            string
+	Extent          string
+	Band            string
+	UseOverviews    string
+	PrescaleRasters string
+	ClipRasters     string
+}
+
+// GeoPackage is read with OGR.
+type GeoPackage struct {
+	Id       string
+	Filename string
+	SRID     string
+	Layer    string
+	Query    string
+	Extent   string
+}
+
+// FlatGeobuf is read with OGR.
+type FlatGeobuf struct {
+	Id       string
+	Filename string
+	SRID     string
+	Extent   string
+}
+
 type Datasource interface{}
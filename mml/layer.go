@@ -11,16 +11,39 @@ const (
 )
 
 type Layer struct {
-	ID              string
-	Classes         []string
-	SRS             string
-	Datasource      Datasource
-	Type            GeometryType
+	ID         string
+	Classes    []string
+	SRS        string
+	Datasource Datasource
+	Type       GeometryType
+	// GeometryTypes contains all types of layers with mixed geometries
+	// (e.g. points and polygons). Type is the first of these types.
+	GeometryTypes   []GeometryType
 	Active          bool
 	GroupBy         string
 	ClearLabelCache bool
 	PostLabelCache  bool
 	CacheFeatures   bool
 	ScaleFactor     float64
-	Properties      map[string]interface{}
+	BufferSize      int
+	MaximumExtent   *[4]float64
+	// Extent of the layer data in EPSG:4326, as written by TileMill and
+	// Kosmtik.
+	Extent        *[4]float64
+	MaxScaleDenom int
+	MinScaleDenom int
+	Opacity       *float64
+	// ZoomStatus contains the status (on=true) of the layer, starting from
+	// each zoom level. Zoom levels before the first entry use Active.
+	ZoomStatus map[int]bool
+	// PruneColumns limits PostGIS/SQLite queries to the referenced fields.
+	// Disabled by default, enabled with the prune-columns property.
+	PruneColumns bool
+	// MapServer specific options
+	Processing []string
+	LabelItem  string
+	Tolerance  *float64
+	// ToleranceUnits of Tolerance (pixels, meters, dd, etc.)
+	ToleranceUnits string
+	Properties     map[string]interface{}
 }
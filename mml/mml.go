@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"sort"
+	"strconv"
 	"strings"
 
 	"gopkg.in/yaml.v2"
@@ -15,13 +17,54 @@ type MML struct {
 	Layers      []Layer
 	Stylesheets []string
 	Map         Map
+	// Warnings contains messages for unknown or invalid layer properties.
+	Warnings []string
+	// Parameters are passed as Map parameters to the style (e.g. bounds,
+	// center, etc.).
+	Parameters map[string]string
 }
 
 type auxMML struct {
 	Name        string
-	Stylesheets []string   `yaml:"Stylesheet"`
-	Layers      []auxLayer `yaml:"Layer"`
-	Map         Map        `yaml:"Map"`
+	Stylesheets []string               `yaml:"Stylesheet"`
+	Layers      []auxLayer             `yaml:"Layer"`
+	Map         Map                    `yaml:"Map"`
+	Parameters  map[string]interface{} `yaml:"Parameters"`
+}
+
+// cartoParameters are top-level MML keys that are passed as Map
+// parameters, as Carto does.
+var cartoParameters = []string{
+	"bounds", "center", "format", "minzoom", "maxzoom", "scale",
+	"metatile", "name", "description", "attribution",
+}
+
+func parameters(aux map[string]interface{}, explicit map[string]interface{}) map[string]string {
+	params := make(map[string]string)
+	for _, k := range cartoParameters {
+		if v, ok := aux[k]; ok {
+			params[k] = parameterString(v)
+		}
+	}
+	for k, v := range explicit {
+		params[k] = parameterString(v)
+	}
+	if len(params) == 0 {
+		return nil
+	}
+	return params
+}
+
+// parameterString converts v to a string. Lists are joined by comma.
+func parameterString(v interface{}) string {
+	if l, ok := v.([]interface{}); ok {
+		parts := make([]string, len(l))
+		for i := range l {
+			parts[i] = fmt.Sprintf("%v", l[i])
+		}
+		return strings.Join(parts, ",")
+	}
+	return fmt.Sprintf("%v", v)
 }
 
 type auxLayer struct {
@@ -32,13 +75,14 @@ type auxLayer struct {
 	Class      string
 	SRS        string
 	Status     string
+	Extent     interface{}
 	Properties map[string]interface{}
 }
 
-func newLayer(l auxLayer) (*Layer, error) {
+func newLayer(l auxLayer) (*Layer, []string, error) {
 	ds, err := newDatasource(l.Datasource)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	isActive := true
@@ -51,7 +95,7 @@ func newLayer(l auxLayer) (*Layer, error) {
 	clearLabelCache, _ := l.Properties["clear-label-cache"].(string)
 	cacheFeatures, _ := l.Properties["cache-features"].(string)
 
-	return &Layer{
+	layer := &Layer{
 		ID:              l.ID,
 		Classes:         classes,
 		Datasource:      ds,
@@ -62,7 +106,202 @@ func newLayer(l auxLayer) (*Layer, error) {
 		ClearLabelCache: clearLabelCache == "on",
 		CacheFeatures:   cacheFeatures == "on",
 		Properties:      l.Properties,
-	}, nil
+	}
+	if e, ok := asExtent(l.Extent); ok {
+		layer.Extent = &e
+	}
+	warnings := layerProperties(layer, l.Properties)
+	return layer, warnings, nil
+}
+
+// layerProperties sets all optional layer properties. Returns warnings
+// for unknown or invalid properties.
+func layerProperties(layer *Layer, props map[string]interface{}) []string {
+	var warnings []string
+	warn := func(format string, args ...interface{}) {
+		warnings = append(warnings, fmt.Sprintf("layer %s: ", layer.ID)+fmt.Sprintf(format, args...))
+	}
+
+	keys := make([]string, 0, len(props))
+	for k := range props {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		v := props[k]
+		switch k {
+		case "group-by", "clear-label-cache", "cache-features", "minzoom", "maxzoom":
+			// handled by newLayer and builder
+		case "buffer-size":
+			if f, ok := asFloat(v); ok {
+				layer.BufferSize = int(f)
+			} else {
+				warn("invalid %s %v", k, v)
+			}
+		case "maximum-extent":
+			if e, ok := asExtent(v); ok {
+				layer.MaximumExtent = &e
+			} else {
+				warn("invalid %s %v", k, v)
+			}
+		case "maxscale":
+			if f, ok := asFloat(v); ok {
+				layer.MaxScaleDenom = int(f)
+			} else {
+				warn("invalid %s %v", k, v)
+			}
+		case "minscale":
+			if f, ok := asFloat(v); ok {
+				layer.MinScaleDenom = int(f)
+			} else {
+				warn("invalid %s %v", k, v)
+			}
+		case "srs":
+			// srs hint for layers without explicit SRS
+			if s, ok := v.(string); ok {
+				if layer.SRS == "" {
+					layer.SRS = s
+				}
+			} else {
+				warn("invalid %s %v", k, v)
+			}
+		case "status":
+			if s, ok := asStatus(v); ok {
+				layer.Active = s
+			} else if zs, ok := asZoomStatus(v); ok {
+				layer.ZoomStatus = zs
+			} else {
+				warn("invalid %s %v", k, v)
+			}
+		case "opacity":
+			if f, ok := asFloat(v); ok {
+				layer.Opacity = &f
+			} else {
+				warn("invalid %s %v", k, v)
+			}
+		case "processing":
+			if s, ok := v.(string); ok {
+				layer.Processing = []string{s}
+			} else if l := asStrings(v); l != nil {
+				layer.Processing = l
+			} else {
+				warn("invalid %s %v", k, v)
+			}
+		case "prune-columns":
+			if b, ok := asStatus(v); ok {
+				layer.PruneColumns = b
+			} else {
+				warn("invalid %s %v", k, v)
+			}
+		case "labelitem":
+			if s, ok := v.(string); ok {
+				layer.LabelItem = s
+			} else {
+				warn("invalid %s %v", k, v)
+			}
+		case "tolerance":
+			if f, ok := asFloat(v); ok {
+				layer.Tolerance = &f
+			} else {
+				warn("invalid %s %v", k, v)
+			}
+		case "tolerance-units":
+			if s, ok := v.(string); ok && toleranceUnits[strings.ToLower(s)] {
+				layer.ToleranceUnits = strings.ToLower(s)
+			} else {
+				warn("invalid %s %v", k, v)
+			}
+		default:
+			warn("unknown property %q", k)
+		}
+	}
+	return warnings
+}
+
+// toleranceUnits are the units supported by MapServer TOLERANCEUNITS.
+var toleranceUnits = map[string]bool{
+	"pixels":        true,
+	"feet":          true,
+	"inches":        true,
+	"kilometers":    true,
+	"meters":        true,
+	"miles":         true,
+	"nauticalmiles": true,
+	"dd":            true,
+}
+
+func asFloat(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case int:
+		return float64(v), true
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// asExtent parses "minx,miny,maxx,maxy" strings or lists of four numbers.
+func asExtent(v interface{}) ([4]float64, bool) {
+	var e [4]float64
+	var parts []interface{}
+	switch v := v.(type) {
+	case string:
+		for _, p := range strings.Split(v, ",") {
+			parts = append(parts, strings.TrimSpace(p))
+		}
+	case []interface{}:
+		parts = v
+	}
+	if len(parts) != 4 {
+		return e, false
+	}
+	for i := range parts {
+		f, ok := asFloat(parts[i])
+		if !ok {
+			return e, false
+		}
+		e[i] = f
+	}
+	return e, true
+}
+
+// asZoomStatus parses a map of zoom levels and on/off status, e.g.
+// {0: off, 10: on}.
+func asZoomStatus(v interface{}) (map[int]bool, bool) {
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, false
+	}
+	zs := make(map[int]bool, len(m))
+	for k, v := range m {
+		z, ok := asFloat(k)
+		if !ok || z < 0 {
+			return nil, false
+		}
+		s, ok := asStatus(v)
+		if !ok {
+			return nil, false
+		}
+		zs[int(z)] = s
+	}
+	return zs, true
+}
+
+// asStatus parses on/off status. YAML decodes unquoted on/off as bool.
+func asStatus(v interface{}) (bool, bool) {
+	switch v := v.(type) {
+	case bool:
+		return v, true
+	case string:
+		if v == "on" || v == "off" {
+			return v == "on", true
+		}
+	}
+	return false, false
 }
 
 func parseGeometryType(t string) GeometryType {
@@ -138,6 +377,51 @@ func newDatasource(params map[string]interface{}) (Datasource, error) {
 		return GeoJson{
 			Filename: d["file"],
 		}, nil
+	} else if d["type"] == "csv" {
+		return CSV{
+			Filename:  d["file"],
+			Inline:    d["inline"],
+			Separator: d["separator"],
+			Quote:     d["quote"],
+			Escape:    d["escape"],
+			Headers:   d["headers"],
+			Extent:    d["extent"],
+			Strict:    d["strict"],
+		}, nil
+	} else if d["type"] == "topojson" {
+		return TopoJSON{
+			Filename: d["file"],
+		}, nil
+	} else if d["type"] == "pgraster" {
+		return PgRaster{
+			Username:        d["user"],
+			Password:        d["password"],
+			Query:           d["table"],
+			Host:            d["host"],
+			Port:            d["port"],
+			Database:        d["dbname"],
+			RasterField:     d["raster_field"],
+			SRID:            d["srid"],
+			Extent:          d["extent"],
+			Band:            d["band"],
+			UseOverviews:    d["use_overviews"],
+			PrescaleRasters: d["prescale_rasters"],
+			ClipRasters:     d["clip_rasters"],
+		}, nil
+	} else if d["type"] == "geopackage" || d["type"] == "gpkg" {
+		return GeoPackage{
+			Filename: d["file"],
+			SRID:     d["srid"],
+			Layer:    d["layer"],
+			Query:    d["layer_by_sql"],
+			Extent:   d["extent"],
+		}, nil
+	} else if d["type"] == "flatgeobuf" {
+		return FlatGeobuf{
+			Filename: d["file"],
+			SRID:     d["srid"],
+			Extent:   d["extent"],
+		}, nil
 	} else if d["type"] == "" {
 		return nil, nil
 	} else {
@@ -171,14 +455,20 @@ func Parse(r io.Reader) (*MML, error) {
 	if err != nil {
 		return nil, err
 	}
+	top := map[string]interface{}{}
+	if err := yaml.Unmarshal([]byte(input), &top); err != nil {
+		return nil, err
+	}
 
 	layers := []Layer{}
+	var warnings []string
 	for _, l := range aux.Layers {
-		layer, err := newLayer(l)
+		layer, w, err := newLayer(l)
 		if err != nil {
 			return nil, err
 		}
 		layers = append(layers, *layer)
+		warnings = append(warnings, w...)
 	}
 
 	m := MML{
@@ -186,6 +476,8 @@ func Parse(r io.Reader) (*MML, error) {
 		Layers:      layers,
 		Stylesheets: aux.Stylesheets,
 		Map:         aux.Map,
+		Parameters:  parameters(top, aux.Parameters),
+		Warnings:    warnings,
 	}
 
 	return &m, nil
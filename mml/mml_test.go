@@ -37,4 +37,78 @@ func TestParse(t *testing.T) {
 	assert.Equal(t, mml.Layers[0].Type, Polygon)
 	ds = mml.Layers[0].Datasource.(Shapefile)
 	assert.Equal(t, ds.Filename, "test.shp")
+	assert.Equal(t, &[4]float64{5.8, 47.2, 15.1, 55.1}, mml.Layers[0].Extent)
+
+	assert.Equal(t, map[string]string{
+		"bounds":      "-180,-85.05112877980659,180,85.05112877980659",
+		"center":      "0,0,4",
+		"description": "YAML",
+		"format":      "png",
+		"maxzoom":     "22",
+		"metatile":    "2",
+		"minzoom":     "0",
+		"name":        "YAML MML",
+		"scale":       "1",
+	}, mml.Parameters)
+}
+
+func TestParseLayerProperties(t *testing.T) {
+	r, err := os.Open("tests/003-layer-properties.mml")
+	assert.NoError(t, err)
+	mml, err := Parse(r)
+	assert.NoError(t, err)
+	r.Close()
+
+	l := mml.Layers[0]
+	assert.Equal(t, 64, l.BufferSize)
+	assert.Equal(t, &[4]float64{-180, -90, 180, 90}, l.MaximumExtent)
+	assert.Equal(t, 500000, l.MaxScaleDenom)
+	assert.Equal(t, 1000, l.MinScaleDenom)
+	assert.Equal(t, "epsg:4326", l.SRS)
+	assert.Equal(t, 0.5, *l.Opacity)
+	assert.Equal(t, map[int]bool{0: false, 10: true}, l.ZoomStatus)
+	assert.Equal(t, []string{"LABEL_NO_CLIP=ON", "CLOSE_CONNECTION=DEFER"}, l.Processing)
+	assert.Equal(t, "name", l.LabelItem)
+	assert.Equal(t, 5.0, *l.Tolerance)
+	assert.Equal(t, "pixels", l.ToleranceUnits)
+	assert.True(t, l.PruneColumns)
+
+	assert.Equal(t, []string{
+		`layer roads: unknown property "foo"`,
+	}, mml.Warnings)
+}
+
+func TestNewDatasource(t *testing.T) {
+	for _, tt := range []struct {
+		params   map[string]interface{}
+		expected Datasource
+	}{
+		{
+			map[string]interface{}{"type": "csv", "file": "points.csv", "separator": ";"},
+			CSV{Filename: "points.csv", Separator: ";"},
+		},
+		{
+			map[string]interface{}{"type": "topojson", "file": "countries.topojson"},
+			TopoJSON{Filename: "countries.topojson"},
+		},
+		{
+			map[string]interface{}{"type": "pgraster", "dbname": "gis", "table": "dem", "raster_field": "rast", "band": 1},
+			PgRaster{Database: "gis", Query: "dem", RasterField: "rast", Band: "1"},
+		},
+		{
+			map[string]interface{}{"type": "geopackage", "file": "data.gpkg", "layer": "roads", "srid": 3857},
+			GeoPackage{Filename: "data.gpkg", Layer: "roads", SRID: "3857"},
+		},
+		{
+			map[string]interface{}{"type": "flatgeobuf", "file": "roads.fgb", "srid": 4326},
+			FlatGeobuf{Filename: "roads.fgb", SRID: "4326"},
+		},
+	} {
+		ds, err := newDatasource(tt.params)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.expected, ds)
+	}
+
+	_, err := newDatasource(map[string]interface{}{"type": "unknown"})
+	assert.Error(t, err)
 }
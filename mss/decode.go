@@ -28,6 +28,7 @@ type Decoder struct {
 	filename      string // for warnings/errors only
 	filesParsed   int
 	propertyIndex int
+	imageFilters  bool // parsing image-filters
 }
 
 type warning struct {
@@ -44,6 +45,33 @@ type position struct {
 	index    int
 }
 
+// Position is the location of a property or filter in a .mss file.
+type Position struct {
+	Filename string
+	Line     int
+	Column   int
+}
+
+func (p Position) String() string {
+	return fmt.Sprintf("%s:%d:%d", p.Filename, p.Line, p.Column)
+}
+
+// Less returns whether p is before o, ordered by filename, line and
+// column.
+func (p Position) Less(o Position) bool {
+	if p.Filename != o.Filename {
+		return p.Filename < o.Filename
+	}
+	if p.Line != o.Line {
+		return p.Line < o.Line
+	}
+	return p.Column < o.Column
+}
+
+func (p position) Position() Position {
+	return Position{Filename: p.filename, Line: p.line, Column: p.column}
+}
+
 func (w *warning) String() string {
 	file := w.file
 	if file == "" {
@@ -214,6 +242,10 @@ func (d *Decoder) valueType(v interface{}) codeType {
 		return typeBool
 	case []Value:
 		return typeList // TODO convert v to typeList?
+	case Stop:
+		return typeStop
+	case ImageFilter:
+		return typeImageFilter
 	default:
 		return typeUnknown
 	}
@@ -296,6 +328,11 @@ func (d *Decoder) block() {
 			d.expect(tokenColon)
 			if keyword == "text-placement-list" {
 				d.textPlacementList()
+			} else if keyword == "image-filters" || keyword == "direct-image-filters" {
+				// parse gray, etc. as filter and not as color
+				d.imageFilters = true
+				d.expressionList()
+				d.imageFilters = false
 			} else {
 				d.expressionList()
 			}
@@ -405,6 +442,7 @@ func (d *Decoder) filter() {
 	}
 
 	var field string
+	fieldPos := d.pos(tok)
 	switch tok.t {
 	case tokenString:
 		field = tok.value[1 : len(tok.value)-1]
@@ -460,7 +498,7 @@ func (d *Decoder) filter() {
 		}
 	}
 	d.expect(tokenRBracket)
-	d.mss.addFilter(field, compOp, value)
+	d.mss.addFilter(field, compOp, value, fieldPos)
 }
 
 // decode comparision. eg:
@@ -652,6 +690,10 @@ func (d *Decoder) value(tok *token) {
 		case "null":
 			d.expr.addValue(nil, typeKeyword)
 		default:
+			if d.imageFilters && isImageFilter(tok.value) {
+				d.expr.addValue(tok.value, typeKeyword)
+				break
+			}
 			c, err := color.Parse(tok.value)
 			if err == nil {
 				d.expr.addValue(c, typeColor)
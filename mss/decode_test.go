@@ -178,6 +178,13 @@ func TestParseExpression(t *testing.T) {
 		{`@foo: [field1] + [field2];`, "", []Value{Field("[field1]"), Field("[field2]")}},
 		{`@foo: "hello " + [field2];`, "", []Value{"hello ", Field("[field2]")}},
 
+		{`@foo: agg-stack-blur(2, 2);`, "", ImageFilter{Name: "agg-stack-blur", Args: []Value{2.0, 2.0}}},
+		{`@foo: agg-stack-blur(red);`, "agg-stack-blur takes numbers only", nil},
+		{`@foo: scale-hsla(0, 1, 0, 1);`, "scale-hsla takes exactly 8 arguments", nil},
+		{`@foo: color-to-alpha(1);`, "color-to-alpha takes exactly one color argument", nil},
+		{`@foo: colorize-alpha(stop(0, red), blue);`, "", ImageFilter{Name: "colorize-alpha", Args: []Value{Stop{0, color.MustParse("red")}, color.MustParse("blue")}}},
+		{`@foo: colorize-alpha(1);`, "colorize-alpha takes colors or stops only", nil},
+
 		{`@foo: red * 0.5;`, "", color.Color{0, 1.0, 0.25, 1, false}},
 		{`@foo: red * blue;`, "unsupported operation", nil},
 	}
@@ -301,6 +308,7 @@ func TestParserWarnings(t *testing.T) {
 		// selector
 		{`#foo {line-width: "foo"}`, "invalid property value for line-width"},
 		{`#foo {line-wi: "foo"}`, "invalid property line-wi"},
+		{`#foo {image-filters: gray, foo}`, "invalid property value for image-filters"},
 	}
 
 	for _, tt := range tests {
@@ -314,6 +322,30 @@ func TestParserWarnings(t *testing.T) {
 	}
 }
 
+func TestParseImageFilters(t *testing.T) {
+	d, err := decodeString(`
+		@blur: agg-stack-blur(4, 4);
+		#foo {
+			image-filters: @blur, gray, colorize-alpha(stop(0, red), stop(100, blue));
+			direct-image-filters: invert;
+		}`)
+	assert.NoError(t, err)
+	assert.Empty(t, d.warnings)
+	p := d.MSS().LayerRules("foo")[0].Properties
+
+	filters, ok := p.GetImageFilters("image-filters")
+	assert.True(t, ok)
+	assert.Equal(t, []ImageFilter{
+		{Name: "agg-stack-blur", Args: []Value{4.0, 4.0}},
+		{Name: "gray"},
+		{Name: "colorize-alpha", Args: []Value{Stop{0, color.MustParse("red")}, Stop{100, color.MustParse("blue")}}},
+	}, filters)
+
+	filters, ok = p.GetImageFilters("direct-image-filters")
+	assert.True(t, ok)
+	assert.Equal(t, []ImageFilter{{Name: "invert"}}, filters)
+}
+
 func decodeLayerProperties(t *testing.T, mss string) *Properties {
 	d, err := decodeString(mss)
 	assert.NoError(t, err)
@@ -634,3 +666,61 @@ func TestDecoderClasses(t *testing.T) {
 	})
 
 }
+
+func TestFieldPositions(t *testing.T) {
+	d, err := decodeString(`#foo[type='bar'] {
+  line-width: 1;
+  text-name: [name] + ' ' + [ref];
+}
+#foo[type='bar'][zoom>=10] { marker-file: url('[kind].svg'); }
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t,
+		[]Position{{Line: 1, Column: 6}, {Line: 5, Column: 6}},
+		d.MSS().FilterPositions("foo", Filter{Field: "type", CompOp: EQ, Value: "bar"}),
+	)
+	assert.Empty(t, d.MSS().FilterPositions("foo", Filter{Field: "type", CompOp: EQ, Value: "baz"}))
+
+	rules := d.MSS().LayerRules("foo")
+	if len(rules) != 2 {
+		t.Fatal(rules)
+	}
+	assert.Equal(t, []FieldRef{
+		{Field: "kind", Property: "marker-file", Pos: Position{Line: 5, Column: 30}},
+		{Field: "name", Property: "text-name", Pos: Position{Line: 3, Column: 3}},
+		{Field: "ref", Property: "text-name", Pos: Position{Line: 3, Column: 3}},
+	}, rules[0].Properties.FieldRefs())
+	assert.Equal(t, []string{"name", "ref"}, rules[1].Properties.Fields())
+}
+
+func TestFilterPositionsPerLayer(t *testing.T) {
+	d, err := decodeString(`#foo[type='bar'] { line-width: 1; }
+#bar[type='bar'] { line-width: 2; }
+#baz {
+  .class[type='bar'] { line-width: 3; }
+}
+[type='bar'] { line-color: red; }
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := Filter{Field: "type", CompOp: EQ, Value: "bar"}
+	assert.Equal(t,
+		[]Position{{Line: 1, Column: 6}, {Line: 6, Column: 2}},
+		d.MSS().FilterPositions("foo", f),
+	)
+	assert.Equal(t,
+		[]Position{{Line: 2, Column: 6}, {Line: 6, Column: 2}},
+		d.MSS().FilterPositions("bar", f),
+	)
+	assert.Equal(t,
+		[]Position{{Line: 6, Column: 2}},
+		d.MSS().FilterPositions("baz", f),
+	)
+	assert.Equal(t,
+		[]Position{{Line: 4, Column: 10}, {Line: 6, Column: 2}},
+		d.MSS().FilterPositions("baz", f, "class"),
+	)
+}
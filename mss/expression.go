@@ -24,6 +24,7 @@ const (
 	typeString
 	typeList
 	typeStop
+	typeImageFilter
 
 	typeNegation
 	typeAdd
@@ -70,6 +71,8 @@ func (t codeType) String() string {
 		return "\""
 	case typeStop:
 		return "S"
+	case typeImageFilter:
+		return "F"
 	case typeUnknown:
 		return "?"
 	default:
@@ -120,7 +123,7 @@ func evaluate(codes []code) ([]code, int, error) {
 	for i := 0; i < len(codes); i++ {
 		c := codes[i]
 		switch c.T {
-		case typeNum, typeColor, typePercent, typeString, typeKeyword, typeURL, typeBool, typeField, typeList:
+		case typeNum, typeColor, typePercent, typeString, typeKeyword, typeURL, typeBool, typeField, typeList, typeStop, typeImageFilter:
 			codes[top] = c
 			top++
 			continue
@@ -317,6 +320,18 @@ func evaluate(codes []code) ([]code, int, error) {
 					Value: Stop{Value: val, Color: c},
 					T:     typeStop},
 				}
+			} else if checkArgs, ok := imageFilterFuncs[c.Value.(string)]; ok {
+				if err := checkArgs(v); err != nil {
+					return nil, 0, fmt.Errorf("%s %v", c.Value.(string), err)
+				}
+				args := make([]Value, len(v))
+				for i := range v {
+					args[i] = v[i].Value
+				}
+				v = []code{{
+					Value: ImageFilter{Name: c.Value.(string), Args: args},
+					T:     typeImageFilter},
+				}
 			} else if c.Value.(string) == "__echo__" {
 				// pass
 			} else {
@@ -374,6 +389,60 @@ type Stop struct {
 	Color color.Color
 }
 
+// ImageFilter is a single filter of image-filters or direct-image-filters.
+// Args contains float64, color.Color or Stop values.
+type ImageFilter struct {
+	Name string
+	Args []Value
+}
+
+// imageFilterKeywords are image filters without arguments.
+var imageFilterKeywords = []string{
+	"blur", "emboss", "sharpen", "edge-detect", "sobel", "gray",
+	"x-gradient", "y-gradient", "invert",
+	"color-blind-protanope", "color-blind-deuteranope", "color-blind-tritanope",
+}
+
+func checkNumArgs(min, max int) func([]code) error {
+	return func(args []code) error {
+		if len(args) < min || len(args) > max {
+			if min == max {
+				return fmt.Errorf("takes exactly %d arguments, got %d", min, len(args))
+			}
+			return fmt.Errorf("takes %d to %d arguments, got %d", min, max, len(args))
+		}
+		for _, a := range args {
+			if a.T != typeNum {
+				return fmt.Errorf("takes numbers only, got %v", a.Value)
+			}
+		}
+		return nil
+	}
+}
+
+// imageFilterFuncs contains the argument checks of all image filter functions.
+var imageFilterFuncs = map[string]func([]code) error{
+	"agg-stack-blur": checkNumArgs(1, 2),
+	"scale-hsla":     checkNumArgs(8, 8),
+	"color-to-alpha": func(args []code) error {
+		if len(args) != 1 || args[0].T != typeColor {
+			return fmt.Errorf("takes exactly one color argument, got %v", args)
+		}
+		return nil
+	},
+	"colorize-alpha": func(args []code) error {
+		if len(args) == 0 {
+			return fmt.Errorf("requires at least one color or stop")
+		}
+		for _, a := range args {
+			if a.T != typeColor && a.T != typeStop {
+				return fmt.Errorf("takes colors or stops only, got %v", a.Value)
+			}
+		}
+		return nil
+	},
+}
+
 type functype func(args []code) ([]code, error)
 
 var colorFuncs map[string]colorFunc
@@ -0,0 +1,192 @@
+package mss
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// Matches returns whether the rule applies to a feature with the attrs at
+// zoom. It evaluates the filters like Mapnik: Missing attributes are null,
+// strings and numbers are never equal, and regular expressions need to
+// match the whole value. Numeric attributes can be int, int64, float32 or
+// float64 and bools are compared as 0 or 1.
+func (r *Rule) Matches(attrs map[string]interface{}, zoom int) bool {
+	if !r.Zoom.ValidFor(zoom) {
+		return false
+	}
+	for _, f := range r.Filters {
+		if !f.Matches(attrs) {
+			return false
+		}
+	}
+	return true
+}
+
+// Matches returns whether the attribute of the filter field matches.
+func (f Filter) Matches(attrs map[string]interface{}) bool {
+	field := f.Field
+	if len(field) > 2 && field[0] == '"' && field[len(field)-1] == '"' {
+		field = field[1 : len(field)-1]
+	}
+	attr := attrs[field]
+
+	switch f.CompOp {
+	case REGEX:
+		pattern, ok := f.Value.(string)
+		if !ok || attr == nil {
+			return false
+		}
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return false
+		}
+		return re.MatchString(attrString(attr))
+	case MODULO:
+		mod, ok := f.Value.(ModuloComparsion)
+		if !ok || mod.Div == 0 {
+			return false
+		}
+		v, ok := attrNumber(attr)
+		if !ok {
+			return false
+		}
+		return compare(mod.CompOp, math.Mod(v, float64(mod.Div)), float64(mod.Value))
+	}
+
+	if f.Value == nil || attr == nil {
+		// null is only equal to null
+		switch f.CompOp {
+		case EQ:
+			return f.Value == nil && attr == nil
+		case NEQ:
+			return f.Value != nil || attr != nil
+		}
+		return false
+	}
+
+	switch v := f.Value.(type) {
+	case float64:
+		a, ok := attrNumber(attr)
+		if !ok {
+			return f.CompOp == NEQ
+		}
+		return compare(f.CompOp, a, v)
+	case string:
+		a, ok := attr.(string)
+		if !ok {
+			return f.CompOp == NEQ
+		}
+		return compareString(f.CompOp, a, v)
+	}
+	return false
+}
+
+func attrNumber(attr interface{}) (float64, bool) {
+	switch v := attr.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+func attrString(attr interface{}) string {
+	switch v := attr.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprint(attr)
+}
+
+func compare(op CompOp, a, b float64) bool {
+	switch op {
+	case EQ:
+		return a == b
+	case NEQ:
+		return a != b
+	case LT:
+		return a < b
+	case LTE:
+		return a <= b
+	case GT:
+		return a > b
+	case GTE:
+		return a >= b
+	}
+	return false
+}
+
+func compareString(op CompOp, a, b string) bool {
+	switch op {
+	case EQ:
+		return a == b
+	case NEQ:
+		return a != b
+	case LT:
+		return a < b
+	case LTE:
+		return a <= b
+	case GT:
+		return a > b
+	case GTE:
+		return a >= b
+	}
+	return false
+}
+
+// MatchingRules returns the rules that style a feature with the attrs at
+// zoom. rules need to be in the order of LayerRules/LayerZoomRules. Only
+// the first matching rule of each attachment is returned, like the
+// filter-mode="first" of Mapnik styles.
+func MatchingRules(rules []Rule, attrs map[string]interface{}, zoom int) []Rule {
+	var result []Rule
+	matched := make(map[string]bool)
+	for i := range rules {
+		if matched[rules[i].Attachment] {
+			continue
+		}
+		if rules[i].Matches(attrs, zoom) {
+			matched[rules[i].Attachment] = true
+			result = append(result, rules[i])
+		}
+	}
+	return result
+}
+
+// Property is a single property with the position of its definition.
+type Property struct {
+	Name     string
+	Instance string
+	Value    Value
+	Pos      Position
+}
+
+// All returns all properties sorted by instance and name.
+func (p *Properties) All() []Property {
+	result := make([]Property, 0, len(p.values))
+	for k, a := range p.values {
+		result = append(result, Property{Name: k.name, Instance: k.instance, Value: a.value, Pos: a.pos.Position()})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Instance != result[j].Instance {
+			return result[i].Instance < result[j].Instance
+		}
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
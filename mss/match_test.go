@@ -0,0 +1,117 @@
+package mss
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilterMatches(t *testing.T) {
+	attrs := map[string]interface{}{
+		"type":   "primary",
+		"lanes":  2,
+		"width":  7.5,
+		"oneway": true,
+		"name":   "Main Street",
+		"ref":    "",
+		"nr":     int64(13),
+	}
+	for _, tt := range []struct {
+		filter Filter
+		match  bool
+	}{
+		{Filter{"type", EQ, "primary"}, true},
+		{Filter{`"type"`, EQ, "primary"}, true},
+		{Filter{"type", EQ, "secondary"}, false},
+		{Filter{"type", NEQ, "secondary"}, true},
+		{Filter{"type", LT, "secondary"}, true},
+		{Filter{"type", GTE, "secondary"}, false},
+		{Filter{"lanes", EQ, 2.0}, true},
+		{Filter{"lanes", GT, 1.0}, true},
+		{Filter{"lanes", LTE, 1.0}, false},
+		{Filter{"width", LT, 8.0}, true},
+		{Filter{"oneway", EQ, 1.0}, true},
+		{Filter{"nr", GTE, 13.0}, true},
+		// no type conversion
+		{Filter{"lanes", EQ, "2"}, false},
+		{Filter{"lanes", NEQ, "2"}, true},
+		{Filter{"type", EQ, 1.0}, false},
+		{Filter{"type", GT, 1.0}, false},
+		// null
+		{Filter{"missing", EQ, nil}, true},
+		{Filter{"missing", NEQ, nil}, false},
+		{Filter{"missing", EQ, "foo"}, false},
+		{Filter{"missing", NEQ, "foo"}, true},
+		{Filter{"missing", GT, 1.0}, false},
+		{Filter{"ref", EQ, nil}, false},
+		{Filter{"ref", NEQ, nil}, true},
+		{Filter{"ref", EQ, ""}, true},
+		// regexp needs to match the whole value
+		{Filter{"name", REGEX, "Main.*"}, true},
+		{Filter{"name", REGEX, "Main"}, false},
+		{Filter{"name", REGEX, ".*Street|.*Road"}, true},
+		{Filter{"lanes", REGEX, "[0-9]"}, true},
+		{Filter{"width", REGEX, `7\.5`}, true},
+		{Filter{"missing", REGEX, ".*"}, false},
+		{Filter{"name", REGEX, "("}, false},
+		// modulo
+		{Filter{"nr", MODULO, ModuloComparsion{2, EQ, 1}}, true},
+		{Filter{"nr", MODULO, ModuloComparsion{2, EQ, 0}}, false},
+		{Filter{"nr", MODULO, ModuloComparsion{5, GT, 2}}, true},
+		{Filter{"lanes", MODULO, ModuloComparsion{2, NEQ, 1}}, true},
+		{Filter{"type", MODULO, ModuloComparsion{2, EQ, 0}}, false},
+		{Filter{"nr", MODULO, ModuloComparsion{0, EQ, 0}}, false},
+	} {
+		assert.Equal(t, tt.match, tt.filter.Matches(attrs), tt.filter.String())
+	}
+}
+
+func TestMatchingRules(t *testing.T) {
+	d, err := decodeString(`
+#roads {
+  ::casing[type='primary'] { line-width: 5; }
+  [type='primary'] { line-color: red; }
+  [type='primary'][zoom>=12] { line-width: 3; }
+  [type=~'.*ary'] { line-color: blue; }
+  line-width: 1;
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := d.MSS().LayerRules("roads")
+
+	matched := MatchingRules(rules, map[string]interface{}{"type": "primary"}, 12)
+	if assert.Len(t, matched, 2) {
+		assert.Equal(t, "", matched[0].Attachment)
+		w, _ := matched[0].Properties.GetFloat("line-width")
+		assert.Equal(t, 3.0, w)
+		assert.Equal(t, "casing", matched[1].Attachment)
+	}
+
+	matched = MatchingRules(rules, map[string]interface{}{"type": "primary"}, 10)
+	if assert.Len(t, matched, 2) {
+		w, _ := matched[0].Properties.GetFloat("line-width")
+		assert.Equal(t, 1.0, w)
+		// regexp rule has the same specificity, but is defined later
+		c, _ := matched[0].Properties.GetColor("line-color")
+		assert.Equal(t, "#0000ff", c.String())
+		assert.Equal(t, REGEX, matched[0].Filters[0].CompOp)
+	}
+
+	matched = MatchingRules(rules, map[string]interface{}{"type": "secondary"}, 10)
+	if assert.Len(t, matched, 1) {
+		c, _ := matched[0].Properties.GetColor("line-color")
+		assert.Equal(t, "#0000ff", c.String())
+	}
+
+	matched = MatchingRules(rules, map[string]interface{}{"type": "track"}, 10)
+	if assert.Len(t, matched, 1) {
+		assert.Empty(t, matched[0].Filters)
+	}
+
+	props := matched[0].Properties.All()
+	if assert.Len(t, props, 1) {
+		assert.Equal(t, Property{Name: "line-width", Value: 1.0, Pos: Position{Line: 7, Column: 3}}, props[0])
+	}
+}
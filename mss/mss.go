@@ -44,10 +44,58 @@ func (m *MSS) addClass(class string) {
 	s.Class = class
 }
 
-func (m *MSS) addFilter(field string, compOp CompOp, value interface{}) {
+func (m *MSS) addFilter(field string, compOp CompOp, value interface{}, pos position) {
 	s := m.current().currentSelector()
 	f := Filter{field, compOp, value}
 	s.Filters = append(s.Filters, f)
+	if s.filterPos == nil {
+		s.filterPos = make(map[Filter][]position)
+	}
+	s.filterPos[f] = append(s.filterPos[f], pos)
+}
+
+// FilterPositions returns the positions of all selectors with this filter
+// that apply to the layer with the given classes.
+func (m *MSS) FilterPositions(layer string, f Filter, classes ...string) []Position {
+	var result []Position
+	seen := make(map[position]struct{})
+	var collect func(*block)
+	collect = func(node *block) {
+		// recurse into root/empty blocks without selectors
+		if len(node.selectors) == 0 {
+			for _, n := range node.blocks {
+				collect(n)
+			}
+		}
+		for _, s := range node.selectors {
+			if s.Layer != "" && s.Layer != layer {
+				continue
+			}
+			if s.Class != "" && !hasClass(classes, s.Class) {
+				continue
+			}
+			for _, pos := range s.filterPos[f] {
+				if _, ok := seen[pos]; !ok {
+					seen[pos] = struct{}{}
+					result = append(result, pos.Position())
+				}
+			}
+			for _, n := range node.blocks {
+				collect(n)
+			}
+		}
+	}
+	collect(&m.root)
+	return result
+}
+
+func hasClass(classes []string, class string) bool {
+	for _, c := range classes {
+		if c == class {
+			return true
+		}
+	}
+	return false
 }
 
 func (m *MSS) addZoom(comp CompOp, level int64) {
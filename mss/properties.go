@@ -3,6 +3,7 @@ package mss
 import (
 	"bytes"
 	"math"
+	"regexp"
 	"sort"
 	"strings"
 
@@ -203,6 +204,63 @@ func (p *Properties) SetDefaultInstance(instance string) {
 	p.defaultInstance = instance
 }
 
+var fieldRef = regexp.MustCompile(`\[([^\[\]]+)\]`)
+
+// FieldRef is a reference to a field by a property.
+type FieldRef struct {
+	Field    string
+	Property string
+	Pos      Position
+}
+
+// FieldRefs returns all references to fields by any property (e.g.
+// text-name: [name] or marker-file: url('[type].svg')), sorted by field
+// and position.
+func (p *Properties) FieldRefs() []FieldRef {
+	var refs []FieldRef
+	var collect func(k key, a attr, v Value)
+	collect = func(k key, a attr, v Value) {
+		switch v := v.(type) {
+		case string:
+			for _, m := range fieldRef.FindAllStringSubmatch(v, -1) {
+				refs = append(refs, FieldRef{Field: m[1], Property: k.name, Pos: a.pos.Position()})
+			}
+		case Field:
+			collect(k, a, string(v))
+		case []Value:
+			for i := range v {
+				collect(k, a, v[i])
+			}
+		}
+	}
+	for k, a := range p.values {
+		collect(k, a, a.value)
+	}
+
+	sort.Slice(refs, func(i, j int) bool {
+		if refs[i].Field != refs[j].Field {
+			return refs[i].Field < refs[j].Field
+		}
+		if refs[i].Pos != refs[j].Pos {
+			return refs[i].Pos.Less(refs[j].Pos)
+		}
+		return refs[i].Property < refs[j].Property
+	})
+	return refs
+}
+
+// Fields returns the sorted names of all fields that are referenced by
+// any property.
+func (p *Properties) Fields() []string {
+	fields := []string{}
+	for _, r := range p.FieldRefs() {
+		if len(fields) == 0 || fields[len(fields)-1] != r.Field {
+			fields = append(fields, r.Field)
+		}
+	}
+	return fields
+}
+
 func (p *Properties) GetBool(property string) (bool, bool) {
 	v, ok := p.get(property)
 	if !ok {
@@ -320,6 +378,44 @@ func (p *Properties) GetStopList(property string) ([]Stop, bool) {
 	return stops, true
 }
 
+// GetExtent returns property as an extent (minx, miny, maxx, maxy).
+func (p *Properties) GetExtent(property string) ([4]float64, bool) {
+	v, ok := p.get(property)
+	if !ok {
+		return [4]float64{}, false
+	}
+	extent, err := parseExtent(v)
+	if err != nil {
+		return [4]float64{}, false
+	}
+	return extent, true
+}
+
+// GetImageFilters returns property as a list of ImageFilters. Filters
+// without arguments (e.g. gray) are returned as ImageFilter without Args.
+func (p *Properties) GetImageFilters(property string) ([]ImageFilter, bool) {
+	v, ok := p.get(property)
+	if !ok {
+		return nil, false
+	}
+	l, ok := v.([]Value)
+	if !ok {
+		l = []Value{v}
+	}
+	filters := make([]ImageFilter, len(l))
+	for i := range l {
+		switch v := l[i].(type) {
+		case ImageFilter:
+			filters[i] = v
+		case string:
+			filters[i] = ImageFilter{Name: v}
+		default:
+			return nil, false
+		}
+	}
+	return filters, true
+}
+
 func (p *Properties) GetPropertiesList(name string) ([]*Properties, bool) {
 	v, ok := p.get(name)
 	if !ok {
@@ -132,3 +132,19 @@ func TestPropertiesGet(t *testing.T) {
 	}
 
 }
+
+func TestPropertiesFields(t *testing.T) {
+	p := &Properties{}
+	p.setPos(key{name: "text-name"}, "[name]", position{})
+	p.setPos(key{name: "shield-name"}, []Value{Field("[ref]"), " ", Field("[name]")}, position{})
+	p.setPos(key{name: "marker-file"}, "icons/[type].svg", position{})
+	p.setPos(key{name: "line-width"}, 2.0, position{})
+	p.setPos(key{name: "text-face-name", instance: "a"}, "DejaVu Sans", position{})
+
+	if v := p.Fields(); !reflect.DeepEqual(v, []string{"name", "ref", "type"}) {
+		t.Error(v)
+	}
+	if v := (&Properties{}).Fields(); len(v) != 0 {
+		t.Error(v)
+	}
+}
@@ -17,6 +17,7 @@ type Selector struct {
 	Attachment string
 	Zoom       ZoomRange
 	Filters    []Filter
+	filterPos  map[Filter][]position
 }
 
 // Filter contains a single condition. A style is only applied if the Field
@@ -1,6 +1,12 @@
 package mss
 
-import "github.com/omniscale/magnacarto/color"
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/omniscale/magnacarto/color"
+)
 
 var attributeTypes map[string]isValid
 
@@ -105,6 +111,75 @@ func isStops(val interface{}) bool {
 	return true
 }
 
+func isImageFilter(val interface{}) bool {
+	switch v := val.(type) {
+	case ImageFilter:
+		return true
+	case string:
+		for _, kw := range imageFilterKeywords {
+			if v == kw {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isImageFilters(val interface{}) bool {
+	if vals, ok := val.([]Value); ok {
+		for _, v := range vals {
+			if !isImageFilter(v) {
+				return false
+			}
+		}
+		return true
+	}
+	return isImageFilter(val)
+}
+
+// isExtent checks for "minx,miny,maxx,maxy" strings or a list of four numbers.
+func isExtent(val interface{}) bool {
+	_, err := parseExtent(val)
+	return err == nil
+}
+
+// parseExtent parses a maximum-extent value, either as "minx,miny,maxx,maxy"
+// string or as a list of four numbers.
+func parseExtent(val interface{}) ([4]float64, error) {
+	var extent [4]float64
+	switch v := val.(type) {
+	case string:
+		parts := strings.Split(v, ",")
+		if len(parts) != 4 {
+			return extent, fmt.Errorf("extent requires four values, got %q", v)
+		}
+		for i, p := range parts {
+			f, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+			if err != nil {
+				return extent, fmt.Errorf("invalid extent %q: %v", v, err)
+			}
+			extent[i] = f
+		}
+	case []Value:
+		if len(v) != 4 {
+			return extent, fmt.Errorf("extent requires four values, got %v", v)
+		}
+		for i := range v {
+			f, ok := v[i].(float64)
+			if !ok {
+				return extent, fmt.Errorf("invalid extent %v", v)
+			}
+			extent[i] = f
+		}
+	default:
+		return extent, fmt.Errorf("invalid extent %v", val)
+	}
+	if extent[0] >= extent[2] || extent[1] >= extent[3] {
+		return extent, fmt.Errorf("invalid extent %v, min values larger than max values", extent)
+	}
+	return extent, nil
+}
+
 func isCompOp(val interface{}) bool {
 	return isKeyword(
 		"clear",
@@ -203,7 +278,18 @@ func isJustifyAlignment(val interface{}) bool {
 
 func init() {
 	attributeTypes = map[string]isValid{
-		"background-color": isColor,
+		"background-color":         isColor,
+		"background-image":         isString,
+		"background-image-comp-op": isCompOp,
+		"background-image-opacity": isNumber,
+		"srs":                      isString,
+		"buffer-size":              isNumber,
+		"maximum-extent":           isExtent,
+		"font-directory":           isString,
+		"base":                     isString,
+
+		// name of the legend entry for the rule
+		"legend-name": isString,
 
 		"building-fill":         isColor,
 		"building-fill-opacity": isNumber,
@@ -396,6 +482,10 @@ func init() {
 		"text-comp-op":                  isCompOp,
 		"text-largest-bbox-only":        isBool,
 
+		"image-filters":         isImageFilters,
+		"image-filters-inflate": isBool,
+		"direct-image-filters":  isImageFilters,
+
 		"raster-opacity":                 isNumber,
 		"raster-scaling":                 isScaling,
 		"raster-colorizer-default-mode":  isKeyword("discrete", "linear", "exact"),
@@ -0,0 +1,86 @@
+package regression
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/omniscale/magnacarto/builder"
+	"github.com/omniscale/magnacarto/builder/mapnik"
+	"github.com/omniscale/magnacarto/builder/mapserver"
+	"github.com/omniscale/magnacarto/config"
+)
+
+// TestSnapshots compares the Mapnik XML and MapServer map files of all
+// cases with the style-mapnik.expected.xml and
+// style-mapserver.expected.map files of each case. It does not require
+// any renderer. Missing or different files are saved as .actual. files
+// for review; rename them to .expected. to update the snapshots.
+func TestSnapshots(t *testing.T) {
+	mmlFiles, err := filepath.Glob("cases/*/test.mml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mml := range mmlFiles {
+		caseName := filepath.Base(filepath.Dir(mml))
+		t.Run(caseName, func(t *testing.T) {
+			snapshot(t, caseName, "mapnik")
+			snapshot(t, caseName, "mapserver")
+		})
+	}
+}
+
+func snapshot(t *testing.T, caseName, builderType string) {
+	caseDir := filepath.Join("cases", caseName)
+	suffix := "xml"
+	if builderType == "mapserver" {
+		suffix = "map"
+	}
+
+	// relative paths for reproducible snapshots
+	here, _ := os.Getwd()
+	conf := config.Magnacarto{BaseDir: caseDir}
+	conf.Mapnik.FontDirs = []string{here}
+	locator := conf.Locator()
+	locator.SetOutDir(filepath.Join(here, caseDir))
+	locator.UseRelPaths(true)
+
+	var m builder.MapWriter
+	if builderType == "mapserver" {
+		m = mapserver.New(locator)
+	} else {
+		m = mapnik.New(locator)
+	}
+	b := builder.New(m)
+	b.SetMML(filepath.Join(caseDir, "test.mml"))
+	if err := b.Build(); err != nil {
+		t.Fatal("error building map: ", err)
+	}
+
+	actual := bytes.Buffer{}
+	if err := m.Write(&actual); err != nil {
+		t.Fatal("error writing map: ", err)
+	}
+
+	base := filepath.Join(caseDir, "style-"+builderType)
+	expectedFname := base + ".expected." + suffix
+	actualFname := base + ".actual." + suffix
+	expected, err := ioutil.ReadFile(expectedFname)
+	if os.IsNotExist(err) {
+		ioutil.WriteFile(actualFname, actual.Bytes(), 0644)
+		t.Errorf("missing %s, saved actual file to %s", expectedFname, actualFname)
+		return
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(expected, actual.Bytes()) {
+		ioutil.WriteFile(actualFname, actual.Bytes(), 0644)
+		t.Errorf("%s differs from %s, saved actual file to %s", builderType, expectedFname, actualFname)
+	} else {
+		os.Remove(actualFname)
+	}
+}
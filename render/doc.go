@@ -1,2 +1,3 @@
-// Package render implements map renderers baseed on Mapnik and MapServer.
+// Package render implements map renderers baseed on Mapnik and MapServer,
+// and a pure-Go preview renderer (render/native).
 package render
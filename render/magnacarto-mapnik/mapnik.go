@@ -22,6 +22,21 @@ func renderReq(m *mapnik.Map, mapReq render.Request) ([]byte, error) {
 		m.SetSRS(fmt.Sprintf("epsg:%d", mapReq.EPSGCode))
 	}
 
+	if len(mapReq.Layers) > 0 {
+		layers := make(map[string]struct{}, len(mapReq.Layers))
+		for _, l := range mapReq.Layers {
+			layers[l] = struct{}{}
+		}
+		m.SelectLayers(mapnik.SelectorFunc(func(name string) mapnik.Status {
+			if _, ok := layers[name]; ok {
+				return mapnik.Include
+			}
+			return mapnik.Exclude
+		}))
+		// map can be cached, restore layers for next request
+		defer m.ResetLayers()
+	}
+
 	m.Resize(mapReq.Width, mapReq.Height)
 	m.ZoomTo(mapReq.BBOX[0], mapReq.BBOX[1], mapReq.BBOX[2], mapReq.BBOX[3])
 
@@ -29,6 +44,16 @@ func renderReq(m *mapnik.Map, mapReq render.Request) ([]byte, error) {
 	renderOpts.Format = mapReq.Format
 	renderOpts.ScaleFactor = mapReq.ScaleFactor
 
+	if mapnik.IsCairoFormat(mapReq.Format) {
+		if mapReq.BGColor != nil {
+			// map can be cached, restore background for next request
+			prev := m.BackgroundColor()
+			m.SetBackgroundColor(*mapReq.BGColor)
+			defer m.SetBackgroundColor(prev)
+		}
+		return m.RenderCairo(renderOpts)
+	}
+
 	if mapReq.BGColor == nil {
 		b, err := m.Render(renderOpts)
 		if err != nil {
@@ -3,21 +3,62 @@ package render
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"io"
+	"log"
 	"net/rpc"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"sync"
 	"time"
 
 	"github.com/natefinch/pie"
 )
 
+// Mapnik renders maps with a pool of magnacarto-mapnik plugin processes.
+// Each process renders one request at a time. Crashed or hanging processes
+// are restarted and get the same fonts and cache settings as the others.
 type Mapnik struct {
+	path string
+	opts MapnikOptions
+	idle chan *mapnikProcess
+	done chan struct{}
+
+	// broadcastMu serializes RegisterFonts and CacheLoadedMap calls
+	broadcastMu sync.Mutex
+
+	mu               sync.Mutex
+	fontDirs         []string
+	cacheWaitTimeout *time.Duration
+	closed           bool
+}
+
+// MapnikOptions configures the plugin pool of NewMapnikPool.
+type MapnikOptions struct {
+	// Size is the number of plugin processes. Defaults to 1.
+	Size int
+	// Timeout for each call. Processes are restarted if a call times out.
+	// No timeout if zero.
+	Timeout time.Duration
+	// HealthCheckInterval is the interval in which idle processes are
+	// checked and restarted if they do not respond. Disabled if zero or
+	// negative.
+	HealthCheckInterval time.Duration
+}
+
+type mapnikProcess struct {
+	// client is nil if the process is not running (e.g. restart failed)
 	client *rpc.Client
 }
 
+var errMapnikTimeout = errors.New("timeout")
+
+// mapnikStartTimeout is the timeout for the font and cache setup of
+// restarted processes.
+const mapnikStartTimeout = 30 * time.Second
+
 var mapnikPluginName = "magnacarto-mapnik"
 
 func init() {
@@ -26,7 +67,13 @@ func init() {
 	}
 }
 
+// NewMapnik starts a single Mapnik plugin process.
 func NewMapnik() (*Mapnik, error) {
+	return NewMapnikPool(MapnikOptions{Size: 1})
+}
+
+// NewMapnikPool starts opts.Size Mapnik plugin processes.
+func NewMapnikPool(opts MapnikOptions) (*Mapnik, error) {
 	path, err := exec.LookPath(mapnikPluginName)
 	if err != nil {
 		path = filepath.Join(filepath.Dir(os.Args[0]), mapnikPluginName)
@@ -35,54 +82,92 @@ func NewMapnik() (*Mapnik, error) {
 			return nil, err
 		}
 	}
+	return newMapnikPool(path, opts)
+}
 
-	client, err := pie.StartProvider(os.Stderr, path)
-	if err != nil {
-		return nil, err
+func newMapnikPool(path string, opts MapnikOptions) (*Mapnik, error) {
+	if opts.Size < 1 {
+		opts.Size = 1
+	}
+	m := &Mapnik{
+		path: path,
+		opts: opts,
+		idle: make(chan *mapnikProcess, opts.Size),
+		done: make(chan struct{}),
 	}
-	return &Mapnik{client: client}, nil
+	for i := 0; i < opts.Size; i++ {
+		client, err := pie.StartProvider(os.Stderr, path)
+		if err != nil {
+			close(m.done)
+			for len(m.idle) > 0 {
+				p := <-m.idle
+				p.client.Close()
+			}
+			return nil, err
+		}
+		m.idle <- &mapnikProcess{client: client}
+	}
+	if opts.HealthCheckInterval > 0 {
+		go m.healthCheck()
+	}
+	return m, nil
+}
+
+// Size returns the number of plugin processes.
+func (m *Mapnik) Size() int {
+	return m.opts.Size
 }
 
 func (m *Mapnik) Is3() (bool, error) {
-	if m.client == nil {
-		return false, errors.New("mapnik plugin not initialized")
-	}
 	var is3 bool
-	err := m.client.Call("Mapnik.Is3", struct{}{} /* not used */, &is3)
+	err := m.call("Mapnik.Is3", struct{}{} /* not used */, &is3)
 	return is3, err
 }
 
+// RegisterFonts registers all fonts from fontDir in all plugin processes.
 func (m *Mapnik) RegisterFonts(fontDir string) error {
-	if m.client == nil {
-		return errors.New("mapnik plugin not initialized")
-	}
-	var tmp interface{}
-	err := m.client.Call("Mapnik.RegisterFonts", fontDir, &tmp /* not used */)
-	return err
+	return m.broadcast("Mapnik.RegisterFonts", fontDir, func() {
+		m.fontDirs = append(m.fontDirs, fontDir)
+	})
 }
 
+// CacheLoadedMap enables the map cache in all plugin processes.
 func (m *Mapnik) CacheLoadedMap(cacheWaitTimeout time.Duration) error {
-	if m.client == nil {
-		return errors.New("mapnik plugin not initialized")
-	}
-	var tmp interface{}
-	err := m.client.Call("Mapnik.CacheLoadedMap", cacheWaitTimeout, &tmp /* not used */)
-	return err
+	return m.broadcast("Mapnik.CacheLoadedMap", cacheWaitTimeout, func() {
+		m.cacheWaitTimeout = &cacheWaitTimeout
+	})
 }
 
+// Close stops all plugin processes. It waits for running calls.
 func (m *Mapnik) Close() error {
-	if m.client == nil {
+	if m.idle == nil {
 		return errors.New("mapnik plugin not initialized")
 	}
-	return m.client.Close()
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil
+	}
+	m.closed = true
+	close(m.done)
+	m.mu.Unlock()
+
+	var err error
+	for i := 0; i < m.opts.Size; i++ {
+		p := <-m.idle
+		if p.client == nil {
+			continue
+		}
+		if cerr := p.client.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
 }
 
 func (m *Mapnik) Render(mapfile string, dst io.Writer, mapReq Request) error {
-	if m.client == nil {
-		return errors.New("mapnik plugin not initialized")
-	}
 	var buf []byte
-	err := m.client.Call("Mapnik.Render", struct {
+	err := m.call("Mapnik.Render", struct {
 		Mapfile string
 		Req     Request
 	}{mapfile, mapReq}, &buf)
@@ -92,3 +177,196 @@ func (m *Mapnik) Render(mapfile string, dst io.Writer, mapReq Request) error {
 	_, err = io.Copy(dst, bytes.NewBuffer(buf))
 	return err
 }
+
+// acquire waits for an idle process.
+func (m *Mapnik) acquire() (*mapnikProcess, error) {
+	if m.idle == nil {
+		return nil, errors.New("mapnik plugin not initialized")
+	}
+	select {
+	case p := <-m.idle:
+		return p, nil
+	case <-m.done:
+		return nil, errors.New("mapnik plugin closed")
+	}
+}
+
+func (m *Mapnik) release(p *mapnikProcess) {
+	m.idle <- p
+}
+
+// call calls method with the next idle process.
+func (m *Mapnik) call(method string, args, reply interface{}) error {
+	p, err := m.acquire()
+	if err != nil {
+		return err
+	}
+	defer m.release(p)
+	return m.callProcess(p, method, args, reply)
+}
+
+// broadcast calls method with all processes. save is called before, to
+// store the settings for processes that are restarted later.
+func (m *Mapnik) broadcast(method string, arg interface{}, save func()) error {
+	m.broadcastMu.Lock()
+	defer m.broadcastMu.Unlock()
+
+	// wait till all processes are idle, so that no process is restarted
+	// with the previous settings
+	procs := make([]*mapnikProcess, 0, m.opts.Size)
+	defer func() {
+		for _, p := range procs {
+			m.release(p)
+		}
+	}()
+	for i := 0; i < m.opts.Size; i++ {
+		p, err := m.acquire()
+		if err != nil {
+			return err
+		}
+		procs = append(procs, p)
+	}
+
+	m.mu.Lock()
+	save()
+	m.mu.Unlock()
+
+	var err error
+	for _, p := range procs {
+		var tmp interface{}
+		if perr := m.callProcess(p, method, arg, &tmp /* not used */); perr != nil && err == nil {
+			err = perr
+		}
+	}
+	return err
+}
+
+// callProcess calls method with p. p is restarted if the plugin crashed
+// or if the call timed out. Calls that were not sent to the plugin are
+// retried once.
+func (m *Mapnik) callProcess(p *mapnikProcess, method string, args, reply interface{}) error {
+	for retry := true; ; retry = false {
+		if p.client == nil {
+			if err := m.restart(p); err != nil {
+				return err
+			}
+		}
+		err := p.call(method, args, reply, m.opts.Timeout)
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(rpc.ServerError); ok {
+			// error from Mapnik, plugin is still running
+			return err
+		}
+
+		if rerr := m.restart(p); rerr != nil {
+			log.Printf("mapnik plugin: %v", rerr)
+		}
+		if err == rpc.ErrShutdown && retry {
+			continue
+		}
+		if err == errMapnikTimeout {
+			return fmt.Errorf("mapnik plugin: %s timed out after %s", method, m.opts.Timeout)
+		}
+		return fmt.Errorf("mapnik plugin: %s failed: %v", method, err)
+	}
+}
+
+// restart stops the process of p and starts a new one with the fonts and
+// cache settings from RegisterFonts and CacheLoadedMap.
+func (m *Mapnik) restart(p *mapnikProcess) error {
+	if p.client != nil {
+		// returns error if the process already crashed
+		p.client.Close()
+		p.client = nil
+	}
+
+	m.mu.Lock()
+	closed := m.closed
+	fontDirs := append([]string{}, m.fontDirs...)
+	cacheWaitTimeout := m.cacheWaitTimeout
+	m.mu.Unlock()
+	if closed {
+		return errors.New("mapnik plugin closed")
+	}
+
+	client, err := pie.StartProvider(os.Stderr, m.path)
+	if err != nil {
+		return fmt.Errorf("restarting plugin: %v", err)
+	}
+	p.client = client
+
+	var tmp interface{}
+	if cacheWaitTimeout != nil {
+		err = p.call("Mapnik.CacheLoadedMap", *cacheWaitTimeout, &tmp, mapnikStartTimeout)
+		if err != nil {
+			err = fmt.Errorf("restarting plugin: enabling map cache: %v", err)
+		}
+	}
+	for _, fontDir := range fontDirs {
+		if err != nil {
+			break
+		}
+		err = p.call("Mapnik.RegisterFonts", fontDir, &tmp, mapnikStartTimeout)
+		if err != nil {
+			err = fmt.Errorf("restarting plugin: registering fonts: %v", err)
+		}
+	}
+	if err != nil {
+		// start again with the next call
+		p.client.Close()
+		p.client = nil
+	}
+	return err
+}
+
+// healthCheck periodically calls Is3 with all idle processes and
+// restarts processes that do not respond.
+func (m *Mapnik) healthCheck() {
+	ticker := time.NewTicker(m.opts.HealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+		}
+
+		var procs []*mapnikProcess
+	collect:
+		for i := 0; i < m.opts.Size; i++ {
+			select {
+			case p := <-m.idle:
+				procs = append(procs, p)
+			default:
+				break collect
+			}
+		}
+		for _, p := range procs {
+			var is3 bool
+			if err := m.callProcess(p, "Mapnik.Is3", struct{}{}, &is3); err != nil {
+				log.Printf("mapnik plugin health check: %v", err)
+			}
+			m.release(p)
+		}
+	}
+}
+
+// call calls method and waits for the result, or till timeout is reached
+// (if timeout is not zero).
+func (p *mapnikProcess) call(method string, args, reply interface{}, timeout time.Duration) error {
+	c := p.client.Go(method, args, reply, make(chan *rpc.Call, 1))
+	if timeout <= 0 {
+		<-c.Done
+		return c.Error
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-c.Done:
+		return c.Error
+	case <-timer.C:
+		return errMapnikTimeout
+	}
+}
@@ -3,8 +3,9 @@
 if command -v mapnik-config &> /dev/null
 then
     # Configuration for mapnik 3
+    # --defines enables optional features, e.g. HAVE_CAIRO
     CGO_CFLAGS=$(mapnik-config --includes)
-    CGO_CXXFLAGS=$(mapnik-config --includes)
+    CGO_CXXFLAGS="$(mapnik-config --includes) $(mapnik-config --defines)"
     CGO_LDFLAGS=$(mapnik-config --libs)
     FONT_DIR=$(mapnik-config --fonts)
     PLUGINS_DIR=$(mapnik-config --input-plugins)
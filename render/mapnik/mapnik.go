@@ -412,6 +412,44 @@ func (m *Map) RenderToFile(opts RenderOpts, path string) error {
 	return nil
 }
 
+// IsCairoFormat returns whether the format is rendered with Cairo
+// (pdf, svg or ps) instead of the image encoders.
+func IsCairoFormat(format string) bool {
+	switch format {
+	case "pdf", "svg", "ps":
+		return true
+	}
+	return false
+}
+
+// RenderCairo returns the map as a PDF, SVG or PostScript document. It
+// requires Mapnik with Cairo support.
+func (m *Map) RenderCairo(opts RenderOpts) ([]byte, error) {
+	if !IsCairoFormat(opts.Format) {
+		return nil, fmt.Errorf("mapnik: unsupported Cairo format '%s'", opts.Format)
+	}
+	scaleFactor := opts.ScaleFactor
+	if scaleFactor == 0.0 {
+		scaleFactor = 1.0
+	}
+	// Cairo surfaces can only be written to files
+	f, err := os.CreateTemp("", "magnacarto-*."+opts.Format)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	cs := C.CString(f.Name())
+	defer C.free(unsafe.Pointer(cs))
+	format := C.CString(opts.Format)
+	defer C.free(unsafe.Pointer(format))
+	if C.mapnik_map_render_to_cairo_file(m.m, cs, C.double(opts.Scale), C.double(scaleFactor), format) != 0 {
+		return nil, m.lastError()
+	}
+	return os.ReadFile(f.Name())
+}
+
 // SetBufferSize sets the pixel buffer at the map image edges where Mapnik should not render any labels.
 func (m *Map) SetBufferSize(s int) {
 	C.mapnik_map_set_buffer_size(m.m, C.int(s))
@@ -11,6 +11,9 @@
 #include <mapnik/load_map.hpp>
 #include <mapnik/datasource_cache.hpp>
 #include <mapnik/font_engine_freetype.hpp>
+#if defined(HAVE_CAIRO)
+#include <mapnik/cairo_io.hpp>
+#endif
 
 
 #if MAPNIK_VERSION < 300000
@@ -298,6 +301,25 @@ int mapnik_map_render_to_file(mapnik_map_t * m, const char* filepath, double sca
     return -1;
 }
 
+int mapnik_map_render_to_cairo_file(mapnik_map_t * m, const char* filepath, double scale, double scale_factor, const char *format) {
+    mapnik_map_reset_last_error(m);
+    if (m && m->m) {
+#if defined(HAVE_CAIRO)
+        try {
+            mapnik::save_to_cairo_file(*m->m, filepath, format, scale_factor, scale);
+        } catch (std::exception const& ex) {
+            m->err = new std::string(ex.what());
+            return -1;
+        }
+        return 0;
+#else
+        m->err = new std::string("Mapnik was built without Cairo support");
+        return -1;
+#endif
+    }
+    return -1;
+}
+
 void mapnik_image_blob_free(mapnik_image_blob_t * b) {
     if (b) {
         if (b->ptr) {
@@ -83,6 +83,7 @@ MAPNIKCAPICALL void mapnik_map_reset_maximum_extent(mapnik_map_t * m);
 
 MAPNIKCAPICALL int mapnik_map_render_to_file(mapnik_map_t * m, const char* filepath, double scale, double scale_factor, const char *format);
 MAPNIKCAPICALL mapnik_image_t * mapnik_map_render_to_image(mapnik_map_t * m, double scale, double scale_factor);
+MAPNIKCAPICALL int mapnik_map_render_to_cairo_file(mapnik_map_t * m, const char* filepath, double scale, double scale_factor, const char *format);
 
 MAPNIKCAPICALL int mapnik_map_layer_count(mapnik_map_t * m);
 MAPNIKCAPICALL const char * mapnik_map_layer_name(mapnik_map_t * m, size_t idx);
@@ -74,6 +74,31 @@ func TestRenderInvalidFormat(t *testing.T) {
 	}
 }
 
+func TestRenderCairo(t *testing.T) {
+	m := New()
+	if err := m.Load("test/map.xml"); err != nil {
+		t.Fatal(err)
+	}
+	m.ZoomAll()
+
+	for format, magic := range map[string]string{"pdf": "%PDF", "svg": "<?xml"} {
+		b, err := m.RenderCairo(RenderOpts{Format: format})
+		if err != nil && strings.Contains(err.Error(), "without Cairo") {
+			t.Skip(err)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(b, []byte(magic)) {
+			t.Errorf("unexpected %s output %q", format, b[:10])
+		}
+	}
+
+	if _, err := m.RenderCairo(RenderOpts{Format: "png"}); err == nil {
+		t.Error("png did not return an error")
+	}
+}
+
 func TestSRS(t *testing.T) {
 	m := New()
 	// default mapnik srs
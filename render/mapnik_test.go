@@ -0,0 +1,226 @@
+package render
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/natefinch/pie"
+)
+
+// TestMain runs the test binary as fake Mapnik plugin for the pool tests.
+func TestMain(m *testing.M) {
+	if os.Getenv("MAGNACARTO_TEST_MAPNIK_PLUGIN") == "1" {
+		p := pie.NewProvider()
+		if err := p.RegisterName("Mapnik", &fakeMapnikPlugin{}); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		p.Serve()
+		os.Exit(0)
+	}
+	// plugins are started (and restarted) by the pool with our environment
+	os.Setenv("MAGNACARTO_TEST_MAPNIK_PLUGIN", "1")
+	os.Exit(m.Run())
+}
+
+type fakeMapnikPlugin struct {
+	mu    sync.Mutex
+	fonts []string
+	cache time.Duration
+}
+
+// Render returns the mapfile, the PID and the registered fonts. Mapfiles
+// crash, hang, sleep and error simulate problems.
+func (f *fakeMapnikPlugin) Render(args *struct {
+	Mapfile string
+	Req     Request
+}, response *[]byte) error {
+	switch args.Mapfile {
+	case "crash":
+		os.Exit(2)
+	case "hang":
+		time.Sleep(time.Hour)
+	case "sleep":
+		time.Sleep(100 * time.Millisecond)
+	case "error":
+		return errors.New("mapnik error")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	*response = []byte(fmt.Sprintf("%s %d %v %s", args.Mapfile, os.Getpid(), f.fonts, f.cache))
+	return nil
+}
+
+func (f *fakeMapnikPlugin) CacheLoadedMap(cacheWaitTimeout time.Duration, _ *interface{}) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cache = cacheWaitTimeout
+	return nil
+}
+
+func (f *fakeMapnikPlugin) Is3(args struct{}, response *bool) error {
+	*response = true
+	return nil
+}
+
+func (f *fakeMapnikPlugin) RegisterFonts(fontDir string, _ *interface{}) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fonts = append(f.fonts, fontDir)
+	return nil
+}
+
+func newTestMapnikPool(t *testing.T, opts MapnikOptions) *Mapnik {
+	m, err := newMapnikPool(os.Args[0], opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// render returns the fields of the fake plugin response.
+func render(t *testing.T, m *Mapnik, mapfile string) ([]string, error) {
+	buf := bytes.Buffer{}
+	if err := m.Render(mapfile, &buf, Request{}); err != nil {
+		return nil, err
+	}
+	return strings.SplitN(buf.String(), " ", 3), nil
+}
+
+func TestMapnikPool_Concurrent(t *testing.T) {
+	m := newTestMapnikPool(t, MapnikOptions{Size: 2})
+	defer m.Close()
+
+	is3, err := m.Is3()
+	if err != nil || !is3 {
+		t.Fatal(is3, err)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	pids := map[string]bool{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := render(t, m, "sleep")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			pids[resp[1]] = true
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if len(pids) != 2 {
+		t.Errorf("expected renderings from 2 processes, got %v", pids)
+	}
+}
+
+func TestMapnikPool_Restart(t *testing.T) {
+	m := newTestMapnikPool(t, MapnikOptions{Size: 1, Timeout: 500 * time.Millisecond})
+	defer m.Close()
+
+	if err := m.CacheLoadedMap(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.RegisterFonts("fonts"); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := render(t, m, "style.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp[0] != "style.xml" || resp[2] != "[fonts] 5s" {
+		t.Fatal(resp)
+	}
+	pid := resp[1]
+
+	// errors from Mapnik do not restart the plugin
+	if _, err := render(t, m, "error"); err == nil || err.Error() != "mapnik error" {
+		t.Fatal(err)
+	}
+	if resp, err = render(t, m, "style.xml"); err != nil || resp[1] != pid {
+		t.Fatal("plugin restarted after render error", resp, err)
+	}
+
+	for _, mapfile := range []string{"crash", "hang"} {
+		_, err := render(t, m, mapfile)
+		if err == nil {
+			t.Fatal("expected error for", mapfile)
+		}
+		if mapfile == "hang" && !strings.Contains(err.Error(), "timed out after 500ms") {
+			t.Error(err)
+		}
+		resp, err := render(t, m, "style.xml")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp[1] == pid {
+			t.Error("plugin not restarted after", mapfile)
+		}
+		if resp[2] != "[fonts] 5s" {
+			t.Error("fonts and cache not restored after restart", resp)
+		}
+		pid = resp[1]
+	}
+}
+
+func TestMapnikPool_HealthCheck(t *testing.T) {
+	m := newTestMapnikPool(t, MapnikOptions{Size: 1, HealthCheckInterval: 20 * time.Millisecond})
+	defer m.Close()
+
+	resp, err := render(t, m, "style.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pid int
+	fmt.Sscan(resp[1], &pid)
+	p := <-m.idle
+	client := p.client
+	m.idle <- p
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := proc.Kill(); err != nil {
+		t.Fatal(err)
+	}
+
+	// wait for the health check to restart the plugin
+	for i := 0; i < 100; i++ {
+		time.Sleep(20 * time.Millisecond)
+		p := <-m.idle
+		restarted := p.client != nil && p.client != client
+		m.idle <- p
+		if restarted {
+			return
+		}
+	}
+	t.Fatal("plugin not restarted")
+}
+
+func TestMapnikPool_Close(t *testing.T) {
+	m := newTestMapnikPool(t, MapnikOptions{Size: 2})
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := render(t, m, "style.xml"); err == nil || err.Error() != "mapnik plugin closed" {
+		t.Fatal(err)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := (&Mapnik{}).Render("style.xml", &bytes.Buffer{}, Request{}); err == nil {
+		t.Fatal("expected error for uninitialized plugin")
+	}
+}
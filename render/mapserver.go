@@ -4,12 +4,14 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"net/http/cgi"
 	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 )
 
@@ -37,7 +39,12 @@ func (m *MapServer) Render(mapfile string, dst io.Writer, mapReq Request) ([]str
 	q.Set("SERVICE", "WMS")
 	q.Set("VERSION", "1.1.1")
 	q.Set("STYLES", "")
-	q.Set("LAYERS", "map")
+	if len(mapReq.Layers) > 0 {
+		// layers with attachments are grouped by the MML layer ID
+		q.Set("LAYERS", strings.Join(mapReq.Layers, ","))
+	} else {
+		q.Set("LAYERS", "map")
+	}
 	q.Set("MAP", "magnacarto")
 	q.Set("TRANSPARENT", "false")
 
@@ -53,6 +60,11 @@ func (m *MapServer) Render(mapfile string, dst io.Writer, mapReq Request) ([]str
 		q.Set("MAP.RESOLUTION", fmt.Sprintf("%d", int(72*mapReq.ScaleFactor)))
 	}
 
+	// values for the runtime substitutions of the Mapnik query tokens
+	for k, v := range substitutions(mapReq) {
+		q.Set(k, v)
+	}
+
 	// Write (temporary) config, as required by Mapserver 8.
 	f, err := os.CreateTemp("", "*.conf")
 	if err != nil {
@@ -97,12 +109,38 @@ func (m *MapServer) Render(mapfile string, dst io.Writer, mapReq Request) ([]str
 	if w.Code != 200 {
 		return warnings, fmt.Errorf("error while calling mapserv CGI (status %d)", w.Code)
 	}
-	if ct := w.Header().Get("Content-type"); ct != "" && !strings.HasPrefix(ct, "image") {
+	// PDF (application/x-pdf) requires MapServer with Cairo, like SVG
+	if ct := w.Header().Get("Content-type"); ct != "" && !strings.HasPrefix(ct, "image") && !strings.Contains(ct, "pdf") {
 		return warnings, fmt.Errorf(" mapserv CGI did not return image (%v)", w.Header())
 	}
 	return warnings, nil
 }
 
+// substitutions returns the values for the %scale%, %pixel_width% and
+// %pixel_height% runtime substitutions of the builder/mapserver queries.
+// The scale is calculated like the scale denominator of Mapnik.
+func substitutions(mapReq Request) map[string]string {
+	if mapReq.Width == 0 || mapReq.Height == 0 {
+		return nil
+	}
+	pixelWidth := (mapReq.BBOX[2] - mapReq.BBOX[0]) / float64(mapReq.Width)
+	pixelHeight := (mapReq.BBOX[3] - mapReq.BBOX[1]) / float64(mapReq.Height)
+	scale := pixelWidth / 0.00028
+	if mapReq.EPSGCode == 4326 {
+		// meters per degree
+		scale *= 6378137 * 2 * math.Pi / 360
+	}
+	if mapReq.ScaleFactor != 0 {
+		scale *= mapReq.ScaleFactor
+	}
+	format := func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) }
+	return map[string]string{
+		"scale":        format(scale),
+		"pixel_width":  format(pixelWidth),
+		"pixel_height": format(pixelHeight),
+	}
+}
+
 // responseRecorder from net/http/httptest
 // copied here to work around global -httptest.server flag from httptest package
 
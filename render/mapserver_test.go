@@ -0,0 +1,31 @@
+package render
+
+import "testing"
+
+func TestSubstitutions(t *testing.T) {
+	subs := substitutions(Request{
+		Width: 256, Height: 128,
+		BBOX:     [4]float64{0, 0, 256 * 10, 128 * 20},
+		EPSGCode: 3857,
+	})
+	if subs["pixel_width"] != "10" || subs["pixel_height"] != "20" {
+		t.Error(subs)
+	}
+	if subs["scale"] != "35714.28571428572" {
+		t.Error(subs)
+	}
+
+	subs = substitutions(Request{
+		Width: 256, Height: 128,
+		BBOX:        [4]float64{0, 0, 256 * 10, 128 * 20},
+		EPSGCode:    3857,
+		ScaleFactor: 2,
+	})
+	if subs["scale"] != "71428.57142857143" {
+		t.Error(subs)
+	}
+
+	if subs := substitutions(Request{}); subs != nil {
+		t.Error(subs)
+	}
+}
@@ -0,0 +1,563 @@
+package native
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// layerData contains all features or the raster image of a datasource in
+// the coordinates of the datasource.
+type layerData struct {
+	features []feature
+	raster   *rasterImage
+}
+
+// dataCache caches loaded datasources until the file changes.
+type dataCache struct {
+	mu      sync.Mutex
+	entries map[Datasource]dataEntry
+}
+
+type dataEntry struct {
+	modTime time.Time
+	data    *layerData
+}
+
+func (c *dataCache) load(ds Datasource) (*layerData, error) {
+	var modTime time.Time
+	if ds.File != "" {
+		fi, err := os.Stat(ds.File)
+		if err != nil {
+			return nil, err
+		}
+		modTime = fi.ModTime()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[ds]; ok && e.modTime.Equal(modTime) {
+		return e.data, nil
+	}
+	data, err := loadDatasource(ds)
+	if err != nil {
+		return nil, err
+	}
+	if c.entries == nil {
+		c.entries = make(map[Datasource]dataEntry)
+	}
+	c.entries[ds] = dataEntry{modTime: modTime, data: data}
+	return data, nil
+}
+
+func loadDatasource(ds Datasource) (*layerData, error) {
+	var features []feature
+	var err error
+	switch ds.Type {
+	case "geojson":
+		features, err = readGeoJSON(ds.File)
+	case "shape":
+		features, err = readShapefile(ds.File)
+	case "sqlite", "gpkg":
+		features, err = readSQLite(ds)
+	case "csv":
+		features, err = readCSV(ds)
+	case "image":
+		img, err := readRasterImage(ds.File)
+		if err != nil {
+			return nil, err
+		}
+		return &layerData{raster: img}, nil
+	default:
+		return nil, fmt.Errorf("unsupported datasource type '%s'", ds.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &layerData{features: features}, nil
+}
+
+type geoJSONObject struct {
+	Type        string                 `json:"type"`
+	Features    []geoJSONObject        `json:"features"`
+	Geometry    *geoJSONObject         `json:"geometry"`
+	Geometries  []geoJSONObject        `json:"geometries"`
+	Properties  map[string]interface{} `json:"properties"`
+	Coordinates json.RawMessage        `json:"coordinates"`
+}
+
+func readGeoJSON(fname string) ([]feature, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	obj := geoJSONObject{}
+	if err := json.NewDecoder(f).Decode(&obj); err != nil {
+		return nil, fmt.Errorf("decoding GeoJSON %s: %v", fname, err)
+	}
+
+	var features []feature
+	var collect func(o geoJSONObject, attrs map[string]interface{}) error
+	collect = func(o geoJSONObject, attrs map[string]interface{}) error {
+		switch o.Type {
+		case "FeatureCollection":
+			for _, f := range o.Features {
+				if err := collect(f, nil); err != nil {
+					return err
+				}
+			}
+		case "Feature":
+			if o.Geometry != nil {
+				return collect(*o.Geometry, o.Properties)
+			}
+		case "GeometryCollection":
+			for _, g := range o.Geometries {
+				if err := collect(g, copyAttrs(attrs)); err != nil {
+					return err
+				}
+			}
+		default:
+			g, err := geoJSONGeometry(o)
+			if err != nil {
+				return fmt.Errorf("decoding GeoJSON %s: %v", fname, err)
+			}
+			if len(g.parts) > 0 {
+				features = append(features, newFeature(attrs, g))
+			}
+		}
+		return nil
+	}
+	if err := collect(obj, nil); err != nil {
+		return nil, err
+	}
+	return features, nil
+}
+
+func copyAttrs(attrs map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(attrs))
+	for k, v := range attrs {
+		result[k] = v
+	}
+	return result
+}
+
+func geoJSONGeometry(o geoJSONObject) (geometry, error) {
+	toPoint := func(c []float64) (point, error) {
+		if len(c) < 2 {
+			return point{}, errors.New("invalid coordinate")
+		}
+		return point{c[0], c[1]}, nil
+	}
+	toLine := func(cs [][]float64) ([]point, error) {
+		line := make([]point, 0, len(cs))
+		for _, c := range cs {
+			p, err := toPoint(c)
+			if err != nil {
+				return nil, err
+			}
+			line = append(line, p)
+		}
+		return line, nil
+	}
+
+	var g geometry
+	var err error
+	switch o.Type {
+	case "Point":
+		var c []float64
+		if err = json.Unmarshal(o.Coordinates, &c); err == nil && len(c) > 0 {
+			var p point
+			p, err = toPoint(c)
+			g = geometry{typ: pointGeom, parts: [][]point{{p}}}
+		}
+	case "MultiPoint", "LineString":
+		var cs [][]float64
+		if err = json.Unmarshal(o.Coordinates, &cs); err == nil {
+			var line []point
+			line, err = toLine(cs)
+			if o.Type == "LineString" {
+				g = geometry{typ: lineGeom, parts: [][]point{line}}
+			} else {
+				g = geometry{typ: pointGeom}
+				for _, p := range line {
+					g.parts = append(g.parts, []point{p})
+				}
+			}
+		}
+	case "MultiLineString", "Polygon":
+		var css [][][]float64
+		if err = json.Unmarshal(o.Coordinates, &css); err == nil {
+			g = geometry{typ: lineGeom}
+			if o.Type == "Polygon" {
+				g.typ = polygonGeom
+			}
+			for _, cs := range css {
+				var line []point
+				if line, err = toLine(cs); err != nil {
+					break
+				}
+				g.parts = append(g.parts, line)
+			}
+		}
+	case "MultiPolygon":
+		var csss [][][][]float64
+		if err = json.Unmarshal(o.Coordinates, &csss); err == nil {
+			g = geometry{typ: polygonGeom}
+			for _, css := range csss {
+				for _, cs := range css {
+					var line []point
+					if line, err = toLine(cs); err != nil {
+						break
+					}
+					g.parts = append(g.parts, line)
+				}
+			}
+		}
+	default:
+		return geometry{}, fmt.Errorf("unsupported geometry type '%s'", o.Type)
+	}
+	if err != nil {
+		return geometry{}, fmt.Errorf("invalid %s: %v", o.Type, err)
+	}
+	return g, nil
+}
+
+// readCSV reads features from a CSV file or inline CSV. Geometries are
+// read from a wkt or geojson column, or from x/y (lon/lat) columns, like
+// the CSV plugin of Mapnik. Numeric values are converted to numbers.
+func readCSV(ds Datasource) ([]feature, error) {
+	content := ds.Inline
+	name := "inline CSV"
+	if ds.File != "" {
+		buf, err := ioutil.ReadFile(ds.File)
+		if err != nil {
+			return nil, err
+		}
+		content = string(buf)
+		name = ds.File
+	}
+	content = strings.TrimLeft(content, "\n\r\t ")
+
+	r := csv.NewReader(strings.NewReader(content))
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	r.Comma = csvSeparator(content, ds.Separator)
+	rows, err := r.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %v", name, err)
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+
+	header := rows[0]
+	wktCol, jsonCol, xCol, yCol := -1, -1, -1, -1
+	for i, h := range header {
+		switch strings.ToLower(strings.TrimSpace(h)) {
+		case "wkt":
+			wktCol = i
+		case "geojson":
+			jsonCol = i
+		case "x", "lon", "lng", "long", "longitude":
+			xCol = i
+		case "y", "lat", "latitude":
+			yCol = i
+		}
+	}
+	if wktCol < 0 && jsonCol < 0 && (xCol < 0 || yCol < 0) {
+		return nil, fmt.Errorf("reading %s: no geometry column found", name)
+	}
+
+	var features []feature
+	for n, row := range rows[1:] {
+		attrs := make(map[string]interface{}, len(header))
+		for i, v := range row {
+			if i >= len(header) || i == wktCol || i == jsonCol {
+				continue
+			}
+			attrs[strings.TrimSpace(header[i])] = csvValue(v)
+		}
+
+		// empty WKT/GeoJSON values fall back to the x/y columns
+		var geoms []geometry
+		switch {
+		case wktCol >= 0 && wktCol < len(row) && strings.TrimSpace(row[wktCol]) != "":
+			geoms, err = parseWKT(row[wktCol])
+		case jsonCol >= 0 && jsonCol < len(row) && strings.TrimSpace(row[jsonCol]) != "":
+			obj := geoJSONObject{}
+			if err = json.Unmarshal([]byte(row[jsonCol]), &obj); err == nil {
+				var g geometry
+				g, err = geoJSONGeometry(obj)
+				geoms = []geometry{g}
+			}
+		case xCol >= 0 && yCol >= 0 && xCol < len(row) && yCol < len(row):
+			var x, y float64
+			x, err = strconv.ParseFloat(strings.TrimSpace(row[xCol]), 64)
+			if err == nil {
+				y, err = strconv.ParseFloat(strings.TrimSpace(row[yCol]), 64)
+			}
+			geoms = []geometry{{typ: pointGeom, parts: [][]point{{{x, y}}}}}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: invalid geometry in row %d: %v", name, n+2, err)
+		}
+		for i, g := range geoms {
+			if len(g.parts) == 0 {
+				continue
+			}
+			a := attrs
+			if i > 0 {
+				a = copyAttrs(attrs)
+			}
+			features = append(features, newFeature(a, g))
+		}
+	}
+	return features, nil
+}
+
+// csvSeparator returns the separator, or detects it from the header.
+func csvSeparator(content, separator string) rune {
+	if separator != "" {
+		return []rune(separator)[0]
+	}
+	header := content
+	if i := strings.IndexAny(content, "\r\n"); i >= 0 {
+		header = content[:i]
+	}
+	sep, max := ',', 0
+	for _, s := range []rune{',', '\t', '|', ';'} {
+		if n := strings.Count(header, string(s)); n > max {
+			sep, max = s, n
+		}
+	}
+	return sep
+}
+
+func csvValue(v string) interface{} {
+	t := strings.TrimSpace(v)
+	if t != "" && !strings.HasPrefix(t, "+") {
+		if i, err := strconv.ParseInt(t, 10, 64); err == nil {
+			return float64(i)
+		}
+		if f, err := strconv.ParseFloat(t, 64); err == nil {
+			return f
+		}
+	}
+	return v
+}
+
+// parseWKT parses WKT geometries. Geometry collections return multiple
+// geometries.
+func parseWKT(s string) ([]geometry, error) {
+	p := &wktParser{s: s}
+	geoms, err := p.geometry()
+	if err != nil {
+		return nil, err
+	}
+	if p.skipSpace(); p.pos != len(p.s) {
+		return nil, fmt.Errorf("unexpected '%s' in WKT", p.s[p.pos:])
+	}
+	return geoms, nil
+}
+
+type wktParser struct {
+	s   string
+	pos int
+}
+
+func (p *wktParser) skipSpace() {
+	for p.pos < len(p.s) && strings.ContainsRune(" \t\r\n", rune(p.s[p.pos])) {
+		p.pos++
+	}
+}
+
+func (p *wktParser) word() string {
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.s) && (p.s[p.pos] >= 'a' && p.s[p.pos] <= 'z' || p.s[p.pos] >= 'A' && p.s[p.pos] <= 'Z') {
+		p.pos++
+	}
+	return strings.ToUpper(p.s[start:p.pos])
+}
+
+func (p *wktParser) peek() byte {
+	p.skipSpace()
+	if p.pos < len(p.s) {
+		return p.s[p.pos]
+	}
+	return 0
+}
+
+func (p *wktParser) expect(c byte) error {
+	if p.peek() != c {
+		return fmt.Errorf("expected '%c' in WKT at %d", c, p.pos)
+	}
+	p.pos++
+	return nil
+}
+
+func (p *wktParser) geometry() ([]geometry, error) {
+	typ := p.word()
+	// optional dimension
+	save := p.pos
+	if w := p.word(); w != "Z" && w != "M" && w != "ZM" {
+		p.pos = save
+	}
+	save = p.pos
+	if p.word() == "EMPTY" {
+		return nil, nil
+	}
+	p.pos = save
+
+	switch typ {
+	case "POINT":
+		line, err := p.points()
+		if err != nil {
+			return nil, err
+		}
+		return []geometry{{typ: pointGeom, parts: [][]point{line}}}, nil
+	case "LINESTRING":
+		line, err := p.points()
+		if err != nil {
+			return nil, err
+		}
+		return []geometry{{typ: lineGeom, parts: [][]point{line}}}, nil
+	case "POLYGON", "MULTILINESTRING":
+		parts, err := p.lines()
+		if err != nil {
+			return nil, err
+		}
+		t := lineGeom
+		if typ == "POLYGON" {
+			t = polygonGeom
+		}
+		return []geometry{{typ: t, parts: parts}}, nil
+	case "MULTIPOINT":
+		g := geometry{typ: pointGeom}
+		var pts []point
+		var err error
+		save := p.pos
+		if err = p.expect('('); err != nil {
+			return nil, err
+		}
+		if p.peek() == '(' {
+			// MULTIPOINT((1 2), (3 4))
+			p.pos = save
+			var parts [][]point
+			if parts, err = p.lines(); err != nil {
+				return nil, err
+			}
+			for _, part := range parts {
+				pts = append(pts, part...)
+			}
+		} else {
+			p.pos = save
+			if pts, err = p.points(); err != nil {
+				return nil, err
+			}
+		}
+		for _, pt := range pts {
+			g.parts = append(g.parts, []point{pt})
+		}
+		return []geometry{g}, nil
+	case "MULTIPOLYGON":
+		if err := p.expect('('); err != nil {
+			return nil, err
+		}
+		g := geometry{typ: polygonGeom}
+		for {
+			parts, err := p.lines()
+			if err != nil {
+				return nil, err
+			}
+			g.parts = append(g.parts, parts...)
+			if p.peek() != ',' {
+				break
+			}
+			p.pos++
+		}
+		return []geometry{g}, p.expect(')')
+	case "GEOMETRYCOLLECTION":
+		if err := p.expect('('); err != nil {
+			return nil, err
+		}
+		var result []geometry
+		for {
+			geoms, err := p.geometry()
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, geoms...)
+			if p.peek() != ',' {
+				break
+			}
+			p.pos++
+		}
+		return result, p.expect(')')
+	}
+	return nil, fmt.Errorf("unsupported WKT type '%s'", typ)
+}
+
+// lines parses ((x y, ...), (x y, ...)).
+func (p *wktParser) lines() ([][]point, error) {
+	if err := p.expect('('); err != nil {
+		return nil, err
+	}
+	var result [][]point
+	for {
+		line, err := p.points()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, line)
+		if p.peek() != ',' {
+			break
+		}
+		p.pos++
+	}
+	return result, p.expect(')')
+}
+
+// points parses (x y, x y z, ...).
+func (p *wktParser) points() ([]point, error) {
+	if err := p.expect('('); err != nil {
+		return nil, err
+	}
+	var result []point
+	for {
+		var coords []float64
+		for {
+			p.skipSpace()
+			start := p.pos
+			for p.pos < len(p.s) && strings.ContainsRune("0123456789+-.eE", rune(p.s[p.pos])) {
+				p.pos++
+			}
+			if start == p.pos {
+				break
+			}
+			v, err := strconv.ParseFloat(p.s[start:p.pos], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number '%s' in WKT", p.s[start:p.pos])
+			}
+			coords = append(coords, v)
+		}
+		if len(coords) < 2 {
+			return nil, fmt.Errorf("invalid coordinate in WKT at %d", p.pos)
+		}
+		result = append(result, point{coords[0], coords[1]})
+		if p.peek() != ',' {
+			break
+		}
+		p.pos++
+	}
+	return result, p.expect(')')
+}
@@ -0,0 +1,100 @@
+package native
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseWKT(t *testing.T) {
+	for _, tt := range []struct {
+		wkt      string
+		expected []geometry
+	}{
+		{"POINT (1 2)", []geometry{{pointGeom, [][]point{{{1, 2}}}}}},
+		{"POINT Z (1 2 3)", []geometry{{pointGeom, [][]point{{{1, 2}}}}}},
+		{"LINESTRING (1 2, 3 4)", []geometry{{lineGeom, [][]point{{{1, 2}, {3, 4}}}}}},
+		{"MULTIPOINT ((1 2), (3 4))", []geometry{{pointGeom, [][]point{{{1, 2}}, {{3, 4}}}}}},
+		{"POLYGON ((0 0, 1 0, 1 1, 0 0))", []geometry{{polygonGeom, [][]point{{{0, 0}, {1, 0}, {1, 1}, {0, 0}}}}}},
+		{"GEOMETRYCOLLECTION (POINT (1 2), LINESTRING (1 2, 3 4))", []geometry{
+			{pointGeom, [][]point{{{1, 2}}}},
+			{lineGeom, [][]point{{{1, 2}, {3, 4}}}},
+		}},
+		{"POINT EMPTY", nil},
+	} {
+		geoms, err := parseWKT(tt.wkt)
+		if err != nil {
+			t.Errorf("%s: %v", tt.wkt, err)
+			continue
+		}
+		if !reflect.DeepEqual(geoms, tt.expected) {
+			t.Errorf("%s: unexpected geometries %v", tt.wkt, geoms)
+		}
+	}
+
+	for _, wkt := range []string{"POINT (1)", "LINESTRING (1 2, 3 4", "POINT (1 2) foo", "CIRCLE (1 2)"} {
+		if _, err := parseWKT(wkt); err == nil {
+			t.Errorf("%s: expected error", wkt)
+		}
+	}
+}
+
+func TestReadCSV(t *testing.T) {
+	features, err := readCSV(Datasource{Type: "csv", Inline: `
+name|x|y|wkt
+a|1|2|
+b|||POINT(3 4)
+`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(features) != 2 {
+		t.Fatalf("unexpected features %v", features)
+	}
+	if features[0].attrs["name"] != "a" || !reflect.DeepEqual(features[0].geom.parts, [][]point{{{1, 2}}}) {
+		t.Errorf("unexpected feature %v", features[0])
+	}
+	if features[1].attrs["name"] != "b" || !reflect.DeepEqual(features[1].geom.parts, [][]point{{{3, 4}}}) {
+		t.Errorf("unexpected feature %v", features[1])
+	}
+}
+
+func TestReadSQLite(t *testing.T) {
+	features, err := readSQLite(Datasource{Type: "gpkg", File: "tests/test.gpkg"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(features) != 2 {
+		t.Fatalf("unexpected features %v", features)
+	}
+	if features[0].attrs["name"] != "A" || features[0].attrs["population"] != int64(1000) ||
+		!reflect.DeepEqual(features[0].geom, geometry{pointGeom, [][]point{{{8, 53}}}}) {
+		t.Errorf("unexpected feature %v", features[0])
+	}
+	if features[1].attrs["population"] != nil {
+		t.Errorf("unexpected feature %v", features[1])
+	}
+
+	features, err = readSQLite(Datasource{Type: "gpkg", File: "tests/test.gpkg", Table: "areas"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(features) != 1 || features[0].attrs["kind"] != "park" ||
+		features[0].geom.typ != polygonGeom || len(features[0].geom.parts) != 2 {
+		t.Errorf("unexpected features %v", features)
+	}
+
+	if _, err := readSQLite(Datasource{Type: "gpkg", File: "tests/test.gpkg", Table: "areas", GeometryField: "missing"}); err == nil {
+		t.Error("expected error for missing geometry column")
+	}
+}
+
+func TestDashes(t *testing.T) {
+	d := dashes([]point{{0, 0}, {10, 0}}, []float64{3, 2})
+	expected := [][]point{
+		{{0, 0}, {3, 0}},
+		{{5, 0}, {8, 0}},
+	}
+	if !reflect.DeepEqual(d, expected) {
+		t.Errorf("unexpected dashes %v", d)
+	}
+}
@@ -0,0 +1,492 @@
+package native
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/omniscale/magnacarto/internal/sfnt"
+)
+
+// font is a parsed TrueType font with glyf outlines. CFF based OpenType
+// fonts are not supported.
+type font struct {
+	unitsPerEm float64
+	ascent     float64
+	descent    float64
+	lineGap    float64
+
+	numGlyphs   int
+	numHMetrics int
+	hmtx        []byte
+	loca        []int
+	glyf        []byte
+	cmap        []byte
+	cmapFormat  int
+
+	mu     sync.Mutex
+	glyphs map[int][][]point
+}
+
+var errInvalidTrueType = errors.New("invalid TrueType font")
+
+// loadFont reads the font with the index from a TTF or TTC file.
+func loadFont(fname string, index int) (*font, error) {
+	buf, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	f, err := parseFont(buf, index)
+	if err != nil {
+		return nil, fmt.Errorf("reading font %s: %v", fname, err)
+	}
+	return f, nil
+}
+
+// maxTableLen limits the size of each table.
+const maxTableLen = 64 << 20
+
+func parseFont(buf []byte, index int) (*font, error) {
+	sf, err := sfnt.Open(bytes.NewReader(buf), index)
+	if err != nil {
+		if err == sfnt.ErrInvalid || err == io.EOF {
+			return nil, errInvalidTrueType
+		}
+		return nil, err
+	}
+	if sf.CFF() {
+		return nil, errors.New("CFF outlines are not supported")
+	}
+	if !sf.HasTable("glyf") {
+		return nil, errors.New("missing glyf table, only TrueType outlines are supported")
+	}
+	tables := make(map[string][]byte)
+	for _, t := range []string{"head", "maxp", "cmap", "hhea", "hmtx", "loca", "glyf"} {
+		if tables[t], err = sf.Table(t, maxTableLen); err != nil {
+			if err == sfnt.ErrInvalid {
+				return nil, errInvalidTrueType
+			}
+			return nil, err
+		}
+	}
+
+	head, maxp, hhea := tables["head"], tables["maxp"], tables["hhea"]
+	if len(head) < 54 || len(maxp) < 6 || len(hhea) < 36 {
+		return nil, errInvalidTrueType
+	}
+	f := &font{
+		unitsPerEm:  float64(binary.BigEndian.Uint16(head[18:])),
+		ascent:      float64(int16(binary.BigEndian.Uint16(hhea[4:]))),
+		descent:     float64(int16(binary.BigEndian.Uint16(hhea[6:]))),
+		lineGap:     float64(int16(binary.BigEndian.Uint16(hhea[8:]))),
+		numGlyphs:   int(binary.BigEndian.Uint16(maxp[4:])),
+		numHMetrics: int(binary.BigEndian.Uint16(hhea[34:])),
+		hmtx:        tables["hmtx"],
+		glyf:        tables["glyf"],
+		glyphs:      make(map[int][][]point),
+	}
+	if f.unitsPerEm == 0 || f.numHMetrics == 0 || len(f.hmtx) < 4*f.numHMetrics {
+		return nil, errInvalidTrueType
+	}
+
+	loca := tables["loca"]
+	short := binary.BigEndian.Uint16(head[50:]) == 0
+	f.loca = make([]int, 0, f.numGlyphs+1)
+	for i := 0; i <= f.numGlyphs; i++ {
+		var v int
+		if short {
+			if 2*i+2 > len(loca) {
+				return nil, errInvalidTrueType
+			}
+			v = 2 * int(binary.BigEndian.Uint16(loca[2*i:]))
+		} else {
+			if 4*i+4 > len(loca) {
+				return nil, errInvalidTrueType
+			}
+			v = int(binary.BigEndian.Uint32(loca[4*i:]))
+		}
+		f.loca = append(f.loca, v)
+	}
+
+	if err := f.parseCmap(tables["cmap"]); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// parseCmap selects a Unicode subtable with format 4 or 12.
+func (f *font) parseCmap(cmap []byte) error {
+	if len(cmap) < 4 {
+		return errInvalidTrueType
+	}
+	num := int(binary.BigEndian.Uint16(cmap[2:]))
+	best := 0
+	for i := 0; i < num; i++ {
+		if 4+8*i+8 > len(cmap) {
+			return errInvalidTrueType
+		}
+		rec := cmap[4+8*i:]
+		platform := binary.BigEndian.Uint16(rec)
+		encoding := binary.BigEndian.Uint16(rec[2:])
+		off := int(binary.BigEndian.Uint32(rec[4:]))
+		if off+2 > len(cmap) {
+			continue
+		}
+		format := int(binary.BigEndian.Uint16(cmap[off:]))
+		prio := 0
+		switch {
+		case format == 12 && (platform == 0 || (platform == 3 && encoding == 10)):
+			prio = 2
+		case format == 4 && (platform == 0 || (platform == 3 && encoding == 1)):
+			prio = 1
+		}
+		if prio > best {
+			best = prio
+			f.cmap = cmap[off:]
+			f.cmapFormat = format
+		}
+	}
+	if best == 0 {
+		return errors.New("no Unicode cmap found")
+	}
+	return nil
+}
+
+// glyphIndex returns the glyph for the rune, 0 if the glyph is missing.
+func (f *font) glyphIndex(r rune) int {
+	c := uint32(r)
+	switch f.cmapFormat {
+	case 4:
+		if c > 0xffff || len(f.cmap) < 14 {
+			return 0
+		}
+		segCount := int(binary.BigEndian.Uint16(f.cmap[6:])) / 2
+		if 16+8*segCount > len(f.cmap) {
+			return 0
+		}
+		ends := f.cmap[14:]
+		starts := f.cmap[16+2*segCount:]
+		deltas := f.cmap[16+4*segCount:]
+		rangeOffsets := f.cmap[16+6*segCount:]
+		for i := 0; i < segCount; i++ {
+			if uint32(binary.BigEndian.Uint16(ends[2*i:])) < c {
+				continue
+			}
+			start := uint32(binary.BigEndian.Uint16(starts[2*i:]))
+			if start > c {
+				return 0
+			}
+			delta := binary.BigEndian.Uint16(deltas[2*i:])
+			ro := int(binary.BigEndian.Uint16(rangeOffsets[2*i:]))
+			if ro == 0 {
+				return int(uint16(c) + delta)
+			}
+			pos := 16 + 6*segCount + 2*i + ro + 2*int(c-start)
+			if pos+2 > len(f.cmap) {
+				return 0
+			}
+			g := binary.BigEndian.Uint16(f.cmap[pos:])
+			if g == 0 {
+				return 0
+			}
+			return int(g + delta)
+		}
+	case 12:
+		if len(f.cmap) < 16 {
+			return 0
+		}
+		n := int(binary.BigEndian.Uint32(f.cmap[12:]))
+		for i := 0; i < n && 16+12*i+12 <= len(f.cmap); i++ {
+			g := f.cmap[16+12*i:]
+			start, end := binary.BigEndian.Uint32(g), binary.BigEndian.Uint32(g[4:])
+			if c >= start && c <= end {
+				return int(binary.BigEndian.Uint32(g[8:]) + c - start)
+			}
+		}
+	}
+	return 0
+}
+
+// advance returns the horizontal advance of the glyph in font units.
+func (f *font) advance(g int) float64 {
+	if g >= f.numHMetrics {
+		g = f.numHMetrics - 1
+	}
+	return float64(binary.BigEndian.Uint16(f.hmtx[4*g:]))
+}
+
+// outline returns the flattened contours of the glyph in font units
+// (y up).
+func (f *font) outline(g int) [][]point {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if c, ok := f.glyphs[g]; ok {
+		return c
+	}
+	c, err := f.parseGlyph(g, 0)
+	if err != nil {
+		c = nil
+	}
+	f.glyphs[g] = c
+	return c
+}
+
+// curveSteps is the number of line segments for each quadratic curve.
+const curveSteps = 6
+
+func (f *font) parseGlyph(g int, depth int) ([][]point, error) {
+	if g < 0 || g >= f.numGlyphs || depth > 8 {
+		return nil, errInvalidTrueType
+	}
+	start, end := f.loca[g], f.loca[g+1]
+	if start == end {
+		return nil, nil // e.g. space
+	}
+	if start > end || end > len(f.glyf) || end-start < 10 {
+		return nil, errInvalidTrueType
+	}
+	data := f.glyf[start:end]
+	numContours := int(int16(binary.BigEndian.Uint16(data)))
+	if numContours < 0 {
+		return f.parseCompositeGlyph(data[10:], depth)
+	}
+
+	pos := 10
+	if pos+2*numContours+2 > len(data) {
+		return nil, errInvalidTrueType
+	}
+	endPts := make([]int, numContours)
+	for i := range endPts {
+		endPts[i] = int(binary.BigEndian.Uint16(data[pos+2*i:]))
+	}
+	pos += 2 * numContours
+	numPoints := 0
+	if numContours > 0 {
+		numPoints = endPts[numContours-1] + 1
+	}
+	pos += 2 + int(binary.BigEndian.Uint16(data[pos:])) // instructions
+
+	flags := make([]byte, 0, numPoints)
+	for len(flags) < numPoints {
+		if pos >= len(data) {
+			return nil, errInvalidTrueType
+		}
+		fl := data[pos]
+		pos++
+		flags = append(flags, fl)
+		if fl&0x08 != 0 { // repeat
+			if pos >= len(data) {
+				return nil, errInvalidTrueType
+			}
+			for n := int(data[pos]); n > 0 && len(flags) < numPoints; n-- {
+				flags = append(flags, fl)
+			}
+			pos++
+		}
+	}
+
+	coords := func(short, same byte) ([]int, error) {
+		result := make([]int, numPoints)
+		v := 0
+		for i, fl := range flags {
+			switch {
+			case fl&short != 0:
+				if pos >= len(data) {
+					return nil, errInvalidTrueType
+				}
+				d := int(data[pos])
+				pos++
+				if fl&same == 0 {
+					d = -d
+				}
+				v += d
+			case fl&same == 0:
+				if pos+2 > len(data) {
+					return nil, errInvalidTrueType
+				}
+				v += int(int16(binary.BigEndian.Uint16(data[pos:])))
+				pos += 2
+			}
+			result[i] = v
+		}
+		return result, nil
+	}
+	xs, err := coords(0x02, 0x10)
+	if err != nil {
+		return nil, err
+	}
+	ys, err := coords(0x04, 0x20)
+	if err != nil {
+		return nil, err
+	}
+
+	var contours [][]point
+	first := 0
+	for _, last := range endPts {
+		if last < first || last >= numPoints {
+			return nil, errInvalidTrueType
+		}
+		pts := make([]point, 0, last-first+1)
+		on := make([]bool, 0, last-first+1)
+		for i := first; i <= last; i++ {
+			pts = append(pts, point{float64(xs[i]), float64(ys[i])})
+			on = append(on, flags[i]&0x01 != 0)
+		}
+		if c := flattenContour(pts, on); len(c) > 2 {
+			contours = append(contours, c)
+		}
+		first = last + 1
+	}
+	return contours, nil
+}
+
+// flattenContour converts the quadratic contour into a polygon.
+func flattenContour(pts []point, on []bool) []point {
+	n := len(pts)
+	if n == 0 {
+		return nil
+	}
+	// start at an on-curve point, or at the implied point between the
+	// first two off-curve points
+	startIdx := -1
+	for i := range on {
+		if on[i] {
+			startIdx = i
+			break
+		}
+	}
+	var start point
+	if startIdx >= 0 {
+		start = pts[startIdx]
+	} else {
+		start = mid(pts[n-1], pts[0])
+		// continue with the first off-curve point as control point
+		startIdx = n - 1
+	}
+
+	result := []point{start}
+	cur := start
+	var ctrl *point
+	for k := 1; k <= n; k++ {
+		i := (startIdx + k) % n
+		p := pts[i]
+		if on[i] {
+			if ctrl != nil {
+				result = appendQuad(result, cur, *ctrl, p)
+				ctrl = nil
+			} else {
+				result = append(result, p)
+			}
+			cur = p
+			continue
+		}
+		if ctrl != nil {
+			m := mid(*ctrl, p)
+			result = appendQuad(result, cur, *ctrl, m)
+			cur = m
+		}
+		c := p
+		ctrl = &c
+	}
+	if ctrl != nil {
+		result = appendQuad(result, cur, *ctrl, start)
+	}
+	return result
+}
+
+func mid(a, b point) point {
+	return point{(a.x + b.x) / 2, (a.y + b.y) / 2}
+}
+
+func appendQuad(dst []point, p0, p1, p2 point) []point {
+	for i := 1; i <= curveSteps; i++ {
+		t := float64(i) / curveSteps
+		u := 1 - t
+		dst = append(dst, point{
+			u*u*p0.x + 2*u*t*p1.x + t*t*p2.x,
+			u*u*p0.y + 2*u*t*p1.y + t*t*p2.y,
+		})
+	}
+	return dst
+}
+
+func (f *font) parseCompositeGlyph(data []byte, depth int) ([][]point, error) {
+	var contours [][]point
+	pos := 0
+	for {
+		if pos+4 > len(data) {
+			return nil, errInvalidTrueType
+		}
+		flags := binary.BigEndian.Uint16(data[pos:])
+		g := int(binary.BigEndian.Uint16(data[pos+2:]))
+		pos += 4
+
+		var dx, dy float64
+		if flags&0x0001 != 0 { // words
+			if pos+4 > len(data) {
+				return nil, errInvalidTrueType
+			}
+			dx = float64(int16(binary.BigEndian.Uint16(data[pos:])))
+			dy = float64(int16(binary.BigEndian.Uint16(data[pos+2:])))
+			pos += 4
+		} else {
+			if pos+2 > len(data) {
+				return nil, errInvalidTrueType
+			}
+			dx = float64(int8(data[pos]))
+			dy = float64(int8(data[pos+1]))
+			pos += 2
+		}
+		if flags&0x0002 == 0 {
+			// point matching is not supported
+			dx, dy = 0, 0
+		}
+
+		a, b, c, d := 1.0, 0.0, 0.0, 1.0
+		f2dot14 := func(off int) float64 {
+			return float64(int16(binary.BigEndian.Uint16(data[pos+off:]))) / 16384
+		}
+		switch {
+		case flags&0x0008 != 0: // scale
+			if pos+2 > len(data) {
+				return nil, errInvalidTrueType
+			}
+			a = f2dot14(0)
+			d = a
+			pos += 2
+		case flags&0x0040 != 0: // x and y scale
+			if pos+4 > len(data) {
+				return nil, errInvalidTrueType
+			}
+			a, d = f2dot14(0), f2dot14(2)
+			pos += 4
+		case flags&0x0080 != 0: // 2x2
+			if pos+8 > len(data) {
+				return nil, errInvalidTrueType
+			}
+			a, b, c, d = f2dot14(0), f2dot14(2), f2dot14(4), f2dot14(6)
+			pos += 8
+		}
+
+		component, err := f.parseGlyph(g, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		for _, contour := range component {
+			t := make([]point, len(contour))
+			for i, p := range contour {
+				t[i] = point{a*p.x + c*p.y + dx, b*p.x + d*p.y + dy}
+			}
+			contours = append(contours, t)
+		}
+
+		if flags&0x0020 == 0 { // more components
+			break
+		}
+	}
+	return contours, nil
+}
@@ -0,0 +1,231 @@
+package native
+
+import (
+	"math"
+	"sort"
+)
+
+type point struct {
+	x, y float64
+}
+
+type geomType int
+
+const (
+	pointGeom   geomType = 1
+	lineGeom    geomType = 2
+	polygonGeom geomType = 3
+)
+
+// geometry is a (multi) point, line or polygon. Each part is a single
+// point, a line or a ring. Rings of polygons are not grouped, as all
+// rings are filled with the non-zero rule.
+type geometry struct {
+	typ   geomType
+	parts [][]point
+}
+
+type feature struct {
+	attrs  map[string]interface{}
+	geom   geometry
+	bounds bbox
+}
+
+// newFeature returns the feature with the mapnik::geometry_type attribute
+// used by filters of layers with mixed geometries.
+func newFeature(attrs map[string]interface{}, g geometry) feature {
+	if attrs == nil {
+		attrs = make(map[string]interface{})
+	}
+	attrs["mapnik::geometry_type"] = float64(g.typ)
+	return feature{attrs: attrs, geom: g, bounds: g.bounds()}
+}
+
+type bbox struct {
+	minx, miny, maxx, maxy float64
+}
+
+func emptyBBOX() bbox {
+	return bbox{math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)}
+}
+
+func (b *bbox) extend(p point) {
+	b.minx = math.Min(b.minx, p.x)
+	b.miny = math.Min(b.miny, p.y)
+	b.maxx = math.Max(b.maxx, p.x)
+	b.maxy = math.Max(b.maxy, p.y)
+}
+
+func (b bbox) intersects(o bbox) bool {
+	return b.minx <= o.maxx && b.maxx >= o.minx && b.miny <= o.maxy && b.maxy >= o.miny
+}
+
+func (g geometry) bounds() bbox {
+	b := emptyBBOX()
+	for _, part := range g.parts {
+		for _, p := range part {
+			b.extend(p)
+		}
+	}
+	return b
+}
+
+func (g geometry) transform(f func(point) point) geometry {
+	parts := make([][]point, len(g.parts))
+	for i, part := range g.parts {
+		parts[i] = make([]point, len(part))
+		for j, p := range part {
+			parts[i][j] = f(p)
+		}
+	}
+	return geometry{typ: g.typ, parts: parts}
+}
+
+func lineLength(line []point) float64 {
+	l := 0.0
+	for i := 1; i < len(line); i++ {
+		l += dist(line[i-1], line[i])
+	}
+	return l
+}
+
+func dist(a, b point) float64 {
+	return math.Hypot(b.x-a.x, b.y-a.y)
+}
+
+// interpolate returns the point at distance d along the line.
+func interpolate(line []point, d float64) point {
+	for i := 1; i < len(line); i++ {
+		l := dist(line[i-1], line[i])
+		if d <= l && l > 0 {
+			t := d / l
+			return point{line[i-1].x + t*(line[i].x-line[i-1].x), line[i-1].y + t*(line[i].y-line[i-1].y)}
+		}
+		d -= l
+	}
+	return line[len(line)-1]
+}
+
+// direction returns the angle of the segment at distance d along the
+// line.
+func direction(line []point, d float64) float64 {
+	for i := 1; i < len(line); i++ {
+		l := dist(line[i-1], line[i])
+		if (d <= l || i == len(line)-1) && l > 0 {
+			return math.Atan2(line[i].y-line[i-1].y, line[i].x-line[i-1].x)
+		}
+		d -= l
+	}
+	return 0
+}
+
+func ringArea(ring []point) float64 {
+	a := 0.0
+	for i := range ring {
+		j := (i + 1) % len(ring)
+		a += ring[i].x*ring[j].y - ring[j].x*ring[i].y
+	}
+	return a / 2
+}
+
+// ringCentroid returns the centroid of a ring. The average of all
+// points is returned for rings without area.
+func ringCentroid(ring []point) point {
+	a := ringArea(ring)
+	if a == 0 {
+		c := point{}
+		for _, p := range ring {
+			c.x += p.x
+			c.y += p.y
+		}
+		return point{c.x / float64(len(ring)), c.y / float64(len(ring))}
+	}
+	var cx, cy float64
+	for i := range ring {
+		j := (i + 1) % len(ring)
+		f := ring[i].x*ring[j].y - ring[j].x*ring[i].y
+		cx += (ring[i].x + ring[j].x) * f
+		cy += (ring[i].y + ring[j].y) * f
+	}
+	return point{cx / (6 * a), cy / (6 * a)}
+}
+
+// largestRing returns the index of the ring with the largest area.
+func largestRing(rings [][]point) int {
+	idx, max := 0, -1.0
+	for i, r := range rings {
+		if a := math.Abs(ringArea(r)); a > max {
+			idx, max = i, a
+		}
+	}
+	return idx
+}
+
+// inside returns whether p is inside the rings (even-odd rule).
+func inside(rings [][]point, p point) bool {
+	in := false
+	for _, ring := range rings {
+		for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+			a, b := ring[i], ring[j]
+			if (a.y > p.y) != (b.y > p.y) && p.x < (b.x-a.x)*(p.y-a.y)/(b.y-a.y)+a.x {
+				in = !in
+			}
+		}
+	}
+	return in
+}
+
+// interiorPoint returns a point inside the polygon rings, close to the
+// centroid of the largest ring. It uses the center of the widest
+// interval of a horizontal line through the centroid.
+func interiorPoint(rings [][]point) point {
+	c := ringCentroid(rings[largestRing(rings)])
+	if inside(rings, c) {
+		return c
+	}
+	var xs []float64
+	for _, ring := range rings {
+		for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+			a, b := ring[i], ring[j]
+			if (a.y > c.y) != (b.y > c.y) {
+				xs = append(xs, (b.x-a.x)*(c.y-a.y)/(b.y-a.y)+a.x)
+			}
+		}
+	}
+	sort.Float64s(xs)
+	best, width := c, -1.0
+	for i := 0; i+1 < len(xs); i += 2 {
+		if w := xs[i+1] - xs[i]; w > width {
+			best, width = point{(xs[i] + xs[i+1]) / 2, c.y}, w
+		}
+	}
+	return best
+}
+
+// labelPoints returns the anchor points for point placements. interior
+// selects a point inside of polygons instead of the centroid.
+func labelPoints(g geometry, interior bool) []point {
+	var result []point
+	switch g.typ {
+	case pointGeom:
+		for _, part := range g.parts {
+			result = append(result, part...)
+		}
+	case lineGeom:
+		for _, part := range g.parts {
+			if len(part) > 0 {
+				result = append(result, interpolate(part, lineLength(part)/2))
+			}
+		}
+	case polygonGeom:
+		if len(g.parts) == 0 {
+			return nil
+		}
+		if interior {
+			result = append(result, interiorPoint(g.parts))
+		} else {
+			result = append(result, ringCentroid(g.parts[largestRing(g.parts)]))
+		}
+	}
+	return result
+}
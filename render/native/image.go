@@ -0,0 +1,139 @@
+package native
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/jpeg"
+	_ "image/png"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// loadImage reads a PNG or JPEG image.
+func loadImage(fname string) (*image.NRGBA, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("decoding %s: %v", fname, err)
+	}
+	if nrgba, ok := img.(*image.NRGBA); ok {
+		return nrgba, nil
+	}
+	b := img.Bounds()
+	nrgba := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(nrgba, nrgba.Bounds(), img, b.Min, draw.Src)
+	return nrgba, nil
+}
+
+// rasterImage is a georeferenced image. The world file values are the
+// pixel size (a, e) and the center of the upper left pixel (c, f).
+type rasterImage struct {
+	img        *image.NRGBA
+	a, e, c, f float64
+}
+
+// readRasterImage reads a PNG or JPEG image with a world file (.pgw,
+// .pngw, .jgw, .jpgw, .wld). Rotated images are not supported.
+func readRasterImage(fname string) (*rasterImage, error) {
+	img, err := loadImage(fname)
+	if err != nil {
+		return nil, err
+	}
+	ext := strings.ToLower(fname[strings.LastIndex(fname, ".")+1:])
+	base := fname[:len(fname)-len(ext)]
+	var candidates []string
+	if len(ext) >= 2 {
+		candidates = append(candidates, base+ext[:1]+ext[len(ext)-1:]+"w", base+ext+"w")
+	}
+	candidates = append(candidates, base+"wld")
+
+	for _, wf := range candidates {
+		vals, err := readWorldFile(wf)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if vals[1] != 0 || vals[2] != 0 {
+			return nil, fmt.Errorf("rotated world file %s not supported", wf)
+		}
+		return &rasterImage{img: img, a: vals[0], e: vals[3], c: vals[4], f: vals[5]}, nil
+	}
+	return nil, fmt.Errorf("missing world file for %s", fname)
+}
+
+func readWorldFile(fname string) ([6]float64, error) {
+	var vals [6]float64
+	f, err := os.Open(fname)
+	if err != nil {
+		return vals, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	n := 0
+	for scanner.Scan() && n < 6 {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(line, 64)
+		if err != nil {
+			return vals, fmt.Errorf("invalid world file %s: %v", fname, err)
+		}
+		vals[n] = v
+		n++
+	}
+	if n < 6 {
+		return vals, fmt.Errorf("invalid world file %s", fname)
+	}
+	return vals, scanner.Err()
+}
+
+// drawRaster draws the raster with nearest neighbor sampling. toSrc
+// transforms pixel centers of the canvas into the coordinates of the
+// raster.
+func drawRaster(dst *image.RGBA, r *rasterImage, toSrc func(x, y float64) point, opacity float64) {
+	b := dst.Bounds()
+	sb := r.img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			p := toSrc(float64(x)+0.5, float64(y)+0.5)
+			sx := int(math.Floor((p.x-r.c)/r.a + 0.5))
+			sy := int(math.Floor((p.y-r.f)/r.e + 0.5))
+			if sx < 0 || sy < 0 || sx >= sb.Dx() || sy >= sb.Dy() {
+				continue
+			}
+			c := r.img.NRGBAAt(sb.Min.X+sx, sb.Min.Y+sy)
+			a := float64(c.A) / 255 * opacity
+			blend(dst, x, y, float64(c.R)/255*a, float64(c.G)/255*a, float64(c.B)/255*a, a)
+		}
+	}
+}
+
+// drawImage draws the image centered at p, scaled to w x h pixels.
+func drawImage(dst *image.RGBA, img *image.NRGBA, p point, w, h float64, opacity float64) {
+	sb := img.Bounds()
+	x0, y0 := p.x-w/2, p.y-h/2
+	b := image.Rect(int(math.Floor(x0)), int(math.Floor(y0)), int(math.Ceil(x0+w)), int(math.Ceil(y0+h))).Intersect(dst.Bounds())
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			sx := int((float64(x) + 0.5 - x0) / w * float64(sb.Dx()))
+			sy := int((float64(y) + 0.5 - y0) / h * float64(sb.Dy()))
+			if sx < 0 || sy < 0 || sx >= sb.Dx() || sy >= sb.Dy() {
+				continue
+			}
+			c := img.NRGBAAt(sb.Min.X+sx, sb.Min.Y+sy)
+			a := float64(c.A) / 255 * opacity
+			blend(dst, x, y, float64(c.R)/255*a, float64(c.G)/255*a, float64(c.B)/255*a, a)
+		}
+	}
+}
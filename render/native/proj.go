@@ -0,0 +1,72 @@
+package native
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	earthRadius = 6378137.0
+	maxLat      = 85.0511287798066
+)
+
+// normalizeEPSG returns 3857 for all aliases of Web Mercator.
+func normalizeEPSG(code int) int {
+	switch code {
+	case 900913, 3785, 102100, 102113:
+		return 3857
+	}
+	return code
+}
+
+// SupportedEPSG returns whether the renderer supports the EPSG code.
+// Only EPSG:4326 and EPSG:3857 (and its aliases) are supported.
+func SupportedEPSG(code int) bool {
+	code = normalizeEPSG(code)
+	return code == 4326 || code == 3857
+}
+
+func mercToLonLat(p point) point {
+	return point{
+		p.x / earthRadius * 180 / math.Pi,
+		(2*math.Atan(math.Exp(p.y/earthRadius)) - math.Pi/2) * 180 / math.Pi,
+	}
+}
+
+func lonLatToMerc(p point) point {
+	lat := math.Max(-maxLat, math.Min(maxLat, p.y))
+	return point{
+		p.x * math.Pi / 180 * earthRadius,
+		math.Log(math.Tan(math.Pi/4+lat*math.Pi/360)) * earthRadius,
+	}
+}
+
+func identity(p point) point { return p }
+
+// transformation returns the function that transforms points from one
+// EPSG code to another. Only EPSG:4326 and EPSG:3857 are supported.
+func transformation(from, to int) (func(point) point, error) {
+	from, to = normalizeEPSG(from), normalizeEPSG(to)
+	if !SupportedEPSG(from) {
+		return nil, fmt.Errorf("unsupported EPSG:%d", from)
+	}
+	if !SupportedEPSG(to) {
+		return nil, fmt.Errorf("unsupported EPSG:%d", to)
+	}
+	switch {
+	case from == to:
+		return identity, nil
+	case from == 4326:
+		return lonLatToMerc, nil
+	default:
+		return mercToLonLat, nil
+	}
+}
+
+// transformBBOX transforms the bbox. The transformations are monotone
+// for each axis, so transforming the corners is sufficient.
+func transformBBOX(b bbox, f func(point) point) bbox {
+	ll := f(point{b.minx, b.miny})
+	ur := f(point{b.maxx, b.maxy})
+	return bbox{ll.x, ll.y, ur.x, ur.y}
+}
@@ -0,0 +1,232 @@
+package native
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// rasterizer accumulates the anti-aliased coverage of paths in pixel
+// coordinates. It uses signed area accumulation (as in font-rs): each
+// edge adds its area to the cells it crosses and the coverage of a pixel
+// is the absolute value of the sum of all cells left of and including
+// the pixel. Overlapping paths with the same orientation add up and are
+// clamped to full coverage, as with the non-zero fill rule.
+type rasterizer struct {
+	w, h   int
+	stride int
+	acc    []float32
+
+	// dirty region
+	minX, minY, maxX, maxY int
+}
+
+func newRasterizer(w, h int) *rasterizer {
+	r := &rasterizer{w: w, h: h, stride: w + 2, acc: make([]float32, (w+2)*h)}
+	r.resetDirty()
+	return r
+}
+
+func (r *rasterizer) resetDirty() {
+	r.minX, r.minY = r.stride, r.h
+	r.maxX, r.maxY = -1, -1
+}
+
+// ring adds the closed ring.
+func (r *rasterizer) ring(pts []point) {
+	if len(pts) < 3 {
+		return
+	}
+	for i := 1; i < len(pts); i++ {
+		r.line(pts[i-1], pts[i])
+	}
+	r.line(pts[len(pts)-1], pts[0])
+}
+
+// convex adds the ring with positive orientation. All pieces of strokes
+// are added with the same orientation, so that overlaps don't cancel
+// out.
+func (r *rasterizer) convex(pts []point) {
+	if ringArea(pts) >= 0 {
+		r.ring(pts)
+		return
+	}
+	for i := len(pts) - 1; i > 0; i-- {
+		r.line(pts[i], pts[i-1])
+	}
+	r.line(pts[0], pts[len(pts)-1])
+}
+
+// line adds a single edge. Edges left of the canvas are moved to x=0 as
+// they still affect the coverage of all pixels to the right.
+func (r *rasterizer) line(p0, p1 point) {
+	h, w := float64(r.h), float64(r.w)
+	if p0.y == p1.y || (p0.y <= 0 && p1.y <= 0) || (p0.y >= h && p1.y >= h) {
+		return
+	}
+	if math.IsNaN(p0.x) || math.IsNaN(p1.x) || math.IsNaN(p0.y) || math.IsNaN(p1.y) {
+		return
+	}
+	for _, b := range []float64{0, w} {
+		if (p0.x-b)*(p1.x-b) < 0 {
+			t := (b - p0.x) / (p1.x - p0.x)
+			m := point{b, p0.y + t*(p1.y-p0.y)}
+			r.line(p0, m)
+			r.line(m, p1)
+			return
+		}
+	}
+	p0.x = math.Max(0, math.Min(w, p0.x))
+	p1.x = math.Max(0, math.Min(w, p1.x))
+	r.edge(p0, p1)
+}
+
+func (r *rasterizer) edge(p0, p1 point) {
+	dir := 1.0
+	if p0.y > p1.y {
+		dir = -1
+		p0, p1 = p1, p0
+	}
+	w := float64(r.w)
+	dxdy := (p1.x - p0.x) / (p1.y - p0.y)
+	x := p0.x
+	y0 := int(p0.y)
+	if p0.y < 0 {
+		x -= p0.y * dxdy
+		y0 = 0
+	}
+	yEnd := int(math.Ceil(p1.y))
+	if yEnd > r.h {
+		yEnd = r.h
+	}
+	if y0 < r.minY {
+		r.minY = y0
+	}
+	if yEnd-1 > r.maxY {
+		r.maxY = yEnd - 1
+	}
+	for y := y0; y < yEnd; y++ {
+		row := r.acc[y*r.stride : (y+1)*r.stride]
+		dy := math.Min(float64(y+1), p1.y) - math.Max(float64(y), p0.y)
+		xnext := math.Max(0, math.Min(w, x+dxdy*dy))
+		d := dy * dir
+		x0, x1 := x, xnext
+		if x0 > x1 {
+			x0, x1 = x1, x0
+		}
+		x0floor := math.Floor(x0)
+		x0i := int(x0floor)
+		x1ceil := math.Ceil(x1)
+		x1i := int(x1ceil)
+		if x0i < r.minX {
+			r.minX = x0i
+		}
+		if x1i <= x0i+1 {
+			xmf := 0.5*(x+xnext) - x0floor
+			row[x0i] += float32(d - d*xmf)
+			row[x0i+1] += float32(d * xmf)
+			if x0i+1 > r.maxX {
+				r.maxX = x0i + 1
+			}
+		} else {
+			s := 1 / (x1 - x0)
+			x0f := x0 - x0floor
+			a0 := 0.5 * s * (1 - x0f) * (1 - x0f)
+			x1f := x1 - x1ceil + 1
+			am := 0.5 * s * x1f * x1f
+			row[x0i] += float32(d * a0)
+			if x1i == x0i+2 {
+				row[x0i+1] += float32(d * (1 - a0 - am))
+			} else {
+				a1 := s * (1.5 - x0f)
+				row[x0i+1] += float32(d * (a1 - a0))
+				for xi := x0i + 2; xi < x1i-1; xi++ {
+					row[xi] += float32(d * s)
+				}
+				a2 := a1 + float64(x1i-x0i-3)*s
+				row[x1i-1] += float32(d * (1 - a2 - am))
+			}
+			row[x1i] += float32(d * am)
+			if x1i > r.maxX {
+				r.maxX = x1i
+			}
+		}
+		x = xnext
+	}
+}
+
+// paint returns the premultiplied color of the pixel.
+type paint func(x, y int) (r, g, b, a float64)
+
+func uniform(c color.NRGBA, opacity float64) paint {
+	a := float64(c.A) / 255 * opacity
+	r, g, b := float64(c.R)/255*a, float64(c.G)/255*a, float64(c.B)/255*a
+	return func(x, y int) (float64, float64, float64, float64) {
+		return r, g, b, a
+	}
+}
+
+// pattern repeats the image, starting at the origin of the canvas.
+func pattern(img *image.NRGBA, opacity float64) paint {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	return func(x, y int) (float64, float64, float64, float64) {
+		c := img.NRGBAAt(b.Min.X+x%w, b.Min.Y+y%h)
+		a := float64(c.A) / 255 * opacity
+		return float64(c.R) / 255 * a, float64(c.G) / 255 * a, float64(c.B) / 255 * a, a
+	}
+}
+
+// fill composites the accumulated coverage with the paint over dst and
+// resets the rasterizer. evenOdd selects the even-odd fill rule instead
+// of non-zero, to fill polygons independent of the ring orientations.
+func (r *rasterizer) fill(dst *image.RGBA, p paint, evenOdd bool) {
+	if r.maxY < 0 {
+		return
+	}
+	maxX := r.maxX
+	if maxX >= r.stride {
+		maxX = r.stride - 1
+	}
+	for y := r.minY; y <= r.maxY; y++ {
+		row := r.acc[y*r.stride : (y+1)*r.stride]
+		sum := float32(0)
+		for x := r.minX; x <= maxX; x++ {
+			sum += row[x]
+			row[x] = 0
+			if x >= r.w {
+				continue
+			}
+			cov := float64(sum)
+			if evenOdd {
+				cov -= 2 * math.Floor(cov/2+0.5)
+			}
+			if cov < 0 {
+				cov = -cov
+			}
+			if cov < 1.0/512 {
+				continue
+			}
+			if cov > 1 {
+				cov = 1
+			}
+			sr, sg, sb, sa := p(x, y)
+			blend(dst, x, y, sr*cov, sg*cov, sb*cov, sa*cov)
+		}
+	}
+	r.resetDirty()
+}
+
+// blend composites the premultiplied color over the pixel of dst.
+func blend(dst *image.RGBA, x, y int, r, g, b, a float64) {
+	if a <= 0 {
+		return
+	}
+	i := dst.PixOffset(x, y)
+	pix := dst.Pix[i : i+4 : i+4]
+	inv := 1 - a
+	pix[0] = uint8(math.Min(255, r*255+float64(pix[0])*inv+0.5))
+	pix[1] = uint8(math.Min(255, g*255+float64(pix[1])*inv+0.5))
+	pix[2] = uint8(math.Min(255, b*255+float64(pix[2])*inv+0.5))
+	pix[3] = uint8(math.Min(255, a*255+float64(pix[3])*inv+0.5))
+}
@@ -0,0 +1,652 @@
+package native
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/omniscale/magnacarto/render"
+)
+
+// Renderer renders styles written by builder/native. Styles and
+// datasources are cached until the files change. Renderer is safe for
+// concurrent use.
+type Renderer struct {
+	mu     sync.Mutex
+	styles map[string]styleEntry
+	images map[string]*image.NRGBA
+	fonts  map[FontFace]*font
+	data   dataCache
+}
+
+type styleEntry struct {
+	modTime time.Time
+	m       *Map
+}
+
+func New() *Renderer {
+	return &Renderer{
+		styles: make(map[string]styleEntry),
+		images: make(map[string]*image.NRGBA),
+		fonts:  make(map[FontFace]*font),
+	}
+}
+
+func (r *Renderer) loadMap(fname string) (*Map, error) {
+	fi, err := os.Stat(fname)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	e, ok := r.styles[fname]
+	r.mu.Unlock()
+	if ok && e.modTime.Equal(fi.ModTime()) {
+		return e.m, nil
+	}
+	m, err := LoadMap(fname)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	r.styles[fname] = styleEntry{modTime: fi.ModTime(), m: m}
+	r.mu.Unlock()
+	return m, nil
+}
+
+func (r *Renderer) image(fname string) (*image.NRGBA, error) {
+	r.mu.Lock()
+	img, ok := r.images[fname]
+	r.mu.Unlock()
+	if ok {
+		return img, nil
+	}
+	img, err := loadImage(fname)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	r.images[fname] = img
+	r.mu.Unlock()
+	return img, nil
+}
+
+func (r *Renderer) font(ff FontFace) (*font, error) {
+	r.mu.Lock()
+	f, ok := r.fonts[ff]
+	r.mu.Unlock()
+	if ok {
+		return f, nil
+	}
+	f, err := loadFont(ff.File, ff.Index)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	r.fonts[ff] = f
+	r.mu.Unlock()
+	return f, nil
+}
+
+// Render renders the style file and writes the PNG or JPEG image to dst.
+// It returns warnings for all features that were not rendered, e.g.
+// layers with unsupported projections or missing fonts.
+func (r *Renderer) Render(styleFile string, dst io.Writer, req render.Request) ([]string, error) {
+	if req.Width <= 0 || req.Height <= 0 {
+		return nil, errors.New("invalid image size")
+	}
+	if req.BBOX[2] <= req.BBOX[0] || req.BBOX[3] <= req.BBOX[1] {
+		return nil, errors.New("invalid bbox")
+	}
+	if !SupportedEPSG(req.EPSGCode) {
+		return nil, fmt.Errorf("unsupported EPSG:%d, only EPSG:3857 and EPSG:4326 are supported", req.EPSGCode)
+	}
+	m, err := r.loadMap(styleFile)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := newRenderContext(r, req)
+	img := image.NewRGBA(image.Rect(0, 0, req.Width, req.Height))
+	isJPEG := strings.Contains(req.Format, "jpeg") || strings.Contains(req.Format, "jpg")
+	switch {
+	case req.BGColor != nil:
+		fillImage(img, *req.BGColor)
+	case m.BackgroundColor != nil:
+		fillImage(img, m.BackgroundColor.nrgba())
+	case isJPEG:
+		fillImage(img, color.NRGBA{255, 255, 255, 255})
+	}
+
+	for i := range m.Layers {
+		if err := ctx.renderLayer(img, &m.Layers[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	if isJPEG {
+		err = jpeg.Encode(dst, img, &jpeg.Options{Quality: 90})
+	} else {
+		err = png.Encode(dst, img)
+	}
+	return ctx.warnings, err
+}
+
+// renderContext contains the state of a single Render call.
+type renderContext struct {
+	r           *Renderer
+	req         render.Request
+	bbox        bbox
+	res         float64
+	scaleDenom  float64
+	scaleFactor float64
+	ras         *rasterizer
+	placed      collisions
+	warnings    []string
+	warned      map[string]bool
+}
+
+func newRenderContext(r *Renderer, req render.Request) *renderContext {
+	scaleFactor := req.ScaleFactor
+	if scaleFactor <= 0 {
+		scaleFactor = 1
+	}
+	b := bbox{req.BBOX[0], req.BBOX[1], req.BBOX[2], req.BBOX[3]}
+	res := (b.maxx - b.minx) / float64(req.Width)
+	meterRes := res
+	if normalizeEPSG(req.EPSGCode) == 4326 {
+		meterRes *= earthRadius * math.Pi / 180
+	}
+	return &renderContext{
+		r:    r,
+		req:  req,
+		bbox: b,
+		res:  res,
+		// 0.28 mm pixel size as in Mapnik and OGC SLD, Mapnik also
+		// multiplies the scale with the scale factor
+		scaleDenom:  meterRes / 0.00028 * scaleFactor,
+		scaleFactor: scaleFactor,
+		ras:         newRasterizer(req.Width, req.Height),
+		warned:      make(map[string]bool),
+	}
+}
+
+func (c *renderContext) warn(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if c.warned[msg] {
+		return
+	}
+	c.warned[msg] = true
+	c.warnings = append(c.warnings, msg)
+}
+
+func (c *renderContext) toPixel(p point) point {
+	return point{
+		(p.x - c.bbox.minx) / (c.bbox.maxx - c.bbox.minx) * float64(c.req.Width),
+		(c.bbox.maxy - p.y) / (c.bbox.maxy - c.bbox.miny) * float64(c.req.Height),
+	}
+}
+
+func (c *renderContext) fromPixel(x, y float64) point {
+	return point{
+		c.bbox.minx + x/float64(c.req.Width)*(c.bbox.maxx-c.bbox.minx),
+		c.bbox.maxy - y/float64(c.req.Height)*(c.bbox.maxy-c.bbox.miny),
+	}
+}
+
+// labelBuffer is the buffer in pixels around the map for features that
+// are outside but may still be visible (e.g. labels or wide lines).
+const labelBuffer = 128
+
+func (c *renderContext) renderLayer(img *image.RGBA, l *Layer) error {
+	if len(c.req.Layers) > 0 && !contains(c.req.Layers, l.Name) {
+		return nil
+	}
+	if !inScale(c.scaleDenom, l.MinScaleDenom, l.MaxScaleDenom) {
+		return nil
+	}
+	if l.Datasource.Type == "" {
+		// unsupported datasource, reported by the builder
+		return nil
+	}
+	active := false
+	for _, s := range l.Styles {
+		for _, rule := range s.Rules {
+			if inScale(c.scaleDenom, rule.MinScaleDenom, rule.MaxScaleDenom) {
+				active = true
+			}
+		}
+	}
+	if !active {
+		return nil
+	}
+
+	epsg := l.EPSGCode
+	if epsg == 0 {
+		epsg = 4326
+	}
+	toReq, err := transformation(epsg, c.req.EPSGCode)
+	if err != nil {
+		c.warn("layer %s: %v", l.Name, err)
+		return nil
+	}
+	fromReq, _ := transformation(c.req.EPSGCode, epsg)
+
+	data, err := c.r.data.load(l.Datasource)
+	if err != nil {
+		return fmt.Errorf("layer %s: %v", l.Name, err)
+	}
+
+	for _, s := range l.Styles {
+		canvas := img
+		if s.Opacity != nil && *s.Opacity < 1 {
+			canvas = image.NewRGBA(img.Bounds())
+		}
+		if data.raster != nil {
+			c.renderRaster(canvas, data.raster, &s, fromReq)
+		} else {
+			buf := labelBuffer * c.res
+			query := transformBBOX(bbox{c.bbox.minx - buf, c.bbox.miny - buf, c.bbox.maxx + buf, c.bbox.maxy + buf}, fromReq)
+			toPixel := func(p point) point { return c.toPixel(toReq(p)) }
+			for _, f := range data.features {
+				if !f.bounds.intersects(query) {
+					continue
+				}
+				for i := range s.Rules {
+					if !s.Rules[i].matches(f.attrs, c.scaleDenom) {
+						continue
+					}
+					g := f.geom.transform(toPixel)
+					for _, sym := range s.Rules[i].Symbolizers {
+						c.renderSymbolizer(canvas, &sym, f, g)
+					}
+					break
+				}
+			}
+		}
+		if canvas != img {
+			composite(img, canvas, *s.Opacity)
+		}
+	}
+	return nil
+}
+
+func (c *renderContext) renderRaster(dst *image.RGBA, raster *rasterImage, s *Style, fromReq func(point) point) {
+	for _, rule := range s.Rules {
+		if !rule.matches(nil, c.scaleDenom) {
+			continue
+		}
+		for _, sym := range rule.Symbolizers {
+			if sym.Type != RasterSymbolizer {
+				continue
+			}
+			drawRaster(dst, raster, func(x, y float64) point {
+				return fromReq(c.fromPixel(x, y))
+			}, value(sym.Opacity, 1))
+		}
+		return
+	}
+}
+
+func (c *renderContext) renderSymbolizer(dst *image.RGBA, sym *Symbolizer, f feature, g geometry) {
+	switch sym.Type {
+	case PolygonSymbolizer:
+		if g.typ != polygonGeom {
+			return
+		}
+		for _, ring := range g.parts {
+			c.ras.ring(ring)
+		}
+		c.ras.fill(dst, uniform(colorOr(sym.Color, color.NRGBA{128, 128, 128, 255}), value(sym.Opacity, 1)), true)
+	case PolygonPatternSymbolizer:
+		if g.typ != polygonGeom {
+			return
+		}
+		img, err := c.r.image(sym.File)
+		if err != nil {
+			c.warn("polygon pattern: %v", err)
+			return
+		}
+		for _, ring := range g.parts {
+			c.ras.ring(ring)
+		}
+		c.ras.fill(dst, pattern(img, value(sym.Opacity, 1)), true)
+	case LineSymbolizer:
+		if g.typ == pointGeom {
+			return
+		}
+		s := stroke{
+			width:      value(sym.Width, 1) * c.scaleFactor,
+			cap:        sym.Cap,
+			join:       sym.Join,
+			miterLimit: value(sym.MiterLimit, 4),
+		}
+		for _, d := range sym.Dasharray {
+			s.dash = append(s.dash, d*c.scaleFactor)
+		}
+		for _, part := range g.parts {
+			s.add(c.ras, part, g.typ == polygonGeom)
+		}
+		c.ras.fill(dst, uniform(colorOr(sym.Color, color.NRGBA{0, 0, 0, 255}), value(sym.Opacity, 1)), false)
+	case MarkerSymbolizer:
+		c.renderMarker(dst, sym, g)
+	case PointSymbolizer:
+		img, err := c.r.image(sym.File)
+		if err != nil {
+			c.warn("point: %v", err)
+			return
+		}
+		w := float64(img.Bounds().Dx()) * c.scaleFactor
+		h := float64(img.Bounds().Dy()) * c.scaleFactor
+		for _, p := range labelPoints(g, sym.Placement == "interior") {
+			if !c.place(p, w, h, 0, sym.AllowOverlap, sym.IgnorePlacement) {
+				continue
+			}
+			drawImage(dst, img, p, w, h, value(sym.Opacity, 1))
+		}
+	case TextSymbolizer:
+		c.renderText(dst, sym, f, g)
+	case DotSymbolizer:
+		w := value(sym.Width, 1) * c.scaleFactor
+		h := value(sym.Height, w/c.scaleFactor) * c.scaleFactor
+		for _, part := range g.parts {
+			for _, p := range part {
+				c.ras.convex([]point{{p.x - w/2, p.y - h/2}, {p.x + w/2, p.y - h/2}, {p.x + w/2, p.y + h/2}, {p.x - w/2, p.y + h/2}})
+			}
+		}
+		c.ras.fill(dst, uniform(colorOr(sym.Color, color.NRGBA{0, 0, 0, 255}), value(sym.Opacity, 1)), false)
+	case RasterSymbolizer:
+		// rendered by renderRaster
+	default:
+		c.warn("unsupported symbolizer '%s'", sym.Type)
+	}
+}
+
+// place checks whether the box of w x h pixels centered at p can be placed
+// and inserts it into the placed boxes.
+func (c *renderContext) place(p point, w, h, minDistance float64, allowOverlap, ignorePlacement bool) bool {
+	box := rect{p.x - w/2, p.y - h/2, p.x + w/2, p.y + h/2}
+	if !allowOverlap && c.placed.collides(box.grow(minDistance)) {
+		return false
+	}
+	if !ignorePlacement {
+		c.placed.insert(box)
+	}
+	return true
+}
+
+// markerPosition is the center and the rotation of a marker.
+type markerPosition struct {
+	p     point
+	angle float64
+}
+
+func (c *renderContext) markerPositions(sym *Symbolizer, g geometry) []markerPosition {
+	var result []markerPosition
+	switch sym.Placement {
+	case "line":
+		if g.typ == pointGeom {
+			break
+		}
+		spacing := value(sym.Spacing, 100) * c.scaleFactor
+		for _, part := range g.parts {
+			if g.typ == polygonGeom && len(part) > 0 {
+				part = append(part[:len(part):len(part)], part[0])
+			}
+			l := lineLength(part)
+			if l == 0 {
+				continue
+			}
+			d := spacing / 2
+			if spacing <= 0 || l < spacing {
+				d = l / 2
+			}
+			for ; d < l; d += spacing {
+				result = append(result, markerPosition{interpolate(part, d), direction(part, d)})
+				if spacing <= 0 {
+					break
+				}
+			}
+		}
+		return result
+	case "vertex-first", "vertex-last":
+		for _, part := range g.parts {
+			if len(part) == 0 {
+				continue
+			}
+			if sym.Placement == "vertex-first" || len(part) == 1 {
+				result = append(result, markerPosition{p: part[0], angle: direction(part, 0)})
+			} else {
+				result = append(result, markerPosition{p: part[len(part)-1], angle: direction(part, lineLength(part))})
+			}
+		}
+		return result
+	}
+	for _, p := range labelPoints(g, sym.Placement == "interior") {
+		result = append(result, markerPosition{p: p})
+	}
+	return result
+}
+
+func (c *renderContext) renderMarker(dst *image.RGBA, sym *Symbolizer, g geometry) {
+	opacity := value(sym.Opacity, 1)
+	var img *image.NRGBA
+	if sym.File != "" {
+		var err error
+		img, err = c.r.image(sym.File)
+		if err != nil {
+			c.warn("marker: %v", err)
+			return
+		}
+	}
+
+	var w, h float64
+	if img != nil {
+		iw, ih := float64(img.Bounds().Dx()), float64(img.Bounds().Dy())
+		switch {
+		case sym.Width != nil && sym.Height != nil:
+			w, h = *sym.Width, *sym.Height
+		case sym.Width != nil:
+			w, h = *sym.Width, *sym.Width*ih/iw
+		case sym.Height != nil:
+			w, h = *sym.Height*iw/ih, *sym.Height
+		default:
+			w, h = iw, ih
+		}
+	} else {
+		w = value(sym.Width, 10)
+		h = value(sym.Height, w)
+	}
+	w, h = w*c.scaleFactor, h*c.scaleFactor
+
+	for _, pos := range c.markerPositions(sym, g) {
+		if !c.place(pos.p, w, h, 0, sym.AllowOverlap, sym.IgnorePlacement) {
+			continue
+		}
+		if img != nil {
+			drawImage(dst, img, pos.p, w, h, opacity)
+			continue
+		}
+		var shape []point
+		if sym.MarkerType == "arrow" {
+			shape = arrow(pos.p, w, h, pos.angle)
+		} else {
+			shape = ellipse(pos.p, w/2, h/2)
+		}
+		c.ras.ring(shape)
+		c.ras.fill(dst, uniform(colorOr(sym.Color, color.NRGBA{0, 0, 255, 255}), value(sym.FillOpacity, 1)*opacity), false)
+		if sw := value(sym.StrokeWidth, 0.5) * c.scaleFactor; sw > 0 {
+			s := stroke{width: sw, join: "round"}
+			s.add(c.ras, shape, true)
+			c.ras.fill(dst, uniform(colorOr(sym.Stroke, color.NRGBA{0, 0, 0, 255}), value(sym.StrokeOpacity, 1)*opacity), false)
+		}
+	}
+}
+
+// arrow returns the outline of an arrow marker pointing in the direction
+// of the angle.
+func arrow(c point, w, h, angle float64) []point {
+	shape := []point{{-0.5, -0.2}, {0.1, -0.2}, {0.1, -0.5}, {0.5, 0}, {0.1, 0.5}, {0.1, 0.2}, {-0.5, 0.2}}
+	sin, cos := math.Sin(angle), math.Cos(angle)
+	for i, p := range shape {
+		x, y := p.x*w, p.y*h
+		shape[i] = point{c.x + x*cos - y*sin, c.y + x*sin + y*cos}
+	}
+	return shape
+}
+
+func (c *renderContext) renderText(dst *image.RGBA, sym *Symbolizer, f feature, g geometry) {
+	text := ""
+	for _, part := range sym.Text {
+		if part.Field == "" {
+			text += part.Text
+			continue
+		}
+		switch v := f.attrs[part.Field].(type) {
+		case nil:
+		case string:
+			text += v
+		case float64:
+			text += strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			text += fmt.Sprint(v)
+		}
+	}
+	text = strings.TrimSpace(transformText(text, sym.TextTransform))
+	if text == "" || sym.Size <= 0 {
+		return
+	}
+
+	var fs fontSet
+	for _, ff := range sym.Fonts {
+		if ff.File == "" {
+			continue
+		}
+		f, err := c.r.font(ff)
+		if err != nil {
+			c.warn("font '%s': %v", ff.Name, err)
+			continue
+		}
+		fs = append(fs, f)
+	}
+	if len(fs) == 0 {
+		names := make([]string, len(sym.Fonts))
+		for i, ff := range sym.Fonts {
+			names[i] = ff.Name
+		}
+		c.warn("no font found for '%s'", strings.Join(names, ", "))
+		return
+	}
+
+	layout := layoutText(fs, text, sym.Size*c.scaleFactor, sym.WrapWidth*c.scaleFactor)
+	dx, dy := sym.Dx*c.scaleFactor, sym.Dy*c.scaleFactor
+	halign := sym.HorizontalAlignment
+	if halign == "" || halign == "auto" {
+		switch {
+		case dx > 0:
+			halign = "right"
+		case dx < 0:
+			halign = "left"
+		}
+	}
+	opacity := value(sym.Opacity, 1)
+	halo := sym.HaloRadius * c.scaleFactor
+
+	for _, p := range labelPoints(g, sym.Placement == "interior") {
+		// top left of the text box
+		x := p.x + dx - layout.width/2
+		switch halign {
+		case "right":
+			x = p.x + dx
+		case "left":
+			x = p.x + dx - layout.width
+		}
+		y := p.y + dy - layout.height/2
+		switch {
+		case dy > 0:
+			y = p.y + dy
+		case dy < 0:
+			y = p.y + dy - layout.height
+		}
+
+		if sym.AvoidEdges && (x < 0 || y < 0 || x+layout.width > float64(c.req.Width) || y+layout.height > float64(c.req.Height)) {
+			continue
+		}
+		center := point{x + layout.width/2, y + layout.height/2}
+		if !c.place(center, layout.width+2*halo, layout.height+2*halo, sym.MinDistance*c.scaleFactor, sym.AllowOverlap, false) {
+			continue
+		}
+
+		contours := layout.contours(x, y)
+		if halo > 0 {
+			s := stroke{width: 2 * halo, join: "round"}
+			for _, contour := range contours {
+				s.add(c.ras, contour, true)
+			}
+			c.ras.fill(dst, uniform(colorOr(sym.HaloFill, color.NRGBA{255, 255, 255, 255}), opacity), false)
+		}
+		for _, contour := range contours {
+			c.ras.ring(contour)
+		}
+		c.ras.fill(dst, uniform(colorOr(sym.Color, color.NRGBA{0, 0, 0, 255}), opacity), false)
+	}
+}
+
+func (c Color) nrgba() color.NRGBA {
+	return color.NRGBA{c[0], c[1], c[2], c[3]}
+}
+
+func colorOr(c *Color, def color.NRGBA) color.NRGBA {
+	if c == nil {
+		return def
+	}
+	return c.nrgba()
+}
+
+func value(v *float64, def float64) float64 {
+	if v == nil {
+		return def
+	}
+	return *v
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+func fillImage(img *image.RGBA, c color.NRGBA) {
+	a := float64(c.A) / 255
+	r, g, b := uint8(float64(c.R)*a+0.5), uint8(float64(c.G)*a+0.5), uint8(float64(c.B)*a+0.5)
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = r, g, b, c.A
+	}
+}
+
+// composite draws the premultiplied src over dst with the opacity.
+func composite(dst, src *image.RGBA, opacity float64) {
+	for i := 0; i < len(src.Pix); i += 4 {
+		if src.Pix[i+3] == 0 {
+			continue
+		}
+		blend(dst, (i%src.Stride)/4, i/src.Stride,
+			float64(src.Pix[i])/255*opacity,
+			float64(src.Pix[i+1])/255*opacity,
+			float64(src.Pix[i+2])/255*opacity,
+			float64(src.Pix[i+3])/255*opacity,
+		)
+	}
+}
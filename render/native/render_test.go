@@ -0,0 +1,185 @@
+package native
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/omniscale/magnacarto/render"
+)
+
+func writeMap(t *testing.T, dir string, m Map) string {
+	buf, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fname := filepath.Join(dir, "map.json")
+	if err := ioutil.WriteFile(fname, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fname
+}
+
+func renderImage(t *testing.T, fname string, req render.Request) (image.Image, []string) {
+	r := New()
+	buf := bytes.Buffer{}
+	warnings, err := r.Render(fname, &buf, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img, warnings
+}
+
+func checkPixel(t *testing.T, img image.Image, x, y int, expected color.NRGBA) {
+	c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+	if c != expected {
+		t.Errorf("unexpected color %v at %d %d, expected %v", c, x, y, expected)
+	}
+}
+
+func TestRender(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magnacarto-native")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lines := filepath.Join(dir, "lines.geojson")
+	err = ioutil.WriteFile(lines, []byte(`{"type": "FeatureCollection", "features": [
+		{"type": "Feature", "properties": {"type": "major"}, "geometry": {"type": "LineString", "coordinates": [[12, 5], [18, 5]]}},
+		{"type": "Feature", "properties": {"type": "minor"}, "geometry": {"type": "LineString", "coordinates": [[12, 8], [18, 8]]}}
+	]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	width := 4.0
+	fname := writeMap(t, dir, Map{
+		BackgroundColor: &Color{255, 255, 255, 255},
+		Layers: []Layer{
+			{
+				Name:       "areas",
+				EPSGCode:   4326,
+				Datasource: Datasource{Type: "gpkg", File: "tests/test.gpkg", Table: "areas"},
+				Styles: []Style{{Rules: []Rule{{
+					Symbolizers: []Symbolizer{{Type: PolygonSymbolizer, Color: &Color{255, 0, 0, 255}}},
+				}}}},
+			},
+			{
+				Name:       "lines",
+				EPSGCode:   4326,
+				Datasource: Datasource{Type: "geojson", File: lines},
+				Styles: []Style{{Rules: []Rule{
+					{
+						Filters:     []Filter{{Field: "type", Op: "=", Value: "major"}},
+						Symbolizers: []Symbolizer{{Type: LineSymbolizer, Color: &Color{0, 0, 255, 255}, Width: &width}},
+					},
+					{
+						// only rendered for scales below 1:1000
+						MaxScaleDenom: 1000,
+						Symbolizers:   []Symbolizer{{Type: LineSymbolizer, Color: &Color{0, 255, 0, 255}, Width: &width}},
+					},
+				}}},
+			},
+			{
+				Name:       "gk",
+				EPSGCode:   31467,
+				Datasource: Datasource{Type: "geojson", File: lines},
+				Styles: []Style{{Rules: []Rule{{
+					Symbolizers: []Symbolizer{{Type: LineSymbolizer}},
+				}}}},
+			},
+		},
+	})
+
+	req := render.Request{Width: 200, Height: 100, BBOX: [4]float64{0, 0, 20, 10}, EPSGCode: 4326, Format: "image/png"}
+	img, warnings := renderImage(t, fname, req)
+
+	red := color.NRGBA{255, 0, 0, 255}
+	white := color.NRGBA{255, 255, 255, 255}
+	blue := color.NRGBA{0, 0, 255, 255}
+	checkPixel(t, img, 10, 90, red)
+	// inside the hole of the polygon
+	checkPixel(t, img, 50, 50, white)
+	checkPixel(t, img, 150, 50, blue)
+	checkPixel(t, img, 150, 47, white)
+	// minor line is out of scale
+	checkPixel(t, img, 150, 20, white)
+
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "EPSG:31467") {
+		t.Errorf("unexpected warnings %v", warnings)
+	}
+
+	// render only lines
+	req.Layers = []string{"lines"}
+	img, _ = renderImage(t, fname, req)
+	checkPixel(t, img, 10, 90, white)
+	checkPixel(t, img, 150, 50, blue)
+
+	r := New()
+	if _, err := r.Render(fname, ioutil.Discard, render.Request{Width: 10, Height: 10, BBOX: [4]float64{0, 0, 1, 1}, EPSGCode: 31467}); err == nil {
+		t.Error("expected error for unsupported EPSG code")
+	}
+	if _, err := r.Render(fname, ioutil.Discard, render.Request{Width: 10, Height: 10, BBOX: [4]float64{1, 1, 0, 0}, EPSGCode: 4326}); err == nil {
+		t.Error("expected error for invalid bbox")
+	}
+}
+
+func TestRenderText(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magnacarto-native")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	text := func(fonts ...FontFace) Symbolizer {
+		return Symbolizer{
+			Type:  TextSymbolizer,
+			Color: &Color{0, 0, 0, 255},
+			Size:  20,
+			Text:  []TextPart{{Field: "name"}, {Text: " city"}},
+			Fonts: fonts,
+		}
+	}
+	fname := writeMap(t, dir, Map{
+		BackgroundColor: &Color{255, 255, 255, 255},
+		Layers: []Layer{
+			{
+				Name:       "places",
+				EPSGCode:   4326,
+				Datasource: Datasource{Type: "gpkg", File: "tests/test.gpkg"},
+				Styles: []Style{
+					{Rules: []Rule{{Symbolizers: []Symbolizer{text(FontFace{Name: "Noto Sans Regular", File: "../../regression/NotoSans-Regular.ttf"})}}}},
+					{Rules: []Rule{{Symbolizers: []Symbolizer{text(FontFace{Name: "Missing Font"})}}}},
+				},
+			},
+		},
+	})
+
+	img, warnings := renderImage(t, fname, render.Request{Width: 200, Height: 100, BBOX: [4]float64{7, 52.5, 9, 53.5}, EPSGCode: 4326})
+	dark := 0
+	for y := 30; y < 70; y++ {
+		for x := 50; x < 150; x++ {
+			if r, _, _, _ := img.At(x, y).RGBA(); r < 0x8000 {
+				dark++
+			}
+		}
+	}
+	if dark < 50 {
+		t.Errorf("label not rendered, only %d dark pixels", dark)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "Missing Font") {
+		t.Errorf("unexpected warnings %v", warnings)
+	}
+}
@@ -0,0 +1,222 @@
+package native
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// readShapefile reads all features of a .shp file with the attributes
+// from the .dbf file.
+func readShapefile(fname string) ([]feature, error) {
+	base := fname
+	if strings.HasSuffix(strings.ToLower(base), ".shp") {
+		base = base[:len(base)-4]
+	}
+	shp, err := ioutil.ReadFile(base + ".shp")
+	if err != nil {
+		return nil, err
+	}
+	geoms, err := parseShp(shp)
+	if err != nil {
+		return nil, fmt.Errorf("reading shapefile %s: %v", fname, err)
+	}
+
+	var records []map[string]interface{}
+	if dbf, err := ioutil.ReadFile(base + ".dbf"); err == nil {
+		records, err = parseDbf(dbf)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s.dbf: %v", base, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	features := make([]feature, 0, len(geoms))
+	for i, g := range geoms {
+		if len(g.parts) == 0 {
+			continue
+		}
+		var attrs map[string]interface{}
+		if i < len(records) {
+			if records[i] == nil {
+				continue // deleted
+			}
+			attrs = records[i]
+		}
+		features = append(features, newFeature(attrs, g))
+	}
+	return features, nil
+}
+
+// parseShp returns the geometries of all records. Z and M values are
+// ignored.
+func parseShp(buf []byte) ([]geometry, error) {
+	if len(buf) < 100 || binary.BigEndian.Uint32(buf) != 9994 {
+		return nil, fmt.Errorf("invalid header")
+	}
+	var result []geometry
+	pos := 100
+	for pos+8 <= len(buf) {
+		length := int(binary.BigEndian.Uint32(buf[pos+4:])) * 2
+		pos += 8
+		if pos+length > len(buf) || length < 4 {
+			return nil, fmt.Errorf("invalid record at %d", pos)
+		}
+		rec := buf[pos : pos+length]
+		pos += length
+
+		g := geometry{}
+		switch binary.LittleEndian.Uint32(rec) {
+		case 0: // null
+		case 1, 11, 21: // point
+			if len(rec) < 20 {
+				return nil, fmt.Errorf("invalid point record")
+			}
+			g = geometry{typ: pointGeom, parts: [][]point{{shpPoint(rec[4:])}}}
+		case 8, 18, 28: // multipoint
+			if len(rec) < 40 {
+				return nil, fmt.Errorf("invalid multipoint record")
+			}
+			n := int(binary.LittleEndian.Uint32(rec[36:]))
+			if 40+16*n > len(rec) {
+				return nil, fmt.Errorf("invalid multipoint record")
+			}
+			g.typ = pointGeom
+			for i := 0; i < n; i++ {
+				g.parts = append(g.parts, []point{shpPoint(rec[40+16*i:])})
+			}
+		case 3, 13, 23, 5, 15, 25: // polyline, polygon
+			if len(rec) < 44 {
+				return nil, fmt.Errorf("invalid polyline/polygon record")
+			}
+			numParts := int(binary.LittleEndian.Uint32(rec[36:]))
+			numPoints := int(binary.LittleEndian.Uint32(rec[40:]))
+			ptsOff := 44 + 4*numParts
+			if numParts < 0 || numPoints < 0 || ptsOff+16*numPoints > len(rec) {
+				return nil, fmt.Errorf("invalid polyline/polygon record")
+			}
+			g.typ = lineGeom
+			if t := binary.LittleEndian.Uint32(rec); t == 5 || t == 15 || t == 25 {
+				g.typ = polygonGeom
+			}
+			for i := 0; i < numParts; i++ {
+				start := int(binary.LittleEndian.Uint32(rec[44+4*i:]))
+				end := numPoints
+				if i+1 < numParts {
+					end = int(binary.LittleEndian.Uint32(rec[44+4*i+4:]))
+				}
+				if start < 0 || start > end || end > numPoints {
+					return nil, fmt.Errorf("invalid part")
+				}
+				part := make([]point, 0, end-start)
+				for j := start; j < end; j++ {
+					part = append(part, shpPoint(rec[ptsOff+16*j:]))
+				}
+				g.parts = append(g.parts, part)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported shape type %d", binary.LittleEndian.Uint32(rec))
+		}
+		result = append(result, g)
+	}
+	return result, nil
+}
+
+func shpPoint(b []byte) point {
+	return point{
+		math.Float64frombits(binary.LittleEndian.Uint64(b)),
+		math.Float64frombits(binary.LittleEndian.Uint64(b[8:])),
+	}
+}
+
+type dbfField struct {
+	name   string
+	typ    byte
+	length int
+}
+
+// parseDbf returns the attributes of all records. Deleted records are
+// nil. Numeric fields are returned as float64, logical fields as bool
+// and all other fields as string. Strings are decoded as UTF-8, or as
+// Latin-1 if they are not valid UTF-8.
+func parseDbf(buf []byte) ([]map[string]interface{}, error) {
+	if len(buf) < 32 {
+		return nil, fmt.Errorf("invalid header")
+	}
+	numRecords := int(binary.LittleEndian.Uint32(buf[4:]))
+	headerLen := int(binary.LittleEndian.Uint16(buf[8:]))
+	recordLen := int(binary.LittleEndian.Uint16(buf[10:]))
+
+	var fields []dbfField
+	for pos := 32; pos+32 <= headerLen && pos < len(buf) && buf[pos] != 0x0d; pos += 32 {
+		name := buf[pos : pos+11]
+		if i := bytes.IndexByte(name, 0); i >= 0 {
+			name = name[:i]
+		}
+		fields = append(fields, dbfField{name: string(name), typ: buf[pos+11], length: int(buf[pos+16])})
+	}
+
+	result := make([]map[string]interface{}, 0, numRecords)
+	for i := 0; i < numRecords; i++ {
+		start := headerLen + i*recordLen
+		if start+recordLen > len(buf) {
+			break
+		}
+		rec := buf[start : start+recordLen]
+		if rec[0] == '*' {
+			result = append(result, nil)
+			continue
+		}
+		attrs := make(map[string]interface{}, len(fields))
+		pos := 1
+		for _, f := range fields {
+			if pos+f.length > len(rec) {
+				break
+			}
+			raw := strings.TrimSpace(decodeDbfString(rec[pos : pos+f.length]))
+			pos += f.length
+			switch f.typ {
+			case 'N', 'F':
+				if raw == "" {
+					attrs[f.name] = nil
+				} else if v, err := strconv.ParseFloat(raw, 64); err == nil {
+					attrs[f.name] = v
+				} else {
+					attrs[f.name] = nil
+				}
+			case 'L':
+				switch raw {
+				case "T", "t", "Y", "y":
+					attrs[f.name] = true
+				case "F", "f", "N", "n":
+					attrs[f.name] = false
+				default:
+					attrs[f.name] = nil
+				}
+			default:
+				attrs[f.name] = raw
+			}
+		}
+		result = append(result, attrs)
+	}
+	return result, nil
+}
+
+func decodeDbfString(b []byte) string {
+	b = bytes.TrimRight(b, "\x00")
+	if utf8.Valid(b) {
+		return string(b)
+	}
+	r := make([]rune, len(b))
+	for i, c := range b {
+		r[i] = rune(c)
+	}
+	return string(r)
+}
@@ -0,0 +1,293 @@
+package native
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/omniscale/magnacarto/internal/sqlite"
+)
+
+// readSQLite reads all features of a GeoPackage or SQLite table. For
+// GeoPackages, the table and geometry column default to the first entry
+// of gpkg_geometry_columns.
+func readSQLite(ds Datasource) ([]feature, error) {
+	db, err := sqlite.Open(ds.File)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %v", ds.File, err)
+	}
+	defer db.Close()
+	table, geomField := ds.Table, ds.GeometryField
+	if ds.Type == "gpkg" {
+		rows, err := db.Table("gpkg_geometry_columns")
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %v", ds.File, err)
+		}
+		for _, row := range rows {
+			// table_name, column_name, geometry_type_name, srs_id, z, m
+			if len(row) < 2 {
+				continue
+			}
+			name, _ := row[0].(string)
+			if table != "" && !strings.EqualFold(name, table) {
+				continue
+			}
+			table = name
+			if geomField == "" {
+				geomField, _ = row[1].(string)
+			}
+			break
+		}
+	} else if geomField == "" {
+		// spatialite metadata
+		if rows, err := db.Table("geometry_columns"); err == nil {
+			for _, row := range rows {
+				if len(row) < 2 {
+					continue
+				}
+				if name, _ := row[0].(string); strings.EqualFold(name, table) {
+					geomField, _ = row[1].(string)
+				}
+			}
+		}
+	}
+	if table == "" {
+		return nil, fmt.Errorf("reading %s: missing table", ds.File)
+	}
+
+	cols, err := db.Columns(table)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %v", ds.File, err)
+	}
+	geomCol := -1
+	for i, c := range cols {
+		if geomField != "" && strings.EqualFold(c, geomField) {
+			geomCol = i
+			break
+		}
+		if geomField == "" {
+			switch strings.ToLower(c) {
+			case "geom", "geometry", "the_geom", "wkb_geometry", "way":
+				geomCol = i
+			}
+		}
+	}
+	if geomCol < 0 {
+		return nil, fmt.Errorf("reading %s: geometry column of %s not found", ds.File, table)
+	}
+
+	rows, err := db.Table(table)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %v", ds.File, err)
+	}
+	var features []feature
+	for _, row := range rows {
+		blob, ok := row[geomCol].([]byte)
+		if !ok {
+			continue
+		}
+		g, err := decodeGeometryBlob(blob)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %v", ds.File, err)
+		}
+		if len(g.parts) == 0 {
+			continue
+		}
+		attrs := make(map[string]interface{}, len(cols))
+		for i, c := range cols {
+			if i == geomCol {
+				continue
+			}
+			if _, ok := row[i].([]byte); ok {
+				continue
+			}
+			attrs[c] = row[i]
+		}
+		features = append(features, newFeature(attrs, g))
+	}
+	return features, nil
+}
+
+// decodeGeometryBlob decodes GeoPackage, SpatiaLite or WKB geometries.
+func decodeGeometryBlob(b []byte) (geometry, error) {
+	switch {
+	case len(b) >= 8 && b[0] == 'G' && b[1] == 'P':
+		flags := b[3]
+		envelopeSize := []int{0, 32, 48, 48, 64}
+		env := int(flags>>1) & 0x07
+		if env >= len(envelopeSize) {
+			return geometry{}, errors.New("invalid GeoPackage geometry")
+		}
+		off := 8 + envelopeSize[env]
+		if flags&0x10 != 0 || off >= len(b) { // empty
+			return geometry{}, nil
+		}
+		g, _, err := parseWKB(b[off:])
+		return g, err
+	case len(b) >= 44 && b[0] == 0x00 && (b[1] == 0 || b[1] == 1) && b[38] == 0x7c:
+		return parseSpatiaLite(b)
+	}
+	g, _, err := parseWKB(b)
+	return g, err
+}
+
+var errInvalidWKB = errors.New("invalid WKB")
+
+// parseWKB parses WKB, ISO WKB with Z/M and EWKB. It returns the number of
+// bytes read.
+func parseWKB(b []byte) (geometry, int, error) {
+	if len(b) < 5 {
+		return geometry{}, 0, errInvalidWKB
+	}
+	var order binary.ByteOrder = binary.BigEndian
+	if b[0] == 1 {
+		order = binary.LittleEndian
+	}
+	typ := order.Uint32(b[1:])
+	pos := 5
+	dims := 2
+	if typ&0x80000000 != 0 { // EWKB Z
+		dims++
+	}
+	if typ&0x40000000 != 0 { // EWKB M
+		dims++
+	}
+	if typ&0x20000000 != 0 { // EWKB SRID
+		pos += 4
+	}
+	typ &= 0x0fffffff
+	switch typ / 1000 {
+	case 1, 2:
+		dims++
+	case 3:
+		dims += 2
+	}
+	typ %= 1000
+	return parseGeometryBody(b, pos, typ, dims, order, parseWKB)
+}
+
+// parseGeometryBody parses the coordinates of WKB-like geometries.
+// Collection members are parsed with member.
+func parseGeometryBody(b []byte, pos int, typ uint32, dims int, order binary.ByteOrder, member func([]byte) (geometry, int, error)) (geometry, int, error) {
+	u32 := func() (int, error) {
+		if pos+4 > len(b) {
+			return 0, errInvalidWKB
+		}
+		v := int(order.Uint32(b[pos:]))
+		pos += 4
+		return v, nil
+	}
+	points := func() ([]point, error) {
+		n, err := u32()
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 || pos+n*dims*8 > len(b) {
+			return nil, errInvalidWKB
+		}
+		pts := make([]point, n)
+		for i := range pts {
+			pts[i] = point{
+				math.Float64frombits(order.Uint64(b[pos:])),
+				math.Float64frombits(order.Uint64(b[pos+8:])),
+			}
+			pos += dims * 8
+		}
+		return pts, nil
+	}
+
+	switch typ {
+	case 1:
+		if pos+dims*8 > len(b) {
+			return geometry{}, 0, errInvalidWKB
+		}
+		p := point{math.Float64frombits(order.Uint64(b[pos:])), math.Float64frombits(order.Uint64(b[pos+8:]))}
+		pos += dims * 8
+		if math.IsNaN(p.x) { // empty point
+			return geometry{}, pos, nil
+		}
+		return geometry{typ: pointGeom, parts: [][]point{{p}}}, pos, nil
+	case 2:
+		pts, err := points()
+		if err != nil {
+			return geometry{}, 0, err
+		}
+		return geometry{typ: lineGeom, parts: [][]point{pts}}, pos, nil
+	case 3:
+		n, err := u32()
+		if err != nil {
+			return geometry{}, 0, err
+		}
+		g := geometry{typ: polygonGeom}
+		for i := 0; i < n; i++ {
+			ring, err := points()
+			if err != nil {
+				return geometry{}, 0, err
+			}
+			g.parts = append(g.parts, ring)
+		}
+		return g, pos, nil
+	case 4, 5, 6, 7:
+		n, err := u32()
+		if err != nil {
+			return geometry{}, 0, err
+		}
+		g := geometry{}
+		for i := 0; i < n; i++ {
+			if pos >= len(b) {
+				return geometry{}, 0, errInvalidWKB
+			}
+			m, l, err := member(b[pos:])
+			if err != nil {
+				return geometry{}, 0, err
+			}
+			pos += l
+			if g.typ == 0 || m.typ > g.typ {
+				// collections are rendered with the highest dimension
+				g.typ = m.typ
+			}
+			g.parts = append(g.parts, m.parts...)
+		}
+		return g, pos, nil
+	}
+	return geometry{}, 0, fmt.Errorf("unsupported geometry type %d", typ)
+}
+
+// parseSpatiaLite parses SpatiaLite geometry blobs. Compressed geometries
+// are not supported.
+func parseSpatiaLite(b []byte) (geometry, error) {
+	var order binary.ByteOrder = binary.BigEndian
+	if b[1] == 1 {
+		order = binary.LittleEndian
+	}
+	var member func(b []byte) (geometry, int, error)
+	parse := func(b []byte, pos int) (geometry, int, error) {
+		if pos+4 > len(b) {
+			return geometry{}, 0, errInvalidWKB
+		}
+		typ := order.Uint32(b[pos:])
+		pos += 4
+		dims := 2
+		switch typ / 1000 {
+		case 1, 2:
+			dims++
+		case 3:
+			dims += 2
+		}
+		if typ/1000 > 3 {
+			return geometry{}, 0, fmt.Errorf("unsupported SpatiaLite geometry type %d", typ)
+		}
+		return parseGeometryBody(b, pos, typ%1000, dims, order, member)
+	}
+	// collection members start with 0x69
+	member = func(b []byte) (geometry, int, error) {
+		if len(b) < 1 || b[0] != 0x69 {
+			return geometry{}, 0, errInvalidWKB
+		}
+		return parse(b, 1)
+	}
+	g, _, err := parse(b, 39)
+	return g, err
+}
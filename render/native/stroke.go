@@ -0,0 +1,227 @@
+package native
+
+import "math"
+
+// stroke describes the outline of lines.
+type stroke struct {
+	width      float64
+	cap        string // butt, round, square
+	join       string // miter, round, bevel
+	miterLimit float64
+	dash       []float64
+}
+
+// add adds the outline of the line to the rasterizer. The outline is
+// built from one quad for each segment, and joins and caps as separate
+// pieces.
+func (s stroke) add(r *rasterizer, line []point, closed bool) {
+	line = dedup(line)
+	if closed && len(line) > 1 && line[0] == line[len(line)-1] {
+		line = line[:len(line)-1]
+	}
+	if len(line) == 0 || s.width <= 0 {
+		return
+	}
+	if len(s.dash) > 0 {
+		if closed {
+			line = append(line, line[0])
+		}
+		for _, d := range dashes(line, s.dash) {
+			s.addLine(r, d, false)
+		}
+		return
+	}
+	s.addLine(r, line, closed)
+}
+
+func (s stroke) addLine(r *rasterizer, line []point, closed bool) {
+	hw := s.width / 2
+	if len(line) == 1 {
+		switch s.cap {
+		case "round":
+			r.convex(circle(line[0], hw))
+		case "square":
+			p := line[0]
+			r.convex([]point{{p.x - hw, p.y - hw}, {p.x + hw, p.y - hw}, {p.x + hw, p.y + hw}, {p.x - hw, p.y + hw}})
+		}
+		return
+	}
+
+	if !closed && s.cap == "square" {
+		line = append([]point{}, line...)
+		line[0] = extend(line[1], line[0], hw)
+		line[len(line)-1] = extend(line[len(line)-2], line[len(line)-1], hw)
+	}
+
+	n := len(line)
+	segs := n - 1
+	if closed {
+		segs = n
+	}
+	for i := 0; i < segs; i++ {
+		a, b := line[i], line[(i+1)%n]
+		nx, ny := normal(a, b, hw)
+		r.convex([]point{{a.x + nx, a.y + ny}, {b.x + nx, b.y + ny}, {b.x - nx, b.y - ny}, {a.x - nx, a.y - ny}})
+	}
+
+	// joins
+	for i := 0; i < n; i++ {
+		if !closed && (i == 0 || i == n-1) {
+			continue
+		}
+		s.addJoin(r, line[(i-1+n)%n], line[i], line[(i+1)%n])
+	}
+
+	if !closed && s.cap == "round" {
+		r.convex(circle(line[0], hw))
+		r.convex(circle(line[n-1], hw))
+	}
+}
+
+func (s stroke) addJoin(r *rasterizer, prev, p, next point) {
+	hw := s.width / 2
+	if s.join == "round" {
+		r.convex(circle(p, hw))
+		return
+	}
+	n0x, n0y := normal(prev, p, hw)
+	n1x, n1y := normal(p, next, hw)
+	// the outer side is opposite of the turn direction
+	turn := n0x*(next.x-p.x) + n0y*(next.y-p.y)
+	if turn == 0 {
+		return
+	}
+	if turn > 0 {
+		n0x, n0y, n1x, n1y = -n0x, -n0y, -n1x, -n1y
+	}
+	a := point{p.x + n0x, p.y + n0y}
+	b := point{p.x + n1x, p.y + n1y}
+	if s.join == "bevel" {
+		r.convex([]point{p, a, b})
+		return
+	}
+
+	// miter
+	mx, my := n0x+n1x, n0y+n1y
+	ml := math.Hypot(mx, my)
+	if ml == 0 {
+		return
+	}
+	// ratio of the miter length to the line width
+	cosHalf := (mx*n0x + my*n0y) / (ml * hw)
+	limit := s.miterLimit
+	if limit == 0 {
+		limit = 4
+	}
+	if cosHalf <= 0 || 1/cosHalf > limit {
+		r.convex([]point{p, a, b})
+		return
+	}
+	l := hw / cosHalf
+	m := point{p.x + mx/ml*l, p.y + my/ml*l}
+	r.convex([]point{p, a, m, b})
+}
+
+// normal returns the normal of the segment with length l.
+func normal(a, b point, l float64) (float64, float64) {
+	d := dist(a, b)
+	if d == 0 {
+		return 0, 0
+	}
+	return -(b.y - a.y) / d * l, (b.x - a.x) / d * l
+}
+
+// extend moves p away from the previous point by l.
+func extend(prev, p point, l float64) point {
+	d := dist(prev, p)
+	if d == 0 {
+		return p
+	}
+	return point{p.x + (p.x-prev.x)/d*l, p.y + (p.y-prev.y)/d*l}
+}
+
+// dedup removes consecutive duplicate points.
+func dedup(line []point) []point {
+	result := make([]point, 0, len(line))
+	for i, p := range line {
+		if i > 0 && p == result[len(result)-1] {
+			continue
+		}
+		result = append(result, p)
+	}
+	return result
+}
+
+// circle returns a polygon for a circle. The number of segments depends
+// on the radius.
+func circle(c point, radius float64) []point {
+	return ellipse(c, radius, radius)
+}
+
+func ellipse(c point, rx, ry float64) []point {
+	n := int(math.Max(rx, ry)*2) + 8
+	if n > 128 {
+		n = 128
+	}
+	pts := make([]point, n)
+	for i := range pts {
+		a := 2 * math.Pi * float64(i) / float64(n)
+		pts[i] = point{c.x + math.Cos(a)*rx, c.y + math.Sin(a)*ry}
+	}
+	return pts
+}
+
+// dashes splits the line into the dashes of the pattern (alternating
+// dash and gap lengths).
+func dashes(line []point, pattern []float64) [][]point {
+	if len(pattern)%2 == 1 {
+		pattern = append(pattern, pattern...)
+	}
+	total := 0.0
+	for _, v := range pattern {
+		total += v
+	}
+	if total <= 0 {
+		return [][]point{line}
+	}
+
+	var result [][]point
+	var current []point
+	idx := 0
+	left := pattern[0]
+	on := true
+	for i := 1; i < len(line); i++ {
+		a, b := line[i-1], line[i]
+		segLen := dist(a, b)
+		pos := 0.0
+		for segLen-pos > left {
+			pos += left
+			t := pos / segLen
+			p := point{a.x + t*(b.x-a.x), a.y + t*(b.y-a.y)}
+			if on {
+				if len(current) == 0 {
+					current = append(current, a)
+				}
+				current = append(current, p)
+				result = append(result, current)
+				current = nil
+			} else {
+				current = []point{p}
+			}
+			on = !on
+			idx = (idx + 1) % len(pattern)
+			left = pattern[idx]
+		}
+		left -= segLen - pos
+		if on {
+			if len(current) == 0 {
+				current = append(current, a)
+			}
+			current = append(current, b)
+		}
+	}
+	if on && len(current) > 1 {
+		result = append(result, current)
+	}
+	return result
+}
@@ -0,0 +1,260 @@
+package native
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/omniscale/magnacarto/mss"
+)
+
+// Map is the style of the native renderer. It is written by
+// builder/native as JSON and contains the evaluated rules of all layers.
+type Map struct {
+	BackgroundColor *Color  `json:"background_color,omitempty"`
+	Layers          []Layer `json:"layers"`
+}
+
+// Layer is a single map layer. Layers without datasource type (e.g.
+// unsupported datasources) are skipped.
+type Layer struct {
+	Name          string     `json:"name"`
+	EPSGCode      int        `json:"epsg_code"`
+	Datasource    Datasource `json:"datasource"`
+	MinScaleDenom float64    `json:"min_scale_denom,omitempty"`
+	MaxScaleDenom float64    `json:"max_scale_denom,omitempty"`
+	Styles        []Style    `json:"styles"`
+}
+
+// Datasource of a layer. Type is geojson, shape, sqlite, gpkg, csv or
+// image (PNG or JPEG with world file).
+type Datasource struct {
+	Type          string `json:"type"`
+	File          string `json:"file,omitempty"`
+	Table         string `json:"table,omitempty"`
+	GeometryField string `json:"geometry_field,omitempty"`
+	Inline        string `json:"inline,omitempty"`
+	Separator     string `json:"separator,omitempty"`
+}
+
+// Style contains the rules of one attachment. Only the first matching
+// rule is rendered for each feature.
+type Style struct {
+	Name    string   `json:"name"`
+	Opacity *float64 `json:"opacity,omitempty"`
+	Rules   []Rule   `json:"rules"`
+}
+
+// Rule is an evaluated mss.Rule. The rule is active for scale
+// denominators >= MinScaleDenom and < MaxScaleDenom (if not 0).
+type Rule struct {
+	MinScaleDenom float64      `json:"min_scale_denom,omitempty"`
+	MaxScaleDenom float64      `json:"max_scale_denom,omitempty"`
+	Filters       []Filter     `json:"filters,omitempty"`
+	Symbolizers   []Symbolizer `json:"symbolizers"`
+
+	filters []mss.Filter
+}
+
+// Filter is the serialized form of an mss.Filter. Value is nil, a string
+// or a number.
+type Filter struct {
+	Field  string      `json:"field"`
+	Op     string      `json:"op"`
+	Value  interface{} `json:"value"`
+	Modulo *Modulo     `json:"modulo,omitempty"`
+}
+
+// Modulo is the comparison of modulo filters, e.g. [field % 2 = 1].
+type Modulo struct {
+	Div   int    `json:"div"`
+	Op    string `json:"op"`
+	Value int    `json:"value"`
+}
+
+// NewFilter returns the serializable filter of f.
+func NewFilter(f mss.Filter) Filter {
+	if mod, ok := f.Value.(mss.ModuloComparsion); ok {
+		return Filter{
+			Field:  f.Field,
+			Op:     f.CompOp.String(),
+			Modulo: &Modulo{Div: mod.Div, Op: mod.CompOp.String(), Value: mod.Value},
+		}
+	}
+	return Filter{Field: f.Field, Op: f.CompOp.String(), Value: f.Value}
+}
+
+var compOps = make(map[string]mss.CompOp)
+
+func init() {
+	for _, op := range []mss.CompOp{mss.GT, mss.LT, mss.GTE, mss.LTE, mss.EQ, mss.NEQ, mss.REGEX, mss.MODULO} {
+		compOps[op.String()] = op
+	}
+}
+
+// Filter returns the mss.Filter of f.
+func (f Filter) Filter() (mss.Filter, error) {
+	op, ok := compOps[f.Op]
+	if !ok {
+		return mss.Filter{}, fmt.Errorf("unknown filter operator '%s'", f.Op)
+	}
+	if op == mss.MODULO {
+		if f.Modulo == nil {
+			return mss.Filter{}, fmt.Errorf("missing modulo for filter on '%s'", f.Field)
+		}
+		modOp, ok := compOps[f.Modulo.Op]
+		if !ok {
+			return mss.Filter{}, fmt.Errorf("unknown filter operator '%s'", f.Modulo.Op)
+		}
+		return mss.Filter{Field: f.Field, CompOp: op, Value: mss.ModuloComparsion{Div: f.Modulo.Div, CompOp: modOp, Value: f.Modulo.Value}}, nil
+	}
+	switch f.Value.(type) {
+	case nil, string, float64:
+	default:
+		return mss.Filter{}, fmt.Errorf("invalid value for filter on '%s': %v", f.Field, f.Value)
+	}
+	return mss.Filter{Field: f.Field, CompOp: op, Value: f.Value}, nil
+}
+
+// Symbolizer types.
+const (
+	PolygonSymbolizer        = "polygon"
+	PolygonPatternSymbolizer = "polygon-pattern"
+	LineSymbolizer           = "line"
+	MarkerSymbolizer         = "marker"
+	PointSymbolizer          = "point"
+	TextSymbolizer           = "text"
+	DotSymbolizer            = "dot"
+	RasterSymbolizer         = "raster"
+)
+
+// Symbolizer describes how features are drawn. Sizes are in pixels and
+// already include the scale factor of the layer.
+type Symbolizer struct {
+	Type string `json:"type"`
+
+	// Color is the fill color of polygons, markers, dots and texts and the
+	// stroke color of lines.
+	Color   *Color   `json:"color,omitempty"`
+	Opacity *float64 `json:"opacity,omitempty"`
+
+	// Width of lines, markers and dots.
+	Width  *float64 `json:"width,omitempty"`
+	Height *float64 `json:"height,omitempty"`
+
+	Dasharray  []float64 `json:"dasharray,omitempty"`
+	Cap        string    `json:"cap,omitempty"`
+	Join       string    `json:"join,omitempty"`
+	MiterLimit *float64  `json:"miter_limit,omitempty"`
+
+	// File is the PNG or JPEG image of markers, points and patterns.
+	File string `json:"file,omitempty"`
+
+	MarkerType    string   `json:"marker_type,omitempty"`
+	FillOpacity   *float64 `json:"fill_opacity,omitempty"`
+	Stroke        *Color   `json:"stroke,omitempty"`
+	StrokeWidth   *float64 `json:"stroke_width,omitempty"`
+	StrokeOpacity *float64 `json:"stroke_opacity,omitempty"`
+	Spacing       *float64 `json:"spacing,omitempty"`
+
+	Placement       string `json:"placement,omitempty"`
+	AllowOverlap    bool   `json:"allow_overlap,omitempty"`
+	IgnorePlacement bool   `json:"ignore_placement,omitempty"`
+
+	// Text is the label expression as list of fields and strings.
+	Text                []TextPart `json:"text,omitempty"`
+	Fonts               []FontFace `json:"fonts,omitempty"`
+	Size                float64    `json:"size,omitempty"`
+	HaloFill            *Color     `json:"halo_fill,omitempty"`
+	HaloRadius          float64    `json:"halo_radius,omitempty"`
+	Dx                  float64    `json:"dx,omitempty"`
+	Dy                  float64    `json:"dy,omitempty"`
+	WrapWidth           float64    `json:"wrap_width,omitempty"`
+	TextTransform       string     `json:"text_transform,omitempty"`
+	HorizontalAlignment string     `json:"horizontal_alignment,omitempty"`
+	AvoidEdges          bool       `json:"avoid_edges,omitempty"`
+	MinDistance         float64    `json:"min_distance,omitempty"`
+}
+
+// TextPart is either a field name or a literal text.
+type TextPart struct {
+	Field string `json:"field,omitempty"`
+	Text  string `json:"text,omitempty"`
+}
+
+// FontFace is a font of a font set. File is empty if the font was not
+// found. Index selects the font of a TrueType collection.
+type FontFace struct {
+	Name  string `json:"name"`
+	File  string `json:"file,omitempty"`
+	Index int    `json:"index,omitempty"`
+}
+
+// Color is a non-premultiplied RGBA color. It is encoded as #rrggbbaa.
+type Color [4]uint8
+
+func (c Color) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("#%02x%02x%02x%02x", c[0], c[1], c[2], c[3])), nil
+}
+
+func (c *Color) UnmarshalText(text []byte) error {
+	s := string(text)
+	if len(s) != 9 || s[0] != '#' {
+		return fmt.Errorf("invalid color '%s'", s)
+	}
+	for i := 0; i < 4; i++ {
+		v, err := strconv.ParseUint(s[1+i*2:3+i*2], 16, 8)
+		if err != nil {
+			return fmt.Errorf("invalid color '%s'", s)
+		}
+		c[i] = uint8(v)
+	}
+	return nil
+}
+
+// LoadMap reads the JSON style from fname.
+func LoadMap(fname string) (*Map, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m := &Map{}
+	if err := json.NewDecoder(f).Decode(m); err != nil {
+		return nil, fmt.Errorf("decoding %s: %v", fname, err)
+	}
+	for i := range m.Layers {
+		for j := range m.Layers[i].Styles {
+			rules := m.Layers[i].Styles[j].Rules
+			for k := range rules {
+				for _, f := range rules[k].Filters {
+					filter, err := f.Filter()
+					if err != nil {
+						return nil, fmt.Errorf("decoding %s: %v", fname, err)
+					}
+					rules[k].filters = append(rules[k].filters, filter)
+				}
+			}
+		}
+	}
+	return m, nil
+}
+
+// matches returns whether the rule is active for scaleDenom and matches
+// the attrs.
+func (r *Rule) matches(attrs map[string]interface{}, scaleDenom float64) bool {
+	if !inScale(scaleDenom, r.MinScaleDenom, r.MaxScaleDenom) {
+		return false
+	}
+	for _, f := range r.filters {
+		if !f.Matches(attrs) {
+			return false
+		}
+	}
+	return true
+}
+
+func inScale(scaleDenom, min, max float64) bool {
+	return scaleDenom >= min && (max == 0 || scaleDenom < max)
+}
@@ -0,0 +1,157 @@
+package native
+
+import (
+	"strings"
+	"unicode"
+)
+
+// fontSet is a list of fonts. Glyphs missing in the first font are taken
+// from the following fonts.
+type fontSet []*font
+
+func (fs fontSet) glyph(r rune) (*font, int) {
+	for _, f := range fs {
+		if g := f.glyphIndex(r); g != 0 {
+			return f, g
+		}
+	}
+	return fs[0], 0
+}
+
+type placedGlyph struct {
+	font  *font
+	glyph int
+	// x is the left position of the glyph and y the baseline, relative to
+	// the top left of the text box
+	x, y float64
+}
+
+// textLayout is a multi-line text with a size in pixels.
+type textLayout struct {
+	glyphs        []placedGlyph
+	size          float64
+	width, height float64
+}
+
+// layoutText places all glyphs of the text. Lines are wrapped at spaces
+// if wrapWidth is set and are centered.
+func layoutText(fs fontSet, text string, size, wrapWidth float64) textLayout {
+	f := fs[0]
+	scale := size / f.unitsPerEm
+	lineHeight := (f.ascent - f.descent + f.lineGap) * scale
+
+	advance := func(s string) float64 {
+		w := 0.0
+		for _, r := range s {
+			gf, g := fs.glyph(r)
+			w += gf.advance(g) * size / gf.unitsPerEm
+		}
+		return w
+	}
+
+	var lines []string
+	for _, para := range strings.Split(text, "\n") {
+		if wrapWidth <= 0 {
+			lines = append(lines, para)
+			continue
+		}
+		line := ""
+		for _, word := range strings.Fields(para) {
+			if line != "" && advance(line+" "+word) > wrapWidth {
+				lines = append(lines, line)
+				line = word
+				continue
+			}
+			if line != "" {
+				line += " "
+			}
+			line += word
+		}
+		lines = append(lines, line)
+	}
+
+	l := textLayout{size: size}
+	for _, line := range lines {
+		if w := advance(line); w > l.width {
+			l.width = w
+		}
+	}
+	for i, line := range lines {
+		x := (l.width - advance(line)) / 2
+		y := float64(i)*lineHeight + f.ascent*scale
+		for _, r := range line {
+			gf, g := fs.glyph(r)
+			l.glyphs = append(l.glyphs, placedGlyph{font: gf, glyph: g, x: x, y: y})
+			x += gf.advance(g) * size / gf.unitsPerEm
+		}
+	}
+	l.height = float64(len(lines)) * lineHeight
+	return l
+}
+
+// contours returns the glyph outlines of the text in pixel coordinates
+// with the top left of the text box at x, y.
+func (l textLayout) contours(x, y float64) [][]point {
+	var result [][]point
+	for _, g := range l.glyphs {
+		scale := l.size / g.font.unitsPerEm
+		for _, c := range g.font.outline(g.glyph) {
+			pts := make([]point, len(c))
+			for i, p := range c {
+				pts[i] = point{x + g.x + p.x*scale, y + g.y - p.y*scale}
+			}
+			result = append(result, pts)
+		}
+	}
+	return result
+}
+
+func transformText(s, transform string) string {
+	switch transform {
+	case "uppercase":
+		return strings.ToUpper(s)
+	case "lowercase":
+		return strings.ToLower(s)
+	case "capitalize":
+		prev := ' '
+		return strings.Map(func(r rune) rune {
+			if unicode.IsSpace(prev) {
+				r = unicode.ToTitle(r)
+			}
+			prev = r
+			return r
+		}, s)
+	}
+	return s
+}
+
+// rect is a bounding box in pixels.
+type rect struct {
+	minx, miny, maxx, maxy float64
+}
+
+func (r rect) intersects(o rect) bool {
+	return r.minx < o.maxx && r.maxx > o.minx && r.miny < o.maxy && r.maxy > o.miny
+}
+
+func (r rect) grow(d float64) rect {
+	return rect{r.minx - d, r.miny - d, r.maxx + d, r.maxy + d}
+}
+
+// collisions keeps track of all placed labels and markers.
+type collisions struct {
+	rects []rect
+}
+
+func (c *collisions) collides(r rect) bool {
+	for _, o := range c.rects {
+		if o.intersects(r) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *collisions) insert(r rect) {
+	c.rects = append(c.rects, r)
+}
@@ -10,4 +10,7 @@ type Request struct {
 	Format      string
 	ScaleFactor float64
 	BGColor     *color.NRGBA
+	// Layers limits rendering to these layers. All layers are rendered
+	// if empty.
+	Layers []string
 }
@@ -0,0 +1,158 @@
+package tiles
+
+import (
+	"container/list"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache stores encoded tiles.
+type Cache interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, data []byte) error
+}
+
+// MemoryCache keeps the most recently used tiles in memory.
+type MemoryCache struct {
+	mu      sync.Mutex
+	limit   int
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type memoryEntry struct {
+	key  string
+	data []byte
+}
+
+// NewMemoryCache returns a cache for up to limit tiles.
+func NewMemoryCache(limit int) *MemoryCache {
+	return &MemoryCache{
+		limit:   limit,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func (c *MemoryCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*memoryEntry).data, true
+}
+
+func (c *MemoryCache) Set(key string, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*memoryEntry).data = data
+		c.lru.MoveToFront(e)
+		return nil
+	}
+	c.entries[key] = c.lru.PushFront(&memoryEntry{key: key, data: data})
+	for c.lru.Len() > c.limit {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.entries, e.Value.(*memoryEntry).key)
+	}
+	return nil
+}
+
+// DiskCache stores tiles as files. Keys are used as relative paths.
+// Tiles older than maxAge are treated as missing and removed by Prune.
+type DiskCache struct {
+	dir    string
+	maxAge time.Duration
+}
+
+// NewDiskCache returns a cache that stores all tiles in dir. Tiles expire
+// after maxAge, a maxAge of 0 keeps all tiles.
+func NewDiskCache(dir string, maxAge time.Duration) *DiskCache {
+	return &DiskCache{dir: dir, maxAge: maxAge}
+}
+
+func (c *DiskCache) expired(fi os.FileInfo) bool {
+	return c.maxAge > 0 && time.Since(fi.ModTime()) > c.maxAge
+}
+
+func (c *DiskCache) Get(key string) ([]byte, bool) {
+	fname := filepath.Join(c.dir, filepath.FromSlash(key))
+	fi, err := os.Stat(fname)
+	if err != nil || c.expired(fi) {
+		return nil, false
+	}
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, false
+	}
+	return data, true
+}
+
+func (c *DiskCache) Set(key string, data []byte) error {
+	fname := filepath.Join(c.dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+		return err
+	}
+	// write to temp file first, to prevent reads of incomplete tiles
+	tmp := fname + tmpSuffix + strconv.Itoa(os.Getpid())
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, fname); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+const tmpSuffix = ".tmp-"
+
+// Prune removes all expired tiles and empty directories from the cache.
+// Tiles of changed styles are stored with a new style key, so Prune also
+// removes the tiles of all previous style versions once they expire.
+func (c *DiskCache) Prune() error {
+	if c.maxAge <= 0 {
+		return nil
+	}
+	var dirs []string
+	err := filepath.Walk(c.dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if fi.IsDir() {
+			if path != c.dir {
+				dirs = append(dirs, path)
+			}
+			return nil
+		}
+		if !strings.HasSuffix(path, ".png") && !strings.Contains(path, tmpSuffix) {
+			return nil
+		}
+		if c.expired(fi) {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// remove empty dirs, deepest first; fails for dirs that are not empty
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Remove(dirs[i])
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package tiles
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"log"
+	"sync"
+
+	"github.com/omniscale/magnacarto/render"
+)
+
+// RenderFunc renders a map request as PNG into w. The Format of the
+// request is empty and needs to be set to a PNG format of the renderer.
+type RenderFunc func(req render.Request, w io.Writer) error
+
+// Renderer renders tiles as metatiles and caches all resulting tiles.
+// Concurrent requests for tiles of the same metatile are rendered once.
+type Renderer struct {
+	cache    Cache
+	metaSize int
+	buffer   int
+
+	mu         sync.Mutex
+	inProgress map[string]*metaTileCall
+}
+
+type metaTileCall struct {
+	wg    sync.WaitGroup
+	tiles map[Tile][]byte
+	err   error
+}
+
+// NewRenderer returns a Renderer for metatiles of metaSize x metaSize
+// tiles. Metatiles are rendered with an additional buffer of buffer pixels
+// (for 256 pixel tiles) on each side, to prevent cut off labels and symbols
+// at the metatile edges.
+func NewRenderer(cache Cache, metaSize int, buffer int) *Renderer {
+	if buffer < 0 {
+		buffer = 0
+	}
+	return &Renderer{
+		cache:      cache,
+		metaSize:   metaSize,
+		buffer:     buffer,
+		inProgress: make(map[string]*metaTileCall),
+	}
+}
+
+func cacheKey(styleKey string, scale int, t Tile) string {
+	return fmt.Sprintf("%s/%d/%d/%d/%d.png", styleKey, scale, t.Z, t.X, t.Y)
+}
+
+// Tile returns the PNG encoded tile for the style. styleKey identifies the
+// style and needs to change whenever the style changes (see StyleKey).
+// Tiles are rendered with scale x 256 pixels.
+func (r *Renderer) Tile(styleKey string, t Tile, scale int, renderFunc RenderFunc) ([]byte, error) {
+	if !t.Valid() {
+		return nil, fmt.Errorf("invalid tile %s", t)
+	}
+	if scale < 1 {
+		scale = 1
+	}
+	if data, ok := r.cache.Get(cacheKey(styleKey, scale, t)); ok {
+		return data, nil
+	}
+
+	mt := NewMetaTile(t, r.metaSize)
+	key := fmt.Sprintf("%s/%d/%s", styleKey, scale, mt)
+
+	r.mu.Lock()
+	if c, ok := r.inProgress[key]; ok {
+		r.mu.Unlock()
+		c.wg.Wait()
+		if c.err != nil {
+			return nil, c.err
+		}
+		return c.tiles[t], nil
+	}
+	c := &metaTileCall{}
+	c.wg.Add(1)
+	r.inProgress[key] = c
+	r.mu.Unlock()
+
+	c.tiles, c.err = r.renderMetaTile(styleKey, mt, scale, renderFunc)
+	c.wg.Done()
+
+	r.mu.Lock()
+	delete(r.inProgress, key)
+	r.mu.Unlock()
+
+	if c.err != nil {
+		return nil, c.err
+	}
+	return c.tiles[t], nil
+}
+
+func (r *Renderer) renderMetaTile(styleKey string, mt MetaTile, scale int, renderFunc RenderFunc) (map[Tile][]byte, error) {
+	tileSize := TileSize * scale
+	buffer := r.buffer * scale
+
+	bbox := mt.Bounds()
+	res := (bbox[2] - bbox[0]) / float64(mt.Width*tileSize)
+	bbox[0] -= float64(buffer) * res
+	bbox[1] -= float64(buffer) * res
+	bbox[2] += float64(buffer) * res
+	bbox[3] += float64(buffer) * res
+
+	req := render.Request{
+		Width:       mt.Width*tileSize + 2*buffer,
+		Height:      mt.Height*tileSize + 2*buffer,
+		BBOX:        bbox,
+		EPSGCode:    3857,
+		ScaleFactor: float64(scale),
+	}
+	buf := bytes.Buffer{}
+	if err := renderFunc(req, &buf); err != nil {
+		return nil, err
+	}
+	img, err := png.Decode(&buf)
+	if err != nil {
+		return nil, fmt.Errorf("decoding metatile %s: %v", mt, err)
+	}
+	if buffer > 0 {
+		sub, ok := img.(interface {
+			SubImage(image.Rectangle) image.Image
+		})
+		if !ok {
+			return nil, fmt.Errorf("unable to remove buffer from metatile %s", mt)
+		}
+		b := img.Bounds()
+		img = sub.SubImage(image.Rect(b.Min.X+buffer, b.Min.Y+buffer, b.Max.X-buffer, b.Max.Y-buffer))
+	}
+	tiles, err := mt.Split(img, tileSize)
+	if err != nil {
+		return nil, err
+	}
+	for t, data := range tiles {
+		if err := r.cache.Set(cacheKey(styleKey, scale, t), data); err != nil {
+			log.Printf("caching tile %s: %v", t, err)
+		}
+	}
+	return tiles, nil
+}
@@ -0,0 +1,136 @@
+// Package tiles renders XYZ tiles in Web Mercator with metatiling and
+// caching.
+package tiles
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/draw"
+	"image/png"
+	"math"
+	"os"
+)
+
+// TileSize is the size of tiles in pixel (without scale factor).
+const TileSize = 256
+
+// maxExtent is half the width of the Web Mercator projection in meters.
+const maxExtent = 20037508.342789244
+
+// Tile is an XYZ tile with the origin in the upper left.
+type Tile struct {
+	Z, X, Y int
+}
+
+// Valid returns whether the tile is within the grid of its zoom level.
+func (t Tile) Valid() bool {
+	if t.Z < 0 || t.Z > 30 {
+		return false
+	}
+	n := 1 << uint(t.Z)
+	return t.X >= 0 && t.Y >= 0 && t.X < n && t.Y < n
+}
+
+// Bounds returns the Web Mercator bounds (minx, miny, maxx, maxy) of the
+// tile.
+func (t Tile) Bounds() [4]float64 {
+	return MetaTile{Z: t.Z, X: t.X, Y: t.Y, Width: 1, Height: 1}.Bounds()
+}
+
+func (t Tile) String() string {
+	return fmt.Sprintf("%d/%d/%d", t.Z, t.X, t.Y)
+}
+
+// MetaTile is a block of Width x Height tiles that are rendered with a
+// single request. X and Y are the coordinates of the upper left tile.
+type MetaTile struct {
+	Z, X, Y       int
+	Width, Height int
+}
+
+// NewMetaTile returns the metatile of size x size tiles that contains t.
+// Metatiles are aligned to multiples of size and clipped at the grid
+// boundary.
+func NewMetaTile(t Tile, size int) MetaTile {
+	if size < 1 {
+		size = 1
+	}
+	n := 1 << uint(t.Z)
+	m := MetaTile{
+		Z:      t.Z,
+		X:      t.X - t.X%size,
+		Y:      t.Y - t.Y%size,
+		Width:  size,
+		Height: size,
+	}
+	if m.X+m.Width > n {
+		m.Width = n - m.X
+	}
+	if m.Y+m.Height > n {
+		m.Height = n - m.Y
+	}
+	return m
+}
+
+// Bounds returns the Web Mercator bounds (minx, miny, maxx, maxy) of the
+// metatile.
+func (m MetaTile) Bounds() [4]float64 {
+	res := 2 * maxExtent / math.Pow(2, float64(m.Z))
+	return [4]float64{
+		-maxExtent + float64(m.X)*res,
+		maxExtent - float64(m.Y+m.Height)*res,
+		-maxExtent + float64(m.X+m.Width)*res,
+		maxExtent - float64(m.Y)*res,
+	}
+}
+
+// Tiles returns all tiles of the metatile.
+func (m MetaTile) Tiles() []Tile {
+	tiles := make([]Tile, 0, m.Width*m.Height)
+	for y := m.Y; y < m.Y+m.Height; y++ {
+		for x := m.X; x < m.X+m.Width; x++ {
+			tiles = append(tiles, Tile{Z: m.Z, X: x, Y: y})
+		}
+	}
+	return tiles
+}
+
+func (m MetaTile) String() string {
+	return fmt.Sprintf("%d/%d/%d/%dx%d", m.Z, m.X, m.Y, m.Width, m.Height)
+}
+
+// Split slices the rendered image of the metatile into PNG encoded tiles
+// of tileSize x tileSize pixels.
+func (m MetaTile) Split(img image.Image, tileSize int) (map[Tile][]byte, error) {
+	b := img.Bounds()
+	if b.Dx() != m.Width*tileSize || b.Dy() != m.Height*tileSize {
+		return nil, fmt.Errorf("metatile image %dx%d does not match %s with %dpx tiles", b.Dx(), b.Dy(), m, tileSize)
+	}
+	result := make(map[Tile][]byte, m.Width*m.Height)
+	for _, t := range m.Tiles() {
+		x0 := b.Min.X + (t.X-m.X)*tileSize
+		y0 := b.Min.Y + (t.Y-m.Y)*tileSize
+		tile := image.NewNRGBA(image.Rect(0, 0, tileSize, tileSize))
+		draw.Draw(tile, tile.Bounds(), img, image.Pt(x0, y0), draw.Src)
+		buf := bytes.Buffer{}
+		if err := png.Encode(&buf, tile); err != nil {
+			return nil, err
+		}
+		result[t] = buf.Bytes()
+	}
+	return result, nil
+}
+
+// StyleKey returns a key for the style file and its modification time.
+// Tiles of changed styles get a new key.
+func StyleKey(styleFile string, renderer string) (string, error) {
+	fi, err := os.Stat(styleFile)
+	if err != nil {
+		return "", err
+	}
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s\x00%s\x00%d", renderer, styleFile, fi.ModTime().UnixNano())
+	return fmt.Sprintf("%016x", h.Sum64()), nil
+}
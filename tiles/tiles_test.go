@@ -0,0 +1,203 @@
+package tiles
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/omniscale/magnacarto/render"
+	"github.com/stretchr/testify/assert"
+)
+
+func slice(b [4]float64) []float64 {
+	return b[:]
+}
+
+func TestTileBounds(t *testing.T) {
+	assert.InDeltaSlice(t, []float64{-maxExtent, -maxExtent, maxExtent, maxExtent}, slice(Tile{0, 0, 0}.Bounds()), 1e-6)
+	assert.InDeltaSlice(t, []float64{-maxExtent, 0, 0, maxExtent}, slice(Tile{1, 0, 0}.Bounds()), 1e-6)
+	assert.InDeltaSlice(t, []float64{0, -maxExtent, maxExtent, 0}, slice(Tile{1, 1, 1}.Bounds()), 1e-6)
+
+	assert.True(t, Tile{2, 3, 3}.Valid())
+	assert.False(t, Tile{2, 4, 0}.Valid())
+	assert.False(t, Tile{2, 0, -1}.Valid())
+}
+
+func TestMetaTile(t *testing.T) {
+	assert.Equal(t, MetaTile{Z: 5, X: 4, Y: 8, Width: 4, Height: 4}, NewMetaTile(Tile{5, 7, 9}, 4))
+	// clipped at grid boundary
+	assert.Equal(t, MetaTile{Z: 1, X: 0, Y: 0, Width: 2, Height: 2}, NewMetaTile(Tile{1, 1, 0}, 4))
+	assert.Equal(t, MetaTile{Z: 3, X: 6, Y: 0, Width: 2, Height: 3}, NewMetaTile(Tile{3, 7, 1}, 3))
+
+	mt := NewMetaTile(Tile{2, 1, 2}, 2)
+	assert.Equal(t, []Tile{{2, 0, 2}, {2, 1, 2}, {2, 0, 3}, {2, 1, 3}}, mt.Tiles())
+	assert.InDeltaSlice(t, []float64{-maxExtent, -maxExtent, 0, 0}, slice(mt.Bounds()), 1e-6)
+}
+
+func metaTileImage(mt MetaTile, tileSize int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, mt.Width*tileSize, mt.Height*tileSize))
+	for y := 0; y < mt.Height; y++ {
+		for x := 0; x < mt.Width; x++ {
+			c := color.NRGBA{uint8(x * 50), uint8(y * 50), 0, 255}
+			for py := 0; py < tileSize; py++ {
+				for px := 0; px < tileSize; px++ {
+					img.Set(x*tileSize+px, y*tileSize+py, c)
+				}
+			}
+		}
+	}
+	return img
+}
+
+func TestSplit(t *testing.T) {
+	mt := MetaTile{Z: 3, X: 2, Y: 4, Width: 2, Height: 2}
+	result, err := mt.Split(metaTileImage(mt, 16), 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, result, 4)
+	img, err := png.Decode(bytes.NewReader(result[Tile{3, 3, 4}]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, image.Rect(0, 0, 16, 16), img.Bounds())
+	assert.Equal(t, color.NRGBA{50, 0, 0, 255}, color.NRGBAModel.Convert(img.At(8, 8)))
+
+	_, err = mt.Split(metaTileImage(mt, 16), 32)
+	assert.Error(t, err)
+}
+
+func TestMemoryCache(t *testing.T) {
+	c := NewMemoryCache(2)
+	c.Set("a", []byte("a"))
+	c.Set("b", []byte("b"))
+	c.Get("a")
+	c.Set("c", []byte("c"))
+
+	_, ok := c.Get("b")
+	assert.False(t, ok)
+	data, ok := c.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, []byte("a"), data)
+	_, ok = c.Get("c")
+	assert.True(t, ok)
+}
+
+func TestDiskCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magnacarto-tiles-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := NewDiskCache(dir, time.Hour)
+	_, ok := c.Get("style/1/2/3/4.png")
+	assert.False(t, ok)
+	assert.NoError(t, c.Set("style/1/2/3/4.png", []byte("tile")))
+	data, ok := c.Get("style/1/2/3/4.png")
+	assert.True(t, ok)
+	assert.Equal(t, []byte("tile"), data)
+
+	// expire tiles of the old style
+	assert.NoError(t, c.Set("old/1/2/3/4.png", []byte("tile")))
+	old := time.Now().Add(-2 * time.Hour)
+	assert.NoError(t, os.Chtimes(filepath.Join(dir, "old/1/2/3/4.png"), old, old))
+	_, ok = c.Get("old/1/2/3/4.png")
+	assert.False(t, ok)
+
+	assert.NoError(t, c.Prune())
+	_, err = os.Stat(filepath.Join(dir, "old"))
+	assert.True(t, os.IsNotExist(err))
+	_, ok = c.Get("style/1/2/3/4.png")
+	assert.True(t, ok)
+}
+
+func TestRenderer(t *testing.T) {
+	var calls int32
+	var reqs []render.Request
+	var mu sync.Mutex
+	renderFunc := func(req render.Request, w io.Writer) error {
+		atomic.AddInt32(&calls, 1)
+		mu.Lock()
+		reqs = append(reqs, req)
+		mu.Unlock()
+		mt := MetaTile{Width: req.Width / 512, Height: req.Height / 512}
+		return png.Encode(w, metaTileImage(mt, 512))
+	}
+
+	r := NewRenderer(NewMemoryCache(100), 4, 0)
+	wg := sync.WaitGroup{}
+	for x := 4; x < 8; x++ {
+		for y := 0; y < 4; y++ {
+			wg.Add(1)
+			go func(x, y int) {
+				defer wg.Done()
+				data, err := r.Tile("style", Tile{3, x, y}, 2, renderFunc)
+				assert.NoError(t, err)
+				assert.NotEmpty(t, data)
+			}(x, y)
+		}
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), calls)
+
+	assert.Equal(t, 2048, reqs[0].Width)
+	assert.Equal(t, 2048, reqs[0].Height)
+	assert.Equal(t, 2.0, reqs[0].ScaleFactor)
+	assert.Equal(t, 3857, reqs[0].EPSGCode)
+	assert.InDeltaSlice(t, []float64{0, 0, maxExtent, maxExtent}, slice(reqs[0].BBOX), 1e-6)
+
+	// cached
+	_, err := r.Tile("style", Tile{3, 5, 1}, 2, renderFunc)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), calls)
+
+	// new style key
+	_, err = r.Tile("style2", Tile{3, 5, 1}, 2, renderFunc)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), calls)
+
+	_, err = r.Tile("style", Tile{3, 8, 1}, 1, renderFunc)
+	assert.Error(t, err)
+}
+
+func TestRendererBuffer(t *testing.T) {
+	var reqs []render.Request
+	renderFunc := func(req render.Request, w io.Writer) error {
+		reqs = append(reqs, req)
+		img := image.NewNRGBA(image.Rect(0, 0, req.Width, req.Height))
+		draw.Draw(img, img.Bounds(), &image.Uniform{color.NRGBA{255, 0, 0, 255}}, image.ZP, draw.Src)
+		// only the buffer is red
+		draw.Draw(img, image.Rect(64, 64, req.Width-64, req.Height-64), &image.Uniform{color.NRGBA{0, 0, 255, 255}}, image.ZP, draw.Src)
+		return png.Encode(w, img)
+	}
+
+	r := NewRenderer(NewMemoryCache(100), 2, 32)
+	data, err := r.Tile("style", Tile{2, 1, 0}, 2, renderFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1024+128, reqs[0].Width)
+	assert.Equal(t, 1024+128, reqs[0].Height)
+	buffer := maxExtent / 1024 * 64
+	assert.InDeltaSlice(t, []float64{-maxExtent - buffer, -buffer, buffer, maxExtent + buffer}, slice(reqs[0].BBOX), 1e-6)
+
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, image.Rect(0, 0, 512, 512), img.Bounds())
+	for _, p := range []image.Point{{0, 0}, {511, 0}, {0, 511}, {511, 511}} {
+		assert.Equal(t, color.NRGBA{0, 0, 255, 255}, color.NRGBAModel.Convert(img.At(p.X, p.Y)))
+	}
+}
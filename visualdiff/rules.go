@@ -0,0 +1,219 @@
+// Package visualdiff compares two versions of a style. It renders the
+// same views with both versions, compares the images with imgdiff and
+// lists all rules with changed properties.
+package visualdiff
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/omniscale/magnacarto/mml"
+	"github.com/omniscale/magnacarto/mss"
+)
+
+// Change is the type of a RuleChange.
+type Change string
+
+const (
+	Added   Change = "added"
+	Removed Change = "removed"
+	Changed Change = "changed"
+)
+
+// RuleChange is a rule that was added, removed or that has changed
+// properties. Rules are identified by layer, attachment, class, zoom
+// and filters.
+type RuleChange struct {
+	Change     Change           `json:"change"`
+	Layer      string           `json:"layer"`
+	Attachment string           `json:"attachment,omitempty"`
+	Class      string           `json:"class,omitempty"`
+	Zoom       string           `json:"zoom"`
+	Filters    []string         `json:"filters"`
+	Properties []PropertyChange `json:"properties"`
+}
+
+// PropertyChange is a property with a different value. Old is empty for
+// added and New is empty for removed properties.
+type PropertyChange struct {
+	Name     string `json:"name"`
+	Instance string `json:"instance,omitempty"`
+	Old      string `json:"old,omitempty"`
+	New      string `json:"new,omitempty"`
+}
+
+// LoadStyle parses the MML file and all MSS files of the MML.
+func LoadStyle(mmlFile string) (*mml.MML, *mss.MSS, error) {
+	f, err := os.Open(mmlFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	m, err := mml.Parse(f)
+	f.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+	carto := mss.New()
+	for _, s := range m.Stylesheets {
+		if err := carto.ParseFile(filepath.Join(filepath.Dir(mmlFile), s)); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := carto.Evaluate(); err != nil {
+		return nil, nil, err
+	}
+	return m, carto.MSS(), nil
+}
+
+// ChangedRules loads both MML files with all MSS files and returns the
+// changed rules, see CompareRules.
+func ChangedRules(mmlA, mmlB string) ([]RuleChange, error) {
+	a, styleA, err := LoadStyle(mmlA)
+	if err != nil {
+		return nil, err
+	}
+	b, styleB, err := LoadStyle(mmlB)
+	if err != nil {
+		return nil, err
+	}
+	return CompareRules(a, styleA, b, styleB), nil
+}
+
+// CompareRules returns all rules of the layers of a and b that were
+// added, removed or changed from a to b. Changes are in the order of the
+// layers and rules of b, followed by the removed rules and layers of a.
+func CompareRules(a *mml.MML, styleA *mss.MSS, b *mml.MML, styleB *mss.MSS) []RuleChange {
+	layersA := make(map[string]mml.Layer, len(a.Layers))
+	for _, l := range a.Layers {
+		layersA[l.ID] = l
+	}
+
+	changes := []RuleChange{}
+	seen := make(map[string]bool)
+	for _, l := range b.Layers {
+		if seen[l.ID] {
+			continue
+		}
+		seen[l.ID] = true
+		rulesB := styleB.LayerRules(l.ID, l.Classes...)
+		var rulesA []mss.Rule
+		if la, ok := layersA[l.ID]; ok {
+			rulesA = styleA.LayerRules(la.ID, la.Classes...)
+		}
+		changes = append(changes, compareLayerRules(rulesA, rulesB)...)
+	}
+	for _, l := range a.Layers {
+		if seen[l.ID] {
+			continue
+		}
+		seen[l.ID] = true
+		changes = append(changes, compareLayerRules(styleA.LayerRules(l.ID, l.Classes...), nil)...)
+	}
+	return changes
+}
+
+func compareLayerRules(rulesA, rulesB []mss.Rule) []RuleChange {
+	byKey := make(map[string]*mss.Rule, len(rulesA))
+	var keysA []string
+	for i, key := range ruleKeys(rulesA) {
+		byKey[key] = &rulesA[i]
+		keysA = append(keysA, key)
+	}
+
+	var changes []RuleChange
+	for i, key := range ruleKeys(rulesB) {
+		rb := &rulesB[i]
+		ra, ok := byKey[key]
+		if !ok {
+			changes = append(changes, newRuleChange(Added, rb, nil, rb.Properties))
+			continue
+		}
+		delete(byKey, key)
+		if c := newRuleChange(Changed, rb, ra.Properties, rb.Properties); len(c.Properties) > 0 {
+			changes = append(changes, c)
+		}
+	}
+	for _, key := range keysA {
+		if ra, ok := byKey[key]; ok {
+			changes = append(changes, newRuleChange(Removed, ra, ra.Properties, nil))
+		}
+	}
+	return changes
+}
+
+// ruleKeys returns unique keys of all rules. Rules with the same
+// attachment, class, zoom and filters are numbered in their order.
+func ruleKeys(rules []mss.Rule) []string {
+	keys := make([]string, len(rules))
+	count := make(map[string]int)
+	for i, r := range rules {
+		parts := []string{r.Attachment, r.Class, r.Zoom.String()}
+		for _, f := range r.Filters {
+			parts = append(parts, f.String())
+		}
+		key := strings.Join(parts, "\x00")
+		count[key]++
+		keys[i] = fmt.Sprintf("%s\x00%d", key, count[key])
+	}
+	return keys
+}
+
+func newRuleChange(change Change, r *mss.Rule, old, new *mss.Properties) RuleChange {
+	c := RuleChange{
+		Change:     change,
+		Layer:      r.Layer,
+		Attachment: r.Attachment,
+		Class:      r.Class,
+		Zoom:       r.Zoom.String(),
+		Filters:    []string{},
+		Properties: compareProperties(old, new),
+	}
+	for _, f := range r.Filters {
+		c.Filters = append(c.Filters, f.String())
+	}
+	return c
+}
+
+// compareProperties returns all properties with different values,
+// sorted by instance and name. old or new can be nil.
+func compareProperties(old, new *mss.Properties) []PropertyChange {
+	type key struct{ name, instance string }
+	values := func(p *mss.Properties) (map[key]string, []key) {
+		if p == nil {
+			return nil, nil
+		}
+		all := p.All()
+		m := make(map[key]string, len(all))
+		keys := make([]key, 0, len(all))
+		for _, prop := range all {
+			k := key{prop.Name, prop.Instance}
+			m[k] = fmt.Sprint(prop.Value)
+			keys = append(keys, k)
+		}
+		return m, keys
+	}
+	oldValues, oldKeys := values(old)
+	newValues, newKeys := values(new)
+
+	changes := []PropertyChange{}
+	for _, k := range newKeys {
+		if v, ok := oldValues[k]; !ok || v != newValues[k] {
+			changes = append(changes, PropertyChange{Name: k.name, Instance: k.instance, Old: v, New: newValues[k]})
+		}
+	}
+	for _, k := range oldKeys {
+		if _, ok := newValues[k]; !ok {
+			changes = append(changes, PropertyChange{Name: k.name, Instance: k.instance, Old: oldValues[k]})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Instance != changes[j].Instance {
+			return changes[i].Instance < changes[j].Instance
+		}
+		return changes[i].Name < changes[j].Name
+	})
+	return changes
+}
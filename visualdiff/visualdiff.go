@@ -0,0 +1,152 @@
+package visualdiff
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"image"
+	"image/png"
+	"io"
+
+	"github.com/omniscale/magnacarto/imgdiff"
+	"github.com/omniscale/magnacarto/render"
+)
+
+// RenderFunc renders the style file with the request as PNG into w.
+type RenderFunc func(styleFile string, req render.Request, w io.Writer) error
+
+// Images are the rendered images of both versions and their comparison.
+type Images struct {
+	A, B   []byte
+	Result *imgdiff.Result
+}
+
+// CompareView renders the request with both style files and compares
+// the images.
+func CompareView(styleA, styleB string, req render.Request, renderFunc RenderFunc, opts imgdiff.Options) (*Images, error) {
+	result := &Images{}
+	var imgA, imgB image.Image
+	for _, v := range []struct {
+		styleFile string
+		data      *[]byte
+		img       *image.Image
+	}{{styleA, &result.A, &imgA}, {styleB, &result.B, &imgB}} {
+		buf := bytes.Buffer{}
+		if err := renderFunc(v.styleFile, req, &buf); err != nil {
+			return nil, err
+		}
+		img, _, err := image.Decode(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			return nil, fmt.Errorf("decoding image of %s: %v", v.styleFile, err)
+		}
+		*v.data = buf.Bytes()
+		*v.img = img
+	}
+
+	res, err := imgdiff.Compare(imgA, imgB, opts)
+	if err != nil {
+		return nil, err
+	}
+	result.Result = res
+	return result, nil
+}
+
+// DiffPNG returns the PNG encoded diff image.
+func (i *Images) DiffPNG() ([]byte, error) {
+	buf := bytes.Buffer{}
+	if err := png.Encode(&buf, i.Result.Diff); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ViewResult is the comparison of a single view in a Report.
+type ViewResult struct {
+	Name string
+	// A, B and Diff are the file names or URLs of the images.
+	A, B, Diff string
+	Result     *imgdiff.Result
+	// Err is set if the view could not be rendered or compared.
+	Err error
+}
+
+// Report is the result of a visual diff of two versions.
+type Report struct {
+	// A and B are the names of the old and new version.
+	A, B  string
+	Views []ViewResult
+	Rules []RuleChange
+}
+
+// ChangedViews returns the number of views with different pixels.
+func (r *Report) ChangedViews() int {
+	n := 0
+	for _, v := range r.Views {
+		if v.Result != nil && v.Result.Pixels > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// WriteHTML writes the report as HTML document with the before, after
+// and diff images of each view and a table of all changed rules.
+func (r *Report) WriteHTML(w io.Writer) error {
+	return htmlTemplate.Execute(w, r)
+}
+
+var htmlTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"percent": func(v float64) string { return fmt.Sprintf("%.2f%%", v*100) },
+	"float":   func(v float64) string { return fmt.Sprintf("%.4f", v) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Visual diff {{.A}} / {{.B}}</title>
+<style>
+  body { font-family: sans-serif; font-size: 13px; }
+  td, th { padding: 2px 6px; text-align: left; vertical-align: top; }
+  .images { display: flex; gap: 8px; }
+  .images figure { margin: 0; }
+  .images img { max-width: 100%; border: 1px solid #ccc; }
+  .different { color: #c00; }
+  .error { color: #c00; font-weight: bold; }
+  .added { background: #e6ffe6; }
+  .removed { background: #ffe6e6; }
+</style>
+</head>
+<body>
+<h1>{{.A}} / {{.B}}</h1>
+<p>{{.ChangedViews}} of {{len .Views}} views changed, {{len .Rules}} changed rules.</p>
+<table>
+  <tr><th>View</th><th>Different pixels</th><th>Similarity</th><th>SSIM</th></tr>
+{{- range .Views}}
+  <tr><td><a href="#view-{{.Name}}">{{.Name}}</a></td>
+  {{- if .Err}}<td class="error" colspan="3">{{.Err}}</td>
+  {{- else}}<td{{if .Result.Pixels}} class="different"{{end}}>{{.Result.Pixels}}</td><td>{{percent .Result.Similarity}}</td><td>{{float .Result.SSIM}}</td>{{end}}</tr>
+{{- end}}
+</table>
+{{- range .Views}}
+<h2 id="view-{{.Name}}">{{.Name}}</h2>
+{{- if .Err}}
+<p class="error">{{.Err}}</p>
+{{- else}}
+<div class="images">
+  <figure><img src="{{.A}}" alt="before"><figcaption>before</figcaption></figure>
+  <figure><img src="{{.B}}" alt="after"><figcaption>after</figcaption></figure>
+  <figure><img src="{{.Diff}}" alt="diff"><figcaption>diff ({{.Result.Pixels}} pixels)</figcaption></figure>
+</div>
+{{- end}}
+{{- end}}
+<h2>Changed rules</h2>
+<table>
+  <tr><th>Change</th><th>Layer</th><th>Attachment</th><th>Class</th><th>Zoom</th><th>Filters</th><th>Properties</th></tr>
+{{- range .Rules}}
+  <tr class="{{.Change}}"><td>{{.Change}}</td><td>{{.Layer}}</td><td>{{.Attachment}}</td><td>{{.Class}}</td><td>{{.Zoom}}</td>
+    <td>{{range .Filters}}{{.}}<br>{{end}}</td>
+    <td>{{range .Properties}}{{if .Instance}}{{.Instance}}/{{end}}{{.Name}}: {{if .Old}}<del>{{.Old}}</del> {{end}}{{if .New}}<ins>{{.New}}</ins>{{end}}<br>{{end}}</td></tr>
+{{- end}}
+</table>
+</body>
+</html>
+`))
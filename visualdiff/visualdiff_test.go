@@ -0,0 +1,182 @@
+package visualdiff
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/omniscale/magnacarto/imgdiff"
+	"github.com/omniscale/magnacarto/mml"
+	"github.com/omniscale/magnacarto/mss"
+	"github.com/omniscale/magnacarto/render"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func parseMSS(t *testing.T, content string) *mss.MSS {
+	d := mss.New()
+	require.NoError(t, d.ParseString(content))
+	require.NoError(t, d.Evaluate())
+	return d.MSS()
+}
+
+func TestCompareRules(t *testing.T) {
+	a := &mml.MML{Layers: []mml.Layer{{ID: "roads"}, {ID: "old"}}}
+	b := &mml.MML{Layers: []mml.Layer{{ID: "roads"}, {ID: "new"}}}
+	styleA := parseMSS(t, `
+#roads { line-width: 1; line-color: red; }
+#roads[type='major'] { line-width: 3; }
+#roads[type='track'] { line-dasharray: 2,2; }
+#old { polygon-fill: blue; }
+`)
+	styleB := parseMSS(t, `
+#roads { line-width: 1; line-color: red; }
+#roads[type='major'] { line-width: 4; line-cap: round; }
+#roads[type='minor'] { line-width: 2; }
+#new { marker-width: 5; }
+`)
+
+	changes := CompareRules(a, styleA, b, styleB)
+	var summary []string
+	for _, c := range changes {
+		summary = append(summary, string(c.Change)+" "+c.Layer+" "+strings.Join(c.Filters, ","))
+	}
+	assert.Equal(t, []string{
+		"added roads type = minor",
+		"changed roads type = major",
+		"removed roads type = track",
+		"added new ",
+		"removed old ",
+	}, summary)
+
+	assert.Equal(t, []PropertyChange{
+		{Name: "line-cap", New: "round"},
+		{Name: "line-width", Old: "3", New: "4"},
+	}, changes[1].Properties)
+	assert.Equal(t, "Zoom{*}", changes[1].Zoom)
+	assert.Equal(t, []PropertyChange{{Name: "marker-width", New: "5"}}, changes[3].Properties)
+	assert.Equal(t, []PropertyChange{{Name: "polygon-fill", Old: "#0000ff"}}, changes[4].Properties)
+
+	assert.Empty(t, CompareRules(a, styleA, a, styleA))
+}
+
+func TestCompareRules_ZoomAndAttachments(t *testing.T) {
+	m := &mml.MML{Layers: []mml.Layer{{ID: "roads"}}}
+	styleA := parseMSS(t, `
+#roads { ::casing { line-width: 3; } [zoom>=10] { line-width: 1; } }
+`)
+	styleB := parseMSS(t, `
+#roads { ::casing { line-width: 5; } [zoom>=12] { line-width: 1; } }
+`)
+
+	changes := CompareRules(m, styleA, m, styleB)
+	var summary []string
+	for _, c := range changes {
+		summary = append(summary, string(c.Change)+" "+c.Attachment+" "+c.Zoom)
+	}
+	assert.Equal(t, []string{
+		"added  Zoom{>=12}",
+		"changed casing Zoom{*}",
+		"removed  Zoom{>=10}",
+	}, summary)
+}
+
+func TestChangedRules(t *testing.T) {
+	changes, err := ChangedRules("../regression/cases/021-polygons/test.mml", "../regression/cases/021-polygons/test.mml")
+	assert.NoError(t, err)
+	assert.Empty(t, changes)
+
+	_, err = ChangedRules("missing.mml", "../regression/cases/021-polygons/test.mml")
+	assert.Error(t, err)
+}
+
+func encodePNG(t *testing.T, c color.Color) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	for y := 0; y < 10; y++ {
+		for x := 0; x < 10; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	img.Set(0, 0, color.Black)
+	buf := bytes.Buffer{}
+	require.NoError(t, png.Encode(&buf, img))
+	return buf.Bytes()
+}
+
+func TestCompareView(t *testing.T) {
+	images := map[string][]byte{
+		"a.xml": encodePNG(t, color.White),
+		"b.xml": encodePNG(t, color.White),
+		"c.xml": encodePNG(t, color.RGBA{255, 0, 0, 255}),
+	}
+	var reqs []render.Request
+	renderFunc := func(styleFile string, req render.Request, w io.Writer) error {
+		reqs = append(reqs, req)
+		if data, ok := images[styleFile]; ok {
+			_, err := w.Write(data)
+			return err
+		}
+		if styleFile == "invalid.xml" {
+			_, err := w.Write([]byte("no png"))
+			return err
+		}
+		return errors.New("render error")
+	}
+	req := render.Request{Width: 10, Height: 10, BBOX: [4]float64{0, 0, 10, 10}}
+
+	imgs, err := CompareView("a.xml", "b.xml", req, renderFunc, imgdiff.Options{})
+	require.NoError(t, err)
+	assert.Equal(t, images["a.xml"], imgs.A)
+	assert.Equal(t, images["b.xml"], imgs.B)
+	assert.Equal(t, 0, imgs.Result.Pixels)
+	assert.Equal(t, []render.Request{req, req}, reqs)
+
+	imgs, err = CompareView("a.xml", "c.xml", req, renderFunc, imgdiff.Options{})
+	require.NoError(t, err)
+	assert.Equal(t, 99, imgs.Result.Pixels)
+	diff, err := imgs.DiffPNG()
+	require.NoError(t, err)
+	img, err := png.Decode(bytes.NewReader(diff))
+	require.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 10, 10), img.Bounds())
+
+	_, err = CompareView("a.xml", "missing.xml", req, renderFunc, imgdiff.Options{})
+	assert.EqualError(t, err, "render error")
+	_, err = CompareView("invalid.xml", "a.xml", req, renderFunc, imgdiff.Options{})
+	assert.Error(t, err)
+}
+
+func TestReportHTML(t *testing.T) {
+	r := Report{
+		A: "old/test.mml",
+		B: "new/test.mml",
+		Views: []ViewResult{
+			{Name: "city", A: "city-a.png", B: "city-b.png", Diff: "city-diff.png", Result: &imgdiff.Result{Width: 10, Height: 10, Pixels: 5, SSIM: 0.9}},
+			{Name: "same", A: "same-a.png", B: "same-b.png", Diff: "same-diff.png", Result: &imgdiff.Result{Width: 10, Height: 10, SSIM: 1}},
+			{Name: "broken", Err: errors.New("render <error>")},
+		},
+		Rules: []RuleChange{{Change: Changed, Layer: "roads", Zoom: "Zoom{*}", Filters: []string{"type = major"},
+			Properties: []PropertyChange{{Name: "line-width", Old: "3", New: "4"}}}},
+	}
+	assert.Equal(t, 1, r.ChangedViews())
+
+	buf := bytes.Buffer{}
+	require.NoError(t, r.WriteHTML(&buf))
+	html := buf.String()
+	for _, s := range []string{
+		"1 of 3 views changed, 1 changed rules.",
+		`<img src="city-diff.png" alt="diff">`,
+		`<td class="different">5</td><td>95.00%</td><td>0.9000</td>`,
+		"render &lt;error&gt;",
+		`<tr class="changed"><td>changed</td><td>roads</td>`,
+		"line-width: <del>3</del> <ins>4</ins>",
+	} {
+		assert.Contains(t, html, s)
+	}
+}